@@ -0,0 +1,199 @@
+package ra
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Accounts are a second kind of built-in resource beside files: a numeric
+// balance that clients deposit to and withdraw from. Each operation reads
+// the balance from fs.Storage, changes it and stores it back inside the
+// critical section for "account:NAME", so the same machinery that orders
+// file writes keeps concurrent updates from being lost, across processes
+// as well as within one.
+
+// accountResource is the critical section guarding account name.
+func accountResource(name string) string {
+	return "account:" + name
+}
+
+// accountFile is where account name's balance is stored.
+func accountFile(name string) string {
+	return name + ".balance"
+}
+
+// Deposit adds amount to account for clientID and returns the new balance.
+func (fs *DistributedFileSystem) Deposit(clientID int, account string, amount int64) (int64, error) {
+	if amount <= 0 {
+		return 0, fmt.Errorf("client %d depositing %d to %s: amount must be positive", clientID, amount, account)
+	}
+	return fs.updateAccount(clientID, account, "Deposit", deposit(amount))
+}
+
+func deposit(amount int64) func(balance int64) (int64, error) {
+	return func(balance int64) (int64, error) {
+		return balance + amount, nil
+	}
+}
+
+// Withdraw takes amount from account for clientID and returns the new
+// balance. It fails with ErrInsufficientFunds, leaving the balance alone,
+// if the account holds less than amount.
+func (fs *DistributedFileSystem) Withdraw(clientID int, account string, amount int64) (int64, error) {
+	if amount <= 0 {
+		return 0, fmt.Errorf("client %d withdrawing %d from %s: amount must be positive", clientID, amount, account)
+	}
+	return fs.updateAccount(clientID, account, "Withdraw", withdraw(amount))
+}
+
+func withdraw(amount int64) func(balance int64) (int64, error) {
+	return func(balance int64) (int64, error) {
+		if balance < amount {
+			return balance, fmt.Errorf("withdrawing %d from a balance of %d: %w", amount, balance, ErrInsufficientFunds)
+		}
+		return balance - amount, nil
+	}
+}
+
+// Balance returns account's balance, read inside its critical section.
+func (fs *DistributedFileSystem) Balance(clientID int, account string) (int64, error) {
+	request, err := fs.AcquireResource(clientID, accountResource(account))
+	if err != nil {
+		return 0, err
+	}
+	request.Op = "Read"
+	balance, err := fs.loadBalance(account)
+	if releaseErr := fs.ReleaseRequest(request); err == nil {
+		err = releaseErr
+	}
+	return balance, err
+}
+
+// updateAccount replaces account's balance with change(balance) inside its
+// critical section. op names the operation in the log and errors.
+func (fs *DistributedFileSystem) updateAccount(clientID int, account, op string, change func(balance int64) (int64, error)) (int64, error) {
+	request, err := fs.AcquireResource(clientID, accountResource(account))
+	if err != nil {
+		return 0, err
+	}
+	request.Op = op
+	balance, err := fs.loadBalance(account)
+	if err == nil {
+		var updated int64
+		if updated, err = change(balance); err == nil {
+			err = fs.Storage.Store(accountFile(account), []byte(strconv.FormatInt(updated, 10)+"\n"))
+			balance = updated
+		}
+	}
+	if err == nil {
+		fs.Log.Debugf("Client %d: %s on %s, balance now %d", clientID, op, account, balance)
+		fs.AddDeferredOperation(fmt.Sprintf("%s on %s by Client %d", op, account, clientID))
+	} else {
+		err = fmt.Errorf("client %d: %s on %s: %w", clientID, op, account, err)
+	}
+	if releaseErr := fs.ReleaseRequest(request); err == nil {
+		err = releaseErr
+	}
+	return balance, err
+}
+
+// loadBalance reads account's stored balance; an account never written
+// holds 0.
+func (fs *DistributedFileSystem) loadBalance(account string) (int64, error) {
+	data, err := fs.Storage.Load(accountFile(account))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	balance, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("account %s: %w", account, err)
+	}
+	return balance, nil
+}
+
+// runBank is the bank scenario: every client makes random deposits to and
+// withdrawals from one account opened with 100, then the final balance is
+// checked against the opening balance plus the operations that succeeded.
+// Each update takes a teller a couple of milliseconds between reading the
+// balance and writing it, so with -no-mutex updates are lost and the check
+// fails.
+func runBank(fs *DistributedFileSystem, n int, diagram *os.File) error {
+	const (
+		account = "bank"
+		opening = 100
+	)
+	if err := fs.Storage.Store(accountFile(account), []byte(strconv.Itoa(opening)+"\n")); err != nil {
+		return err
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		net      int64
+		declined int
+		errs     []error
+	)
+	for id := 1; id <= n; id++ {
+		wg.Add(1)
+		go func(clientID int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(clientID)))
+			for op := 0; op < 10; op++ {
+				start := time.Now()
+				amount := int64(1 + rng.Intn(20))
+				op, change := "Deposit", deposit(amount)
+				if rng.Intn(2) == 0 {
+					op, change = "Withdraw", withdraw(amount)
+					amount = -amount
+				}
+				_, err := fs.updateAccount(clientID, account, op, teller(change))
+				mu.Lock()
+				switch {
+				case err == nil:
+					net += amount
+				case errors.Is(err, ErrInsufficientFunds):
+					declined++
+				default:
+					errs = append(errs, err)
+				}
+				mu.Unlock()
+				printSpaceTimeDiagram(clientID, start, time.Now(), diagram)
+				time.Sleep(time.Duration(rng.Intn(3)) * time.Millisecond)
+			}
+		}(id)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return errs[0]
+	}
+
+	balance, err := fs.Balance(1, account)
+	if err != nil {
+		return err
+	}
+	expected := opening + net
+	verdict := "correct"
+	if balance != expected {
+		verdict = fmt.Sprintf("off by %+d, so updates were lost to overlapping critical sections", balance-expected)
+	}
+	narrate("Account %s: opened with %d, the successful operations changed it by %+d (%d withdrawals declined); final balance %d, expected %d: %s.",
+		account, opening, net, declined, balance, expected, verdict)
+	return nil
+}
+
+// teller is change done by hand: it takes a couple of milliseconds.
+func teller(change func(balance int64) (int64, error)) func(balance int64) (int64, error) {
+	return func(balance int64) (int64, error) {
+		time.Sleep(2 * time.Millisecond)
+		return change(balance)
+	}
+}
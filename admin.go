@@ -0,0 +1,50 @@
+package ra
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+)
+
+// Admin is the HTTP admin endpoint of a process. Components add their own
+// routes with Handle.
+type Admin struct {
+	mux      *http.ServeMux
+	server   *http.Server
+	listener net.Listener
+}
+
+// StartAdmin starts serving the admin endpoint on addr, e.g. ":8080".
+func StartAdmin(addr string) (*Admin, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	a := &Admin{mux: mux, server: &http.Server{Handler: mux}, listener: listener}
+	go a.server.Serve(listener)
+	return a, nil
+}
+
+// Handle registers handler for pattern, e.g. "POST /heal".
+func (a *Admin) Handle(pattern string, handler http.HandlerFunc) {
+	a.mux.HandleFunc(pattern, handler)
+}
+
+func (a *Admin) Addr() net.Addr {
+	return a.listener.Addr()
+}
+
+func (a *Admin) Close() error {
+	return a.server.Close()
+}
+
+// writeJSON writes v as an indented JSON response.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		DefaultLogger.Errorf("Error writing admin response: %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package ra
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DistributedMutex is a distributed mutual exclusion algorithm. Every
+// client runs the same one, and the file system calls it to enter and
+// leave critical sections and to handle the protocol messages it sends.
+//
+// Implementations drive the node's RELEASED/WANTED/HELD state machine
+// (Node.want, Node.enter, Node.release) so diagnostics, leases and
+// snapshots see the same states whichever algorithm runs.
+type DistributedMutex interface {
+	Name() string
+	// Acquire returns once node holds resource as a member of session (see
+	// AcquireSession). An algorithm that cannot admit a session together
+	// may treat every request as exclusive. span is the request's trace span
+	// and is stored on the request.
+	Acquire(node *Node, resource, session string, file *File, span *Span) (*Request, error)
+	// Release leaves or withdraws request and reports whether it was held.
+	Release(request *Request) bool
+	// Receive handles a protocol message delivered to msg.To and reports
+	// false if the algorithm does not use its type.
+	Receive(msg *Message) bool
+}
+
+// messageCoster is implemented by algorithms that can state their expected
+// messages per critical section entry for n clients.
+type messageCoster interface {
+	MessageCost(n int) string
+}
+
+// clientResource keys an algorithm's per-client, per-resource state.
+type clientResource struct {
+	clientID int
+	resource string
+}
+
+// algorithms are the DistributedMutex implementations selectable by name.
+var algorithms = map[string]func(fs *DistributedFileSystem) DistributedMutex{
+	"ricart-agarwala": func(fs *DistributedFileSystem) DistributedMutex { return &RicartAgarwala{fs: fs} },
+	"lamport":         func(fs *DistributedFileSystem) DistributedMutex { return NewLamport(fs) },
+	"raymond":         func(fs *DistributedFileSystem) DistributedMutex { return NewRaymond(fs) },
+}
+
+// algorithmNames returns the selectable algorithm names, sorted.
+func algorithmNames() []string {
+	names := make([]string, 0, len(algorithms))
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetAlgorithm selects the mutual exclusion algorithm by name. It must be
+// called before any client joins.
+func (fs *DistributedFileSystem) SetAlgorithm(name string) error {
+	newAlgorithm, ok := algorithms[name]
+	if !ok {
+		return fmt.Errorf("unknown algorithm %q (want one of %s)", name, strings.Join(algorithmNames(), ", "))
+	}
+	fs.Mutex = newAlgorithm(fs)
+	return nil
+}
+
+// want moves node to WANTED for resource and returns the new request.
+func (fs *DistributedFileSystem) want(node *Node, resource, session string, file *File, span *Span) *Request {
+	request := node.want(resource, func(timestamp int) *Request {
+		return &Request{
+			ClientID:  node.ID,
+			Resource:  resource,
+			Session:   session,
+			File:      file,
+			Timestamp: timestamp,
+			Seq:       fs.NextSequence(node.ID),
+			Requested: time.Now(),
+			span:      span,
+			cancelled: make(chan struct{}),
+		}
+	})
+	span.SetAttribute("lamport.timestamp", request.Timestamp)
+	return request
+}
+
+// broadcastRequest sends request to every other client and registers it to
+// collect their replies. The caller must call forgetRequest once it stops
+// waiting.
+func (fs *DistributedFileSystem) broadcastRequest(request *Request) {
+	peers := fs.peersExcept(request.ClientID)
+	request.expectReplies(peers)
+
+	fs.OutstandingMutex.Lock()
+	fs.Outstanding[outstandingKey{request.ClientID, request.Seq}] = request
+	fs.OutstandingMutex.Unlock()
+
+	broadcast := fs.Tracer.Start("request.broadcast", request.span)
+	broadcast.SetAttribute("peers", len(peers))
+	fs.FanOut.Run(peers, func(peer int) {
+		fs.SendRequest(request, peer)
+	})
+	request.messages.Add(int32(len(peers)))
+	broadcast.Finish()
+}
+
+func (fs *DistributedFileSystem) forgetRequest(request *Request) {
+	fs.OutstandingMutex.Lock()
+	delete(fs.Outstanding, outstandingKey{request.ClientID, request.Seq})
+	fs.OutstandingMutex.Unlock()
+}
+
+// replyTimeout returns a channel that fires after fs.ReplyTimeout, or nil
+// if there is none, and a function releasing its timer.
+func (fs *DistributedFileSystem) replyTimeout() (<-chan time.Time, func() bool) {
+	if fs.ReplyTimeout <= 0 {
+		return nil, func() bool { return false }
+	}
+	timer := time.NewTimer(fs.ReplyTimeout)
+	return timer.C, timer.Stop
+}
+
+// RicartAgarwala is the Ricart-Agarwala algorithm: a request is broadcast
+// to every peer and the critical section is entered once all have replied.
+// A peer defers its reply while it holds the resource or wants it with a
+// smaller (timestamp, id), so each entry costs 2(N-1) messages. A peer in
+// the same session as the request replies at once instead, which lets a
+// whole session in together.
+type RicartAgarwala struct {
+	fs *DistributedFileSystem
+}
+
+func (ra *RicartAgarwala) Name() string { return "ricart-agarwala" }
+
+func (ra *RicartAgarwala) MessageCost(n int) string { return fmt.Sprintf("2(N-1) = %d", 2*(n-1)) }
+
+func (ra *RicartAgarwala) Acquire(node *Node, resource, session string, file *File, span *Span) (*Request, error) {
+	fs := ra.fs
+	done := fs.step(TraceStep{Client: node.ID, Kind: StepWant, Resource: resource})
+	request := fs.want(node, resource, session, file, span)
+	fs.broadcastRequest(request)
+	done()
+
+	gather := fs.Tracer.Start("replies.gather", span)
+	timeout, stop := fs.replyTimeout()
+	defer stop()
+	cancelled := false
+	select {
+	case <-request.repliesDone:
+	case <-timeout:
+	case <-request.cancelled:
+		cancelled = true
+	}
+	fs.forgetRequest(request)
+
+	if cancelled {
+		ra.Release(request)
+		gather.SetAttribute("error", "cancelled")
+		gather.Finish()
+		return nil, fmt.Errorf("client %d requesting %s: %w", node.ID, resource, ErrCancelled)
+	}
+	if awaiting := request.Awaiting(); len(awaiting) > 0 {
+		ra.Release(request)
+		gather.SetAttribute("error", "peer timeout")
+		gather.Finish()
+		return nil, fmt.Errorf("client %d requesting %s: %w: no reply from clients %v", node.ID, resource, ErrPeerTimeout, awaiting)
+	}
+	gather.Finish()
+
+	if !node.enter(request) {
+		return nil, fmt.Errorf("client %d requesting %s: %w", node.ID, resource, ErrNotHoldingCS)
+	}
+	return request, nil
+}
+
+func (ra *RicartAgarwala) granted(request *Request) bool {
+	return len(request.Awaiting()) == 0
+}
+
+// Release moves request's node back to RELEASED and sends the replies it
+// deferred while it wanted or held the resource. A request withdrawn before
+// entering is cancelled at the peers that have not replied, which would
+// otherwise keep it deferred.
+func (ra *RicartAgarwala) Release(request *Request) bool {
+	defer ra.fs.step(TraceStep{Client: request.ClientID, Kind: StepRelease, Resource: request.Resource})()
+	deferred, held := ra.fs.Node(request.ClientID).release(request)
+	for _, d := range deferred {
+		ra.fs.sendReply(request.ClientID, d)
+	}
+	if len(deferred) > 0 {
+		ra.fs.journalDeferred()
+	}
+	if !held {
+		for _, peer := range request.Awaiting() {
+			ra.fs.sendCancel(request, peer)
+		}
+	}
+	return held
+}
+
+func (ra *RicartAgarwala) Receive(msg *Message) bool {
+	switch msg.Type {
+	case MsgRequest:
+		ra.fs.ReceiveRequest(msg)
+	case MsgReply:
+		ra.fs.ReceiveReply(msg)
+	case MsgCancel:
+		ra.fs.ReceiveCancel(msg)
+	case MsgBusy:
+		ra.fs.ReceiveBusy(msg)
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package ra
+
+// ReadResult is the outcome of a ReadFileAsync.
+type ReadResult struct {
+	Content string
+	Err     error
+}
+
+// ReadFileAsync starts ReadFile in the background and returns at once. The
+// channel receives the one result and is then closed; it is buffered, so a
+// caller that loses interest need not drain it. Operations on different
+// files proceed concurrently; a client's operations on the same file take
+// turns, as the node never has two requests outstanding for one resource.
+// Every pending operation counts against fs.MaxOutstanding.
+func (fs *DistributedFileSystem) ReadFileAsync(clientID int, handle *Handle) <-chan ReadResult {
+	results := make(chan ReadResult, 1)
+	go func() {
+		content, err := fs.ReadFile(clientID, handle)
+		results <- ReadResult{Content: content, Err: err}
+		close(results)
+	}()
+	return results
+}
+
+// WriteFileAsync is WriteFile in the background, delivering its error (nil
+// on success) like ReadFileAsync delivers its result.
+func (fs *DistributedFileSystem) WriteFileAsync(clientID int, handle *Handle, content string) <-chan error {
+	return async(func() error { return fs.WriteFile(clientID, handle, content) })
+}
+
+// AppendFileAsync is AppendFile in the background.
+func (fs *DistributedFileSystem) AppendFileAsync(clientID int, handle *Handle, data string) <-chan error {
+	return async(func() error { return fs.AppendFile(clientID, handle, data) })
+}
+
+// TruncateFileAsync is TruncateFile in the background.
+func (fs *DistributedFileSystem) TruncateFileAsync(clientID int, handle *Handle, size int) <-chan error {
+	return async(func() error { return fs.TruncateFile(clientID, handle, size) })
+}
+
+// async runs op in a goroutine and delivers its error on a buffered
+// channel that is closed afterwards.
+func async(op func() error) <-chan error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- op()
+		close(errs)
+	}()
+	return errs
+}
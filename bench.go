@@ -0,0 +1,159 @@
+package ra
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BenchResult is one algorithm's run of the benchmark.
+type BenchResult struct {
+	Algorithm  string
+	Clients    int
+	FanOut     int
+	Entries    int
+	Messages   uint64
+	MeanWait   time.Duration
+	Elapsed    time.Duration
+	Violations int
+	Cost       string
+	// Allocs and GCs are the heap allocations and garbage collections
+	// during the run.
+	Allocs uint64
+	GCs    uint32
+}
+
+// RunBench has numClients in-process clients each enter one shared
+// resource ops times using the named algorithm, and counts the messages
+// sent. Broadcasts fan out on fanout workers, or one send at a time if it
+// is below 2.
+func RunBench(algorithm string, numClients, ops int, hold time.Duration, fanout int) (*BenchResult, error) {
+	fs := NewDistributedFileSystem(JSONCodec{}, NewLocalTransport())
+	defer fs.Transport.Close()
+	if fanout > 1 {
+		fs.FanOut = NewFanOut(fanout)
+		defer fs.FanOut.Close()
+	}
+	if err := fs.SetAlgorithm(algorithm); err != nil {
+		return nil, err
+	}
+	for i := 1; i <= numClients; i++ {
+		fs.Join(i)
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		totalWait time.Duration
+		entries   int
+		firstErr  error
+	)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	for i := 1; i <= numClients; i++ {
+		wg.Add(1)
+		go func(clientID int) {
+			defer wg.Done()
+			for op := 0; op < ops; op++ {
+				request, err := fs.AcquireResource(clientID, "bench")
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					return
+				}
+				time.Sleep(hold)
+				fs.ReleaseRequest(request)
+
+				mu.Lock()
+				totalWait += request.Entered.Sub(request.Requested)
+				entries++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	result := &BenchResult{
+		Algorithm:  algorithm,
+		Clients:    numClients,
+		FanOut:     fanout,
+		Entries:    entries,
+		Messages:   fs.Metrics.Total("ra_messages_sent_total"),
+		Elapsed:    elapsed,
+		Violations: fs.Safety.Violations(),
+		Allocs:     after.Mallocs - before.Mallocs,
+		GCs:        after.NumGC - before.NumGC,
+	}
+	if entries > 0 {
+		result.MeanWait = totalWait / time.Duration(entries)
+	}
+	if coster, ok := fs.Mutex.(messageCoster); ok {
+		result.Cost = coster.MessageCost(numClients)
+	}
+	return result, nil
+}
+
+func runBenchCommand(args []string) int {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	numClients := flags.Int("clients", 5, "number of in-process clients")
+	ops := flags.Int("ops", 20, "critical section entries per client")
+	hold := flags.Duration("hold", time.Millisecond, "time spent inside each critical section")
+	algos := flags.String("algos", strings.Join(algorithmNames(), ","), "comma-separated algorithms to compare")
+	fanouts := flags.String("fanout", "0", "comma-separated broadcast worker counts to compare (0 or 1 sends one at a time)")
+	verbose := flags.Bool("v", false, "show the clients' protocol output while benchmarking")
+	flags.Parse(args)
+
+	var workers []int
+	for _, text := range splitList(*fanouts) {
+		n, err := strconv.Atoi(text)
+		if err != nil || n < 0 {
+			fmt.Fprintf(os.Stderr, "Error: bad -fanout %q\n", text)
+			return 2
+		}
+		workers = append(workers, n)
+	}
+
+	defer quietLogs(*verbose)()
+
+	var results []*BenchResult
+	for _, algo := range splitList(*algos) {
+		for _, fanout := range workers {
+			r, err := RunBench(algo, *numClients, *ops, *hold, fanout)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error benchmarking %s: %v\n", algo, err)
+				return 1
+			}
+			results = append(results, r)
+		}
+	}
+
+	fmt.Fprintf(os.Stdout, "\n%d clients, %d entries each\n", *numClients, *ops)
+	fmt.Fprintf(os.Stdout, "%-16s %7s %8s %9s %10s %-14s %10s %10s %10s %6s %10s\n", "Algorithm", "Fan-out", "Entries", "Messages", "Msgs/entry", "Expected", "Mean wait", "Elapsed", "Allocs/msg", "GCs", "Violations")
+	for _, r := range results {
+		perEntry, allocsPerMsg := 0.0, 0.0
+		if r.Entries > 0 {
+			perEntry = float64(r.Messages) / float64(r.Entries)
+		}
+		if r.Messages > 0 {
+			allocsPerMsg = float64(r.Allocs) / float64(r.Messages)
+		}
+		fmt.Fprintf(os.Stdout, "%-16s %7d %8d %9d %10.2f %-14s %10s %10s %10.1f %6d %10d\n", r.Algorithm, r.FanOut, r.Entries, r.Messages, perEntry, r.Cost,
+			r.MeanWait.Round(time.Microsecond), r.Elapsed.Round(time.Millisecond), allocsPerMsg, r.GCs, r.Violations)
+	}
+	return 0
+}
@@ -0,0 +1,243 @@
+package ra
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var initEnvTemplate = template.Must(template.New("env").Parse(`# Generated by "ra init". Configuration of node {{.ID}}, read by start.sh;
+# every variable is documented in "ra node -h".
+RA_NODE_ID={{.ID}}
+RA_PEERS={{.Peers}}
+RA_TLS_CERT=node-{{.ID}}.pem
+RA_TLS_KEY=node-{{.ID}}-key.pem
+RA_TLS_CA=ca.pem
+RA_LINK_SECRETS={{.LinkSecrets}}
+RA_EVENTS=node-{{.ID}}.events.jsonl
+RA_HISTORY=node-{{.ID}}.history.jsonl
+{{- if .Admin}}
+RA_ADMIN={{.Admin}}
+{{- end}}
+`))
+
+var initStartTemplate = template.Must(template.New("start").Parse(`#!/bin/sh
+# Generated by "ra init --nodes {{len .Nodes}}". Starts every node of the
+# cluster in the background, each configured by its node-N.env and logging
+# to node-N.log, and stops them all on Ctrl-C. Set RA to the ra binary if it
+# is not on the PATH.
+cd "$(dirname "$0")" || exit 1
+RA=${RA:-ra}
+[ -e file1.txt ] || : > file1.txt
+pids=
+for n in{{range .Nodes}} {{.ID}}{{end}}; do
+	(set -a; . ./node-$n.env; exec "$RA" node) > node-$n.log 2>&1 &
+	pids="$pids $!"
+	echo "Started node $n (pid $!), logging to node-$n.log"
+done
+trap 'kill $pids 2>/dev/null' INT TERM
+wait
+`))
+
+type initNode struct {
+	ID          int
+	Peers       string
+	LinkSecrets string
+	Admin       string
+}
+
+// runInitCommand writes everything needed to run a cluster of node
+// processes: a CA and a certificate per node for TLS between them, a
+// node-N.env per node with its RA_* settings, and start.sh to run them.
+func runInitCommand(args []string) int {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	numNodes := flags.Int("nodes", 3, "number of nodes in the cluster")
+	host := flags.String("host", "127.0.0.1", "host name or address the nodes reach each other on")
+	basePort := flags.Int("base-port", 7000, "node i listens on base-port+i-1")
+	adminPort := flags.Int("admin-base-port", 8000, "node i serves its admin endpoint on admin-base-port+i-1 (0 disables)")
+	dir := flags.String("dir", "cluster", "directory to write the cluster's files to")
+	validFor := flags.Duration("valid-for", 365*24*time.Hour, "how long the certificates are valid")
+	flags.Parse(args)
+	if *numNodes < 1 {
+		fmt.Fprintln(os.Stderr, "--nodes must be at least 1")
+		return 2
+	}
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating %s: %v\n", *dir, err)
+		return 1
+	}
+	// Never replace a CA: certificates already handed out would stop
+	// matching it.
+	if _, err := os.Stat(filepath.Join(*dir, "ca.pem")); err == nil {
+		fmt.Fprintf(os.Stderr, "%s already holds a cluster; remove it or pick another --dir\n", *dir)
+		return 1
+	}
+
+	// Each node gets only the secrets of its own links, derived from a key
+	// that is discarded once they are written.
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		fmt.Fprintf(os.Stderr, "Error generating cluster secret: %v\n", err)
+		return 1
+	}
+	ids := make([]int, *numNodes)
+	peers := make([]string, *numNodes)
+	for i := range peers {
+		ids[i] = i + 1
+		peers[i] = fmt.Sprintf("%d=%s", i+1, net.JoinHostPort(*host, fmt.Sprint(*basePort+i)))
+	}
+
+	ca, err := newCertAuthority(*validFor)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating CA: %v\n", err)
+		return 1
+	}
+	if err := ca.write(filepath.Join(*dir, "ca.pem"), filepath.Join(*dir, "ca-key.pem")); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing CA: %v\n", err)
+		return 1
+	}
+	var nodes []initNode
+	for i := 1; i <= *numNodes; i++ {
+		node := initNode{ID: i, Peers: strings.Join(peers, ","), LinkSecrets: FormatLinkSecrets(secret, i, ids)}
+		if *adminPort != 0 {
+			node.Admin = net.JoinHostPort(*host, fmt.Sprint(*adminPort+i-1))
+		}
+		nodes = append(nodes, node)
+
+		cert, err := ca.issue(nodeName(i), []string{*host, "localhost", "127.0.0.1", "::1"}, *validFor)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error issuing certificate for node %d: %v\n", i, err)
+			return 1
+		}
+		if err := cert.write(filepath.Join(*dir, fmt.Sprintf("node-%d.pem", i)), filepath.Join(*dir, fmt.Sprintf("node-%d-key.pem", i))); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing certificate for node %d: %v\n", i, err)
+			return 1
+		}
+		// The env file holds the cluster secret, so only its owner may read it.
+		if err := writeTemplate(filepath.Join(*dir, fmt.Sprintf("node-%d.env", i)), 0600, initEnvTemplate, node); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing node %d config: %v\n", i, err)
+			return 1
+		}
+	}
+	if err := writeTemplate(filepath.Join(*dir, "start.sh"), 0755, initStartTemplate, struct{ Nodes []initNode }{nodes}); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing start script: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Wrote a %d-node cluster to %s: CA, certificates, node-N.env and start.sh\n", *numNodes, *dir)
+	fmt.Printf("Start it with: %s\n", filepath.Join(*dir, "start.sh"))
+	if *adminPort != 0 {
+		fmt.Printf("Node 1's dashboard will be at http://%s/dashboard/\n", nodes[0].Admin)
+	}
+	return 0
+}
+
+func writeTemplate(path string, perm os.FileMode, tmpl *template.Template, data any) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	err = tmpl.Execute(f, data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// keyPair is a certificate and its private key.
+type keyPair struct {
+	cert *x509.Certificate
+	der  []byte
+	key  *ecdsa.PrivateKey
+}
+
+func newCertAuthority(validFor time.Duration) (*keyPair, error) {
+	template, err := certTemplate("ra cluster CA", validFor)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	return sign(template, nil)
+}
+
+// issue returns a certificate for name that is valid for both ends of a
+// connection to any of hosts.
+func (ca *keyPair) issue(name string, hosts []string, validFor time.Duration) (*keyPair, error) {
+	template, err := certTemplate(name, validFor)
+	if err != nil {
+		return nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	return sign(template, ca)
+}
+
+func certTemplate(name string, validFor time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(validFor),
+	}, nil
+}
+
+// sign creates the certificate described by template with a new key,
+// signed by parent, or self-signed if parent is nil.
+func sign(template *x509.Certificate, parent *keyPair) (*keyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	issuer, signer := template, key
+	if parent != nil {
+		issuer, signer = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &keyPair{cert: cert, der: der, key: key}, nil
+}
+
+// write saves the certificate and key as PEM, the key readable only by its
+// owner.
+func (p *keyPair) write(certPath, keyPath string) error {
+	keyDER, err := x509.MarshalECPrivateKey(p.key)
+	if err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return errors.Join(os.WriteFile(certPath, certPEM, 0644), os.WriteFile(keyPath, keyPEM, 0600))
+}
@@ -0,0 +1,66 @@
+package ra
+
+import (
+	"fmt"
+	"time"
+)
+
+// WithCriticalSection enters the critical section for resource on behalf
+// of clientID, runs fn inside it and leaves when fn returns, returning fn's
+// error. If fs.HoldLimit is set and fn is still running when it runs out,
+// the critical section is released without waiting for fn, so a handler
+// that never returns cannot stall the cluster: the request is revoked, so
+// file operations through it fail with ErrNotHoldingCS,
+// fs.OnForcedRelease is called and WithCriticalSection returns an error
+// wrapping ErrForcedRelease. fn is left running and should stop once
+// request.Revoked reports true.
+func (fs *DistributedFileSystem) WithCriticalSection(clientID int, resource string, fn func(request *Request) error) error {
+	request, err := fs.AcquireResource(clientID, resource)
+	if err != nil {
+		return err
+	}
+	return fs.runHeld(request, fn)
+}
+
+// runHeld runs fn for a request holding its critical section and then
+// releases it, or releases it early if fn overruns fs.HoldLimit.
+func (fs *DistributedFileSystem) runHeld(request *Request, fn func(request *Request) error) error {
+	if fs.HoldLimit <= 0 {
+		err := fn(request)
+		if releaseErr := fs.ReleaseRequest(request); err == nil {
+			err = releaseErr
+		}
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(request)
+	}()
+	timer := time.NewTimer(fs.HoldLimit)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		if releaseErr := fs.ReleaseRequest(request); err == nil {
+			err = releaseErr
+		}
+		return err
+	case <-timer.C:
+		fs.forceRelease(request)
+		return fmt.Errorf("client %d holding %s: %w of %s", request.ClientID, request.Resource, ErrForcedRelease, fs.HoldLimit)
+	}
+}
+
+// forceRelease takes the critical section away from a holder that overran
+// fs.HoldLimit and tells the application through fs.OnForcedRelease.
+func (fs *DistributedFileSystem) forceRelease(request *Request) {
+	request.revoke("hold limit exceeded")
+	fs.Log.Warnf("Client %d overran its %s hold limit on %s; releasing it", request.ClientID, fs.HoldLimit, request.Resource)
+	fs.Metrics.addNode("ra_forced_releases_total", request.ClientID)
+	if err := fs.ReleaseRequest(request); err != nil {
+		fs.Log.Errorf("Error releasing %s: %v", request.Resource, err)
+	}
+	if fs.OnForcedRelease != nil {
+		fs.OnForcedRelease(request)
+	}
+}
@@ -0,0 +1,330 @@
+package ra
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Misbehavior is one way a ByzantinePeer deviates from the protocol.
+type Misbehavior string
+
+const (
+	// Unsolicited answers requests it was never sent: replies for the next
+	// few sequence numbers of every requester, and replies forged to look
+	// as if they came from the other clients.
+	Unsolicited Misbehavior = "unsolicited"
+	// LieTimestamps stamps its own requests 0, so they win every
+	// comparison, and its replies far in the future, dragging every
+	// clock forward.
+	LieTimestamps Misbehavior = "lie"
+	// Silent never replies.
+	Silent Misbehavior = "silent"
+	// Duplicate replies twice to every request and sends each of its own
+	// requests twice.
+	Duplicate Misbehavior = "duplicate"
+)
+
+// misbehaviors lists every Misbehavior in report order, with what the
+// protocol makes of it.
+var misbehaviors = []struct {
+	behavior   Misbehavior
+	resilience string
+}{
+	{Unsolicited, "resilient: a reply only counts for an outstanding request that awaits its sender, and replies claiming another sender are rejected by the link's identity"},
+	{LieTimestamps, "safe but unfair: a peer can win every tie and inflate everyone's Lamport clock, but it only grants its own permission, so honest clients still exclude each other"},
+	{Silent, "not live: every entry needs every peer's reply, so one silent peer blocks all of them; ReplyTimeout turns the hang into ErrPeerTimeout"},
+	{Duplicate, "resilient: repeated requests are dropped by the per-link sequence window and extra replies are ignored"},
+}
+
+// lieAhead is how far past the truth a lying peer stamps its replies.
+const lieAhead = 1 << 20
+
+// ByzantinePeer is a client that speaks the Ricart-Agarwala wire protocol
+// but misbehaves in one chosen way, for exercising the timeout, duplicate
+// and validation logic in experiments and tests. It never enters a
+// critical section itself. Never run one in a real cluster.
+type ByzantinePeer struct {
+	ID       int
+	Behavior Misbehavior
+
+	fs       *DistributedFileSystem
+	resource string
+	mu       sync.Mutex
+	clock    int
+	seq      uint64
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewByzantinePeer registers a misbehaving client id on fs's transport. With
+// LieTimestamps or Duplicate it also requests resource every interval, so
+// the honest clients have its requests to handle. Stop it when done.
+func NewByzantinePeer(fs *DistributedFileSystem, id int, behavior Misbehavior, resource string, interval time.Duration) (*ByzantinePeer, error) {
+	if !knownMisbehavior(behavior) {
+		return nil, fmt.Errorf("unknown misbehavior %q (want one of %s)", behavior, strings.Join(misbehaviorNames(), ", "))
+	}
+	p := &ByzantinePeer{
+		ID:       id,
+		Behavior: behavior,
+		fs:       fs,
+		resource: resource,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	fs.Transport.Register(id, p.receive)
+	if behavior == LieTimestamps || behavior == Duplicate {
+		go p.run(interval)
+	} else {
+		close(p.done)
+	}
+	return p, nil
+}
+
+// Stop ends the peer's own requests. It keeps misbehaving on whatever it
+// is sent until the transport closes.
+func (p *ByzantinePeer) Stop() {
+	close(p.stop)
+	<-p.done
+}
+
+func (p *ByzantinePeer) run(interval time.Duration) {
+	defer close(p.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.request()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// request sends the peer's own REQUEST for its resource to every client.
+func (p *ByzantinePeer) request() {
+	p.mu.Lock()
+	p.seq++
+	p.clock++
+	msg := Message{Type: MsgRequest, From: p.ID, Seq: p.seq, Resource: p.resource, Timestamp: p.clock}
+	p.mu.Unlock()
+	if p.Behavior == LieTimestamps {
+		msg.Timestamp = 0
+	}
+
+	for _, peer := range p.fs.peersExcept(p.ID) {
+		msg.To = peer
+		p.send(msg)
+		if p.Behavior == Duplicate {
+			p.send(msg)
+		}
+	}
+}
+
+// receive misbehaves on a frame sent to the peer. Only REQUESTs get an
+// answer; everything else is swallowed.
+func (p *ByzantinePeer) receive(from int, data []byte) {
+	msg, err := p.fs.Codec.Decode(data)
+	if err != nil || msg.Type != MsgRequest {
+		return
+	}
+	p.mu.Lock()
+	if msg.Timestamp > p.clock {
+		p.clock = msg.Timestamp
+	}
+	clock := p.clock
+	p.mu.Unlock()
+
+	reply := Message{Type: MsgReply, From: p.ID, To: from, Seq: msg.Seq, Resource: msg.Resource, Timestamp: clock}
+	switch p.Behavior {
+	case Silent:
+	case Duplicate:
+		p.send(reply)
+		p.send(reply)
+	case LieTimestamps:
+		reply.Timestamp = clock + lieAhead
+		p.send(reply)
+	case Unsolicited:
+		p.send(reply)
+		for ahead := uint64(1); ahead <= 3; ahead++ {
+			early := reply
+			early.Seq = msg.Seq + ahead
+			p.send(early)
+		}
+		for _, other := range p.fs.peersExcept(p.ID) {
+			if other == from {
+				continue
+			}
+			forged := reply
+			forged.From = other
+			p.send(forged)
+		}
+	}
+}
+
+// send puts msg on the wire from the peer's own link, whatever sender it
+// claims.
+func (p *ByzantinePeer) send(msg Message) {
+	data, err := p.fs.Codec.Encode(&msg)
+	if err != nil {
+		return
+	}
+	p.fs.Transport.Send(p.ID, msg.To, data)
+}
+
+func knownMisbehavior(behavior Misbehavior) bool {
+	for _, m := range misbehaviors {
+		if m.behavior == behavior {
+			return true
+		}
+	}
+	return false
+}
+
+func misbehaviorNames() []string {
+	names := make([]string, len(misbehaviors))
+	for i, m := range misbehaviors {
+		names[i] = string(m.behavior)
+	}
+	return names
+}
+
+// ByzantineResult is one run of honest clients alongside a ByzantinePeer.
+type ByzantineResult struct {
+	Behavior   Misbehavior
+	Attempts   int
+	Entries    int
+	Timeouts   int
+	Violations int
+	// MaxClock is the highest Lamport clock among the honest clients, and
+	// Inflated reports whether it is higher than the run's requests and
+	// messages could have ticked it honestly.
+	MaxClock   int
+	Inflated   bool
+	Rejected   uint64
+	Duplicates uint64
+	Unexpected uint64
+}
+
+// Verdict sums up the run: UNSAFE if two honest clients were ever inside
+// together, "not live" if any entry failed, "unfair" if clocks were
+// inflated, and "resilient" otherwise.
+func (r *ByzantineResult) Verdict() string {
+	switch {
+	case r.Violations > 0:
+		return "UNSAFE"
+	case r.Entries < r.Attempts:
+		return "not live"
+	case r.Inflated:
+		return "unfair"
+	}
+	return "resilient"
+}
+
+// RunByzantine has numClients honest in-process clients each enter one
+// shared resource ops times under Ricart-Agarwala, while one more client
+// misbehaves as behavior. Acquires give up after replyTimeout.
+func RunByzantine(behavior Misbehavior, numClients, ops int, replyTimeout time.Duration) (*ByzantineResult, error) {
+	fs := NewDistributedFileSystem(JSONCodec{}, NewLocalTransport())
+	defer fs.Transport.Close()
+	fs.ReplyTimeout = replyTimeout
+	for i := 1; i <= numClients; i++ {
+		fs.Join(i)
+	}
+	peer, err := NewByzantinePeer(fs, numClients+1, behavior, "shared", 5*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	defer peer.Stop()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	result := &ByzantineResult{Behavior: behavior, Attempts: numClients * ops}
+	for i := 1; i <= numClients; i++ {
+		wg.Add(1)
+		go func(clientID int) {
+			defer wg.Done()
+			for op := 0; op < ops; op++ {
+				request, err := fs.AcquireResource(clientID, "shared")
+				mu.Lock()
+				switch {
+				case err == nil:
+					result.Entries++
+				case errors.Is(err, ErrPeerTimeout):
+					result.Timeouts++
+				case firstErr == nil:
+					firstErr = err
+				}
+				mu.Unlock()
+				if err != nil {
+					continue
+				}
+				time.Sleep(time.Millisecond)
+				fs.ReleaseRequest(request)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	for _, node := range fs.nodes() {
+		if clock := node.Clock(); clock > result.MaxClock {
+			result.MaxClock = clock
+		}
+	}
+	// Every honest tick is a request or follows a message, so together they
+	// bound the clocks.
+	result.Inflated = uint64(result.MaxClock) > uint64(result.Attempts)+fs.Metrics.Total("ra_messages_received_total")
+	result.Violations = fs.Safety.Violations()
+	result.Rejected = fs.Metrics.Total("ra_impersonation_rejections_total")
+	result.Duplicates = fs.Metrics.Total("ra_duplicates_dropped_total")
+	result.Unexpected = fs.Metrics.Total("ra_unexpected_replies_total")
+	return result, nil
+}
+
+func runByzantineCommand(args []string) int {
+	flags := flag.NewFlagSet("byzantine", flag.ExitOnError)
+	numClients := flags.Int("clients", 3, "number of honest in-process clients")
+	ops := flags.Int("ops", 10, "critical section entries each honest client attempts")
+	replyTimeout := flags.Duration("reply-timeout", 200*time.Millisecond, "give up on an entry if peers have not replied within this long")
+	behaviors := flags.String("behaviors", strings.Join(misbehaviorNames(), ","), "comma-separated misbehaviors to try: "+strings.Join(misbehaviorNames(), ", "))
+	verbose := flags.Bool("v", false, "show the clients' protocol output while running")
+	flags.Parse(args)
+	defer quietLogs(*verbose)()
+
+	var results []*ByzantineResult
+	for _, name := range splitList(*behaviors) {
+		result, err := RunByzantine(Misbehavior(name), *numClients, *ops, *replyTimeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error running %s: %v\n", name, err)
+			return 1
+		}
+		results = append(results, result)
+	}
+
+	unsafe := false
+	fmt.Printf("\n%d honest clients, 1 Byzantine peer, %d entries each\n", *numClients, *ops)
+	fmt.Printf("%-12s %8s %8s %10s %10s %8s %10s %10s  %s\n", "Behavior", "Entries", "Timeouts", "Violations", "Max clock", "Forged", "Duplicates", "Unexpected", "Verdict")
+	for _, r := range results {
+		fmt.Printf("%-12s %4d/%-3d %8d %10d %10d %8d %10d %10d  %s\n", r.Behavior, r.Entries, r.Attempts, r.Timeouts, r.Violations, r.MaxClock, r.Rejected, r.Duplicates, r.Unexpected, r.Verdict())
+		unsafe = unsafe || r.Violations > 0
+	}
+	fmt.Println("\nResilience:")
+	for _, m := range misbehaviors {
+		fmt.Printf("  %-12s %s\n", m.behavior, m.resilience)
+	}
+	if unsafe {
+		return 1
+	}
+	return 0
+}
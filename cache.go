@@ -0,0 +1,87 @@
+package ra
+
+import "sync"
+
+// ReadCache keeps, per node, the content of the files it last read or
+// wrote. A node serves reads of a cached file without running the protocol
+// until it sees an INVALIDATE for the file, which every writer broadcasts
+// while it still holds the critical section. A read can therefore return
+// content a peer has just replaced, until that peer's INVALIDATE arrives.
+type ReadCache struct {
+	mu      sync.Mutex
+	entries map[int]map[string]string
+}
+
+func NewReadCache() *ReadCache {
+	return &ReadCache{entries: make(map[int]map[string]string)}
+}
+
+func (c *ReadCache) get(clientID int, fileName string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	content, ok := c.entries[clientID][fileName]
+	return content, ok
+}
+
+func (c *ReadCache) put(clientID int, fileName, content string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries[clientID] == nil {
+		c.entries[clientID] = make(map[string]string)
+	}
+	c.entries[clientID][fileName] = content
+}
+
+func (c *ReadCache) invalidate(clientID int, fileName string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[clientID][fileName]
+	delete(c.entries[clientID], fileName)
+	return ok
+}
+
+// cachedRead returns clientID's cached content of file, if the read cache
+// is enabled and holds it.
+func (fs *DistributedFileSystem) cachedRead(clientID int, file *File) (string, bool) {
+	if _, lightweight := fs.Proxies[clientID]; fs.Cache == nil || lightweight {
+		return "", false
+	}
+	content, ok := fs.Cache.get(clientID, file.Name)
+	if !ok {
+		fs.Metrics.Add("ra_read_cache_misses_total", 1)
+		return "", false
+	}
+	fs.Metrics.Add("ra_read_cache_hits_total", 1)
+	fs.Log.Debugf("Client %d read file %s from cache: %s", clientID, file.Name, content)
+	return content, true
+}
+
+// wrote updates the writer's cache entry for a file it has just written and
+// tells every peer to drop theirs. The writer still holds the critical
+// section, so the INVALIDATEs reach each peer ahead of the reply that lets
+// it in next.
+func (fs *DistributedFileSystem) wrote(request *Request, content string) {
+	if fs.Cache == nil {
+		return
+	}
+	fs.Cache.put(request.ClientID, request.Resource, content)
+	fs.FanOut.Run(fs.peersExcept(request.ClientID), func(peer int) {
+		err := fs.send(&Message{
+			Type:      MsgInvalidate,
+			From:      request.ClientID,
+			To:        peer,
+			Resource:  request.Resource,
+			Timestamp: request.Timestamp,
+		})
+		if err != nil {
+			fs.Log.Errorf("Error sending invalidate from client %d: %v", request.ClientID, err)
+		}
+	})
+}
+
+// ReceiveInvalidate drops msg.To's cached copy of msg.Resource.
+func (fs *DistributedFileSystem) ReceiveInvalidate(msg *Message) {
+	if fs.Cache != nil && fs.Cache.invalidate(msg.To, msg.Resource) {
+		fs.Metrics.Add("ra_read_cache_invalidations_total", 1)
+	}
+}
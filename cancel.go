@@ -0,0 +1,59 @@
+package ra
+
+// CancelRequest withdraws clientID's request for resource if it is still
+// waiting to enter, e.g. because the user gave up. The waiting acquire
+// fails with ErrCancelled, and peers are sent a CANCEL so they purge the
+// request instead of keeping it queued or deferred. It reports whether a
+// request was waiting; one granted at the same moment may still enter.
+func (fs *DistributedFileSystem) CancelRequest(clientID int, resource string) bool {
+	node := fs.Node(clientID)
+	if node == nil {
+		return false
+	}
+	request := node.wanting(resource)
+	if request == nil {
+		return false
+	}
+	request.cancel()
+	return true
+}
+
+// cancel wakes the acquire waiting on r, which then withdraws it.
+func (r *Request) cancel() {
+	if r.cancelled == nil {
+		return
+	}
+	r.cancelOnce.Do(func() { close(r.cancelled) })
+}
+
+// sendCancel tells peer that request is withdrawn.
+func (fs *DistributedFileSystem) sendCancel(request *Request, peer int) {
+	timestamp := fs.Node(request.ClientID).tick()
+	err := fs.send(&Message{
+		Type:      MsgCancel,
+		From:      request.ClientID,
+		To:        peer,
+		Seq:       request.Seq,
+		Resource:  request.Resource,
+		Timestamp: timestamp,
+	})
+	if err != nil {
+		fs.Log.Errorf("Error sending cancel from client %d: %v", request.ClientID, err)
+		return
+	}
+	request.messages.Add(1)
+	fs.Log.Debugf("Client %d cancelled its request for %s at client %d", request.ClientID, request.Resource, peer)
+	fs.event(EventCancelSent, request.ClientID, peer, request.Resource, timestamp)
+}
+
+// ReceiveCancel drops a withdrawn request the receiver deferred its reply
+// to. The reply may already be on its way, in which case there is nothing
+// to drop and the requester ignores it.
+func (fs *DistributedFileSystem) ReceiveCancel(msg *Message) {
+	if !fs.Node(msg.To).onCancel(msg.Resource, msg.From, msg.Seq) {
+		return
+	}
+	fs.Log.Debugf("Client %d purged cancelled request %d from client %d", msg.To, msg.Seq, msg.From)
+	fs.journalDeferred()
+	fs.event(EventCancelRecv, msg.To, msg.From, msg.Resource, msg.Timestamp)
+}
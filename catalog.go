@@ -0,0 +1,155 @@
+package ra
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// CatalogResource is the critical section every change to the file
+// catalog is made in. The name is reserved: no file may use it.
+const CatalogResource = ".catalog"
+
+// Catalog is each node's view of the cluster-wide file namespace. A node
+// starts from the files in its own storage and learns the rest from CATALOG
+// messages. CreateFile announces a new file before leaving the catalog's
+// critical section, so whichever node enters it next has already heard of
+// the file and cannot create it again.
+type Catalog struct {
+	mu    sync.Mutex
+	files map[int]map[string]bool
+}
+
+func NewCatalog() *Catalog {
+	return &Catalog{files: make(map[int]map[string]bool)}
+}
+
+// view returns node's catalog, seeding it from seed on first use. The
+// caller holds c.mu.
+func (c *Catalog) view(node int, seed func() []string) map[string]bool {
+	files, ok := c.files[node]
+	if !ok {
+		files = make(map[string]bool)
+		for _, name := range seed() {
+			files[name] = true
+		}
+		c.files[node] = files
+	}
+	return files
+}
+
+// catalog runs fn on clientID's catalog under the catalog lock.
+func (fs *DistributedFileSystem) catalog(clientID int, fn func(files map[string]bool)) {
+	fs.Catalog.mu.Lock()
+	defer fs.Catalog.mu.Unlock()
+	fn(fs.Catalog.view(clientID, func() []string {
+		names, err := fs.Storage.List()
+		if err != nil {
+			fs.Log.Errorf("Error listing storage for client %d's catalog: %v", clientID, err)
+		}
+		return names
+	}))
+}
+
+// ListFiles returns every file clientID knows of anywhere in the cluster,
+// sorted by name.
+func (fs *DistributedFileSystem) ListFiles(clientID int) ([]string, error) {
+	if fs.Node(clientID) == nil {
+		return nil, fmt.Errorf("client %d listing files: %w", clientID, ErrUnknownPeer)
+	}
+	var names []string
+	fs.catalog(clientID, func(files map[string]bool) {
+		for name := range files {
+			names = append(names, name)
+		}
+	})
+	sort.Strings(names)
+	return names, nil
+}
+
+// CreateFile creates an empty file called name and announces it to every
+// peer, inside the catalog's critical section. It fails with ErrFileExists
+// if any node has already created or stored a file by that name.
+func (fs *DistributedFileSystem) CreateFile(clientID int, name string) error {
+	if name == CatalogResource {
+		return fmt.Errorf("client %d creating %s: name is reserved", clientID, name)
+	}
+	request, err := fs.AcquireResource(clientID, CatalogResource)
+	if err != nil {
+		return err
+	}
+	defer fs.ReleaseRequest(request)
+
+	exists := false
+	fs.catalog(clientID, func(files map[string]bool) { exists = files[name] })
+	if !exists {
+		_, err := fs.Storage.Load(name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("client %d creating %s: %w", clientID, name, err)
+		}
+		exists = err == nil
+	}
+	if exists {
+		return fmt.Errorf("client %d creating %s: %w", clientID, name, ErrFileExists)
+	}
+	if err := fs.Storage.Store(name, nil); err != nil {
+		return fmt.Errorf("client %d creating %s: %w", clientID, name, err)
+	}
+	fs.catalog(clientID, func(files map[string]bool) { files[name] = true })
+	fs.Log.Debugf("Client %d created file %s", clientID, name)
+
+	fs.announceCatalog(clientID, MsgCatalog, fs.peersExcept(clientID), []string{name})
+	return nil
+}
+
+// SyncCatalog sends clientID's whole catalog to every peer and asks for
+// theirs in return. A node calls it after joining to learn the files
+// created before it started.
+func (fs *DistributedFileSystem) SyncCatalog(clientID int) error {
+	names, err := fs.ListFiles(clientID)
+	if err != nil {
+		return err
+	}
+	fs.announceCatalog(clientID, MsgCatalogSync, fs.peersExcept(clientID), names)
+	return nil
+}
+
+// announceCatalog sends names to peers in a CATALOG or CATALOG_SYNC.
+func (fs *DistributedFileSystem) announceCatalog(clientID int, msgType MessageType, peers []int, names []string) {
+	timestamp := fs.Node(clientID).tick()
+	fs.FanOut.Run(peers, func(peer int) {
+		err := fs.send(&Message{
+			Type:      msgType,
+			From:      clientID,
+			To:        peer,
+			Timestamp: timestamp,
+			Files:     names,
+		})
+		if err != nil {
+			fs.Log.Errorf("Error sending %s from client %d: %v", msgType, clientID, err)
+		}
+	})
+}
+
+// ReceiveCatalog merges the files a peer announced into msg.To's catalog,
+// and answers a CATALOG_SYNC with msg.To's own catalog.
+func (fs *DistributedFileSystem) ReceiveCatalog(msg *Message) {
+	var learned []string
+	fs.catalog(msg.To, func(files map[string]bool) {
+		for _, name := range msg.Files {
+			if !files[name] {
+				files[name] = true
+				learned = append(learned, name)
+			}
+		}
+	})
+	if len(learned) > 0 {
+		fs.Log.Debugf("Client %d learned of %v from client %d", msg.To, learned, msg.From)
+	}
+	if msg.Type == MsgCatalogSync {
+		names, _ := fs.ListFiles(msg.To)
+		fs.announceCatalog(msg.To, MsgCatalog, []int{msg.From}, names)
+	}
+}
@@ -0,0 +1,305 @@
+package ra
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ClientSession is an application client's registration with a node. The
+// client takes its critical sections through the session and must Renew
+// it within its TTL. If it stops renewing, e.g. because it died, the
+// session expires: the node withdraws the requests it is waiting on and
+// releases the critical sections it holds, so a dead client cannot leave
+// a lock orphaned.
+//
+// These are unrelated to the group sessions of AcquireSession, which let
+// several clients hold a resource together.
+type ClientSession struct {
+	ID     string
+	Client int
+	TTL    time.Duration
+	// Priority ranks the session among the node's local callers when its
+	// LocalQueue serves by priority.
+	Priority int
+
+	fs      *DistributedFileSystem
+	mu      sync.Mutex
+	timer   *time.Timer
+	expires time.Time
+	ended   bool
+	held    map[string]*Request
+	wanting map[string]bool
+}
+
+// ClientSessionStatus is a session as served by the admin endpoint.
+type ClientSessionStatus struct {
+	ID      string    `json:"id"`
+	Node    int       `json:"node"`
+	TTL     Duration  `json:"ttl"`
+	Expires time.Time `json:"expires"`
+	Held    []string  `json:"held"`
+}
+
+// OpenClientSession registers a client with clientID's node under a lease
+// of ttl.
+func (fs *DistributedFileSystem) OpenClientSession(clientID int, ttl time.Duration) (*ClientSession, error) {
+	if fs.Node(clientID) == nil {
+		return nil, fmt.Errorf("client %d opening session: %w", clientID, ErrUnknownPeer)
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("client %d opening session: ttl must be positive", clientID)
+	}
+	s := &ClientSession{
+		ID:      randomHex(8),
+		Client:  clientID,
+		TTL:     ttl,
+		fs:      fs,
+		expires: time.Now().Add(ttl),
+		held:    make(map[string]*Request),
+		wanting: make(map[string]bool),
+	}
+	s.mu.Lock()
+	s.timer = time.AfterFunc(ttl, s.expire)
+	s.mu.Unlock()
+	fs.ClientSessionsMutex.Lock()
+	fs.ClientSessions[s.ID] = s
+	fs.ClientSessionsMutex.Unlock()
+	fs.Log.Debugf("Client %d opened session %s (ttl %s)", clientID, s.ID, ttl)
+	return s, nil
+}
+
+// ClientSession returns the open session with id, or nil.
+func (fs *DistributedFileSystem) ClientSession(id string) *ClientSession {
+	fs.ClientSessionsMutex.Lock()
+	defer fs.ClientSessionsMutex.Unlock()
+	return fs.ClientSessions[id]
+}
+
+// Renew extends the session's lease to TTL from now. It fails with
+// ErrSessionExpired once the session has expired or been closed.
+func (s *ClientSession) Renew() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return s.expiredErr("renewing")
+	}
+	s.expires = time.Now().Add(s.TTL)
+	s.timer.Reset(s.TTL)
+	return nil
+}
+
+// Acquire enters resource's critical section for the session's client. If
+// the session expires while the request waits, the request is withdrawn
+// and Acquire fails with ErrSessionExpired.
+func (s *ClientSession) Acquire(resource string) (*Request, error) {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return nil, s.expiredErr("acquiring " + resource)
+	}
+	if request, ok := s.held[resource]; ok {
+		s.mu.Unlock()
+		return request, nil
+	}
+	s.wanting[resource] = true
+	s.mu.Unlock()
+
+	request, err := s.fs.AcquireAs(s.Client, resource, LocalCaller{Name: s.ID, Priority: s.Priority})
+
+	s.mu.Lock()
+	delete(s.wanting, resource)
+	ended := s.ended
+	if err == nil && !ended {
+		s.held[resource] = request
+	}
+	s.mu.Unlock()
+	if ended {
+		// Granted as the session expired, after it withdrew its requests.
+		if err == nil {
+			s.fs.ReleaseRequest(request)
+		}
+		return nil, s.expiredErr("acquiring " + resource)
+	}
+	return request, err
+}
+
+// Release leaves resource's critical section.
+func (s *ClientSession) Release(resource string) error {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return s.expiredErr("releasing " + resource)
+	}
+	request, ok := s.held[resource]
+	delete(s.held, resource)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("session %s releasing %s: %w", s.ID, resource, ErrNotHoldingCS)
+	}
+	return s.fs.ReleaseRequest(request)
+}
+
+// Close ends the session, releasing whatever it still holds.
+func (s *ClientSession) Close() {
+	s.end("")
+}
+
+// Status returns the session's lease and the resources it holds.
+func (s *ClientSession) Status() ClientSessionStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := ClientSessionStatus{ID: s.ID, Node: s.Client, TTL: Duration(s.TTL), Expires: s.expires, Held: []string{}}
+	for resource := range s.held {
+		status.Held = append(status.Held, resource)
+	}
+	sort.Strings(status.Held)
+	return status
+}
+
+func (s *ClientSession) expire() {
+	s.mu.Lock()
+	late := time.Now().Before(s.expires)
+	s.mu.Unlock()
+	if late {
+		// Renewed while the timer fired.
+		return
+	}
+	if s.end("client session expired") {
+		s.fs.Metrics.addNode("ra_session_expiries_total", s.Client)
+	}
+}
+
+// end closes the session, withdrawing its waiting requests and releasing
+// its critical sections, revoked for reason if it is not empty. It
+// reports false if the session had already ended.
+func (s *ClientSession) end(reason string) bool {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return false
+	}
+	s.ended = true
+	s.timer.Stop()
+	held := s.held
+	s.held = nil
+	var wanting []string
+	for resource := range s.wanting {
+		wanting = append(wanting, resource)
+	}
+	s.mu.Unlock()
+
+	s.fs.ClientSessionsMutex.Lock()
+	delete(s.fs.ClientSessions, s.ID)
+	s.fs.ClientSessionsMutex.Unlock()
+
+	if reason != "" {
+		s.fs.Log.Warnf("Client %d's session %s expired: withdrawing %v, releasing %d held", s.Client, s.ID, wanting, len(held))
+	}
+	for _, resource := range wanting {
+		s.fs.CancelRequest(s.Client, resource)
+	}
+	for _, request := range held {
+		if reason != "" {
+			request.revoke(reason)
+		}
+		s.fs.ReleaseRequest(request)
+	}
+	return true
+}
+
+func (s *ClientSession) expiredErr(action string) error {
+	return fmt.Errorf("session %s %s: %w", s.ID, action, ErrSessionExpired)
+}
+
+// registerClientSessions adds the session routes to admin, for clients in
+// other processes:
+//
+//	POST /sessions?node=2&ttl=10s&priority=1
+//	POST /sessions/{id}/renew
+//	POST /sessions/{id}/acquire?resource=file1.txt
+//	POST /sessions/{id}/release?resource=file1.txt
+//	DELETE /sessions/{id}
+//
+// Opening, renewing and acquiring answer with the session's status.
+func (fs *DistributedFileSystem) registerClientSessions(admin *Admin) {
+	admin.Handle("POST /sessions", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		ttl := 10 * time.Second
+		if v := q.Get("ttl"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ttl = d
+		}
+		priority := 0
+		if v := q.Get("priority"); v != "" {
+			p, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, "bad priority", http.StatusBadRequest)
+				return
+			}
+			priority = p
+		}
+		clientID, err := fs.adminNode(q.Get("node"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s, err := fs.OpenClientSession(clientID, ttl)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.Priority = priority
+		writeJSON(w, s.Status())
+	})
+	session := func(handler func(w http.ResponseWriter, r *http.Request, s *ClientSession) error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			s := fs.ClientSession(r.PathValue("id"))
+			if s == nil {
+				http.Error(w, fmt.Sprintf("no session %q; it may have expired", r.PathValue("id")), http.StatusNotFound)
+				return
+			}
+			if err := handler(w, r, s); err != nil {
+				status := http.StatusConflict
+				if errors.Is(err, ErrSessionExpired) {
+					status = http.StatusGone
+				}
+				http.Error(w, err.Error(), status)
+			}
+		}
+	}
+	admin.Handle("POST /sessions/{id}/renew", session(func(w http.ResponseWriter, r *http.Request, s *ClientSession) error {
+		if err := s.Renew(); err != nil {
+			return err
+		}
+		writeJSON(w, s.Status())
+		return nil
+	}))
+	admin.Handle("POST /sessions/{id}/acquire", session(func(w http.ResponseWriter, r *http.Request, s *ClientSession) error {
+		if _, err := s.Acquire(r.URL.Query().Get("resource")); err != nil {
+			return err
+		}
+		writeJSON(w, s.Status())
+		return nil
+	}))
+	admin.Handle("POST /sessions/{id}/release", session(func(w http.ResponseWriter, r *http.Request, s *ClientSession) error {
+		if err := s.Release(r.URL.Query().Get("resource")); err != nil {
+			return err
+		}
+		writeJSON(w, s.Status())
+		return nil
+	}))
+	admin.Handle("DELETE /sessions/{id}", session(func(w http.ResponseWriter, r *http.Request, s *ClientSession) error {
+		s.Close()
+		fmt.Fprintf(w, "closed session %s\n", s.ID)
+		return nil
+	}))
+}
@@ -1,31 +1,242 @@
-package main
+package ra
 
 import (
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type File struct {
-	Name    string
-	IsOpen  bool
+	Name string
+	// Content is only changed under Mutex; read it through Snapshot.
 	Content string
 	Mutex   sync.Mutex
+	// handles counts the open handles on the file; see IsOpen.
+	handles int
+	// version counts the changes to Content since the file was loaded,
+	// the last of them at modified.
+	version  uint64
+	modified time.Time
+	// stored is the checksum of the content the file system last loaded
+	// from or stored to Storage, and storing that of a write in flight;
+	// anything else found there was changed from outside. See watch.go.
+	stored  string
+	storing string
+	// storeMutex orders the writes stored for the file, and fence is the
+	// highest fencing token among them; see stagedWrite.
+	storeMutex sync.Mutex
+	fence      uint64
+	// seen maps each client to the version it last read or wrote, with
+	// fs.Optimistic set. See conflict.go.
+	seen map[int]uint64
+}
+
+// FileSnapshot is a copy of a file's content as it was at one moment.
+// Later writes to the file never change it.
+type FileSnapshot struct {
+	Name    string
+	Content string
+	// Version counts the writes to the file since it was loaded, so two
+	// snapshots with the same version have the same content.
+	Version uint64
+	// Modified is when the file was last written; zero if it has not been
+	// since it was loaded.
+	Modified time.Time
+}
+
+// Snapshot returns a copy of the file's content, version and modification
+// time, taken together so a concurrent write is either wholly in it or not
+// at all.
+func (f *File) Snapshot() FileSnapshot {
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+	return FileSnapshot{Name: f.Name, Content: f.Content, Version: f.version, Modified: f.modified}
+}
+
+// setContent replaces the file's content as one new version and returns
+// its number.
+func (f *File) setContent(content string) uint64 {
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+	return f.setContentLocked(content)
+}
+
+func (f *File) setContentLocked(content string) uint64 {
+	f.Content = content
+	f.version++
+	f.modified = time.Now()
+	return f.version
 }
 
 type DistributedFileSystem struct {
-	Files            map[string]*File
-	FilesMutex       sync.Mutex
-	Requests         []*Request
-	RequestMutex     sync.Mutex
-	Acknowledged     []bool
-	AcknowledgeMutex sync.Mutex
-	Timestamps       []int
-	TimestampMutex   sync.Mutex
-	LogFile          *os.File
-	DeferredArray    []string
+	Files      map[string]*File
+	FilesMutex sync.Mutex
+	Nodes      map[int]*Node
+	NodesMutex sync.Mutex
+	LogFile    *os.File
+	// Operations is the bounded history of file operations; see
+	// AddDeferredOperation.
+	Operations       *OperationLog
+	Codec            Codec
+	Sequences        map[int]uint64
+	SequenceMutex    sync.Mutex
+	Dedupe           *Deduper
+	Recorder         *FairnessRecorder
+	LastSeen         map[int]time.Time
+	LastSeenMutex    sync.Mutex
+	Tracer           *Tracer
+	History          *HistoryStore
+	Versions         *VersionStore
+	Transport        Transport
+	Outstanding      map[outstandingKey]*Request
+	OutstandingMutex sync.Mutex
+	Snapshots        *Snapshotter
+	Lease            time.Duration
+	LeaseBreak       bool
+	// fences hands out fencing tokens; see Request.fence.
+	fences atomic.Uint64
+	// HoldLimit bounds how long a WithCriticalSection callback may hold
+	// the critical section before it is released anyway; 0 is no bound.
+	// OnForcedRelease, if set, is told about every such release.
+	HoldLimit       time.Duration
+	OnForcedRelease func(request *Request)
+	Fenced          map[int]bool
+	FencedMutex     sync.Mutex
+	ReplyTimeout    time.Duration
+	Events          *EventLog
+	Observers       []EventSink
+	// Trace records messages for the space-time diagram; nil disables it.
+	Trace  *MessageTrace
+	Safety *SafetyChecker
+	// NoMutex skips the protocol entirely, so clients enter critical
+	// sections whenever they like. It exists to show what goes wrong
+	// without mutual exclusion.
+	NoMutex bool
+	// SharedReads lets reads of a file proceed together, excluding only
+	// writers, by putting every read in ReadSession.
+	SharedReads bool
+	// Hierarchical treats resource names as slash-separated paths, with a
+	// trailing slash naming a directory: holding a directory, e.g. "docs/",
+	// excludes every critical section on a path under it. Clients take
+	// intention locks on the directories above a path first (see
+	// IntentSession); only Ricart-Agarwala lets those be shared, so the
+	// other algorithms serialize all work under a directory.
+	Hierarchical bool
+	// TieBreak orders requests with equal timestamps, by lowest client id
+	// if nil. Every node must use the same policy; set it before Join.
+	TieBreak TieBreak
+	// Storage persists file contents; it is the working directory unless
+	// set before any file is opened.
+	Storage Storage
+	// Quotas limits file sizes at write time; nil is no limit.
+	Quotas *Quotas
+	// FanOut sends broadcasts to peers in parallel; nil sends them one at
+	// a time.
+	FanOut *FanOut
+	// Cache is nil unless the read cache is enabled.
+	Cache   *ReadCache
+	Metrics *Metrics
+	// Log receives the file system's log messages; it must not be nil.
+	Log Logger
+	// Consistency holds the files not using the default Strong mode.
+	Consistency      map[string]Consistency
+	ConsistencyMutex sync.Mutex
+	Replicas         *LWWStore
+	Catalog          *Catalog
+	// Txns holds each local client's running transaction.
+	Txns      map[int]*Txn
+	TxnsMutex sync.Mutex
+	// ClientSessions holds the open client sessions by id.
+	ClientSessions      map[string]*ClientSession
+	ClientSessionsMutex sync.Mutex
+	// Report, if set, collects a record of every critical section.
+	Report *OperationReport
+	// LocalQueue, if set, orders the local callers of each node that want
+	// the same resource.
+	LocalQueue *LocalQueue
+	// DeferredJournal, if set, keeps the replies the local clients owe on
+	// disk so they survive a restart.
+	DeferredJournal *DeferredJournal
+	// MaxOutstanding limits each client's requests in flight (0 is no
+	// limit); MaxQueued limits the callers waiting for one (-1 is no
+	// limit). See Limiter.
+	MaxOutstanding int
+	MaxQueued      int
+	Limiters       map[int]*Limiter
+	LimitersMutex  sync.Mutex
+	// Mutex is the mutual exclusion algorithm every client runs.
+	Mutex DistributedMutex
+	// Scheduler, when set, records or replays the order of every client's
+	// protocol steps.
+	Scheduler Scheduler
+	// Coalesce, if positive, keeps a released Ricart-Agarwala critical
+	// section held this long for the same client's next operation on it,
+	// as long as no peer is waiting; CoalesceLimit bounds the operations
+	// one entry serves (0 is DefaultCoalesceLimit). See coalesce.go.
+	Coalesce      time.Duration
+	CoalesceLimit int
+	coalesceMutex sync.Mutex
+	lingering     map[clientResource]*lingering
+	// PeerWindow, if positive, is how many REQUESTs from any one peer a
+	// Ricart-Agarwala node defers at a time; it answers more with BUSY,
+	// asking the peer to retry after BusyRetryAfter (0 is
+	// DefaultBusyRetryAfter). See flowcontrol.go.
+	PeerWindow     int
+	BusyRetryAfter time.Duration
+	// Optimistic rejects a Write by a client that has not read the file's
+	// current version with ErrConflict, telling OnConflict, if set, about
+	// it. See conflict.go.
+	Optimistic bool
+	OnConflict func(Conflict)
+	// Proxies maps each lightweight client to the participant it enters
+	// critical sections through; clients not in it are participants.
+	// Every node must agree on it; set it before Join. See roles.go.
+	Proxies    map[int]int
+	proxyMutex sync.Mutex
+	proxyWaits map[proxyKey]chan proxyGrant
+	proxyHeld  map[proxyKey]*Request
+	// intents holds the intention locks each client holds or is taking,
+	// shared by all its requests under a directory. See hierarchy.go.
+	intents      map[intentKey]*sharedIntent
+	intentsMutex sync.Mutex
+}
+
+// NewDistributedFileSystem returns a file system with no clients joined
+// whose protocol messages are encoded with codec and sent over transport.
+// It runs Ricart-Agarwala until SetAlgorithm picks another algorithm.
+func NewDistributedFileSystem(codec Codec, transport Transport) *DistributedFileSystem {
+	fs := &DistributedFileSystem{
+		Files:          make(map[string]*File),
+		Nodes:          make(map[int]*Node),
+		Codec:          codec,
+		Sequences:      make(map[int]uint64),
+		Dedupe:         NewDeduper(),
+		LastSeen:       make(map[int]time.Time),
+		Transport:      transport,
+		Outstanding:    make(map[outstandingKey]*Request),
+		Snapshots:      NewSnapshotter(),
+		Fenced:         make(map[int]bool),
+		Safety:         NewSafetyChecker(),
+		Metrics:        NewMetrics(),
+		Consistency:    make(map[string]Consistency),
+		Replicas:       NewLWWStore(),
+		Catalog:        NewCatalog(),
+		Operations:     NewOperationLog(DefaultOperationLogSize),
+		Txns:           make(map[int]*Txn),
+		ClientSessions: make(map[string]*ClientSession),
+		Storage:        DiskStorage{},
+		MaxQueued:      -1,
+		Limiters:       make(map[int]*Limiter),
+		Log:            DefaultLogger,
+	}
+	fs.Mutex = &RicartAgarwala{fs: fs}
+	return fs
 }
 
 type Client struct {
@@ -35,148 +246,794 @@ type Client struct {
 
 type Request struct {
 	ClientID  int
+	Resource  string
+	Session   string
 	File      *File
 	Timestamp int
+	Seq       uint64
+	Requested time.Time
+	Entered   time.Time
+	Op        string
+	index     int
+	checksum  string
+	span      *Span
+	heldSpan  *Span
+	// endTurn gives up the caller's turn in the LocalQueue.
+	endTurn func()
+	// intents are the intention locks taken on the directories above
+	// Resource when fs.Hierarchical is set.
+	intents []*Request
+	// fence is the fencing token of the critical section: a number every
+	// entry takes from fs.fences, so a later holder's is higher. 0 for a
+	// request that did not enter through the protocol.
+	fence uint64
+	// proxy is the participant a lightweight client's request was
+	// granted by; see roles.go.
+	proxy int
+	// coalesced counts the operations after the first that have entered
+	// the critical section without a new protocol round; see fs.Coalesce.
+	coalesced int
+	// messages counts the protocol messages sent or received on the
+	// request's behalf.
+	messages atomic.Int32
+
+	repliesMutex sync.Mutex
+	awaiting     map[int]bool
+	repliesDone  chan struct{}
+
+	// cancelled is closed by Cancel to withdraw a waiting request.
+	cancelled  chan struct{}
+	cancelOnce sync.Once
+
+	leaseMutex   sync.Mutex
+	leaseExpires time.Time
+	// revoked says why the critical section was taken away from the
+	// holder; it is empty while the request holds it.
+	revoked string
+	// released is set by the first ReleaseRequest, so a revocation and
+	// the holder's own release leave the critical section only once.
+	released atomic.Bool
+}
+
+// outstandingKey identifies a request that is still collecting replies.
+type outstandingKey struct {
+	ClientID int
+	Seq      uint64
 }
 
-func (fs *DistributedFileSystem) OpenFile(clientID int, fileName string) *File {
+// expectReplies records the peers the request was sent to. repliesDone is
+// closed once every one of them has replied.
+func (r *Request) expectReplies(peers []int) {
+	r.repliesMutex.Lock()
+	defer r.repliesMutex.Unlock()
+
+	r.awaiting = make(map[int]bool, len(peers))
+	for _, peer := range peers {
+		r.awaiting[peer] = true
+	}
+	r.repliesDone = make(chan struct{})
+	if len(r.awaiting) == 0 {
+		close(r.repliesDone)
+	}
+}
+
+// replied records peer's reply and reports whether the request was
+// awaiting it.
+func (r *Request) replied(peer int) bool {
+	r.repliesMutex.Lock()
+	defer r.repliesMutex.Unlock()
+
+	if !r.awaiting[peer] {
+		return false
+	}
+	delete(r.awaiting, peer)
+	if len(r.awaiting) == 0 {
+		close(r.repliesDone)
+	}
+	return true
+}
+
+// Awaiting returns the peers that have not yet replied to the request.
+func (r *Request) Awaiting() []int {
+	r.repliesMutex.Lock()
+	defer r.repliesMutex.Unlock()
+
+	peers := make([]int, 0, len(r.awaiting))
+	for peer := range r.awaiting {
+		peers = append(peers, peer)
+	}
+	sort.Ints(peers)
+	return peers
+}
+
+// OpenFile opens fileName for clientID, loading it from storage the first time
+// any client opens it, and returns a new handle owned by clientID. It
+// returns an error wrapping ErrFileNotFound if the file does not exist.
+func (fs *DistributedFileSystem) OpenFile(clientID int, fileName string) (*Handle, error) {
 	fs.FilesMutex.Lock()
 	defer fs.FilesMutex.Unlock()
 
 	file, ok := fs.Files[fileName]
 	if !ok {
-		fileContent, err := ioutil.ReadFile(fileName)
+		fileContent, err := fs.Storage.Load(fileName)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %s", ErrFileNotFound, fileName)
+		}
 		if err != nil {
-			fmt.Printf("Error opening file %s: %v\n", fileName, err)
-			return nil
+			return nil, fmt.Errorf("opening %s: %w", fileName, err)
 		}
 
 		file = &File{
 			Name:    fileName,
-			IsOpen:  true,
 			Content: string(fileContent),
+			stored:  checksum(string(fileContent)),
 		}
 		fs.Files[fileName] = file
-	} else {
-		file.Mutex.Lock()
-		file.IsOpen = true
-		file.Mutex.Unlock()
+		fs.recordVersion(file, 0, 0, 0, file.Content)
 	}
+	file.Mutex.Lock()
+	file.handles++
+	file.Mutex.Unlock()
 
-	fmt.Printf("Client %d opened file %s\n", clientID, fileName)
-	return file
+	fs.Log.Debugf("Client %d opened file %s", clientID, fileName)
+	return &Handle{Client: clientID, File: file}, nil
 }
 
-func (fs *DistributedFileSystem) CloseFile(file *File) {
+// CloseFile closes handle. The file itself closes once no client holds an
+// open handle on it. Closing a handle twice returns ErrHandleClosed.
+func (fs *DistributedFileSystem) CloseFile(handle *Handle) error {
+	handle.mu.Lock()
+	if handle.closed {
+		handle.mu.Unlock()
+		return fmt.Errorf("client %d closing %s: %w", handle.Client, handle.File.Name, ErrHandleClosed)
+	}
+	handle.closed = true
+	handle.mu.Unlock()
+
+	file := handle.File
 	file.Mutex.Lock()
-	file.IsOpen = false
+	file.handles--
+	open := file.handles
 	file.Mutex.Unlock()
-	fmt.Printf("File %s closed\n", file.Name)
+	fs.Log.Debugf("Client %d closed file %s", handle.Client, file.Name)
+	if open == 0 {
+		fs.Log.Debugf("File %s closed", file.Name)
+	}
+	return nil
+}
+
+// ReadFile enters file's critical section and returns its content. With
+// the read cache enabled a cached copy is returned without entering, and
+// files in Eventual mode are read from clientID's replica.
+func (fs *DistributedFileSystem) ReadFile(clientID int, handle *Handle) (string, error) {
+	file, err := handle.use(clientID)
+	if err != nil {
+		return "", err
+	}
+	if fs.consistency(file.Name) == Eventual {
+		return fs.readEventual(clientID, file), nil
+	}
+	if content, ok := fs.cachedRead(clientID, file); ok {
+		return content, nil
+	}
+	request, err := fs.acquireRead(clientID, file)
+	if err != nil {
+		return "", err
+	}
+	content, err := fs.readHeld(request)
+	if releaseErr := fs.ReleaseRequest(request); err == nil {
+		err = releaseErr
+	}
+	return content, err
 }
 
-func (fs *DistributedFileSystem) ReadFile(clientID int, file *File) {
-	fs.RequestMutex.Lock()
-	defer fs.RequestMutex.Unlock()
+// WriteFile enters file's critical section and replaces its content. Files
+// in Eventual mode are written to clientID's replica without blocking.
+func (fs *DistributedFileSystem) WriteFile(clientID int, handle *Handle, content string) error {
+	file, err := handle.use(clientID)
+	if err != nil {
+		return err
+	}
+	if fs.consistency(file.Name) == Eventual {
+		return fs.writeEventual(clientID, file, content)
+	}
+	request, err := fs.AcquireRequest(clientID, handle)
+	if err != nil {
+		return err
+	}
+	err = fs.writeHeld(request, content)
+	if releaseErr := fs.ReleaseRequest(request); err == nil {
+		err = releaseErr
+	}
+	return err
+}
 
-	fs.TimestampMutex.Lock()
-	timestamp := len(fs.Timestamps) + 1
-	fs.Timestamps = append(fs.Timestamps, timestamp)
-	fs.TimestampMutex.Unlock()
+// AppendFile enters file's critical section and appends data to its
+// content, so concurrent appends from different clients are all kept. Files
+// in Eventual mode append to clientID's replica, and concurrent appends there
+// are resolved last-writer-wins like any other write.
+func (fs *DistributedFileSystem) AppendFile(clientID int, handle *Handle, data string) error {
+	file, err := handle.use(clientID)
+	if err != nil {
+		return err
+	}
+	if fs.consistency(file.Name) == Eventual {
+		return fs.writeEventual(clientID, file, fs.replicaContent(clientID, file)+data)
+	}
+	request, err := fs.AcquireRequest(clientID, handle)
+	if err != nil {
+		return err
+	}
+	err = fs.appendHeld(request, data)
+	if releaseErr := fs.ReleaseRequest(request); err == nil {
+		err = releaseErr
+	}
+	return err
+}
 
-	request := &Request{
-		ClientID:  clientID,
-		File:      file,
-		Timestamp: timestamp,
+// TruncateFile enters file's critical section and cuts its content to size
+// bytes, padding it with zero bytes if it is shorter.
+func (fs *DistributedFileSystem) TruncateFile(clientID int, handle *Handle, size int) error {
+	file, err := handle.use(clientID)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		return fmt.Errorf("client %d truncating %s: negative size %d", clientID, file.Name, size)
+	}
+	if fs.consistency(file.Name) == Eventual {
+		return fs.writeEventual(clientID, file, truncate(fs.replicaContent(clientID, file), size))
+	}
+	request, err := fs.AcquireRequest(clientID, handle)
+	if err != nil {
+		return err
+	}
+	err = fs.truncateHeld(request, size)
+	if releaseErr := fs.ReleaseRequest(request); err == nil {
+		err = releaseErr
+	}
+	return err
+}
+
+// readHeld performs a read for a request that already holds the file's
+// critical section.
+func (fs *DistributedFileSystem) readHeld(request *Request) (string, error) {
+	clientID, file := request.ClientID, request.File
+	request.Op = "Read"
+	if request.Revoked() {
+		return "", fmt.Errorf("client %d reading %s: %w: %s", clientID, file.Name, ErrNotHoldingCS, request.revocation())
+	}
+
+	content := file.Snapshot().Content
+	if fs.Optimistic {
+		file.markSeen(clientID)
+	}
+	fs.Log.Debugf("Client %d read file %s: %s", clientID, file.Name, content)
+	if fs.Cache != nil {
+		fs.Cache.put(clientID, file.Name, content)
+	}
+	fs.LogRequest(clientID, "Read", file.Name, request.Timestamp)
+	fs.AddDeferredOperation(fmt.Sprintf("Read by Client %d", clientID))
+	return content, nil
+}
+
+// writeHeld performs a write for a request that already holds the file's
+// critical section.
+func (fs *DistributedFileSystem) writeHeld(request *Request, content string) error {
+	if err := fs.checkConflict(request); err != nil {
+		return err
+	}
+	if _, err := fs.storeHeld(request, "Write", "writing", func(string) string { return content }); err != nil {
+		return err
+	}
+	if fs.Optimistic {
+		request.File.markSeen(request.ClientID)
 	}
+	fs.Log.Debugf("Client %d wrote to file %s: %s", request.ClientID, request.Resource, content)
+	return nil
+}
+
+// appendHeld appends data for a request that already holds the file's
+// critical section.
+func (fs *DistributedFileSystem) appendHeld(request *Request, data string) error {
+	if _, err := fs.storeHeld(request, "Append", "appending to", func(old string) string { return old + data }); err != nil {
+		return err
+	}
+	fs.Log.Debugf("Client %d appended to file %s: %s", request.ClientID, request.Resource, data)
+	return nil
+}
 
-	fs.Requests = append(fs.Requests, request)
+// truncateHeld truncates the file to size bytes for a request that already
+// holds the file's critical section.
+func (fs *DistributedFileSystem) truncateHeld(request *Request, size int) error {
+	if _, err := fs.storeHeld(request, "Truncate", "truncating", func(old string) string { return truncate(old, size) }); err != nil {
+		return err
+	}
+	fs.Log.Debugf("Client %d truncated file %s to %d bytes", request.ClientID, request.Resource, size)
+	return nil
+}
+
+// storeHeld replaces the content of the file held by request with
+// modify(current content), in storage and then in memory, and returns the
+// new content. If storing fails the file keeps its old content. op names
+// the operation in the log; verb in errors.
+func (fs *DistributedFileSystem) storeHeld(request *Request, op, verb string, modify func(old string) string) (string, error) {
+	clientID, file := request.ClientID, request.File
+	request.Op = op
+	if request.Revoked() {
+		return "", fmt.Errorf("client %d %s %s: %w: %s", clientID, verb, file.Name, ErrNotHoldingCS, request.revocation())
+	}
+
+	staged, err := fs.stage(request, modify)
+	if err != nil {
+		return "", err
+	}
+	if err := fs.apply(staged, verb); err != nil {
+		return "", err
+	}
+	content := staged.content
+	fs.recordVersion(file, staged.version, clientID, request.Timestamp, content)
+
+	request.checksum = checksum(content)
+	fs.wrote(request, content)
+	fs.LogRequest(clientID, op, file.Name, request.Timestamp)
+	fs.AddDeferredOperation(fmt.Sprintf("%s by Client %d", op, clientID))
+	return content, nil
+}
+
+// truncate cuts content to size bytes, or pads it with zero bytes up to
+// size, as truncate(2) does.
+func truncate(content string, size int) string {
+	if size <= len(content) {
+		return content[:size]
+	}
+	return content + strings.Repeat("\x00", size-len(content))
+}
+
+// AcquireRequest enters the critical section for file on behalf of
+// clientID. The returned request must be handed to ReleaseRequest. It fails
+// with ErrFenced if clientID is fenced after a lease violation and with
+// ErrPeerTimeout if peers do not reply within fs.ReplyTimeout.
+func (fs *DistributedFileSystem) AcquireRequest(clientID int, handle *Handle) (*Request, error) {
+	file, err := handle.use(clientID)
+	if err != nil {
+		return nil, err
+	}
+	return fs.acquire(clientID, file.Name, "", file)
+}
 
-	for i := range fs.Requests {
-		if fs.Requests[i].ClientID != clientID {
-			go fs.SendRequest(clientID, fs.Requests[i])
+// AcquireResource enters the critical section for an arbitrary named
+// resource. Resource names share a namespace with file names.
+func (fs *DistributedFileSystem) AcquireResource(clientID int, resource string) (*Request, error) {
+	return fs.acquire(clientID, resource, "", nil)
+}
+
+// AcquireSession enters resource as a member of session: every client in
+// the same session may hold it at once, while other sessions, and requests
+// with no session, are kept out (group mutual exclusion). Only the Ricart-Agarwala algorithm lets a
+// session in together; the others admit one member at a time.
+func (fs *DistributedFileSystem) AcquireSession(clientID int, resource, session string) (*Request, error) {
+	return fs.acquire(clientID, resource, session, nil)
+}
+
+// ReadSession is the session reads join when SharedReads is set.
+const ReadSession = "read"
+
+// acquireRead enters file's critical section for a read. With SharedReads
+// every read joins ReadSession, so readers share the file and only writers
+// are exclusive.
+func (fs *DistributedFileSystem) acquireRead(clientID int, file *File) (*Request, error) {
+	session := ""
+	if fs.SharedReads {
+		session = ReadSession
+	}
+	return fs.acquire(clientID, file.Name, session, file)
+}
+
+// AcquireAs enters resource's critical section like AcquireResource, on
+// behalf of one of clientID's local callers. With fs.LocalQueue set, the
+// callers of a node wanting the same resource take turns in the order of
+// its discipline.
+func (fs *DistributedFileSystem) AcquireAs(clientID int, resource string, caller LocalCaller) (*Request, error) {
+	return fs.acquireAs(caller, clientID, resource, "", nil)
+}
+
+// acquire moves clientID's node to WANTED for resource, sends a REQUEST to
+// every other client and enters the critical section (HELD) once all of
+// them have replied. file is nil for resources that are not files. It
+// queues as a local caller named after the client.
+func (fs *DistributedFileSystem) acquire(clientID int, resource, session string, file *File) (*Request, error) {
+	return fs.acquireAs(LocalCaller{Name: fmt.Sprintf("client %d", clientID)}, clientID, resource, session, file)
+}
+
+func (fs *DistributedFileSystem) acquireAs(caller LocalCaller, clientID int, resource, session string, file *File) (*Request, error) {
+	if participant, ok := fs.Proxies[clientID]; ok {
+		return fs.acquireVia(participant, clientID, resource, session, file)
+	}
+	if fs.Hierarchical {
+		return fs.acquirePath(caller, clientID, resource, session, file)
+	}
+	return fs.acquireOne(caller, clientID, resource, session, file)
+}
+
+// acquireOne enters resource's critical section alone, whatever
+// directories it is under.
+func (fs *DistributedFileSystem) acquireOne(caller LocalCaller, clientID int, resource, session string, file *File) (*Request, error) {
+	if fs.isFenced(clientID) {
+		return nil, fmt.Errorf("client %d requesting %s: %w", clientID, resource, ErrFenced)
+	}
+	node := fs.Node(clientID)
+	if node == nil {
+		return nil, fmt.Errorf("client %d requesting %s: %w", clientID, resource, ErrUnknownPeer)
+	}
+	if limiter := fs.limiter(clientID); limiter != nil {
+		if err := limiter.acquire(); err != nil {
+			fs.Metrics.Add("ra_backpressure_rejections_total", 1)
+			return nil, fmt.Errorf("client %d requesting %s: %w", clientID, resource, err)
 		}
+		defer limiter.release()
+	}
+	if fs.NoMutex {
+		return fs.acquireUnprotected(node, resource, session, file), nil
 	}
 
-	for i := range fs.Requests {
-		if fs.Requests[i].ClientID != clientID {
-			fs.ReceiveAcknowledge()
+	endTurn := fs.LocalQueue.wait(clientID, resource, caller)
+	span := fs.Tracer.Start("cs.request", nil)
+	span.SetAttribute("client.id", clientID)
+	span.SetAttribute("resource", resource)
+	span.SetAttribute("algorithm", fs.Mutex.Name())
+	if session != "" {
+		span.SetAttribute("session", session)
+	}
+	request := fs.takeLingering(node, resource, session, span)
+	if request == nil {
+		var err error
+		if request, err = fs.Mutex.Acquire(node, resource, session, file, span); err != nil {
+			endTurn()
+			span.Finish()
+			return nil, err
 		}
 	}
+	request.endTurn = endTurn
+	if request.fence == 0 {
+		request.fence = fs.fences.Add(1)
+	}
+	request.Entered = time.Now()
+	fs.csEvent(EventEnter, request)
+	fs.Metrics.addNode("ra_cs_entries_total", request.ClientID)
+	fs.Safety.Enter(request)
+	fs.Trace.enter(request, node.Clock())
+	if fs.Lease > 0 {
+		request.renewLease(fs.Lease)
+	}
 
-	fmt.Printf("Client %d read file %s: %s\n", clientID, file.Name, file.Content)
-	fs.LogRequest(clientID, "Read", file.Name, timestamp)
-	fs.AddDeferredOperation(fmt.Sprintf("Read by Client %d", clientID))
+	request.heldSpan = fs.Tracer.Start("cs.held", span)
+	request.heldSpan.SetAttribute("lamport.timestamp", request.Timestamp)
+	if fs.Recorder != nil {
+		fs.Recorder.Record(request, request.Entered)
+	}
+	return request, nil
 }
 
-func (fs *DistributedFileSystem) WriteFile(clientID int, file *File, content string) {
-	fs.RequestMutex.Lock()
-	defer fs.RequestMutex.Unlock()
+// ReleaseRequest leaves the critical section entered by AcquireRequest. It
+// returns ErrNotHoldingCS if the critical section had already been taken
+// away, e.g. by a lease revocation.
+func (fs *DistributedFileSystem) ReleaseRequest(request *Request) error {
+	if request.proxy != 0 {
+		return fs.releaseVia(request)
+	}
+	if request.released.Swap(true) {
+		return fmt.Errorf("client %d releasing %s: %w", request.ClientID, request.Resource, ErrNotHoldingCS)
+	}
+	request.heldSpan.Finish()
 
-	fs.TimestampMutex.Lock()
-	timestamp := len(fs.Timestamps) + 1
-	fs.Timestamps = append(fs.Timestamps, timestamp)
-	fs.TimestampMutex.Unlock()
+	if fs.History != nil {
+		err := fs.History.Append(HistoryRecord{
+			Node:      request.ClientID,
+			Resource:  request.Resource,
+			Op:        request.Op,
+			Timestamp: request.Timestamp,
+			Entered:   request.Entered,
+			Duration:  time.Since(request.Entered),
+		})
+		if err != nil {
+			fs.Log.Errorf("Error recording history: %v", err)
+		}
+	}
 
+	flush := fs.Tracer.Start("deferred.flush", request.span)
+	fs.csEvent(EventExit, request)
+	fs.Safety.Exit(request)
+	if fs.Trace != nil {
+		fs.Trace.exit(request, fs.Node(request.ClientID).Clock())
+	}
+	held := fs.release(request)
+	flush.Finish()
+	fs.Report.record(request, time.Now())
+	if request.endTurn != nil {
+		request.endTurn()
+	}
+
+	request.span.Finish()
+	if request.checksum != "" {
+		fs.logChecksum(request)
+	}
+	fs.releaseIntents(request.intents)
+	if !held {
+		return fmt.Errorf("client %d releasing %s: %w", request.ClientID, request.Resource, ErrNotHoldingCS)
+	}
+	return nil
+}
+
+// acquireUnprotected enters the critical section at once, without asking
+// any peer. It is what acquire does in NoMutex mode.
+func (fs *DistributedFileSystem) acquireUnprotected(node *Node, resource, session string, file *File) *Request {
+	now := time.Now()
 	request := &Request{
-		ClientID:  clientID,
+		ClientID:  node.ID,
+		Resource:  resource,
+		Session:   session,
 		File:      file,
-		Timestamp: timestamp,
+		Timestamp: node.Clock(),
+		Seq:       fs.NextSequence(node.ID),
+		Requested: now,
+		Entered:   now,
 	}
+	fs.csEvent(EventEnter, request)
+	fs.Metrics.addNode("ra_cs_entries_total", request.ClientID)
+	fs.Safety.Enter(request)
+	fs.Trace.enter(request, node.Clock())
+	return request
+}
 
-	fs.Requests = append(fs.Requests, request)
+// release moves request's node back to RELEASED and lets the algorithm tell
+// the peers waiting on it, or keeps it held a little longer with
+// fs.Coalesce. It reports whether request was in the critical section.
+func (fs *DistributedFileSystem) release(request *Request) bool {
+	if fs.NoMutex || fs.linger(request) {
+		return true
+	}
+	return fs.Mutex.Release(request)
+}
 
-	for i := range fs.Requests {
-		if fs.Requests[i].ClientID != clientID {
-			go fs.SendRequest(clientID, fs.Requests[i])
-		}
+// Node returns the protocol state of clientID, or nil if it has not joined.
+func (fs *DistributedFileSystem) Node(clientID int) *Node {
+	fs.NodesMutex.Lock()
+	defer fs.NodesMutex.Unlock()
+	return fs.Nodes[clientID]
+}
+
+// nodes returns every joined node in id order.
+func (fs *DistributedFileSystem) nodes() []*Node {
+	fs.NodesMutex.Lock()
+	defer fs.NodesMutex.Unlock()
+
+	nodes := make([]*Node, 0, len(fs.Nodes))
+	for _, node := range fs.Nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+// NextSequence returns the next message sequence number for clientID.
+// Sequence numbers start at 1 and are never reused.
+func (fs *DistributedFileSystem) NextSequence(clientID int) uint64 {
+	fs.SequenceMutex.Lock()
+	defer fs.SequenceMutex.Unlock()
+
+	fs.Sequences[clientID]++
+	return fs.Sequences[clientID]
+}
+
+// Join registers clientID with the transport so it starts receiving
+// messages. A lightweight client in fs.Proxies joins without a node.
+func (fs *DistributedFileSystem) Join(clientID int) {
+	if _, ok := fs.Proxies[clientID]; ok {
+		fs.joinLightweight(clientID)
+		return
 	}
+	node := NewNode(clientID)
+	node.tieBreak = fs.TieBreak
+	fs.NodesMutex.Lock()
+	fs.Nodes[clientID] = node
+	fs.NodesMutex.Unlock()
+
+	fs.Transport.Register(clientID, func(from int, data []byte) {
+		fs.HandleMessage(clientID, from, data)
+	})
+}
 
-	for i := range fs.Requests {
-		if fs.Requests[i].ClientID != clientID {
-			fs.ReceiveAcknowledge()
+func (fs *DistributedFileSystem) send(msg *Message) error {
+	data, err := fs.Codec.Encode(msg)
+	if err != nil {
+		return err
+	}
+	fs.Metrics.addMessage("ra_messages_sent_total", msg.From, msg.Type)
+	if node := fs.Node(msg.From); node != nil {
+		node.countMessage(true)
+		if fs.Trace != nil {
+			fs.Trace.sent(msg, node.Clock())
 		}
 	}
+	return fs.Transport.Send(msg.From, msg.To, data)
+}
 
-	file.Mutex.Lock()
-	file.Content = content
-	file.Mutex.Unlock()
+func (fs *DistributedFileSystem) SendRequest(request *Request, to int) {
+	fs.Log.Debugf("Client %d sent request to client %d", request.ClientID, to)
 
-	err := ioutil.WriteFile(file.Name, []byte(content), 0644)
+	msg := newMessage()
+	defer freeMessage(msg)
+	*msg = Message{
+		Type:      MsgRequest,
+		From:      request.ClientID,
+		To:        to,
+		Seq:       request.Seq,
+		Resource:  request.Resource,
+		Timestamp: request.Timestamp,
+		Session:   request.Session,
+	}
+	if request.span != nil {
+		msg.TraceID = request.span.TraceID
+		msg.SpanID = request.span.SpanID
+	}
+
+	if err := fs.send(msg); err != nil {
+		fs.Log.Errorf("Error sending request from client %d: %v", request.ClientID, err)
+		return
+	}
+	fs.event(EventRequestSent, request.ClientID, to, request.Resource, request.Timestamp)
+}
+
+// HandleMessage decodes a frame delivered to clientID and dispatches it by
+// message type. A message claiming a sender other than the client whose
+// link delivered it is rejected.
+func (fs *DistributedFileSystem) HandleMessage(clientID, from int, data []byte) {
+	msg, err := fs.decode(data)
 	if err != nil {
-		fmt.Printf("Error writing to file %s: %v\n", file.Name, err)
+		fs.Log.Warnf("Client %d: error decoding message from client %d: %v", clientID, from, err)
 		return
 	}
+	defer freeMessage(msg)
+	if msg.From != from {
+		fs.Log.Warnf("Client %d: rejecting %s claiming to be from client %d on client %d's link", clientID, msg.Type, msg.From, from)
+		fs.Metrics.addNode("ra_impersonation_rejections_total", clientID)
+		return
+	}
+	done := fs.step(TraceStep{Client: clientID, Kind: StepDeliver, From: from, Type: msg.Type.String(), Seq: msg.Seq, Resource: msg.Resource})
+	defer done()
+	fs.Metrics.addMessage("ra_messages_received_total", clientID, msg.Type)
 
-	fmt.Printf("Client %d wrote to file %s: %s\n", clientID, file.Name, content)
-	fs.LogRequest(clientID, "Write", file.Name, timestamp)
-	fs.AddDeferredOperation(fmt.Sprintf("Write by Client %d", clientID))
-}
+	fs.LastSeenMutex.Lock()
+	fs.LastSeen[msg.From] = time.Now()
+	fs.LastSeenMutex.Unlock()
+	fs.Node(clientID).observe(msg.Timestamp)
+	fs.Node(clientID).countMessage(false)
+	if fs.Trace != nil {
+		fs.Trace.received(msg, fs.Node(clientID).Clock())
+	}
 
-func (fs *DistributedFileSystem) SendRequest(clientID int, request *Request) {
-	fmt.Printf("Client %d sent request to client %d\n", clientID, request.ClientID)
-	fs.AcknowledgeMutex.Lock()
-	defer fs.AcknowledgeMutex.Unlock()
+	switch msg.Type {
+	case MsgRequest, MsgReply, MsgRelease, MsgToken, MsgCancel, MsgBusy:
+		fs.Snapshots.recordMessage(clientID, msg)
+		if !fs.Mutex.Receive(msg) {
+			fs.Log.Warnf("Client %d: %s does not use %s messages", clientID, fs.Mutex.Name(), msg.Type)
+		}
+	case MsgMarker:
+		fs.Snapshots.receiveMarker(fs, clientID, msg)
+	case MsgInvalidate:
+		fs.Snapshots.recordMessage(clientID, msg)
+		fs.ReceiveInvalidate(msg)
+	case MsgUpdate:
+		fs.Snapshots.recordMessage(clientID, msg)
+		fs.ReceiveUpdate(msg)
+	case MsgCatalog, MsgCatalogSync:
+		fs.Snapshots.recordMessage(clientID, msg)
+		fs.ReceiveCatalog(msg)
+	case MsgWound:
+		fs.Snapshots.recordMessage(clientID, msg)
+		fs.ReceiveWound(msg)
+	case MsgProxyRequest:
+		fs.ReceiveProxyRequest(msg)
+	case MsgProxyRelease:
+		fs.ReceiveProxyRelease(msg)
+	default:
+		fs.Log.Debugf("Client %d: ignoring %s from client %d", clientID, msg.Type, from)
+	}
+}
 
-	if request.ClientID < len(fs.Acknowledged) {
-		fs.Acknowledged[request.ClientID] = true
-	} else {
-		fmt.Println("Invalid client ID in SendRequest......")
+// decode decodes a frame into a pooled message where the codec allows it.
+// The caller frees the message once it has been handled.
+func (fs *DistributedFileSystem) decode(data []byte) (*Message, error) {
+	decoder, ok := fs.Codec.(messageDecoder)
+	if !ok {
+		return fs.Codec.Decode(data)
 	}
+	msg := newMessage()
+	if err := decoder.decodeInto(data, msg); err != nil {
+		freeMessage(msg)
+		return nil, err
+	}
+	return msg, nil
 }
 
-func (fs *DistributedFileSystem) ReceiveAcknowledge() {
-	fs.AcknowledgeMutex.Lock()
-	defer fs.AcknowledgeMutex.Unlock()
+// ReceiveRequest handles a REQUEST delivered to msg.To, replying at once or
+// deferring it depending on the receiver's state for the resource.
+func (fs *DistributedFileSystem) ReceiveRequest(msg *Message) {
+	if msg.TraceID != "" {
+		span := fs.Tracer.StartRemote("request.receive", msg.TraceID, msg.SpanID)
+		span.SetAttribute("client.id", msg.To)
+		span.SetAttribute("from", msg.From)
+		span.SetAttribute("lamport.timestamp", msg.Timestamp)
+		defer span.Finish()
+	}
 
-	for i := 0; i < len(fs.Acknowledged); i++ {
-		if !fs.Acknowledged[i] {
-			return
-		}
+	if fs.Dedupe.Seen(msg.From, msg.To, msg.Seq) {
+		fs.Log.Debugf("Client %d dropped duplicate request %d from client %d", msg.To, msg.Seq, msg.From)
+		fs.Metrics.addNode("ra_duplicates_dropped_total", msg.To)
+		return
 	}
 
-	fs.Acknowledged = make([]bool, len(fs.Requests))
+	request := newPeerRequest()
+	request.ClientID = msg.From
+	request.Resource = msg.Resource
+	request.Session = msg.Session
+	request.Timestamp = msg.Timestamp
+	request.Seq = msg.Seq
+	request.Requested = time.Now()
+	replyNow, busy := fs.Node(msg.To).onRequest(request, fs.PeerWindow)
+	fs.event(EventRequestRecv, msg.To, msg.From, msg.Resource, msg.Timestamp)
+	switch {
+	case busy:
+		// The REQUEST will come again with the same sequence number.
+		fs.Dedupe.Forget(msg.From, msg.To, msg.Seq)
+		fs.sendBusy(msg.To, request)
+		freePeerRequest(request)
+	case replyNow:
+		fs.sendReply(msg.To, request)
+		freePeerRequest(request)
+	default:
+		fs.event(EventReplyDeferred, msg.To, msg.From, msg.Resource, msg.Timestamp)
+		fs.Metrics.addNode("ra_replies_deferred_total", msg.To)
+		fs.journalDeferred()
+		fs.yieldLingering(msg.To, msg.Resource)
+	}
+}
 
-	fmt.Println("All acknowledgments received")
+// sendReply answers request on behalf of clientID.
+func (fs *DistributedFileSystem) sendReply(clientID int, request *Request) {
+	reply := newMessage()
+	defer freeMessage(reply)
+	*reply = Message{
+		Type:      MsgReply,
+		From:      clientID,
+		To:        request.ClientID,
+		Seq:       request.Seq,
+		Resource:  request.Resource,
+		Timestamp: fs.Node(clientID).Clock(),
+	}
+	if err := fs.send(reply); err != nil {
+		fs.Log.Errorf("Error sending reply from client %d: %v", clientID, err)
+		return
+	}
+	fs.event(EventReplySent, clientID, request.ClientID, request.Resource, request.Timestamp)
+}
+
+// ReceiveReply credits a REPLY to the outstanding request it answers.
+func (fs *DistributedFileSystem) ReceiveReply(msg *Message) {
+	fs.OutstandingMutex.Lock()
+	request, ok := fs.Outstanding[outstandingKey{msg.To, msg.Seq}]
+	fs.OutstandingMutex.Unlock()
+
+	if ok {
+		fs.event(EventReplyRecv, msg.To, msg.From, msg.Resource, request.Timestamp)
+	}
+	if !ok || !request.replied(msg.From) {
+		fs.Log.Debugf("Client %d ignored unexpected reply %d from client %d", msg.To, msg.Seq, msg.From)
+		fs.Metrics.addNode("ra_unexpected_replies_total", msg.To)
+		return
+	}
+	request.messages.Add(1)
 }
 
 func (fs *DistributedFileSystem) LogRequest(clientID int, action string, fileName string, timestamp int) {
@@ -185,7 +1042,7 @@ func (fs *DistributedFileSystem) LogRequest(clientID int, action string, fileNam
 }
 
 func (fs *DistributedFileSystem) AddDeferredOperation(operation string) {
-	fs.DeferredArray = append(fs.DeferredArray, operation)
+	fs.Operations.Add(operation)
 }
 
 func printSpaceTimeDiagram(clientID int, startTime time.Time, endTime time.Time, outputFile *os.File) {
@@ -211,16 +1068,223 @@ func printSpaceTimeDiagram(clientID int, startTime time.Time, endTime time.Time,
 	fmt.Fprintln(outputFile)
 }
 
-func main() {
-	fileSystem := &DistributedFileSystem{
-		Files:            make(map[string]*File),
-		FilesMutex:       sync.Mutex{},
-		Requests:         []*Request{},
-		RequestMutex:     sync.Mutex{},
-		AcknowledgeMutex: sync.Mutex{},
-		Timestamps:       []int{},
-		TimestampMutex:   sync.Mutex{},
-		DeferredArray:    []string{},
+// runDemo has every client write and then read file1.txt once.
+func runDemo(fileSystem *DistributedFileSystem, numClients int, outputFile *os.File) {
+	var wg sync.WaitGroup
+
+	for i := 0; i < numClients; i++ {
+		wg.Add(1)
+		go func(clientID int) {
+			defer wg.Done()
+			client := &Client{
+				ID:       clientID + 1,
+				FileName: "file1.txt",
+			}
+			handle, err := fileSystem.OpenFile(client.ID, client.FileName)
+			if err != nil {
+				fileSystem.Log.Errorf("Error opening file %s: %v", client.FileName, err)
+				return
+			}
+			startTime := time.Now()
+			if err := fileSystem.WriteFile(client.ID, handle, fmt.Sprintf("Content written by Client %d", client.ID)); err != nil {
+				fileSystem.Log.Errorf("Error writing file %s: %v", client.FileName, err)
+			}
+			if _, err := fileSystem.ReadFile(client.ID, handle); err != nil {
+				fileSystem.Log.Errorf("Error reading file %s: %v", client.FileName, err)
+			}
+			fileSystem.CloseFile(handle)
+			endTime := time.Now()
+			printSpaceTimeDiagram(client.ID, startTime, endTime, outputFile)
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+// Main runs the ra command: the subcommand named by the first argument,
+// or the demo when there is none. cmd/ra is a thin wrapper around it.
+func Main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+
+	codecName := flag.String("codec", "json", "wire codec for protocol messages (json or gob)")
+	fairness := flag.Duration("fairness", 0, "run the fairness experiment for this long instead of the demo")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "export OpenTelemetry spans to this OTLP/HTTP endpoint, e.g. http://localhost:4318")
+	lease := flag.Duration("lease", 0, "maximum time a client may hold a critical section without renewing (0 disables)")
+	leaseBreak := flag.Bool("lease-break", false, "revoke critical sections held past their lease instead of only logging")
+	holdLimit := flag.Duration("hold-limit", 0, "release a workload's critical section if its work inside runs longer than this (0 disables)")
+	replyTimeout := flag.Duration("reply-timeout", 0, "give up on a request if peers have not replied within this long (0 waits forever)")
+	snapshotAfter := flag.Duration("snapshot-after", 0, "take a Chandy-Lamport snapshot this long into the run (0 disables)")
+	historyPath := flag.String("history", "", "record every critical section in this history store, e.g. history.jsonl (empty disables)")
+	versionsPath := flag.String("versions", "versions.jsonl", "record every version of every file in this store, for ra cat --as-of, which is only meaningful under ricart-agarwala and lamport (empty disables)")
+	workloadPath := flag.String("workload", "", "JSON workload description to run instead of a scenario")
+	scenarioName := flag.String("scenario", "demo", "built-in run when no -workload is given: "+strings.Join(scenarioNames(), ", "))
+	watchdog := flag.Duration("watchdog", 10*time.Second, "dump diagnostics for requests waiting longer than this (0 disables)")
+	latency := flag.Duration("latency", 0, "emulated network latency on every link between clients")
+	jitter := flag.Duration("jitter", 0, "extra random latency of up to this much per message")
+	loss := flag.Float64("loss", 0, "drop this fraction of messages between clients, e.g. 0.1; without -retransmit a lost message stalls its requester")
+	retransmit := flag.Bool("retransmit", false, "acknowledge every message and retransmit unacknowledged ones with exponential backoff, reporting peers that never answer as down")
+	adminAddr := flag.String("admin", "", "serve the admin endpoint (partitions, link latency, dashboard) on this address, e.g. :8080")
+	noMutex := flag.Bool("no-mutex", false, "bypass Ricart-Agarwala entirely to show the mutual-exclusion violations it prevents")
+	readCache := flag.Bool("read-cache", false, "serve repeated reads from a per-client cache until a peer writes the file")
+	eventual := flag.String("eventual", "", "comma-separated files to run with last-writer-wins eventual consistency instead of mutual exclusion")
+	sharedReads := flag.Bool("shared-reads", false, "let reads of a file run together, excluding only writers (group mutual exclusion)")
+	algo := flag.String("algo", "ricart-agarwala", "mutual exclusion algorithm: "+strings.Join(algorithmNames(), ", "))
+	tree := flag.String("tree", "", "with -algo raymond, the tree as child=parent pairs, e.g. 2=1,3=1,4=2 (default: a balanced binary tree rooted at the lowest id)")
+	recordPath := flag.String("record", "", "record the order of every client's protocol steps to this trace, for `ra replay`")
+	maxOutstanding := flag.Int("max-outstanding", 0, "limit each client's critical section requests in flight (0 is no limit)")
+	participants := flag.Int("participants", 0, "run only the first N clients as protocol participants and the rest as lightweight clients proxied through them (0: every client participates)")
+	localQueue := flag.String("local-queue", "", "order local callers of a node wanting the same file: fifo, priority or fair-share (default: whoever wakes first)")
+	tieBreak := flag.String("tie-break", "lowest-id", "order of requests with equal timestamps: lowest-id, round-robin[:N], random[:seed] or weighted:id=weight,...; all preserve mutual exclusion")
+	fileQuota := flag.String("file-quota", "", "limit file sizes in bytes, as N for every file and/or name=N for one, e.g. file1.txt=64,1024")
+	clientQuota := flag.String("client-quota", "", "limit the bytes of the files each client last wrote, as N for every client and/or id=N for one")
+	checkpointPath := flag.String("checkpoint", "", "save files, replicas and clocks to this checkpoint at the end of the run (.gob for gob, JSON otherwise)")
+	restorePath := flag.String("restore", "", "resume from this checkpoint instead of the files on disk")
+	fanout := flag.Int("fanout", 0, "send each broadcast to peers in parallel on this many workers (0 or 1 sends one at a time)")
+	storageSpec := flag.String("storage", "disk", "where file contents are kept: disk[:dir], memory, or s3://bucket[/prefix]?endpoint=URL&region=R")
+	clockDrift := flag.Duration("clock-drift", 0, "skew each client's simulated physical clock by up to this much either way, and report how ordering by physical time differs from Lamport ordering")
+	maxQueued := flag.Int("max-queued", -1, "with -max-outstanding, let at most this many operations wait for a slot before failing them (-1 waits without limit, 0 never waits)")
+	logLevel := flag.String("log-level", "info", "least severe messages to log: debug (every protocol message and file operation), info, warn or error")
+	logFormat := flag.String("log-format", "text", "log as plain text lines or as JSON through log/slog: text or json")
+	opHistory := flag.Int("op-history", DefaultOperationLogSize, "keep this many of the latest file operations in memory for the deferred array")
+	opSpill := flag.String("op-spill", "", "append file operations pushed out of -op-history to this file instead of dropping them")
+	speed := flag.Float64("speed", 1, "run the emulated network at this multiple of real time, e.g. 0.25 to slow a -latency run down for a lecture")
+	step := flag.Bool("step", false, "start with the network paused and deliver messages one at a time from stdin commands (s to step, r to resume)")
+	peerWindow := flag.Int("peer-window", 0, "defer at most this many requests from any one peer at a time, answering more with BUSY (0 is no limit)")
+	busyRetryAfter := flag.Duration("busy-retry-after", DefaultBusyRetryAfter, "with -peer-window, how long a BUSY tells the peer to wait before asking again")
+	watchFiles := flag.Duration("watch-files", 0, "check the open files for changes made outside the system this often, refreshing them or logging a conflict (0 disables)")
+	optimistic := flag.Bool("optimistic", false, "reject a write with a conflict if the file changed after the client last read it, instead of losing the other update")
+	coalesce := flag.Duration("coalesce", 0, "keep a released critical section held this long for the same client's next operation on the file, unless a peer is waiting (0 disables)")
+	hierarchical := flag.Bool("hierarchical", false, "treat file and resource names as paths, so locking a directory such as docs/ excludes everything under it")
+	reportPath := flag.String("report", "", "write every operation's request, entry and exit times and message count to this file for plotting (.csv for CSV, JSON otherwise)")
+	flag.Parse()
+
+	logger, err := newLogger(*logLevel, *logFormat)
+	if err != nil {
+		fmt.Printf("Error configuring logging: %v\n", err)
+		return
+	}
+	DefaultLogger = logger
+
+	codec, err := NewCodec(*codecName)
+	if err != nil {
+		fmt.Printf("Error selecting codec: %v\n", err)
+		return
+	}
+
+	var workload *Workload
+	if *workloadPath != "" {
+		workload, err = LoadWorkload(*workloadPath)
+		if err != nil {
+			fmt.Printf("Error loading workload: %v\n", err)
+			return
+		}
+	}
+	scenario, err := LookupScenario(*scenarioName)
+	if err != nil {
+		fmt.Printf("Error selecting scenario: %v\n", err)
+		return
+	}
+
+	var transport Transport = NewLocalTransport()
+	var netem *NetEm
+	if *latency > 0 || *jitter > 0 || *loss > 0 || *adminAddr != "" || *speed != 1 || *step {
+		netem = NewNetEm(transport, LinkConditions{Latency: *latency, Jitter: *jitter, Loss: *loss})
+		if err := netem.SetSpeed(*speed); err != nil {
+			fmt.Printf("Error setting simulation speed: %v\n", err)
+			return
+		}
+		transport = netem
+	}
+	var reliable *ReliableTransport
+	if *retransmit {
+		reliable = NewReliableTransport(transport)
+		transport = reliable
+	}
+	fileSystem := NewDistributedFileSystem(codec, transport)
+	if reliable != nil {
+		reliable.OnPeerDown = fileSystem.peerDown
+	}
+	fileSystem.Lease = *lease
+	fileSystem.LeaseBreak = *leaseBreak
+	fileSystem.HoldLimit = *holdLimit
+	fileSystem.ReplyTimeout = *replyTimeout
+	fileSystem.NoMutex = *noMutex
+	fileSystem.SharedReads = *sharedReads
+	if err := fileSystem.SetAlgorithm(*algo); err != nil {
+		fmt.Printf("Error selecting algorithm: %v\n", err)
+		return
+	}
+	if *tree != "" {
+		if err := fileSystem.SetTree(*tree); err != nil {
+			fmt.Printf("Error setting tree: %v\n", err)
+			return
+		}
+	}
+	var recorder *TraceRecorder
+	if *recordPath != "" {
+		recorder = NewTraceRecorder(&Trace{Codec: *codecName, Algorithm: *algo, SharedReads: *sharedReads, Workload: workload})
+		fileSystem.Scheduler = recorder
+	}
+	fileSystem.MaxOutstanding = *maxOutstanding
+	fileSystem.MaxQueued = *maxQueued
+	if *fanout > 1 {
+		fileSystem.FanOut = NewFanOut(*fanout)
+		defer fileSystem.FanOut.Close()
+	}
+	if *readCache {
+		fileSystem.Cache = NewReadCache()
+	}
+	if fileSystem.Quotas, err = newQuotas(*fileQuota, *clientQuota); err != nil {
+		fmt.Printf("Error parsing quotas: %v\n", err)
+		return
+	}
+	if fileSystem.Storage, err = ParseStorage(*storageSpec); err != nil {
+		fmt.Printf("Error selecting storage: %v\n", err)
+		return
+	}
+	for _, name := range splitList(*eventual) {
+		fileSystem.SetConsistency(name, Eventual)
+	}
+	defer fileSystem.Transport.Close()
+
+	if *adminAddr != "" {
+		admin, err := StartAdmin(*adminAddr)
+		if err != nil {
+			fmt.Printf("Error starting admin endpoint: %v\n", err)
+			return
+		}
+		defer admin.Close()
+		netem.RegisterAdmin(admin)
+		fileSystem.RegisterAdmin(admin)
+		fileSystem.RegisterDashboard(admin)
+		fileSystem.Metrics.RegisterAdmin(admin)
+		fileSystem.Log.Infof("Admin endpoint listening on %s, dashboard at http://%s/dashboard/", admin.Addr(), admin.Addr())
+	}
+
+	if *otlpEndpoint != "" {
+		fileSystem.Tracer = NewTracer(NewOTLPExporter(*otlpEndpoint, "ricart-agarwala"), time.Second)
+		defer fileSystem.Tracer.Shutdown()
+	}
+
+	if *historyPath != "" {
+		fileSystem.History, err = OpenHistory(*historyPath)
+		if err != nil {
+			fmt.Printf("Error opening history: %v\n", err)
+			return
+		}
+		defer fileSystem.History.Close()
+	}
+	if *versionsPath != "" {
+		fileSystem.Versions, err = OpenVersions(*versionsPath)
+		if err != nil {
+			fmt.Printf("Error opening version store: %v\n", err)
+			return
+		}
+		defer fileSystem.Versions.Close()
 	}
 
 	/* Make a Note of this ------ creating a log file so that we can keep a track of the previous state of the file which will be useful for the loopp crearion of the clients*/
@@ -232,12 +1296,111 @@ func main() {
 	defer logFile.Close()
 
 	fileSystem.LogFile = logFile
+	if fileSystem.Lease > 0 {
+		stop := fileSystem.StartLeaseMonitor()
+		defer stop()
+	}
+	if *watchdog > 0 {
+		stop := fileSystem.StartWatchdog(*watchdog)
+		defer stop()
+	}
+	if *watchFiles > 0 {
+		stop := fileSystem.StartFileWatcher(*watchFiles)
+		defer stop()
+	}
 	var numClients int
 	fmt.Print("Enter the number of clients: ")
 	fmt.Scanln(&numClients)
-	fileSystem.Acknowledged = make([]bool, numClients)
+	if netem != nil {
+		netem.Describe = func(data []byte) string {
+			if reliable != nil {
+				payload, ok := reliablePayload(data)
+				if !ok {
+					return "ack"
+				}
+				data = payload
+			}
+			msg, err := fileSystem.Codec.Decode(data)
+			if err != nil {
+				return fmt.Sprintf("%d bytes", len(data))
+			}
+			return fmt.Sprintf("%s %s ts %d", msg.Type, msg.Resource, msg.Timestamp)
+		}
+	}
+	if *step {
+		netem.Pause()
+		go RunSimConsole(os.Stdin, os.Stdout, netem)
+	}
+	fileSystem.Hierarchical = *hierarchical
+	fileSystem.Coalesce = *coalesce
+	fileSystem.PeerWindow = *peerWindow
+	fileSystem.BusyRetryAfter = *busyRetryAfter
+	fileSystem.Optimistic = *optimistic
+	fileSystem.Operations = NewOperationLog(*opHistory)
+	if *opSpill != "" {
+		if err := fileSystem.Operations.SpillTo(*opSpill); err != nil {
+			fmt.Printf("Error opening operation spill file: %v\n", err)
+			return
+		}
+		defer fileSystem.Operations.Close()
+	}
+	if *localQueue != "" {
+		discipline, err := ParseQueueDiscipline(*localQueue)
+		if err != nil {
+			fmt.Printf("Error selecting local queue: %v\n", err)
+			return
+		}
+		fileSystem.LocalQueue = NewLocalQueue(discipline)
+	}
+	if fileSystem.TieBreak, err = ParseTieBreak(*tieBreak, numClients); err != nil {
+		fmt.Printf("Error selecting tie-break: %v\n", err)
+		return
+	}
+	if *participants > 0 && *participants < numClients {
+		fileSystem.Proxies = SpreadClients(numClients, *participants)
+		fmt.Printf("Clients %d-%d are lightweight clients proxied through participants 1-%d\n", *participants+1, numClients, *participants)
+	}
+	for i := 1; i <= numClients; i++ {
+		fileSystem.Join(i)
+	}
+	if *restorePath != "" {
+		state, err := fileSystem.Restore(*restorePath)
+		if err != nil {
+			fmt.Printf("Error restoring checkpoint: %v\n", err)
+			return
+		}
+		printCheckpoint(*restorePath, state)
+	}
+	if workload == nil && scenario.Workload != nil {
+		workload = scenario.Workload(numClients)
+		if err := fileSystem.ensureFiles(workload.files()); err != nil {
+			fmt.Printf("Error creating scenario files: %v\n", err)
+			return
+		}
+	}
+	var entries *EntryOrder
+	if recorder != nil {
+		if workload == nil && *scenarioName != "demo" {
+			fmt.Printf("Error recording: the %s scenario is scripted and cannot be replayed\n", *scenarioName)
+			return
+		}
+		recorder.trace.Clients = numClients
+		recorder.trace.Workload = workload
+		entries = fileSystem.WatchEntries()
+	}
+	if *snapshotAfter > 0 {
+		go func() {
+			time.Sleep(*snapshotAfter)
+			fileSystem.SaveSnapshot(1, 5*time.Second)
+		}()
+	}
 
-	var wg sync.WaitGroup
+	if *fairness > 0 {
+		RunFairness(fileSystem, numClients, "file1.txt", *fairness, os.Stdout)
+		fmt.Println("Message summary:")
+		WriteMessageSummary(os.Stdout, fileSystem.MessageSummary())
+		return
+	}
 
 	outputFile, err := os.Create("spacetime_diagram.txt")
 	if err != nil {
@@ -245,31 +1408,85 @@ func main() {
 		return
 	}
 	defer outputFile.Close()
-
-	for i := 0; i < numClients; i++ {
-		wg.Add(1)
-		go func(clientID int) {
-			defer wg.Done()
-			client := &Client{
-				ID:       clientID + 1,
-				FileName: "file1.txt",
-			}
-			file := fileSystem.OpenFile(client.ID, client.FileName)
-			if file != nil {
-				startTime := time.Now()
-				fileSystem.WriteFile(client.ID, file, fmt.Sprintf("Content written by Client %d", client.ID))
-				fileSystem.ReadFile(client.ID, file)
-				fileSystem.CloseFile(file)
-				endTime := time.Now()
-				printSpaceTimeDiagram(client.ID, startTime, endTime, outputFile)
-			}
-		}(i)
+	fileSystem.Trace = NewMessageTrace(*clockDrift, time.Now().UnixNano())
+	if *reportPath != "" {
+		fileSystem.Report = NewOperationReport()
 	}
 
-	wg.Wait()
+	if workload != nil {
+		RunWorkload(fileSystem, numClients, workload, outputFile)
+	} else if err := scenario.Run(fileSystem, numClients, outputFile); err != nil {
+		fmt.Printf("Error running scenario: %v\n", err)
+		return
+	}
+	fmt.Fprintln(outputFile)
+	fileSystem.Trace.WriteDiagram(outputFile)
 
 	fmt.Println("Deferred Array Operations:")
-	for i, operation := range fileSystem.DeferredArray {
-		fmt.Printf("%d. %s\n", i+1, operation)
+	recent := fileSystem.Operations.Recent()
+	earlier := fileSystem.Operations.Total() - len(recent)
+	if earlier > 0 {
+		where := "dropped"
+		if path := fileSystem.Operations.SpillPath(); path != "" {
+			where = "spilled to " + path
+		}
+		fmt.Printf("(%d earlier operations %s)\n", earlier, where)
+	}
+	for i, operation := range recent {
+		fmt.Printf("%d. %s\n", earlier+i+1, operation)
+	}
+	fmt.Printf("Safety check: %d mutual-exclusion violations\n", fileSystem.Safety.Violations())
+	for _, node := range fileSystem.nodes() {
+		if err := node.Verify(); err != nil {
+			fmt.Printf("Event log check: %v\n", err)
+		}
+	}
+	if *clockDrift > 0 {
+		fmt.Printf("Physical clocks (drift up to %s): %s\n", *clockDrift, fileSystem.Trace.CompareClocks())
+	}
+	fmt.Println("Message summary:")
+	WriteMessageSummary(os.Stdout, fileSystem.MessageSummary())
+	if fileSystem.LocalQueue != nil {
+		fmt.Printf("Local queue (%s):\n", fileSystem.LocalQueue.Discipline.Name())
+		WriteLocalQueueStats(os.Stdout, fileSystem.LocalQueue)
+	}
+	if *reportPath != "" {
+		if err := fileSystem.Report.Write(*reportPath); err != nil {
+			fmt.Printf("Error writing report: %v\n", err)
+		} else {
+			fmt.Printf("Report of %d operations written to %s\n", len(fileSystem.Report.Records()), *reportPath)
+		}
+	}
+	if *checkpointPath != "" {
+		if err := fileSystem.Checkpoint(*checkpointPath); err != nil {
+			fmt.Printf("Error writing checkpoint: %v\n", err)
+		} else {
+			fmt.Printf("Checkpoint written to %s\n", *checkpointPath)
+		}
+	}
+	if recorder != nil {
+		if err := recorder.Save(*recordPath, entries.Entries()); err != nil {
+			fmt.Printf("Error saving trace: %v\n", err)
+		} else {
+			fmt.Printf("Trace recorded to %s\n", *recordPath)
+		}
+	}
+	fileSystem.printConvergence(time.Second)
+	if disk, ok := fileSystem.Storage.(DiskStorage); ok {
+		dir := disk.Dir
+		if dir == "" {
+			dir = "."
+		}
+		if results, err := VerifyChecksums([]string{"file_access.log"}, []string{dir}); err != nil {
+			fmt.Printf("Error verifying checksums: %v\n", err)
+		} else {
+			failed := printVerification(results)
+			fmt.Printf("Checksum verification: %d files, %d mismatches\n", len(results), failed)
+		}
+	}
+	if fileSystem.Cache != nil {
+		m := fileSystem.Metrics
+		fmt.Printf("Read cache: %d hits, %d misses, %d invalidations\n",
+			m.Get("ra_read_cache_hits_total"), m.Get("ra_read_cache_misses_total"), m.Get("ra_read_cache_invalidations_total"))
 	}
 }
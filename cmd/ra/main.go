@@ -0,0 +1,9 @@
+// Command ra runs the Ricart-Agarwala distributed file system demo and its
+// tools; see ra.Main.
+package main
+
+import ra "github.com/deepan-31/Ricart-Agarwala-Algo-in-golang"
+
+func main() {
+	ra.Main()
+}
@@ -0,0 +1,126 @@
+package ra
+
+import "time"
+
+// DefaultCoalesceLimit is how many operations may share one critical
+// section entry when fs.CoalesceLimit is 0.
+const DefaultCoalesceLimit = 8
+
+// Coalescing saves a protocol round when a client works on the same
+// resource twice in a row, as the demo does when it writes a file and
+// reads it back. With fs.Coalesce set, a Ricart-Agarwala critical section
+// whose holder releases it while no peer is waiting stays HELD for up to
+// that long, and the client's next acquire of the resource takes it over
+// without sending a message. Peers are never kept waiting for it: a
+// REQUEST arriving during the grace period ends it at once, and one entry
+// serves at most CoalesceLimit operations. To everything watching the
+// node, each operation is a critical section of its own: the exit hooks
+// run when its caller releases it and the enter hooks when the next takes
+// it over, and no lease runs while nobody is in it.
+
+// lingering is a critical section kept held after its release, waiting for
+// its client's next operation.
+type lingering struct {
+	request *Request
+	timer   *time.Timer
+}
+
+// linger keeps request's critical section held instead of releasing it,
+// and reports whether it did. It only does so for a plain Ricart-Agarwala
+// request that no peer is waiting on and that has not used up
+// CoalesceLimit.
+func (fs *DistributedFileSystem) linger(request *Request) bool {
+	if fs.Coalesce <= 0 || request.Session != "" || request.intents != nil || request.Revoked() {
+		return false
+	}
+	if _, ok := fs.Mutex.(*RicartAgarwala); !ok {
+		return false
+	}
+	limit := fs.CoalesceLimit
+	if limit <= 0 {
+		limit = DefaultCoalesceLimit
+	}
+	if request.coalesced+1 >= limit {
+		return false
+	}
+
+	key := clientResource{request.ClientID, request.Resource}
+	fs.coalesceMutex.Lock()
+	defer fs.coalesceMutex.Unlock()
+	// A REQUEST deferred after this check finds the request in
+	// fs.lingering and ends the grace period; see yieldLingering.
+	if !fs.Node(request.ClientID).linger(request) {
+		return false
+	}
+	if fs.lingering == nil {
+		fs.lingering = make(map[clientResource]*lingering)
+	}
+	hold := &lingering{request: request}
+	hold.timer = time.AfterFunc(fs.Coalesce, func() { fs.endLingering(key, hold) })
+	fs.lingering[key] = hold
+	return true
+}
+
+// takeLingering returns the critical section node is keeping held for
+// resource, ready to be entered by its next operation, or nil if there is
+// none to take.
+func (fs *DistributedFileSystem) takeLingering(node *Node, resource, session string, span *Span) *Request {
+	if session != "" {
+		return nil
+	}
+	key := clientResource{node.ID, resource}
+	fs.coalesceMutex.Lock()
+	hold, ok := fs.lingering[key]
+	if ok {
+		delete(fs.lingering, key)
+		hold.timer.Stop()
+	}
+	fs.coalesceMutex.Unlock()
+	if !ok {
+		return nil
+	}
+	request := hold.request
+	if request.Revoked() || !node.reenter(request) {
+		fs.Mutex.Release(request)
+		return nil
+	}
+
+	request.coalesced++
+	request.released.Store(false)
+	request.Requested = time.Now()
+	request.Op = ""
+	request.checksum = ""
+	request.span = span
+	request.messages.Store(0)
+	span.SetAttribute("lamport.timestamp", request.Timestamp)
+	span.SetAttribute("coalesced", true)
+	fs.Metrics.addNode("ra_coalesced_entries_total", node.ID)
+	fs.Log.Debugf("Client %d: kept %s held for its next operation", node.ID, resource)
+	return request
+}
+
+// yieldLingering ends clientID's grace period on resource, if it is in
+// one, because a peer has asked for it.
+func (fs *DistributedFileSystem) yieldLingering(clientID int, resource string) {
+	key := clientResource{clientID, resource}
+	fs.coalesceMutex.Lock()
+	hold, ok := fs.lingering[key]
+	fs.coalesceMutex.Unlock()
+	if ok {
+		fs.endLingering(key, hold)
+	}
+}
+
+// endLingering releases hold's critical section, unless its client has
+// taken it over in the meantime.
+func (fs *DistributedFileSystem) endLingering(key clientResource, hold *lingering) {
+	fs.coalesceMutex.Lock()
+	if fs.lingering[key] != hold {
+		fs.coalesceMutex.Unlock()
+		return
+	}
+	delete(fs.lingering, key)
+	hold.timer.Stop()
+	fs.coalesceMutex.Unlock()
+	fs.Mutex.Release(hold.request)
+}
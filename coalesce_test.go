@@ -0,0 +1,46 @@
+package ra
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Each operation sharing a coalesced entry is a critical section of its
+// own to the node's hooks, and the lease monitor leaves the entry alone
+// while no caller is in it.
+func TestCoalescedEntriesRunHooksAndSkipLeases(t *testing.T) {
+	fs := NewDistributedFileSystem(JSONCodec{}, NewLocalTransport())
+	fs.Storage = NewMemoryStorage(nil)
+	fs.Coalesce = time.Second
+	fs.Lease = 20 * time.Millisecond
+	fs.LeaseBreak = true
+	fs.Join(1)
+	fs.Join(2)
+	var enters, exits atomic.Int32
+	fs.Node(1).OnEnterCS(func(string, int) { enters.Add(1) })
+	fs.Node(1).OnExitCS(func(string, int) { exits.Add(1) })
+	stop := fs.StartLeaseMonitor()
+	defer stop()
+
+	for op := 1; op <= 3; op++ {
+		request, err := fs.AcquireResource(1, "notes.txt")
+		if err != nil {
+			t.Fatalf("operation %d: %v", op, err)
+		}
+		if op > 1 && request.coalesced == 0 {
+			t.Fatalf("operation %d did not reuse the lingering entry", op)
+		}
+		if err := fs.ReleaseRequest(request); err != nil {
+			t.Fatalf("operation %d: %v", op, err)
+		}
+		if enters.Load() != int32(op) || exits.Load() != int32(op) {
+			t.Fatalf("after operation %d: %d enters and %d exits, want %d of each", op, enters.Load(), exits.Load(), op)
+		}
+		// Outlive the lease while the entry lingers.
+		time.Sleep(3 * fs.Lease)
+	}
+	if fs.isFenced(1) {
+		t.Fatal("client 1 was fenced for a lease that ran out while no caller held the entry")
+	}
+}
@@ -0,0 +1,166 @@
+package ra
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// WireVersion is bumped whenever the Message layout changes incompatibly.
+// Peers refuse frames carrying a version they do not understand instead of
+// guessing at the payload.
+const WireVersion = 8
+
+const (
+	headerMagic0 = 'R'
+	headerMagic1 = 'A'
+	headerSize   = 4
+)
+
+const (
+	codecIDJSON byte = 1
+	codecIDGob  byte = 2
+)
+
+var (
+	ErrShortFrame         = errors.New("frame shorter than header")
+	ErrBadMagic           = errors.New("frame has bad magic")
+	ErrUnsupportedVersion = errors.New("unsupported wire version")
+	ErrCodecMismatch      = errors.New("frame encoded with a different codec")
+)
+
+// Codec turns a Message into a framed byte slice and back. Every frame starts
+// with a 4 byte header: magic "RA", wire version, codec id.
+type Codec interface {
+	Name() string
+	Encode(msg *Message) ([]byte, error)
+	Decode(data []byte) (*Message, error)
+}
+
+// NewCodec returns the codec registered under name ("json" or "gob").
+func NewCodec(name string) (Codec, error) {
+	switch name {
+	case "json":
+		return JSONCodec{}, nil
+	case "gob":
+		return GobCodec{}, nil
+	}
+	return nil, fmt.Errorf("unknown codec %q", name)
+}
+
+func writeHeader(buf *bytes.Buffer, codecID byte) {
+	buf.Write([]byte{headerMagic0, headerMagic1, WireVersion, codecID})
+}
+
+func readHeader(data []byte, codecID byte) ([]byte, error) {
+	if len(data) < headerSize {
+		return nil, ErrShortFrame
+	}
+	if data[0] != headerMagic0 || data[1] != headerMagic1 {
+		return nil, ErrBadMagic
+	}
+	if data[2] != WireVersion {
+		return nil, fmt.Errorf("%w: got %d, want %d", ErrUnsupportedVersion, data[2], WireVersion)
+	}
+	if data[3] != codecID {
+		return nil, fmt.Errorf("%w: got id %d, want %d", ErrCodecMismatch, data[3], codecID)
+	}
+	return data[headerSize:], nil
+}
+
+// messageDecoder is implemented by codecs that can decode into a message
+// the caller provides, so HandleMessage can reuse pooled messages.
+type messageDecoder interface {
+	decodeInto(data []byte, msg *Message) error
+}
+
+// encodeBuffer is a reusable scratch buffer for encoding frames, with a
+// JSON encoder bound to it. Gob encoders carry type state from one message
+// to the next, so gob frames get a fresh encoder every time.
+type encodeBuffer struct {
+	buf  bytes.Buffer
+	json *json.Encoder
+}
+
+var encodeBuffers = sync.Pool{New: func() any {
+	b := &encodeBuffer{}
+	b.json = json.NewEncoder(&b.buf)
+	return b
+}}
+
+// frame copies the encoded frame out of b, whose buffer goes back to the
+// pool, into a slice of exactly its size that the transport may keep.
+func (b *encodeBuffer) frame() []byte {
+	data := make([]byte, b.buf.Len())
+	copy(data, b.buf.Bytes())
+	b.buf.Reset()
+	encodeBuffers.Put(b)
+	return data
+}
+
+// JSONCodec is the human readable codec, handy when debugging captures.
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string { return "json" }
+
+func (JSONCodec) Encode(msg *Message) ([]byte, error) {
+	b := encodeBuffers.Get().(*encodeBuffer)
+	writeHeader(&b.buf, codecIDJSON)
+	if err := b.json.Encode(msg); err != nil {
+		b.buf.Reset()
+		encodeBuffers.Put(b)
+		return nil, err
+	}
+	return b.frame(), nil
+}
+
+func (c JSONCodec) Decode(data []byte) (*Message, error) {
+	msg := &Message{}
+	if err := c.decodeInto(data, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (JSONCodec) decodeInto(data []byte, msg *Message) error {
+	payload, err := readHeader(data, codecIDJSON)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, msg)
+}
+
+// GobCodec is the compact binary codec.
+type GobCodec struct{}
+
+func (GobCodec) Name() string { return "gob" }
+
+func (GobCodec) Encode(msg *Message) ([]byte, error) {
+	b := encodeBuffers.Get().(*encodeBuffer)
+	writeHeader(&b.buf, codecIDGob)
+	if err := gob.NewEncoder(&b.buf).Encode(msg); err != nil {
+		b.buf.Reset()
+		encodeBuffers.Put(b)
+		return nil, err
+	}
+	return b.frame(), nil
+}
+
+func (c GobCodec) Decode(data []byte) (*Message, error) {
+	msg := &Message{}
+	if err := c.decodeInto(data, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (GobCodec) decodeInto(data []byte, msg *Message) error {
+	payload, err := readHeader(data, codecIDGob)
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(payload)).Decode(msg)
+}
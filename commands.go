@@ -0,0 +1,121 @@
+package ra
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// commands are the subcommands accepted as the first argument. Running the
+// binary without one starts the demo.
+var commands = map[string]func(args []string) int{
+	"bench":      runBenchCommand,
+	"byzantine":  runByzantineCommand,
+	"cat":        runCatCommand,
+	"compose":    runComposeCommand,
+	"explore":    runExploreCommand,
+	"history":    runHistoryCommand,
+	"init":       runInitCommand,
+	"launch":     runLaunchCommand,
+	"merge-logs": runMergeLogsCommand,
+	"node":       runNodeCommand,
+	"observe":    runObserveCommand,
+	"replay":     runReplayCommand,
+	"status":     runStatusCommand,
+	"verify":     runVerifyCommand,
+	"version":    runVersionCommand,
+}
+
+func runVersionCommand(args []string) int {
+	fmt.Printf("ra %s (wire version %d)\n", Version, WireVersion)
+	return 0
+}
+
+func runHistoryCommand(args []string) int {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	db := flags.String("db", "history.jsonl", "history store to query, as written with -history")
+	file := flags.String("file", "", "only show entries for this file or named resource")
+	node := flags.Int("node", 0, "only show entries for this node")
+	op := flags.String("op", "", "only show entries for this operation (Read, Write, Append or Truncate)")
+	since := flags.Duration("since", 0, "only show entries from the last duration, e.g. 10m")
+	flags.Parse(args)
+
+	filter := HistoryFilter{Node: *node, Resource: *file, Op: *op}
+	if *since > 0 {
+		filter.Since = time.Now().Add(-*since)
+	}
+
+	records, err := queryHistory(*db, filter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading history: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("%-12s %-6s %-12s %-6s %10s %12s\n", "Entered", "Node", "Resource", "Op", "Timestamp", "Duration")
+	for _, r := range records {
+		op := r.Op
+		if op == "" {
+			op = "-"
+		}
+		fmt.Printf("%-12s %-6d %-12s %-6s %10d %12s\n", r.Entered.Format("15:04:05.000"), r.Node, r.Resource, op, r.Timestamp, r.Duration.Round(time.Microsecond))
+	}
+	return 0
+}
+
+// runMergeLogsCommand merges the event logs written by separate node
+// processes (--events) into one global timeline.
+func runMergeLogsCommand(args []string) int {
+	flags := flag.NewFlagSet("merge-logs", flag.ExitOnError)
+	out := flags.String("out", "", "write the timeline to this file instead of stdout")
+	asJSON := flags.Bool("json", false, "write the merged events as JSON lines, e.g. for diagram tools")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s merge-logs [flags] node-1.events.jsonl node-2.events.jsonl ...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	var logs [][]Event
+	for _, path := range flags.Args() {
+		events, err := ReadEvents(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", path, err)
+			return 1
+		}
+		logs = append(logs, events)
+	}
+	timeline := MergeEventsCausal(logs...)
+
+	w := os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating %s: %v\n", *out, err)
+			return 1
+		}
+		defer file.Close()
+		w = file
+	}
+	var err error
+	if *asJSON {
+		enc := json.NewEncoder(w)
+		for _, e := range timeline {
+			if err = enc.Encode(e); err != nil {
+				break
+			}
+		}
+	} else {
+		err = WriteTimeline(w, timeline)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing timeline: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Merged %d events from %d logs, %d mutual-exclusion violations\n", len(timeline), len(logs), timelineViolations(timeline))
+	return 0
+}
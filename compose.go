@@ -0,0 +1,102 @@
+package ra
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var composeTemplate = template.Must(template.New("compose").Parse(`# Generated by "ra compose --nodes {{len .Nodes}}". Put file1.txt in ./data
+# and start the cluster with: docker compose up --build
+# Set RA_CLUSTER_SECRET in the environment to have the nodes authenticate
+# each other.
+services:
+{{- range .Nodes}}
+  node{{.ID}}:
+    image: {{$.Image}}
+{{- if eq .ID 1}}
+    build: .
+{{- end}}
+    command: ["node"]
+    environment:
+      RA_NODE_ID: "{{.ID}}"
+      RA_PEERS: "{{$.Peers}}"
+      RA_LISTEN: ":{{$.Port}}"
+      RA_EVENTS: "/data/node-{{.ID}}.events.jsonl"
+      RA_DIAL_TIMEOUT: "{{$.DialTimeout}}"
+      RA_CLUSTER_SECRET: "${RA_CLUSTER_SECRET:-}"
+      RA_ADMIN: ":8080"
+{{- if $.Workload}}
+      RA_WORKLOAD: "{{$.Workload}}"
+{{- end}}
+    healthcheck:
+      test: ["CMD", "ra", "node", "--probe"]
+      interval: 10s
+      start_period: "{{$.DialTimeout}}"
+    working_dir: /data
+    volumes:
+      - ./data:/data
+{{- end}}
+`))
+
+type composeNode struct {
+	ID int
+}
+
+// runComposeCommand writes a Docker Compose file that runs each node in its
+// own container, configured through the RA_* environment variables read by
+// the node command.
+func runComposeCommand(args []string) int {
+	flags := flag.NewFlagSet("compose", flag.ExitOnError)
+	numNodes := flags.Int("nodes", 3, "number of node containers")
+	port := flags.Int("port", 7000, "port every node listens on inside its container")
+	image := flags.String("image", "ricart-agarwala", "image name to build and run")
+	workload := flags.String("workload", "", "workload file, as a path inside the container (e.g. /data/workload.json)")
+	// Containers start in no particular order and a peer's name only
+	// resolves once it is up, so nodes wait longer for peers than on one host.
+	dialTimeout := flags.Duration("dial-timeout", time.Minute, "how long nodes keep retrying peers that are not up yet")
+	out := flags.String("out", "docker-compose.yml", "file to write, or - for stdout")
+	flags.Parse(args)
+
+	if *numNodes < 1 {
+		fmt.Fprintln(os.Stderr, "Error: --nodes must be at least 1")
+		return 2
+	}
+
+	data := struct {
+		Nodes       []composeNode
+		Peers       string
+		Port        int
+		Image       string
+		Workload    string
+		DialTimeout string
+	}{Port: *port, Image: *image, Workload: *workload, DialTimeout: dialTimeout.String()}
+	peers := make([]string, *numNodes)
+	for i := 1; i <= *numNodes; i++ {
+		data.Nodes = append(data.Nodes, composeNode{ID: i})
+		peers[i-1] = fmt.Sprintf("%d=node%d:%d", i, i, *port)
+	}
+	data.Peers = strings.Join(peers, ",")
+
+	w := os.Stdout
+	if *out != "-" {
+		file, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating %s: %v\n", *out, err)
+			return 1
+		}
+		defer file.Close()
+		w = file
+	}
+	if err := composeTemplate.Execute(w, data); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing compose file: %v\n", err)
+		return 1
+	}
+	if *out != "-" {
+		fmt.Printf("Wrote %s for %d nodes\n", *out, *numNodes)
+	}
+	return 0
+}
@@ -0,0 +1,114 @@
+package ra
+
+import (
+	"embed"
+	"net/http"
+	"sort"
+	"time"
+)
+
+//go:embed dashboard
+var dashboardAssets embed.FS
+
+// DashboardRequest is a request holding or waiting for a resource.
+type DashboardRequest struct {
+	Client    int    `json:"client"`
+	Timestamp int    `json:"timestamp"`
+	Session   string `json:"session,omitempty"`
+	// Awaiting lists the peers a waiting request has no reply from yet.
+	Awaiting []int `json:"awaiting,omitempty"`
+}
+
+// DashboardResource is the state of one file or named resource across the
+// local nodes.
+type DashboardResource struct {
+	Resource string             `json:"resource"`
+	Holders  []DashboardRequest `json:"holders"`
+	Waiting  []DashboardRequest `json:"waiting"`
+	// Deferred maps each node to the replies it is holding back.
+	Deferred map[int]int `json:"deferred"`
+	// Content and Version are set for files.
+	Content *string `json:"content,omitempty"`
+	Version uint64  `json:"version,omitempty"`
+}
+
+// DashboardNode is one local node's clock.
+type DashboardNode struct {
+	ID    int `json:"id"`
+	Clock int `json:"clock"`
+}
+
+// DashboardState is what the dashboard renders, as served by
+// /dashboard/state.
+type DashboardState struct {
+	Time      time.Time           `json:"time"`
+	Algorithm string              `json:"algorithm"`
+	Nodes     []DashboardNode     `json:"nodes"`
+	Resources []DashboardResource `json:"resources"`
+}
+
+// DashboardState collects the state of every local node and file. Waiting
+// requests are in the order they will be granted.
+func (fs *DistributedFileSystem) DashboardState() DashboardState {
+	state := DashboardState{Time: time.Now(), Algorithm: fs.Mutex.Name(), Nodes: []DashboardNode{}, Resources: []DashboardResource{}}
+	resources := make(map[string]*DashboardResource)
+	resource := func(name string) *DashboardResource {
+		r, ok := resources[name]
+		if !ok {
+			r = &DashboardResource{Resource: name, Holders: []DashboardRequest{}, Waiting: []DashboardRequest{}, Deferred: make(map[int]int)}
+			resources[name] = r
+		}
+		return r
+	}
+
+	for _, node := range fs.nodes() {
+		clock, views := node.View()
+		state.Nodes = append(state.Nodes, DashboardNode{ID: node.ID, Clock: clock})
+		for _, view := range views {
+			r := resource(view.Resource)
+			if n := len(view.Deferred); n > 0 {
+				r.Deferred[node.ID] = n
+			}
+			if view.Request == nil {
+				continue
+			}
+			request := DashboardRequest{Client: node.ID, Timestamp: view.Request.Timestamp, Session: view.Request.Session}
+			switch view.State {
+			case Held:
+				r.Holders = append(r.Holders, request)
+			case Wanted:
+				request.Awaiting = view.Request.Awaiting()
+				r.Waiting = append(r.Waiting, request)
+			}
+		}
+	}
+
+	fs.FilesMutex.Lock()
+	for name, file := range fs.Files {
+		snapshot := file.Snapshot()
+		resource(name).Content = &snapshot.Content
+		resource(name).Version = snapshot.Version
+	}
+	fs.FilesMutex.Unlock()
+
+	for _, r := range resources {
+		sort.Slice(r.Waiting, func(i, j int) bool {
+			a, b := r.Waiting[i], r.Waiting[j]
+			return before(fs.TieBreak, a.Timestamp, a.Client, b.Timestamp, b.Client)
+		})
+		state.Resources = append(state.Resources, *r)
+	}
+	sort.Slice(state.Resources, func(i, j int) bool { return state.Resources[i].Resource < state.Resources[j].Resource })
+	return state
+}
+
+// RegisterDashboard adds the web dashboard to admin:
+//
+//	GET /dashboard/        the page, which polls
+//	GET /dashboard/state   the state as JSON
+func (fs *DistributedFileSystem) RegisterDashboard(admin *Admin) {
+	admin.Handle("GET /dashboard/state", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, fs.DashboardState())
+	})
+	admin.Handle("GET /dashboard/", http.FileServer(http.FS(dashboardAssets)).ServeHTTP)
+}
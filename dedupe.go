@@ -0,0 +1,79 @@
+package ra
+
+import "sync"
+
+// DedupeWindow is how many sequence numbers behind the highest one seen a
+// receiver still remembers. Anything older is treated as a duplicate.
+const DedupeWindow = 64
+
+type seqWindow struct {
+	highest uint64
+	// bit i set means highest-i has been seen
+	mask uint64
+}
+
+// Deduper suppresses retransmitted messages. Each sender numbers its
+// messages from 1 and every (sender, receiver) link keeps a sliding window
+// of the sequence numbers it has accepted, plus the ones it was told to
+// expect again, which are accepted once however far behind they are.
+type Deduper struct {
+	mu      sync.Mutex
+	windows map[[2]int]*seqWindow
+	retries map[[2]int]map[uint64]bool
+}
+
+func NewDeduper() *Deduper {
+	return &Deduper{windows: make(map[[2]int]*seqWindow), retries: make(map[[2]int]map[uint64]bool)}
+}
+
+// Forget clears seq on the from->to link, so the same message is accepted
+// the next time it is sent, even if by then more than DedupeWindow newer
+// messages have arrived.
+func (d *Deduper) Forget(from, to int, seq uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := [2]int{from, to}
+	if d.retries[key] == nil {
+		d.retries[key] = make(map[uint64]bool)
+	}
+	d.retries[key][seq] = true
+}
+
+// Seen records seq on the from->to link and reports whether it had already
+// been accepted (or is too old to tell).
+func (d *Deduper) Seen(from, to int, seq uint64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := [2]int{from, to}
+	w, ok := d.windows[key]
+	if !ok {
+		w = &seqWindow{}
+		d.windows[key] = w
+	}
+	retry := d.retries[key][seq]
+	delete(d.retries[key], seq)
+
+	if seq > w.highest {
+		shift := seq - w.highest
+		if shift >= DedupeWindow {
+			w.mask = 0
+		} else {
+			w.mask <<= shift
+		}
+		w.mask |= 1
+		w.highest = seq
+		return false
+	}
+
+	offset := w.highest - seq
+	if offset >= DedupeWindow {
+		return !retry
+	}
+	bit := uint64(1) << offset
+	if w.mask&bit != 0 && !retry {
+		return true
+	}
+	w.mask |= bit
+	return false
+}
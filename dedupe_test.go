@@ -0,0 +1,24 @@
+package ra
+
+import "testing"
+
+// A REQUEST turned away with BUSY is accepted when it comes again, even
+// after more than DedupeWindow newer messages from its sender.
+func TestDeduperAcceptsRetryBehindWindow(t *testing.T) {
+	d := NewDeduper()
+	if d.Seen(1, 2, 1) {
+		t.Fatal("first message reported as a duplicate")
+	}
+	d.Forget(1, 2, 1)
+	for seq := uint64(2); seq <= DedupeWindow+10; seq++ {
+		if d.Seen(1, 2, seq) {
+			t.Fatalf("message %d reported as a duplicate", seq)
+		}
+	}
+	if d.Seen(1, 2, 1) {
+		t.Fatal("retry of message 1 dropped as a duplicate")
+	}
+	if !d.Seen(1, 2, 1) {
+		t.Fatal("second copy of the retry accepted")
+	}
+}
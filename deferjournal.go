@@ -0,0 +1,110 @@
+package ra
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// DeferredJournal keeps the replies each local node owes its peers on disk.
+// A node that crashes while deferring replies would otherwise leave those
+// peers waiting forever; with the journal it sends them once it restarts.
+// The file is rewritten whenever a node defers a request, releases the
+// resource or drops a cancelled request.
+type DeferredJournal struct {
+	path string
+	// mu serialises reading the nodes' state and writing it, so the file
+	// never ends up older than the last change.
+	mu sync.Mutex
+}
+
+func NewDeferredJournal(path string) *DeferredJournal {
+	return &DeferredJournal{path: path}
+}
+
+// load returns the replies each node owed when the journal was last
+// written; none if it never was.
+func (j *DeferredJournal) load() (map[int][]DeferredReply, error) {
+	data, err := os.ReadFile(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var owed map[int][]DeferredReply
+	if err := json.Unmarshal(data, &owed); err != nil {
+		return nil, fmt.Errorf("reading deferred journal %s: %w", j.path, err)
+	}
+	return owed, nil
+}
+
+// write replaces the journal atomically with owed.
+func (j *DeferredJournal) write(owed map[int][]DeferredReply) error {
+	data, err := json.MarshalIndent(owed, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(j.path, data, 0644)
+}
+
+// journalDeferred records the replies the local nodes owe now, if fs keeps
+// a DeferredJournal.
+func (fs *DistributedFileSystem) journalDeferred() {
+	j := fs.DeferredJournal
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	owed := make(map[int][]DeferredReply)
+	for _, node := range fs.nodes() {
+		_, views := node.View()
+		for _, view := range views {
+			for _, r := range view.Deferred {
+				owed[node.ID] = append(owed[node.ID], DeferredReply{Resource: view.Resource, Client: r.ClientID, Timestamp: r.Timestamp, Seq: r.Seq})
+			}
+		}
+	}
+	if err := j.write(owed); err != nil {
+		fs.Log.Errorf("Error journaling deferred replies: %v", err)
+	}
+}
+
+// ReplayDeferred sends the replies clientID owed when its process last
+// stopped, as recorded in fs.DeferredJournal, and returns how many it sent.
+// A restarted node neither holds nor wants anything, so it owes each of
+// those peers its permission; a peer that has since given up ignores the
+// reply. Call it after Join, before the node requests anything.
+func (fs *DistributedFileSystem) ReplayDeferred(clientID int) (int, error) {
+	j := fs.DeferredJournal
+	if j == nil {
+		return 0, nil
+	}
+	node := fs.Node(clientID)
+	if node == nil {
+		return 0, fmt.Errorf("client %d replaying deferred replies: %w", clientID, ErrUnknownPeer)
+	}
+	j.mu.Lock()
+	owed, err := j.load()
+	j.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	replies := owed[clientID]
+	sort.Slice(replies, func(a, b int) bool { return replies[a].Timestamp < replies[b].Timestamp })
+	for _, d := range replies {
+		node.observe(d.Timestamp)
+	}
+	for _, d := range replies {
+		fs.Log.Infof("Client %d sending reply owed before restart to client %d for %s (ts %d)", clientID, d.Client, d.Resource, d.Timestamp)
+		fs.sendReply(clientID, &Request{ClientID: d.Client, Resource: d.Resource, Timestamp: d.Timestamp, Seq: d.Seq})
+	}
+	fs.journalDeferred()
+	return len(replies), nil
+}
@@ -0,0 +1,18 @@
+// Package ra is a distributed file system whose clients coordinate access
+// to shared files with distributed mutual exclusion: Ricart-Agarwala by
+// default, or Lamport's or Raymond's algorithm.
+//
+// Embed it by creating a DistributedFileSystem on a Transport, joining the
+// local clients, and guarding shared state with AcquireResource and
+// ReleaseRequest, or reading and writing files through the handles
+// OpenFile returns. NewLocalTransport runs every client in one process;
+// NewTCPTransport runs one client per process. See the examples directory
+// for a counter shared by several processes, and cmd/ra for the command
+// line built on the package.
+//
+// The API follows semantic versioning under Version. Until 1.0.0, minor
+// releases may change it.
+package ra
+
+// Version is the version of the package and the ra command.
+const Version = "0.1.0"
@@ -0,0 +1,33 @@
+package ra
+
+import "errors"
+
+// Sentinel errors returned by the file system API. They are usually wrapped
+// with more detail, so compare with errors.Is.
+var (
+	ErrFileNotFound   = errors.New("file not found")
+	ErrFileExists     = errors.New("file already exists")
+	ErrNotHoldingCS   = errors.New("not holding the critical section")
+	ErrPeerTimeout    = errors.New("timed out waiting for peer replies")
+	ErrFenced         = errors.New("client is fenced after a lease violation")
+	ErrBackpressure   = errors.New("too many requests outstanding")
+	ErrHandleClosed   = errors.New("file handle is closed")
+	ErrNotOwner       = errors.New("file handle is not owned by the client")
+	ErrQuotaExceeded  = errors.New("quota exceeded")
+	ErrCancelled      = errors.New("request cancelled")
+	ErrForcedRelease  = errors.New("critical section released after the hold limit")
+	ErrWounded        = errors.New("transaction wounded by an older one")
+	ErrSessionExpired = errors.New("client session expired")
+	// ErrUnordered is returned by ReadAsOf when writes to the file were
+	// not made in Lamport timestamp order.
+	ErrUnordered = errors.New("writes are not ordered by timestamp")
+	// ErrLockUpgrade is returned when a client asks for a directory it
+	// holds intention locks on, i.e. while it holds a path under it.
+	ErrLockUpgrade = errors.New("client holds paths under the directory")
+	// ErrConflict is returned by an optimistic write to a file that
+	// changed after the client last read it.
+	ErrConflict = errors.New("file changed since it was last read")
+	// ErrInsufficientFunds is returned by Withdraw from an account holding
+	// less than the amount.
+	ErrInsufficientFunds = errors.New("insufficient funds")
+)
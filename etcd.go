@@ -0,0 +1,186 @@
+package ra
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EtcdBridge mirrors the critical sections of the local nodes into etcd, so
+// systems outside the cluster can see who holds what, e.g. while migrating
+// to or from an etcd-based lock. Each holder is a key
+//
+//	<prefix><resource>/<node>
+//
+// whose value is a JSON HolderRecord. Every key is attached to one lease
+// that the bridge keeps alive, so if the node dies its keys vanish within
+// the lease TTL. The bridge talks to etcd's v3 JSON gateway with plain
+// HTTP and is an EventSink: append it to fs.Observers. A bridge to
+// ZooKeeper or another store plugs in the same way, with ephemeral nodes
+// in place of the lease.
+//
+// Entries and exits are written in order on a background goroutine, so
+// etcd is never on the critical section's path and lags it slightly.
+type EtcdBridge struct {
+	Endpoint *url.URL
+	Prefix   string
+	TTL      time.Duration
+	Client   *http.Client
+	// Log receives errors talking to etcd; nil is DefaultLogger.
+	Log Logger
+
+	lease  string
+	events chan Event
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// HolderRecord is the value of a holder's key in etcd.
+type HolderRecord struct {
+	Node      int       `json:"node"`
+	Resource  string    `json:"resource"`
+	Timestamp int       `json:"timestamp"`
+	Session   string    `json:"session,omitempty"`
+	Since     time.Time `json:"since"`
+}
+
+// NewEtcdBridge grants a lease of ttl from the etcd at endpoint and starts
+// mirroring under prefix. Close it to remove the node's keys at once.
+func NewEtcdBridge(endpoint, prefix string, ttl time.Duration) (*EtcdBridge, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("etcd bridge: bad endpoint %q", endpoint)
+	}
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	b := &EtcdBridge{
+		Endpoint: u,
+		Prefix:   prefix,
+		TTL:      ttl,
+		Client:   &http.Client{Timeout: 5 * time.Second},
+		events:   make(chan Event, 1024),
+		stop:     make(chan struct{}),
+	}
+
+	var grant struct{ ID string }
+	if err := b.call("/v3/lease/grant", map[string]any{"TTL": int64(ttl / time.Second)}, &grant); err != nil {
+		return nil, fmt.Errorf("etcd bridge: granting lease: %w", err)
+	}
+	if grant.ID == "" {
+		return nil, errors.New("etcd bridge: granting lease: no lease id in response")
+	}
+	b.lease = grant.ID
+
+	b.wg.Add(2)
+	go b.run()
+	go b.keepAlive()
+	return b, nil
+}
+
+// Record queues critical section entries and exits for etcd. It never
+// blocks: if etcd has fallen too far behind, the event is dropped.
+func (b *EtcdBridge) Record(e Event) {
+	if e.Kind != EventEnter && e.Kind != EventExit {
+		return
+	}
+	select {
+	case b.events <- e:
+	default:
+		loggerOr(b.Log).Warnf("etcd bridge: dropping %s of %s by node %d: queue full", e.Kind, e.Resource, e.Node)
+	}
+}
+
+// Close stops mirroring and revokes the lease, deleting every key the
+// bridge wrote.
+func (b *EtcdBridge) Close() error {
+	close(b.stop)
+	b.wg.Wait()
+	return b.call("/v3/lease/revoke", map[string]any{"ID": b.lease}, nil)
+}
+
+// key returns the etcd key of node holding resource.
+func (b *EtcdBridge) key(resource string, node int) string {
+	return b.Prefix + resource + "/" + strconv.Itoa(node)
+}
+
+func (b *EtcdBridge) run() {
+	defer b.wg.Done()
+	for {
+		select {
+		case e := <-b.events:
+			b.mirror(e)
+		case <-b.stop:
+			for {
+				select {
+				case e := <-b.events:
+					b.mirror(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (b *EtcdBridge) mirror(e Event) {
+	key := base64.StdEncoding.EncodeToString([]byte(b.key(e.Resource, e.Node)))
+	var err error
+	if e.Kind == EventEnter {
+		value, _ := json.Marshal(HolderRecord{Node: e.Node, Resource: e.Resource, Timestamp: e.Timestamp, Session: e.Session, Since: e.Time})
+		err = b.call("/v3/kv/put", map[string]any{"key": key, "value": base64.StdEncoding.EncodeToString(value), "lease": b.lease}, nil)
+	} else {
+		err = b.call("/v3/kv/deleterange", map[string]any{"key": key}, nil)
+	}
+	if err != nil {
+		loggerOr(b.Log).Errorf("etcd bridge: mirroring %s of %s by node %d: %v", e.Kind, e.Resource, e.Node, err)
+	}
+}
+
+// keepAlive renews the lease three times per TTL until the bridge closes.
+func (b *EtcdBridge) keepAlive() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(b.TTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.call("/v3/lease/keepalive", map[string]any{"ID": b.lease}, nil); err != nil {
+				loggerOr(b.Log).Errorf("etcd bridge: renewing lease: %v", err)
+			}
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// call posts body as JSON to path on the gateway and decodes the response
+// into out, if it is not nil.
+func (b *EtcdBridge) call(path string, body any, out any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := b.Client.Post(b.Endpoint.JoinPath(path).String(), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s: %s", path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
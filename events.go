@@ -0,0 +1,274 @@
+package ra
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Event kinds written to an EventLog.
+const (
+	EventRequestSent   = "request.sent"
+	EventRequestRecv   = "request.received"
+	EventReplyDeferred = "reply.deferred"
+	EventReplySent     = "reply.sent"
+	EventReplyRecv     = "reply.received"
+	EventEnter         = "cs.enter"
+	EventExit          = "cs.exit"
+	EventTokenSent     = "token.sent"
+	EventTokenRecv     = "token.received"
+	EventCancelSent    = "cancel.sent"
+	// EventCancelRecv is recorded when a CANCEL purges a queued or
+	// deferred request.
+	EventCancelRecv = "cancel.received"
+	// EventBusySent is recorded when a REQUEST is turned away because its
+	// sender already has fs.PeerWindow requests deferred.
+	EventBusySent = "busy.sent"
+	EventBusyRecv = "busy.received"
+	// EventExternalChange is recorded when a file changed in storage by
+	// someone else is refreshed, and EventExternalConflict when the change
+	// raced with a critical section on it; see StartFileWatcher.
+	EventExternalChange   = "file.external_change"
+	EventExternalConflict = "file.external_conflict"
+	// EventWriteConflict is recorded when an optimistic write is rejected
+	// because the file changed after its client read it.
+	EventWriteConflict = "file.write_conflict"
+	// EventPeerDown is recorded when a node gives up retransmitting to
+	// a peer; Peer is the one given up on.
+	EventPeerDown = "peer.down"
+)
+
+// Event is one protocol step taken by a node.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Node      int       `json:"node"`
+	Clock     int       `json:"clock"`
+	Kind      string    `json:"kind"`
+	Peer      int       `json:"peer,omitempty"`
+	Resource  string    `json:"resource"`
+	Timestamp int       `json:"timestamp"`
+	Session   string    `json:"session,omitempty"`
+}
+
+func (e Event) String() string {
+	s := fmt.Sprintf("%s node %d [clock %d] %-16s %s ts=%d", e.Time.Format("15:04:05.000000"), e.Node, e.Clock, e.Kind, e.Resource, e.Timestamp)
+	if e.Peer != 0 {
+		s += fmt.Sprintf(" peer=%d", e.Peer)
+	}
+	if e.Session != "" {
+		s += " session=" + e.Session
+	}
+	return s
+}
+
+// EventLog writes events as JSON lines. A nil EventLog discards them.
+type EventLog struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+}
+
+// CreateEventLog creates (truncating) the event log at path.
+func CreateEventLog(path string) (*EventLog, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &EventLog{file: file, w: bufio.NewWriter(file)}, nil
+}
+
+func (l *EventLog) Record(e Event) {
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(append(data, '\n'))
+}
+
+func (l *EventLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.w.Flush(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// EventSink receives every protocol event of the local nodes, e.g. an
+// observer building a live view of the cluster.
+type EventSink interface {
+	Record(e Event)
+}
+
+// event records a protocol step of the local node clientID.
+func (fs *DistributedFileSystem) event(kind string, clientID, peer int, resource string, timestamp int) {
+	if fs.Events == nil && len(fs.Observers) == 0 {
+		return
+	}
+	fs.emit(Event{
+		Node:      clientID,
+		Clock:     fs.Node(clientID).Clock(),
+		Kind:      kind,
+		Peer:      peer,
+		Resource:  resource,
+		Timestamp: timestamp,
+	})
+}
+
+// csEvent records request entering or leaving its critical section.
+func (fs *DistributedFileSystem) csEvent(kind string, request *Request) {
+	if fs.Events == nil && len(fs.Observers) == 0 {
+		return
+	}
+	fs.emit(Event{
+		Node:      request.ClientID,
+		Clock:     fs.Node(request.ClientID).Clock(),
+		Kind:      kind,
+		Resource:  request.Resource,
+		Timestamp: request.Timestamp,
+		Session:   request.Session,
+	})
+}
+
+// emit hands e to the event log and every observer.
+func (fs *DistributedFileSystem) emit(e Event) {
+	e.Time = time.Now()
+	fs.Events.Record(e)
+	for _, sink := range fs.Observers {
+		sink.Record(e)
+	}
+}
+
+// ReadEvents reads an event log. A torn final line is skipped.
+func ReadEvents(path string) ([]Event, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
+
+// MergeEvents combines per-node event logs into one timeline ordered by
+// wall-clock time, which is meaningful when every node ran on the same
+// host. Events with equal times keep node order.
+func MergeEvents(logs ...[]Event) []Event {
+	var merged []Event
+	for _, events := range logs {
+		merged = append(merged, events...)
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		if !merged[i].Time.Equal(merged[j].Time) {
+			return merged[i].Time.Before(merged[j].Time)
+		}
+		return merged[i].Node < merged[j].Node
+	})
+	return merged
+}
+
+// messageKey matches the event recording a message's send with the one
+// recording its receipt.
+type messageKey struct {
+	from, to  int
+	kind      string
+	resource  string
+	timestamp int
+}
+
+// sentKinds maps each receive event kind to its send kind.
+var sentKinds = map[string]string{
+	EventRequestRecv: EventRequestSent,
+	EventReplyRecv:   EventReplySent,
+	EventTokenRecv:   EventTokenSent,
+	EventCancelRecv:  EventCancelSent,
+}
+
+// MergeEventsCausal combines per-node event logs into one timeline ordered
+// by Lamport clock, which needs no synchronised wall clocks. Ties, and
+// clocks read late enough to disagree, are broken causally: each node's
+// events keep their log order and a message is never received before it
+// was sent. Otherwise equal events are ordered by node.
+func MergeEventsCausal(logs ...[]Event) []Event {
+	heads := make([]int, len(logs))
+	inFlight := make(map[messageKey]int)
+	var merged []Event
+	for {
+		best := -1
+		bestReady := false
+		for i, events := range logs {
+			if heads[i] == len(events) {
+				continue
+			}
+			e := events[heads[i]]
+			ready := true
+			if kind, ok := sentKinds[e.Kind]; ok {
+				ready = inFlight[messageKey{e.Peer, e.Node, kind, e.Resource, e.Timestamp}] > 0
+			}
+			if best == -1 || (ready && !bestReady) || (ready == bestReady && causalLess(e, logs[best][heads[best]])) {
+				best, bestReady = i, ready
+			}
+		}
+		if best == -1 {
+			return merged
+		}
+		// With no event ready the send is missing from the logs; take the
+		// earliest event anyway rather than stall.
+		e := logs[best][heads[best]]
+		heads[best]++
+		switch e.Kind {
+		case EventRequestSent, EventReplySent, EventTokenSent, EventCancelSent:
+			inFlight[messageKey{e.Node, e.Peer, e.Kind, e.Resource, e.Timestamp}]++
+		case EventRequestRecv, EventReplyRecv, EventTokenRecv, EventCancelRecv:
+			key := messageKey{e.Peer, e.Node, sentKinds[e.Kind], e.Resource, e.Timestamp}
+			if inFlight[key] > 0 {
+				inFlight[key]--
+			}
+		}
+		merged = append(merged, e)
+	}
+}
+
+func causalLess(a, b Event) bool {
+	if a.Clock != b.Clock {
+		return a.Clock < b.Clock
+	}
+	return a.Node < b.Node
+}
+
+// WriteTimeline writes events one per line.
+func WriteTimeline(w io.Writer, events []Event) error {
+	for _, e := range events {
+		if _, err := fmt.Fprintln(w, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package ra_test
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	ra "github.com/deepan-31/Ricart-Agarwala-Algo-in-golang"
+)
+
+// Two clients in one process take turns incrementing a counter, entering
+// the critical section for the "counter" resource around each increment.
+func Example() {
+	fs := ra.NewDistributedFileSystem(ra.JSONCodec{}, ra.NewLocalTransport())
+	fs.Join(1)
+	fs.Join(2)
+
+	counter := 0
+	for _, client := range []int{1, 2, 1} {
+		request, err := fs.AcquireResource(client, "counter")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		counter++
+		if err := fs.ReleaseRequest(request); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	fmt.Println("counter:", counter)
+	// Output:
+	// counter: 3
+}
+
+func ExampleParsePeers() {
+	addrs, err := ra.ParsePeers("1=localhost:7001,2=localhost:7002")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	ids := make([]int, 0, len(addrs))
+	for id := range addrs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		fmt.Println(id, addrs[id])
+	}
+	// Output:
+	// 1 localhost:7001
+	// 2 localhost:7002
+}
+
+func ExampleMemoryStorage() {
+	storage := ra.NewMemoryStorage(nil)
+	storage.Store("notes.txt", []byte("hello"))
+	data, _ := storage.Load("notes.txt")
+	fmt.Println(string(data))
+
+	storage.Delete("notes.txt")
+	_, err := storage.Load("notes.txt")
+	fmt.Println(err)
+	// Output:
+	// hello
+	// load notes.txt: file does not exist
+}
+
+// A replica whose copy of a file only gained CRLF line endings, as a
+// Windows checkout gives it, still verifies.
+func ExampleVerifyChecksums() {
+	dir, err := os.MkdirTemp("", "verify")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	content := "line 1\nline 2\n"
+	log := filepath.Join(dir, "file_access.log")
+	entry := fmt.Sprintf("Client 1 checksum file notes.txt at timestamp 3 entered 2024-01-02T03:04:05Z sha256 %x\n",
+		sha256.Sum256([]byte(content)))
+	os.WriteFile(log, []byte(entry), 0644)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("line 1\r\nline 2\r\n"), 0644)
+
+	results, err := ra.VerifyChecksums([]string{log}, []string{dir})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, r := range results {
+		fmt.Println(r.File, r.OK())
+	}
+	// Output:
+	// notes.txt true
+}
+
+func ExampleDistributedFileSystem_ReadAsOf() {
+	dir, err := os.MkdirTemp("", "versions")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	fs := ra.NewDistributedFileSystem(ra.JSONCodec{}, ra.NewLocalTransport())
+	storage := ra.NewMemoryStorage(nil)
+	storage.Store("notes.txt", []byte("draft"))
+	fs.Storage = storage
+	fs.Versions, err = ra.OpenVersions(filepath.Join(dir, "versions.jsonl"))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer fs.Versions.Close()
+	fs.Join(1)
+	fs.Join(2)
+
+	for _, client := range []int{1, 2} {
+		handle, err := fs.OpenFile(client, "notes.txt")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if err := fs.WriteFile(client, handle, fmt.Sprintf("written by client %d", client)); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	for _, timestamp := range []int{0, 1, 2} {
+		snapshot, err := fs.ReadAsOf("notes.txt", timestamp)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("as of %d: %s (version %d)\n", timestamp, snapshot.Content, snapshot.Version)
+	}
+	// Output:
+	// as of 0: draft (version 0)
+	// as of 1: written by client 1 (version 1)
+	// as of 2: written by client 2 (version 2)
+}
@@ -0,0 +1,95 @@
+// Command counter increments a counter shared by several processes, each
+// one client of the ra package talking to the others over TCP. Every
+// increment reads the counter from a file, adds one and writes it back
+// inside the critical section for the "counter" resource, so no increment
+// is lost however the processes interleave.
+//
+// Run three of them in the same directory, one per terminal:
+//
+//	go run ./examples/counter -id 1 -peers 1=localhost:7101,2=localhost:7102,3=localhost:7103
+//	go run ./examples/counter -id 2 -peers 1=localhost:7101,2=localhost:7102,3=localhost:7103
+//	go run ./examples/counter -id 3 -peers 1=localhost:7101,2=localhost:7102,3=localhost:7103
+//
+// Once all three have finished, counter.txt holds 3 times -n. Each process
+// keeps answering its peers' requests until interrupted. Export the same
+// RA_CLUSTER_SECRET in every terminal to have them authenticate each other.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	ra "github.com/deepan-31/Ricart-Agarwala-Algo-in-golang"
+)
+
+func main() {
+	id := flag.Int("id", 0, "this process's client id")
+	peers := flag.String("peers", "", "every client's address, e.g. 1=localhost:7101,2=localhost:7102")
+	n := flag.Int("n", 100, "increments to make")
+	dir := flag.String("dir", ".", "directory holding counter.txt")
+	flag.Parse()
+
+	addrs, err := ra.ParsePeers(*peers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing peers: %v\n", err)
+		os.Exit(2)
+	}
+	listen, ok := addrs[*id]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: client %d is not in -peers\n", *id)
+		os.Exit(2)
+	}
+	transport, err := ra.NewTCPTransport(*id, listen, addrs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error starting transport: %v\n", err)
+		os.Exit(1)
+	}
+	transport.Secret = []byte(os.Getenv("RA_CLUSTER_SECRET"))
+	defer transport.Close()
+
+	fs := ra.NewDistributedFileSystem(ra.GobCodec{}, transport)
+	storage := ra.DiskStorage{Dir: *dir}
+	fs.Join(*id)
+
+	for i := 0; i < *n; i++ {
+		value, err := increment(fs, storage, *id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error incrementing: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Client %d set the counter to %d\n", *id, value)
+	}
+	fmt.Printf("Client %d done; interrupt to stop serving peers\n", *id)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	<-stop
+}
+
+// increment adds one to the counter stored in storage, holding the
+// "counter" critical section while it reads and writes.
+func increment(fs *ra.DistributedFileSystem, storage ra.Storage, id int) (int, error) {
+	request, err := fs.AcquireResource(id, "counter")
+	if err != nil {
+		return 0, err
+	}
+	defer fs.ReleaseRequest(request)
+
+	value := 0
+	data, err := storage.Load("counter.txt")
+	switch {
+	case err == nil:
+		if value, err = strconv.Atoi(strings.TrimSpace(string(data))); err != nil {
+			return 0, fmt.Errorf("counter.txt: %w", err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return 0, err
+	}
+	value++
+	return value, storage.Store("counter.txt", []byte(strconv.Itoa(value)+"\n"))
+}
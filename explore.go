@@ -0,0 +1,412 @@
+package ra
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// granter is implemented by algorithms that can tell whether a waiting
+// request has been granted, i.e. its Acquire is about to return. The
+// explorer uses it to let the client enter before choosing the next step.
+type granter interface {
+	granted(request *Request) bool
+}
+
+// SimTransport holds every frame until the explorer delivers it. Frames on
+// a link still arrive in order; which link goes next is the explorer's
+// choice.
+type SimTransport struct {
+	mu       sync.Mutex
+	handlers map[int]Handler
+	links    map[linkKey][][]byte
+	closed   bool
+}
+
+func NewSimTransport() *SimTransport {
+	return &SimTransport{handlers: make(map[int]Handler), links: make(map[linkKey][][]byte)}
+}
+
+func (t *SimTransport) Register(id int, handler Handler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handlers[id] = handler
+}
+
+func (t *SimTransport) Send(from, to int, data []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return net.ErrClosed
+	}
+	if _, ok := t.handlers[to]; !ok {
+		return fmt.Errorf("%w: client %d", ErrUnknownPeer, to)
+	}
+	key := linkKey{from, to}
+	t.links[key] = append(t.links[key], data)
+	return nil
+}
+
+func (t *SimTransport) Peers() []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	peers := make([]int, 0, len(t.handlers))
+	for id := range t.handlers {
+		peers = append(peers, id)
+	}
+	sort.Ints(peers)
+	return peers
+}
+
+func (t *SimTransport) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+}
+
+// pending returns the links with frames waiting, in a fixed order.
+func (t *SimTransport) pending() []linkKey {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var keys []linkKey
+	for key, frames := range t.links {
+		if len(frames) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
+
+// deliver hands the next frame on key to its receiver and returns once the
+// receiver has handled it.
+func (t *SimTransport) deliver(key linkKey) {
+	t.mu.Lock()
+	data := t.links[key][0]
+	t.links[key] = t.links[key][1:]
+	handler := t.handlers[key[1]]
+	t.mu.Unlock()
+	handler(key[0], data)
+}
+
+// ExploreConfig describes an exploration of one algorithm.
+type ExploreConfig struct {
+	Algorithm string
+	Nodes     int
+	// Ops is how many times each client enters the critical section.
+	Ops  int
+	Runs int
+	Seed int64
+	// Exhaustive enumerates schedules depth-first instead of sampling them
+	// at random, stopping after Runs schedules if there are more.
+	Exhaustive bool
+	// MaxSteps bounds a run; a run still going after it is a liveness
+	// failure.
+	MaxSteps int
+	// TieBreak is the clients' tie-break policy, lowest id if nil.
+	TieBreak TieBreak
+}
+
+// ExploreFailure is a schedule that broke safety or liveness.
+type ExploreFailure struct {
+	Run      int
+	Reason   string
+	Schedule []string
+}
+
+// ExploreResult summarises an exploration.
+type ExploreResult struct {
+	Runs int
+	// Exhausted is set when an exhaustive exploration tried every schedule.
+	Exhausted bool
+	Failure   *ExploreFailure
+}
+
+// Explore runs the clients of cfg.Algorithm under many different orders of
+// message deliveries, request starts and releases, checking after each run
+// that no two clients were ever in the critical section together (safety)
+// and that every request was served (liveness). It stops at the first
+// failure.
+func Explore(cfg ExploreConfig) (ExploreResult, error) {
+	if _, ok := algorithms[cfg.Algorithm]; !ok {
+		return ExploreResult{}, fmt.Errorf("unknown algorithm %q", cfg.Algorithm)
+	}
+	if cfg.MaxSteps == 0 {
+		cfg.MaxSteps = 100 * cfg.Nodes * cfg.Nodes * cfg.Ops
+	}
+
+	var result ExploreResult
+	var prefix []int
+	for run := 1; run <= cfg.Runs; run++ {
+		var choose func(n int) int
+		var choices, widths []int
+		if cfg.Exhaustive {
+			choose = func(n int) int {
+				c := 0
+				if len(choices) < len(prefix) {
+					c = prefix[len(choices)]
+				}
+				choices = append(choices, c)
+				widths = append(widths, n)
+				return c
+			}
+		} else {
+			rng := rand.New(rand.NewSource(cfg.Seed + int64(run)))
+			choose = rng.Intn
+		}
+
+		schedule, reason := exploreOnce(cfg, choose)
+		result.Runs = run
+		if reason != "" {
+			result.Failure = &ExploreFailure{Run: run, Reason: reason, Schedule: schedule}
+			return result, nil
+		}
+		if cfg.Exhaustive {
+			prefix = nextSchedule(choices, widths)
+			if prefix == nil {
+				result.Exhausted = true
+				return result, nil
+			}
+		}
+	}
+	return result, nil
+}
+
+// nextSchedule returns the choices leading to the next unexplored schedule
+// after the one taken, or nil if every schedule has been explored.
+func nextSchedule(choices, widths []int) []int {
+	for d := len(choices) - 1; d >= 0; d-- {
+		if choices[d]+1 < widths[d] {
+			next := append([]int(nil), choices[:d]...)
+			return append(next, choices[d]+1)
+		}
+	}
+	return nil
+}
+
+// exploreClient is the explorer's view of one client.
+type exploreClient struct {
+	id      int
+	ops     int
+	state   CSState
+	request *Request
+	start   chan struct{}
+	release chan struct{}
+	wanted  chan struct{}
+	entered chan *Request
+	done    chan error
+}
+
+// exploreScheduler signals the explorer once a client has sent its
+// request, which is when its Acquire starts waiting.
+type exploreScheduler struct {
+	clients map[int]*exploreClient
+}
+
+func (s *exploreScheduler) Step(step TraceStep) func() {
+	if step.Kind != StepWant {
+		return func() {}
+	}
+	return func() { s.clients[step.Client].wanted <- struct{}{} }
+}
+
+// exploreOnce runs one schedule, picking each step with choose, and returns
+// the schedule taken and why it failed, if it did.
+func exploreOnce(cfg ExploreConfig, choose func(n int) int) ([]string, string) {
+	const resource = "explore"
+	transport := NewSimTransport()
+	fs := NewDistributedFileSystem(JSONCodec{}, transport)
+	defer transport.Close()
+	fs.SetAlgorithm(cfg.Algorithm)
+	fs.TieBreak = cfg.TieBreak
+	scheduler := &exploreScheduler{clients: make(map[int]*exploreClient)}
+	fs.Scheduler = scheduler
+
+	var clients []*exploreClient
+	for i := 1; i <= cfg.Nodes; i++ {
+		fs.Join(i)
+		c := &exploreClient{
+			id:      i,
+			ops:     cfg.Ops,
+			state:   Released,
+			start:   make(chan struct{}),
+			release: make(chan struct{}),
+			wanted:  make(chan struct{}, 1),
+			entered: make(chan *Request, 1),
+			done:    make(chan error, 1),
+		}
+		clients = append(clients, c)
+		scheduler.clients[i] = c
+		go func() {
+			for range c.start {
+				request, err := fs.AcquireResource(c.id, resource)
+				if err != nil {
+					c.done <- err
+					return
+				}
+				c.entered <- request
+				<-c.release
+				c.done <- fs.ReleaseRequest(request)
+			}
+		}()
+	}
+	defer func() {
+		for _, c := range clients {
+			close(c.start)
+		}
+	}()
+
+	// settle lets every client whose request has been granted enter.
+	settle := func() {
+		for _, c := range clients {
+			if c.state != Wanted {
+				continue
+			}
+			node := fs.Node(c.id)
+			ready := node.State(resource) == Held
+			if !ready {
+				if g, ok := fs.Mutex.(granter); ok {
+					_, views := node.View()
+					for _, view := range views {
+						if view.Resource == resource && view.Request != nil && g.granted(view.Request) {
+							ready = true
+						}
+					}
+				}
+			}
+			if ready {
+				c.request = <-c.entered
+				c.state = Held
+			}
+		}
+	}
+
+	var schedule []string
+	for step := 0; ; step++ {
+		var actions []string
+		var run []func() string
+		for _, key := range transport.pending() {
+			key := key
+			actions = append(actions, fmt.Sprintf("deliver %d->%d", key[0], key[1]))
+			run = append(run, func() string {
+				transport.deliver(key)
+				return ""
+			})
+		}
+		for _, c := range clients {
+			c := c
+			switch {
+			case c.state == Released && c.ops > 0:
+				actions = append(actions, fmt.Sprintf("client %d requests", c.id))
+				run = append(run, func() string {
+					c.ops--
+					c.state = Wanted
+					c.start <- struct{}{}
+					select {
+					case <-c.wanted:
+					case err := <-c.done:
+						return fmt.Sprintf("client %d failed to request: %v", c.id, err)
+					}
+					return ""
+				})
+			case c.state == Held:
+				actions = append(actions, fmt.Sprintf("client %d releases", c.id))
+				run = append(run, func() string {
+					c.release <- struct{}{}
+					if err := <-c.done; err != nil {
+						return fmt.Sprintf("client %d failed to release: %v", c.id, err)
+					}
+					c.state = Released
+					return ""
+				})
+			}
+		}
+
+		if len(actions) == 0 {
+			for _, c := range clients {
+				if c.state != Released || c.ops > 0 {
+					return schedule, fmt.Sprintf("liveness: no step left but client %d is %s with %d entries to go", c.id, c.state, c.ops)
+				}
+			}
+			return schedule, ""
+		}
+		if step == cfg.MaxSteps {
+			return schedule, fmt.Sprintf("liveness: still running after %d steps", cfg.MaxSteps)
+		}
+
+		i := choose(len(actions))
+		schedule = append(schedule, actions[i])
+		if reason := run[i](); reason != "" {
+			return schedule, reason
+		}
+		settle()
+		if n := fs.Safety.Violations(); n > 0 {
+			return schedule, fmt.Sprintf("safety: %d clients entered the critical section together", n+1)
+		}
+	}
+}
+
+func runExploreCommand(args []string) int {
+	flags := flag.NewFlagSet("explore", flag.ExitOnError)
+	algos := flags.String("algos", strings.Join(algorithmNames(), ","), "comma-separated algorithms to explore")
+	nodes := flags.Int("nodes", 3, "number of clients")
+	ops := flags.Int("ops", 2, "critical section entries per client")
+	runs := flags.Int("runs", 200, "schedules to try per algorithm")
+	seed := flags.Int64("seed", 1, "seed for the random schedules")
+	exhaustive := flags.Bool("exhaustive", false, "enumerate schedules depth-first instead of at random")
+	tieBreak := flags.String("tie-break", "lowest-id", "order of requests with equal timestamps: lowest-id, round-robin[:N], random[:seed] or weighted:id=weight,...")
+	verbose := flags.Bool("v", false, "show the clients' protocol output while exploring")
+	flags.Parse(args)
+	tb, err := ParseTieBreak(*tieBreak, *nodes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error selecting tie-break: %v\n", err)
+		return 2
+	}
+
+	report := func(format string, args ...any) { fmt.Printf(format, args...) }
+	defer quietLogs(*verbose)()
+
+	failed := false
+	for _, algo := range splitList(*algos) {
+		result, err := Explore(ExploreConfig{
+			Algorithm:  algo,
+			Nodes:      *nodes,
+			Ops:        *ops,
+			Runs:       *runs,
+			Seed:       *seed,
+			Exhaustive: *exhaustive,
+			TieBreak:   tb,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error exploring %s: %v\n", algo, err)
+			return 2
+		}
+		if f := result.Failure; f != nil {
+			failed = true
+			report("%s: run %d failed: %s\n", algo, f.Run, f.Reason)
+			for i, action := range f.Schedule {
+				report("  %3d. %s\n", i+1, action)
+			}
+			continue
+		}
+		exhausted := ""
+		if result.Exhausted {
+			exhausted = ", every schedule covered"
+		}
+		report("%s: %d schedules passed%s\n", algo, result.Runs, exhausted)
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,44 @@
+package ra
+
+import "testing"
+
+func TestExploreRandomSchedules(t *testing.T) {
+	for _, algo := range algorithmNames() {
+		result, err := Explore(ExploreConfig{Algorithm: algo, Nodes: 3, Ops: 2, Runs: 200, Seed: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f := result.Failure; f != nil {
+			t.Errorf("%s: run %d: %s\nschedule: %v", algo, f.Run, f.Reason, f.Schedule)
+		}
+	}
+}
+
+func TestExploreAllSchedules(t *testing.T) {
+	for _, algo := range algorithmNames() {
+		result, err := Explore(ExploreConfig{Algorithm: algo, Nodes: 2, Ops: 2, Runs: 20000, Exhaustive: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f := result.Failure; f != nil {
+			t.Errorf("%s: run %d: %s\nschedule: %v", algo, f.Run, f.Reason, f.Schedule)
+		}
+		if !result.Exhausted {
+			t.Errorf("%s: %d schedules did not cover every interleaving", algo, result.Runs)
+		}
+	}
+}
+
+func TestExploreTieBreaks(t *testing.T) {
+	for _, tb := range []TieBreak{LowestID{}, RoundRobin{N: 3}, Seeded{Seed: 7}, Weighted{N: 3, Weights: map[int]int{1: 3}}} {
+		for _, algo := range []string{"ricart-agarwala", "lamport"} {
+			result, err := Explore(ExploreConfig{Algorithm: algo, Nodes: 3, Ops: 2, Runs: 100, Seed: 1, TieBreak: tb})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f := result.Failure; f != nil {
+				t.Errorf("%s with %s: run %d: %s\nschedule: %v", algo, tb.Name(), f.Run, f.Reason, f.Schedule)
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package ra
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// csEntry is one critical section entry as seen by the FairnessRecorder.
+type csEntry struct {
+	ClientID  int
+	Resource  string
+	Timestamp int
+	Requested time.Time
+	Entered   time.Time
+}
+
+// FairnessRecorder keeps every critical section entry in the order they
+// happened so a run can be checked for starvation and timestamp ordering.
+type FairnessRecorder struct {
+	mu       sync.Mutex
+	entries  []csEntry
+	tieBreak TieBreak
+}
+
+// NewFairnessRecorder returns a recorder expecting timestamp ties to be
+// broken by tb, or by lowest client id if tb is nil.
+func NewFairnessRecorder(tb TieBreak) *FairnessRecorder {
+	return &FairnessRecorder{tieBreak: tb}
+}
+
+func (r *FairnessRecorder) Record(request *Request, entered time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.entries = append(r.entries, csEntry{
+		ClientID:  request.ClientID,
+		Resource:  request.Resource,
+		Timestamp: request.Timestamp,
+		Requested: request.Requested,
+		Entered:   entered,
+	})
+}
+
+// Bypasses returns the entries that were granted while a request ordered
+// before them for the same resource was still waiting. Ricart-Agarwala
+// serves requests in timestamp order, ties broken by the tie-break policy,
+// so this should always be empty.
+func (r *FairnessRecorder) Bypasses() []csEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	earlier := func(a, b csEntry) bool {
+		return before(r.tieBreak, a.Timestamp, a.ClientID, b.Timestamp, b.ClientID)
+	}
+
+	var bypasses []csEntry
+	minLater := make(map[string]csEntry)
+	for i := len(r.entries) - 1; i >= 0; i-- {
+		entry := r.entries[i]
+		later, ok := minLater[entry.Resource]
+		if ok && earlier(later, entry) {
+			bypasses = append(bypasses, entry)
+		}
+		if !ok || earlier(entry, later) {
+			minLater[entry.Resource] = entry
+		}
+	}
+	return bypasses
+}
+
+// Report prints per-client entry counts and wait times followed by the
+// bypass check.
+func (r *FairnessRecorder) Report(w io.Writer) {
+	type clientStats struct {
+		entries int
+		total   time.Duration
+		max     time.Duration
+	}
+
+	r.mu.Lock()
+	stats := make(map[int]*clientStats)
+	for _, entry := range r.entries {
+		s, ok := stats[entry.ClientID]
+		if !ok {
+			s = &clientStats{}
+			stats[entry.ClientID] = s
+		}
+		wait := entry.Entered.Sub(entry.Requested)
+		s.entries++
+		s.total += wait
+		if wait > s.max {
+			s.max = wait
+		}
+	}
+	r.mu.Unlock()
+
+	ids := make([]int, 0, len(stats))
+	for id := range stats {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	fmt.Fprintln(w, "Fairness report:")
+	fmt.Fprintf(w, "%-8s %8s %12s %12s\n", "Client", "Entries", "Mean wait", "Max wait")
+	for _, id := range ids {
+		s := stats[id]
+		mean := s.total / time.Duration(s.entries)
+		fmt.Fprintf(w, "%-8d %8d %12s %12s\n", id, s.entries, mean.Round(time.Microsecond), s.max.Round(time.Microsecond))
+	}
+
+	bypasses := r.Bypasses()
+	if len(bypasses) == 0 {
+		fmt.Fprintln(w, "No request was bypassed by a later-timestamped request")
+		return
+	}
+	fmt.Fprintf(w, "%d requests were bypassed:\n", len(bypasses))
+	for _, entry := range bypasses {
+		fmt.Fprintf(w, "  Client %d entered %s at timestamp %d ahead of an older request\n", entry.ClientID, entry.Resource, entry.Timestamp)
+	}
+}
+
+// RunFairness has every client contend for fileName's critical section in a
+// tight loop for the given duration and then prints the fairness report.
+func RunFairness(fs *DistributedFileSystem, numClients int, fileName string, duration time.Duration, w io.Writer) {
+	fs.Recorder = NewFairnessRecorder(fs.TieBreak)
+	deadline := time.Now().Add(duration)
+
+	var wg sync.WaitGroup
+	for i := 0; i < numClients; i++ {
+		wg.Add(1)
+		go func(clientID int) {
+			defer wg.Done()
+			handle, err := fs.OpenFile(clientID, fileName)
+			if err != nil {
+				fs.Log.Errorf("Error opening file %s: %v", fileName, err)
+				return
+			}
+			for time.Now().Before(deadline) {
+				request, err := fs.AcquireRequest(clientID, handle)
+				if errors.Is(err, ErrFenced) {
+					fs.Resynchronize(clientID)
+					continue
+				}
+				if err != nil {
+					fs.Log.Errorf("Error acquiring %s: %v", fileName, err)
+					continue
+				}
+				time.Sleep(time.Millisecond)
+				fs.ReleaseRequest(request)
+			}
+		}(i + 1)
+	}
+	wg.Wait()
+
+	tb := fs.TieBreak
+	if tb == nil {
+		tb = LowestID{}
+	}
+	fmt.Fprintf(w, "Tie-break policy: %s\n", tb.Name())
+	fs.Recorder.Report(w)
+}
@@ -0,0 +1,77 @@
+package ra
+
+import "sync"
+
+// FanOut sends a broadcast to many peers in parallel on a fixed pool of
+// worker goroutines, so a broadcast to hundreds of peers neither waits on
+// one send at a time nor starts a goroutine per peer. When every worker is
+// busy the broadcasting goroutine sends the next message itself, which
+// bounds parallelism at Workers+1 and keeps nested broadcasts from
+// deadlocking on the pool.
+type FanOut struct {
+	Workers int
+
+	tasks     chan func()
+	closeOnce sync.Once
+}
+
+// NewFanOut starts a pool of workers goroutines. Close stops them.
+func NewFanOut(workers int) *FanOut {
+	f := &FanOut{Workers: workers, tasks: make(chan func())}
+	for i := 0; i < workers; i++ {
+		go f.work()
+	}
+	return f
+}
+
+func (f *FanOut) work() {
+	for task := range f.tasks {
+		task()
+	}
+}
+
+// Run calls send for every peer and returns once all the calls have
+// returned. A nil FanOut, or one with fewer than two workers, calls send
+// for one peer after another in order.
+func (f *FanOut) Run(peers []int, send func(peer int)) {
+	if f == nil || f.Workers < 2 || len(peers) < 2 {
+		for _, peer := range peers {
+			send(peer)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(peers))
+	for _, peer := range peers {
+		peer := peer
+		task := func() {
+			defer wg.Done()
+			send(peer)
+		}
+		select {
+		case f.tasks <- task:
+		default:
+			task()
+		}
+	}
+	wg.Wait()
+}
+
+// Close stops the workers. Run must not be called afterwards.
+func (f *FanOut) Close() {
+	if f == nil {
+		return
+	}
+	f.closeOnce.Do(func() { close(f.tasks) })
+}
+
+// peersExcept returns the participants other than id.
+func (fs *DistributedFileSystem) peersExcept(id int) []int {
+	var peers []int
+	for _, peer := range fs.participants() {
+		if peer != id {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
@@ -0,0 +1,156 @@
+package ra
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultBusyRetryAfter is how long a BUSY tells the requester to wait
+// when fs.BusyRetryAfter is 0.
+const DefaultBusyRetryAfter = 20 * time.Millisecond
+
+// Flow control keeps one peer from filling a node with deferred requests.
+// With fs.PeerWindow set, a Ricart-Agarwala node defers at most that many
+// REQUESTs from any one peer at a time. It answers the next one with BUSY
+// instead of deferring it, and the requester sends the REQUEST again after
+// the retry-after the BUSY carries. A BUSY is not a REPLY, so the request
+// keeps waiting for that peer and mutual exclusion is unaffected.
+
+// deferredFrom counts the requests from peer the node is deferring. The
+// caller holds n.mu.
+func (n *Node) deferredFrom(peer int) int {
+	count := 0
+	for _, rs := range n.resources {
+		for _, d := range rs.deferred.Items() {
+			if d.ClientID == peer {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// sendBusy turns away request on behalf of clientID, telling the requester
+// when to try again.
+func (fs *DistributedFileSystem) sendBusy(clientID int, request *Request) {
+	retryAfter := fs.BusyRetryAfter
+	if retryAfter <= 0 {
+		retryAfter = DefaultBusyRetryAfter
+	}
+	busy := newMessage()
+	defer freeMessage(busy)
+	*busy = Message{
+		Type:       MsgBusy,
+		From:       clientID,
+		To:         request.ClientID,
+		Seq:        request.Seq,
+		Resource:   request.Resource,
+		Timestamp:  fs.Node(clientID).Clock(),
+		RetryAfter: retryAfter,
+	}
+	if err := fs.send(busy); err != nil {
+		fs.Log.Errorf("Error sending busy from client %d: %v", clientID, err)
+		return
+	}
+	fs.Log.Debugf("Client %d is deferring %d requests from client %d; told it to retry %s in %s",
+		clientID, fs.PeerWindow, request.ClientID, request.Resource, retryAfter)
+	fs.Metrics.addNode("ra_busy_sent_total", clientID)
+	fs.event(EventBusySent, clientID, request.ClientID, request.Resource, request.Timestamp)
+}
+
+// ReceiveBusy schedules the REQUEST a BUSY turned away to be sent again
+// after its retry-after, if it is still waiting for that peer by then.
+func (fs *DistributedFileSystem) ReceiveBusy(msg *Message) {
+	key := outstandingKey{msg.To, msg.Seq}
+	fs.OutstandingMutex.Lock()
+	request, ok := fs.Outstanding[key]
+	fs.OutstandingMutex.Unlock()
+	if !ok {
+		return
+	}
+	peer := msg.From
+	fs.Metrics.addNode("ra_busy_received_total", msg.To)
+	fs.event(EventBusyRecv, msg.To, peer, msg.Resource, request.Timestamp)
+	time.AfterFunc(msg.RetryAfter, func() {
+		fs.OutstandingMutex.Lock()
+		current := fs.Outstanding[key]
+		fs.OutstandingMutex.Unlock()
+		if current != request || !slices.Contains(request.Awaiting(), peer) {
+			return
+		}
+		request.messages.Add(1)
+		fs.SendRequest(request, peer)
+	})
+}
+
+// runFlood is the flood scenario: client 2 holds eight resources while
+// client 1 asks for all of them at once. With a peer window of 2 (set
+// unless -peer-window gives another) client 2 defers two of the requests
+// and turns the rest away with BUSY until it has room.
+func runFlood(fs *DistributedFileSystem, n int, diagram *os.File) error {
+	if n < 2 {
+		return fmt.Errorf("the flood scenario needs at least 2 clients")
+	}
+	if fs.PeerWindow == 0 {
+		fs.PeerWindow = 2
+	}
+	const resources = 8
+
+	var (
+		held, hold, wg sync.WaitGroup
+		mu             sync.Mutex
+		errs           []error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	}
+	hold.Add(1)
+	for i := 1; i <= resources; i++ {
+		resource := fmt.Sprintf("flood-%d", i)
+		held.Add(1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			request, err := fs.AcquireResource(2, resource)
+			held.Done()
+			if err != nil {
+				fail(err)
+				return
+			}
+			hold.Wait()
+			fs.ReleaseRequest(request)
+			printSpaceTimeDiagram(2, start, time.Now(), diagram)
+		}()
+	}
+	held.Wait()
+	for i := 1; i <= resources; i++ {
+		resource := fmt.Sprintf("flood-%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			request, err := fs.AcquireResource(1, resource)
+			if err != nil {
+				fail(err)
+				return
+			}
+			fs.ReleaseRequest(request)
+			printSpaceTimeDiagram(1, start, time.Now(), diagram)
+		}()
+	}
+	time.Sleep(30 * time.Millisecond)
+	hold.Done()
+	wg.Wait()
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	narrate("Client 1 asked for %d resources client 2 held; with a peer window of %d, client 2 answered BUSY %d times and every request got in.",
+		resources, fs.PeerWindow, fs.Metrics.Total("ra_busy_sent_total"))
+	return nil
+}
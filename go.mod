@@ -0,0 +1,3 @@
+module github.com/deepan-31/Ricart-Agarwala-Algo-in-golang
+
+go 1.22
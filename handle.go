@@ -0,0 +1,46 @@
+package ra
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Handle is one client's reference to an open file, returned by OpenFile.
+// A file stays open while any client holds an open handle on it; closing a
+// handle only gives up that client's reference. Operations through a
+// closed handle, or by a client that does not own it, fail.
+type Handle struct {
+	Client int
+	File   *File
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// use returns the file behind h for an operation by clientID, or an error
+// if h is closed or owned by another client.
+func (h *Handle) use(clientID int) (*File, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, fmt.Errorf("client %d using %s: %w", clientID, h.File.Name, ErrHandleClosed)
+	}
+	if h.Client != clientID {
+		return nil, fmt.Errorf("client %d using %s: %w of client %d", clientID, h.File.Name, ErrNotOwner, h.Client)
+	}
+	return h.File, nil
+}
+
+// Closed reports whether h has been closed.
+func (h *Handle) Closed() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.closed
+}
+
+// IsOpen reports whether any client holds an open handle on f.
+func (f *File) IsOpen() bool {
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+	return f.handles > 0
+}
@@ -0,0 +1,185 @@
+package ra
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// defaultStuckAfter is how long a request may stay WANTED before the node
+// stops counting as ready.
+const defaultStuckAfter = 30 * time.Second
+
+// HealthCheck is one of the checks behind a node's readiness.
+type HealthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// Readiness is a node's answer to /readyz.
+type Readiness struct {
+	Node   int           `json:"node"`
+	Ready  bool          `json:"ready"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// linkUp reports whether transport's from->to link is up. Links of
+// transports that do not track them count as up.
+func linkUp(transport Transport, from, to int) bool {
+	if t, ok := transport.(interface{ LinkUp(from, to int) bool }); ok {
+		return t.LinkUp(from, to)
+	}
+	return true
+}
+
+// Readiness reports whether clientID can take part in critical sections:
+//
+//   - quorum: its links to a majority of the cluster, itself included, are
+//     up;
+//   - clock: it has heard from a majority since it started, so its Lamport
+//     clock has caught up with theirs;
+//   - requests: none of its requests has been WANTED longer than
+//     stuckAfter.
+func (fs *DistributedFileSystem) Readiness(clientID int, stuckAfter time.Duration) (*Readiness, error) {
+	node := fs.Node(clientID)
+	if node == nil {
+		return nil, fmt.Errorf("%w: client %d", ErrUnknownPeer, clientID)
+	}
+	cluster := fs.participants()
+	majority := len(cluster)/2 + 1
+
+	connected, heard := 1, 1
+	var down, silent []int
+	fs.LastSeenMutex.Lock()
+	for _, peer := range cluster {
+		if peer == clientID {
+			continue
+		}
+		if linkUp(fs.Transport, clientID, peer) {
+			connected++
+		} else {
+			down = append(down, peer)
+		}
+		if lastSeen, ok := fs.LastSeen[peer]; ok && lastSeen.After(node.created) {
+			heard++
+		} else {
+			silent = append(silent, peer)
+		}
+	}
+	fs.LastSeenMutex.Unlock()
+
+	r := &Readiness{Node: clientID}
+	r.Checks = append(r.Checks, HealthCheck{
+		Name:   "quorum",
+		OK:     connected >= majority,
+		Detail: fmt.Sprintf("connected to %d of %d nodes, need %d; down: %v", connected, len(cluster), majority, down),
+	})
+	r.Checks = append(r.Checks, HealthCheck{
+		Name:   "clock",
+		OK:     heard >= majority,
+		Detail: fmt.Sprintf("clock %d merged with %d of %d nodes, need %d; not heard from: %v", node.Clock(), heard, len(cluster), majority, silent),
+	})
+
+	stuck := HealthCheck{Name: "requests", OK: true, Detail: "no request waiting longer than " + stuckAfter.String()}
+	now := time.Now()
+	for _, request := range fs.stuckRequests(now, stuckAfter) {
+		if request.ClientID != clientID {
+			continue
+		}
+		stuck.OK = false
+		stuck.Detail = fmt.Sprintf("waiting %s for %s, no reply from %v",
+			now.Sub(request.Requested).Round(time.Millisecond), request.Resource, request.Awaiting())
+		break
+	}
+	r.Checks = append(r.Checks, stuck)
+
+	r.Ready = true
+	for _, c := range r.Checks {
+		r.Ready = r.Ready && c.OK
+	}
+	return r, nil
+}
+
+// registerHealth adds the probe routes to admin:
+//
+//	GET /healthz
+//	GET /readyz?node=2&stuck=30s
+//
+// /healthz answers as long as the process serves HTTP. /readyz answers 503
+// when the node is not ready, with the checks as JSON either way.
+func (fs *DistributedFileSystem) registerHealth(admin *Admin) {
+	admin.Handle("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	admin.Handle("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		stuckAfter := defaultStuckAfter
+		if v := q.Get("stuck"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			stuckAfter = d
+		}
+		clientID, err := fs.adminNode(q.Get("node"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		readiness, err := fs.Readiness(clientID, stuckAfter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if !readiness.Ready {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		writeJSON(w, readiness)
+	})
+}
+
+// probeNode asks the node process whose admin endpoint listens on addr
+// whether it is ready, printing any failed checks. It returns the exit
+// code of `ra node --probe`: 0 when ready, 1 otherwise.
+func probeNode(addr string, node int, stuckAfter time.Duration) int {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing admin address %q: %v\n", addr, err)
+		return 1
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	url := fmt.Sprintf("http://%s/readyz?stuck=%s", net.JoinHostPort(host, port), stuckAfter)
+	if node != 0 {
+		url += fmt.Sprintf("&node=%d", node)
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error contacting node: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	var readiness Readiness
+	if err := json.NewDecoder(resp.Body).Decode(&readiness); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading readiness (%s): %v\n", resp.Status, err)
+		return 1
+	}
+	for _, c := range readiness.Checks {
+		if !c.OK {
+			fmt.Fprintf(os.Stderr, "node %d not ready: %s: %s\n", readiness.Node, c.Name, c.Detail)
+		}
+	}
+	if !readiness.Ready {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,211 @@
+package ra
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IntentSession is the session of the intention locks a client takes on
+// the directories above a path when fs.Hierarchical is set. Intention
+// locks share a directory with each other, so clients working on different
+// files in it go ahead together, but not with a client holding the
+// directory itself.
+const IntentSession = "intent"
+
+// pathDirs returns the directories above path, outermost first, each with
+// its trailing slash: "docs/2024/a.txt" is under "docs/" and "docs/2024/".
+// A directory is a resource named with a trailing slash, so "docs/" is
+// under nothing.
+func pathDirs(path string) []string {
+	var dirs []string
+	for i := 0; i < len(path)-1; i++ {
+		if path[i] == '/' {
+			dirs = append(dirs, path[:i+1])
+		}
+	}
+	return dirs
+}
+
+// intentKey names a client's intention lock on a directory.
+type intentKey struct {
+	clientID int
+	dir      string
+}
+
+// sharedIntent is an intention lock shared by every request of one client
+// under its directory. ready is closed once request or err is set.
+type sharedIntent struct {
+	ready   chan struct{}
+	request *Request
+	err     error
+	holders int
+}
+
+// acquirePath enters resource like acquireOne, after taking an intention
+// lock on each directory above it, outermost first. Every client locking
+// from the top down is what keeps directory and file locks from
+// deadlocking. The intention locks are released with the request. A
+// client cannot upgrade its intention lock on a directory to the
+// directory itself, which would wait on its own intention lock forever:
+// it gets ErrLockUpgrade and must release the paths under it first.
+func (fs *DistributedFileSystem) acquirePath(caller LocalCaller, clientID int, resource, session string, file *File) (*Request, error) {
+	fs.intentsMutex.Lock()
+	_, upgrade := fs.intents[intentKey{clientID, resource}]
+	fs.intentsMutex.Unlock()
+	if upgrade {
+		return nil, fmt.Errorf("client %d requesting %s: %w", clientID, resource, ErrLockUpgrade)
+	}
+	var intents []*Request
+	for _, dir := range pathDirs(resource) {
+		intent, err := fs.acquireIntent(caller, clientID, dir)
+		if err != nil {
+			fs.releaseIntents(intents)
+			return nil, err
+		}
+		intents = append(intents, intent)
+	}
+	request, err := fs.acquireOne(caller, clientID, resource, session, file)
+	if err != nil {
+		fs.releaseIntents(intents)
+		return nil, err
+	}
+	request.intents = intents
+	return request, nil
+}
+
+// acquireIntent takes clientID's intention lock on dir. A client holds one
+// intention lock per directory however many of its requests are under it,
+// since a second one would queue behind the first: the client could never
+// hold two files in a directory at once.
+func (fs *DistributedFileSystem) acquireIntent(caller LocalCaller, clientID int, dir string) (*Request, error) {
+	key := intentKey{clientID, dir}
+	fs.intentsMutex.Lock()
+	if fs.intents == nil {
+		fs.intents = make(map[intentKey]*sharedIntent)
+	}
+	shared, ok := fs.intents[key]
+	if ok {
+		shared.holders++
+		fs.intentsMutex.Unlock()
+		<-shared.ready
+		return shared.request, shared.err
+	}
+	shared = &sharedIntent{ready: make(chan struct{}), holders: 1}
+	fs.intents[key] = shared
+	fs.intentsMutex.Unlock()
+
+	shared.request, shared.err = fs.acquireOne(caller, clientID, dir, IntentSession, nil)
+	if shared.err != nil {
+		fs.intentsMutex.Lock()
+		delete(fs.intents, key)
+		fs.intentsMutex.Unlock()
+	}
+	close(shared.ready)
+	return shared.request, shared.err
+}
+
+// releaseIntents gives up intention locks, innermost first. Each is
+// released when the last request of its client under the directory is.
+func (fs *DistributedFileSystem) releaseIntents(intents []*Request) {
+	for i := len(intents) - 1; i >= 0; i-- {
+		intent := intents[i]
+		key := intentKey{intent.ClientID, intent.Resource}
+		fs.intentsMutex.Lock()
+		shared := fs.intents[key]
+		if shared != nil && shared.request == intent {
+			if shared.holders--; shared.holders > 0 {
+				fs.intentsMutex.Unlock()
+				continue
+			}
+			delete(fs.intents, key)
+		}
+		fs.intentsMutex.Unlock()
+		if err := fs.ReleaseRequest(intent); err != nil {
+			fs.Log.Errorf("Error releasing intention lock on %s: %v", intent.Resource, err)
+		}
+	}
+}
+
+// runHierarchy is the hierarchy scenario: client 1 repeatedly locks the
+// directory docs/, as a rename of it would, while the other clients write
+// files inside it. Only intention locks are taken on docs/ for the file
+// writes, yet none of them runs while client 1 holds the directory.
+func runHierarchy(fs *DistributedFileSystem, n int, diagram *os.File) error {
+	const dir = "docs/"
+	fs.Hierarchical = true
+
+	var (
+		dirHeld   atomic.Bool
+		inside    atomic.Int32
+		overlaps  atomic.Int32
+		together  atomic.Int32
+		wg        sync.WaitGroup
+		errsMutex sync.Mutex
+		errs      []error
+	)
+	fail := func(err error) {
+		errsMutex.Lock()
+		errs = append(errs, err)
+		errsMutex.Unlock()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for op := 0; op < 3; op++ {
+			time.Sleep(5 * time.Millisecond)
+			start := time.Now()
+			request, err := fs.AcquireResource(1, dir)
+			if err != nil {
+				fail(err)
+				return
+			}
+			request.Op = "Rename"
+			dirHeld.Store(true)
+			if inside.Load() > 0 {
+				overlaps.Add(1)
+			}
+			time.Sleep(10 * time.Millisecond)
+			dirHeld.Store(false)
+			fs.ReleaseRequest(request)
+			printSpaceTimeDiagram(1, start, time.Now(), diagram)
+		}
+	}()
+	for id := 2; id <= n; id++ {
+		wg.Add(1)
+		go func(clientID int) {
+			defer wg.Done()
+			path := fmt.Sprintf("%sfile%d.txt", dir, clientID)
+			for op := 0; op < 5; op++ {
+				start := time.Now()
+				request, err := fs.AcquireResource(clientID, path)
+				if err != nil {
+					fail(err)
+					return
+				}
+				request.Op = "Write"
+				if inside.Add(1) > 1 {
+					together.Add(1)
+				}
+				if dirHeld.Load() {
+					overlaps.Add(1)
+				}
+				time.Sleep(2 * time.Millisecond)
+				inside.Add(-1)
+				fs.ReleaseRequest(request)
+				printSpaceTimeDiagram(clientID, start, time.Now(), diagram)
+				time.Sleep(3 * time.Millisecond)
+			}
+		}(id)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	narrate("Client 1 locked %s three times; writes to files inside it overlapped the directory lock %d times and each other %d times.",
+		dir, overlaps.Load(), together.Load())
+	return nil
+}
@@ -0,0 +1,107 @@
+package ra
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// A client holding a file in a directory can take another file in it: its
+// requests share one intention lock on the directory, which is released
+// with the last of them.
+func TestHierarchicalSiblingsShareIntent(t *testing.T) {
+	fs := NewDistributedFileSystem(JSONCodec{}, NewLocalTransport())
+	fs.Storage = NewMemoryStorage(nil)
+	fs.Hierarchical = true
+	fs.Join(1)
+	fs.Join(2)
+
+	acquired := make(chan *MultiRequest)
+	go func() {
+		multi, err := fs.RequestCSMulti(1, "docs/a.txt", "docs/b.txt")
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- multi
+	}()
+	var multi *MultiRequest
+	select {
+	case multi = <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client 1 could not hold two files in docs/")
+	}
+	if multi == nil {
+		return
+	}
+	if err := fs.ReleaseRequest(multi.Requests[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Client 1 still holds docs/b.txt, so docs/ stays locked for client 2
+	// until it is released.
+	dir := make(chan *Request)
+	go func() {
+		request, err := fs.AcquireResource(2, "docs/")
+		if err != nil {
+			t.Error(err)
+		}
+		dir <- request
+	}()
+	select {
+	case <-dir:
+		t.Fatal("client 2 locked docs/ while client 1 held a file in it")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := fs.ReleaseRequest(multi.Requests[1]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case request := <-dir:
+		if request != nil {
+			fs.ReleaseRequest(request)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("docs/ stayed locked after client 1 released both files")
+	}
+}
+
+// A client holding a file cannot also lock the directory above it, which
+// would wait on its own intention lock: it is told so instead.
+func TestHierarchicalUpgradeRejected(t *testing.T) {
+	fs := NewDistributedFileSystem(JSONCodec{}, NewLocalTransport())
+	fs.Storage = NewMemoryStorage(nil)
+	fs.Hierarchical = true
+	fs.Join(1)
+	fs.Join(2)
+
+	file, err := fs.AcquireResource(1, "docs/sub/x.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"docs/", "docs/sub/"} {
+		acquired := make(chan error, 1)
+		go func() {
+			request, err := fs.AcquireResource(1, dir)
+			if err == nil {
+				fs.ReleaseRequest(request)
+			}
+			acquired <- err
+		}()
+		select {
+		case err := <-acquired:
+			if !errors.Is(err, ErrLockUpgrade) {
+				t.Fatalf("client 1 locking %s: got %v, want %v", dir, err, ErrLockUpgrade)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("client 1 deadlocked locking %s above a file it holds", dir)
+		}
+	}
+	if err := fs.ReleaseRequest(file); err != nil {
+		t.Fatal(err)
+	}
+	request, err := fs.AcquireResource(1, "docs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.ReleaseRequest(request)
+}
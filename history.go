@@ -0,0 +1,110 @@
+package ra
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// HistoryRecord is one completed critical section.
+type HistoryRecord struct {
+	Node      int           `json:"node"`
+	Resource  string        `json:"resource"`
+	Op        string        `json:"op"`
+	Timestamp int           `json:"timestamp"`
+	Entered   time.Time     `json:"entered"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// HistoryFilter selects records in a query. Zero fields match everything.
+type HistoryFilter struct {
+	Node     int
+	Resource string
+	Op       string
+	Since    time.Time
+}
+
+func (f HistoryFilter) Match(r HistoryRecord) bool {
+	if f.Node != 0 && r.Node != f.Node {
+		return false
+	}
+	if f.Resource != "" && r.Resource != f.Resource {
+		return false
+	}
+	if f.Op != "" && r.Op != f.Op {
+		return false
+	}
+	if !f.Since.IsZero() && r.Entered.Before(f.Since) {
+		return false
+	}
+	return true
+}
+
+// HistoryStore is an append-only store of HistoryRecords kept as one JSON
+// document per line, so it survives crashes mid-write and can still be read
+// with ordinary tools. It is a file rather than an embedded database such
+// as bbolt or SQLite because the module depends on the standard library
+// alone; queries scan the whole file, which suits the history of a run.
+type HistoryStore struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// OpenHistory opens (creating if needed) the store at path.
+func OpenHistory(path string) (*HistoryStore, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &HistoryStore{path: path, file: file}, nil
+}
+
+func (h *HistoryStore) Append(r HistoryRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err = h.file.Write(append(data, '\n'))
+	return err
+}
+
+// Query returns the matching records in the order they were written.
+// Lines that fail to parse (a torn final write) are skipped.
+func (h *HistoryStore) Query(filter HistoryFilter) ([]HistoryRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return queryHistory(h.path, filter)
+}
+
+func (h *HistoryStore) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.file.Close()
+}
+
+func queryHistory(path string, filter HistoryFilter) ([]HistoryRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []HistoryRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r HistoryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			continue
+		}
+		if filter.Match(r) {
+			records = append(records, r)
+		}
+	}
+	return records, scanner.Err()
+}
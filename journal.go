@@ -0,0 +1,71 @@
+package ra
+
+import "fmt"
+
+// stagedWrite is a change to a file held in a critical section, journaled
+// so memory and storage never disagree: the new content is staged, stored,
+// and only then committed to memory. Side effects of staging, such as the
+// quota charge, are kept as undo steps and run in reverse if storing fails.
+type stagedWrite struct {
+	file    *File
+	content string
+	undo    []func()
+	// version is the file's version once committed.
+	version uint64
+	// fence is the fencing token of the critical section writing it.
+	fence uint64
+}
+
+// stage computes the new content of the file request holds and charges it
+// to the client's quota, leaving the file's content untouched.
+func (fs *DistributedFileSystem) stage(request *Request, modify func(old string) string) (*stagedWrite, error) {
+	file := request.File
+	w := &stagedWrite{file: file, content: modify(file.Snapshot().Content), fence: request.fence}
+
+	undo, err := fs.Quotas.charge(request.ClientID, file.Name, len(w.content))
+	if err != nil {
+		fs.Metrics.addNode("ra_quota_rejections_total", request.ClientID)
+		return nil, err
+	}
+	w.undo = append(w.undo, undo)
+	return w, nil
+}
+
+// commit makes the staged content the file's content in memory.
+func (w *stagedWrite) commit() {
+	w.version = w.file.setContent(w.content)
+}
+
+// rollback abandons the staged write, undoing its side effects.
+func (w *stagedWrite) rollback() {
+	for i := len(w.undo) - 1; i >= 0; i-- {
+		w.undo[i]()
+	}
+}
+
+// apply stores a staged write and commits it, or rolls it back and
+// returns the storage error. A write whose fencing token is older than
+// the last one stored for the file is rejected with ErrFenced: its
+// critical section was revoked and a later holder has written since.
+func (fs *DistributedFileSystem) apply(w *stagedWrite, verb string) error {
+	w.file.storeMutex.Lock()
+	defer w.file.storeMutex.Unlock()
+	if w.fence != 0 {
+		if w.fence < w.file.fence {
+			w.rollback()
+			fs.Metrics.Add("ra_fenced_writes_total", 1)
+			return fmt.Errorf("%s %s: %w: fencing token %d is older than %d", verb, w.file.Name, ErrFenced, w.fence, w.file.fence)
+		}
+		w.file.fence = w.fence
+	}
+	w.file.beginStore(w.content)
+	err := fs.Storage.Store(w.file.Name, []byte(w.content))
+	w.file.endStore(err == nil)
+	if err != nil {
+		w.rollback()
+		fs.Metrics.Add("ra_write_rollbacks_total", 1)
+		return fmt.Errorf("%s %s: %w", verb, w.file.Name, err)
+	}
+	w.commit()
+	return nil
+}
@@ -0,0 +1,211 @@
+package ra
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Lamport is Lamport's original algorithm. Each client keeps a queue of
+// every request it knows of per resource. A request is broadcast and queued
+// by every peer, which replies at once. A client enters once its own
+// request heads its queue and every peer has replied; because links are
+// FIFO, a peer's reply arriving means any older request of that peer has
+// already been queued. Leaving broadcasts a RELEASE that removes the request
+// from every queue, so each entry costs 3(N-1) messages.
+type Lamport struct {
+	fs *DistributedFileSystem
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queues map[clientResource]*RequestQueue
+}
+
+func NewLamport(fs *DistributedFileSystem) *Lamport {
+	l := &Lamport{fs: fs, queues: make(map[clientResource]*RequestQueue)}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+func (l *Lamport) Name() string { return "lamport" }
+
+func (l *Lamport) MessageCost(n int) string { return fmt.Sprintf("3(N-1) = %d", 3*(n-1)) }
+
+// queue returns clientID's queue for resource. The caller holds l.mu.
+func (l *Lamport) queue(clientID int, resource string) *RequestQueue {
+	key := clientResource{clientID, resource}
+	q, ok := l.queues[key]
+	if !ok {
+		q = NewRequestQueue(l.fs.TieBreak)
+		l.queues[key] = q
+	}
+	return q
+}
+
+func (l *Lamport) Acquire(node *Node, resource, session string, file *File, span *Span) (*Request, error) {
+	fs := l.fs
+	stepped := fs.step(TraceStep{Client: node.ID, Kind: StepWant, Resource: resource})
+	request := fs.want(node, resource, session, file, span)
+	l.mu.Lock()
+	l.queue(node.ID, resource).Push(request)
+	l.mu.Unlock()
+	fs.broadcastRequest(request)
+	stepped()
+
+	gather := fs.Tracer.Start("replies.gather", span)
+	timeout, stop := fs.replyTimeout()
+	defer stop()
+	timedOut, cancelled := false, false
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-timeout:
+			l.mu.Lock()
+			timedOut = true
+			l.cond.Broadcast()
+			l.mu.Unlock()
+		case <-request.cancelled:
+			l.mu.Lock()
+			cancelled = true
+			l.cond.Broadcast()
+			l.mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	l.mu.Lock()
+	q := l.queue(node.ID, resource)
+	for !timedOut && !cancelled && !(allReplied(request) && q.Peek() == request) {
+		l.cond.Wait()
+	}
+	l.mu.Unlock()
+	fs.forgetRequest(request)
+
+	if cancelled {
+		l.Release(request)
+		gather.SetAttribute("error", "cancelled")
+		gather.Finish()
+		return nil, fmt.Errorf("client %d requesting %s: %w", node.ID, resource, ErrCancelled)
+	}
+
+	if timedOut {
+		awaiting := request.Awaiting()
+		l.Release(request)
+		gather.SetAttribute("error", "peer timeout")
+		gather.Finish()
+		if len(awaiting) == 0 {
+			return nil, fmt.Errorf("client %d requesting %s: %w: an older request was never released", node.ID, resource, ErrPeerTimeout)
+		}
+		return nil, fmt.Errorf("client %d requesting %s: %w: no reply from clients %v", node.ID, resource, ErrPeerTimeout, awaiting)
+	}
+	gather.Finish()
+
+	if !node.enter(request) {
+		return nil, fmt.Errorf("client %d requesting %s: %w", node.ID, resource, ErrNotHoldingCS)
+	}
+	return request, nil
+}
+
+func (l *Lamport) granted(request *Request) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return allReplied(request) && l.queue(request.ClientID, request.Resource).Peek() == request
+}
+
+func allReplied(request *Request) bool {
+	select {
+	case <-request.repliesDone:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release takes request out of its client's queue and tells every peer to
+// do the same: with a RELEASE if it was held, or a CANCEL if it is
+// withdrawn before entering.
+func (l *Lamport) Release(request *Request) bool {
+	fs := l.fs
+	defer fs.step(TraceStep{Client: request.ClientID, Kind: StepRelease, Resource: request.Resource})()
+	node := fs.Node(request.ClientID)
+	_, held := node.release(request)
+
+	l.mu.Lock()
+	queued := l.queue(request.ClientID, request.Resource).Remove(request)
+	l.cond.Broadcast()
+	l.mu.Unlock()
+	if !queued {
+		return held
+	}
+
+	if !held {
+		fs.FanOut.Run(fs.peersExcept(request.ClientID), func(peer int) {
+			fs.sendCancel(request, peer)
+		})
+		return held
+	}
+	timestamp := node.tick()
+	fs.FanOut.Run(fs.peersExcept(request.ClientID), func(peer int) {
+		err := fs.send(&Message{
+			Type:      MsgRelease,
+			From:      request.ClientID,
+			To:        peer,
+			Seq:       request.Seq,
+			Resource:  request.Resource,
+			Timestamp: timestamp,
+		})
+		if err != nil {
+			l.fs.Log.Errorf("Error sending release from client %d: %v", request.ClientID, err)
+			return
+		}
+		request.messages.Add(1)
+	})
+	return held
+}
+
+func (l *Lamport) Receive(msg *Message) bool {
+	fs := l.fs
+	switch msg.Type {
+	case MsgRequest:
+		if fs.Dedupe.Seen(msg.From, msg.To, msg.Seq) {
+			l.fs.Log.Debugf("Client %d dropped duplicate request %d from client %d", msg.To, msg.Seq, msg.From)
+			return true
+		}
+		request := &Request{
+			ClientID:  msg.From,
+			Resource:  msg.Resource,
+			Timestamp: msg.Timestamp,
+			Seq:       msg.Seq,
+			Requested: time.Now(),
+		}
+		l.mu.Lock()
+		l.queue(msg.To, msg.Resource).Push(request)
+		l.cond.Broadcast()
+		l.mu.Unlock()
+		fs.event(EventRequestRecv, msg.To, msg.From, msg.Resource, msg.Timestamp)
+
+		fs.Node(msg.To).tick()
+		fs.sendReply(msg.To, request)
+	case MsgReply:
+		fs.ReceiveReply(msg)
+		l.mu.Lock()
+		l.cond.Broadcast()
+		l.mu.Unlock()
+	case MsgRelease, MsgCancel:
+		l.mu.Lock()
+		q := l.queue(msg.To, msg.Resource)
+		queued := q.Find(msg.From, msg.Seq)
+		if queued != nil {
+			q.Remove(queued)
+		}
+		l.cond.Broadcast()
+		l.mu.Unlock()
+		if msg.Type == MsgCancel && queued != nil {
+			fs.event(EventCancelRecv, msg.To, msg.From, msg.Resource, msg.Timestamp)
+		}
+	default:
+		return false
+	}
+	return true
+}
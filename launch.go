@@ -0,0 +1,604 @@
+package ra
+
+import (
+	"bufio"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// nodeDoneMarker is printed by a node process once its workload is done.
+// It keeps running after that, answering peers, until it is signalled.
+const nodeDoneMarker = "NODE WORKLOAD DONE"
+
+// launchWorkload is what launched nodes run when no workload file is given:
+// a few reads and writes of file1.txt each.
+var launchWorkload = &Workload{
+	Seed: 1,
+	Default: ClientWorkload{
+		Operations: 5,
+		ReadRatio:  0.5,
+		ThinkTime:  Distribution{Kind: "uniform", Min: Duration(10 * time.Millisecond), Max: Duration(50 * time.Millisecond)},
+		HoldTime:   Distribution{Kind: "constant", Mean: Duration(5 * time.Millisecond)},
+		Files:      []string{"file1.txt"},
+	},
+}
+
+// runNodeCommand runs a single client as its own process, talking to its
+// peers over TCP. Every flag can also be set through the RA_* environment
+// variable named in its usage, which is how containers configure a node;
+// flags win over the environment.
+func runNodeCommand(args []string) int {
+	flags := flag.NewFlagSet("node", flag.ExitOnError)
+	id := flags.Int("id", envInt("RA_NODE_ID", 0), "client id of this node ($RA_NODE_ID)")
+	peerList := flags.String("peers", os.Getenv("RA_PEERS"), "every node in the cluster, this one included, as id=host:port,... or with socket paths, id=/path/to.sock, for nodes on this host ($RA_PEERS)")
+	peersFile := flags.String("peers-file", os.Getenv("RA_PEERS_FILE"), "remember known peers and their link state in this file, and rejoin from it when --peers is not given ($RA_PEERS_FILE)")
+	listen := flags.String("listen", os.Getenv("RA_LISTEN"), "local address to listen on, if not this node's entry in --peers ($RA_LISTEN)")
+	codecName := flags.String("codec", envString("RA_CODEC", "json"), "wire codec for protocol messages, json or gob ($RA_CODEC)")
+	workloadPath := flags.String("workload", os.Getenv("RA_WORKLOAD"), "JSON workload description, defaults to a short scripted run ($RA_WORKLOAD)")
+	eventsPath := flags.String("events", os.Getenv("RA_EVENTS"), "write protocol events to this file as JSON lines ($RA_EVENTS)")
+	historyPath := flags.String("history", os.Getenv("RA_HISTORY"), "record every critical section in this history store ($RA_HISTORY)")
+	opHistory := flags.Int("op-history", envInt("RA_OP_HISTORY", DefaultOperationLogSize), "keep this many of the latest file operations in memory ($RA_OP_HISTORY)")
+	opSpill := flags.String("op-spill", os.Getenv("RA_OP_SPILL"), "append file operations pushed out of --op-history to this file instead of dropping them ($RA_OP_SPILL)")
+	reportPath := flags.String("report", os.Getenv("RA_REPORT"), "on shutdown, write every operation's request, entry and exit times and message count to this file (.csv for CSV, JSON otherwise) ($RA_REPORT)")
+	deferredPath := flags.String("deferred-journal", os.Getenv("RA_DEFERRED_JOURNAL"), "keep the replies this node owes in this file, and send them on restart so peers are not left waiting ($RA_DEFERRED_JOURNAL)")
+	replyTimeout := flags.Duration("reply-timeout", envDuration("RA_REPLY_TIMEOUT", 0), "give up on a request if peers have not replied within this long, 0 waits forever ($RA_REPLY_TIMEOUT)")
+	dialTimeout := flags.Duration("dial-timeout", envDuration("RA_DIAL_TIMEOUT", 10*time.Second), "keep retrying a peer that is not up yet for this long ($RA_DIAL_TIMEOUT)")
+	latency := flags.Duration("latency", envDuration("RA_LATENCY", 0), "emulated latency on this node's outgoing links ($RA_LATENCY)")
+	jitter := flags.Duration("jitter", envDuration("RA_JITTER", 0), "extra random latency of up to this much per message ($RA_JITTER)")
+	loss := flags.Float64("loss", envFloat("RA_LOSS", 0), "drop this fraction of this node's outgoing messages, e.g. 0.1 ($RA_LOSS)")
+	retransmit := flags.Bool("retransmit", os.Getenv("RA_RETRANSMIT") != "", "acknowledge messages and retransmit unacknowledged ones with exponential backoff, reporting peers that never answer as down; every node must agree ($RA_RETRANSMIT)")
+	adminAddr := flags.String("admin", os.Getenv("RA_ADMIN"), "serve the admin endpoint (partitions, link latency) on this address ($RA_ADMIN)")
+	noMutex := flags.Bool("no-mutex", os.Getenv("RA_NO_MUTEX") != "", "bypass Ricart-Agarwala entirely to show the violations it prevents ($RA_NO_MUTEX)")
+	readCache := flags.Bool("read-cache", os.Getenv("RA_READ_CACHE") != "", "serve repeated reads from a cache until a peer writes the file ($RA_READ_CACHE)")
+	algo := flags.String("algo", envString("RA_ALGO", "ricart-agarwala"), "mutual exclusion algorithm: "+strings.Join(algorithmNames(), ", ")+" ($RA_ALGO)")
+	sharedReads := flags.Bool("shared-reads", os.Getenv("RA_SHARED_READS") != "", "let reads of a file run together, excluding only writers ($RA_SHARED_READS)")
+	tree := flags.String("tree", os.Getenv("RA_TREE"), "with --algo raymond, the tree as child=parent pairs; every node must be given the same tree ($RA_TREE)")
+	localQueue := flags.String("local-queue", os.Getenv("RA_LOCAL_QUEUE"), "order this node's local callers wanting the same resource: fifo, priority or fair-share; empty lets whoever wakes first go ($RA_LOCAL_QUEUE)")
+	tieBreak := flags.String("tie-break", envString("RA_TIE_BREAK", "lowest-id"), "order of requests with equal timestamps: lowest-id, round-robin[:N], random[:seed] or weighted:id=weight,...; every node must use the same ($RA_TIE_BREAK)")
+	eventual := flags.String("eventual", os.Getenv("RA_EVENTUAL"), "comma-separated files to run with last-writer-wins eventual consistency ($RA_EVENTUAL)")
+	fileQuota := flags.String("file-quota", os.Getenv("RA_FILE_QUOTA"), "limit file sizes in bytes, as N for every file and/or name=N for one ($RA_FILE_QUOTA)")
+	clientQuota := flags.String("client-quota", os.Getenv("RA_CLIENT_QUOTA"), "limit the bytes of the files each client last wrote, as N and/or id=N ($RA_CLIENT_QUOTA)")
+	holdLimit := flags.Duration("hold-limit", envDuration("RA_HOLD_LIMIT", 0), "release a critical section if the work inside runs longer than this (0 disables) ($RA_HOLD_LIMIT)")
+	secret := flags.String("cluster-secret", os.Getenv("RA_CLUSTER_SECRET"), "key shared by every node; peers must prove it when connecting, but any node holding it can claim another's id (prefer $RA_CLUSTER_SECRET, which stays out of the process list)")
+	linkSecrets := flags.String("link-secrets", os.Getenv("RA_LINK_SECRETS"), "secrets of this node's links as peer=hex pairs, as written by `ra init`; peers must prove the secret of their link when connecting, so none can claim another's id (prefer $RA_LINK_SECRETS)")
+	proxies := flags.String("proxies", os.Getenv("RA_PROXIES"), "lightweight clients that enter critical sections through a participant instead of running the protocol, as client=participant pairs; every node must be given the same ($RA_PROXIES)")
+	hierarchical := flags.Bool("hierarchical", os.Getenv("RA_HIERARCHICAL") != "", "treat resource names as paths, so locking a directory such as docs/ excludes everything under it; every node must agree ($RA_HIERARCHICAL)")
+	peerWindow := flags.Int("peer-window", envInt("RA_PEER_WINDOW", 0), "defer at most this many requests from any one peer at a time, answering more with BUSY (0 is no limit) ($RA_PEER_WINDOW)")
+	busyRetryAfter := flags.Duration("busy-retry-after", envDuration("RA_BUSY_RETRY_AFTER", DefaultBusyRetryAfter), "with --peer-window, how long a BUSY tells the peer to wait before asking again ($RA_BUSY_RETRY_AFTER)")
+	watchFiles := flags.Duration("watch-files", envDuration("RA_WATCH_FILES", 0), "check the open files for changes made outside this node, such as other nodes' writes to a shared disk, this often (0 disables) ($RA_WATCH_FILES)")
+	optimistic := flags.Bool("optimistic", os.Getenv("RA_OPTIMISTIC") != "", "reject a write with a conflict if the file changed after the client last read it, instead of losing the other update ($RA_OPTIMISTIC)")
+	coalesce := flags.Duration("coalesce", envDuration("RA_COALESCE", 0), "keep a released critical section held this long for this node's next operation on it, unless a peer is waiting (0 disables) ($RA_COALESCE)")
+	tlsCert := flags.String("tls-cert", os.Getenv("RA_TLS_CERT"), "connect to peers over TLS with this certificate; needs --tls-key and --tls-ca, as written by `ra init` ($RA_TLS_CERT)")
+	tlsKey := flags.String("tls-key", os.Getenv("RA_TLS_KEY"), "private key of --tls-cert ($RA_TLS_KEY)")
+	tlsCA := flags.String("tls-ca", os.Getenv("RA_TLS_CA"), "accept only peers with certificates from this CA ($RA_TLS_CA)")
+	fanout := flags.Int("fanout", envInt("RA_FANOUT", 0), "send each broadcast to peers in parallel on this many workers (0 or 1 sends one at a time) ($RA_FANOUT)")
+	storageSpec := flags.String("storage", envString("RA_STORAGE", "disk"), "where file contents are kept: disk[:dir], memory, or s3://bucket[/prefix]?endpoint=URL&region=R ($RA_STORAGE)")
+	observerAddr := flags.String("observer", os.Getenv("RA_OBSERVER"), "stream protocol events to the `ra observe` process at this address ($RA_OBSERVER)")
+	etcdEndpoint := flags.String("etcd", os.Getenv("RA_ETCD"), "mirror this node's critical sections as leased keys in the etcd at this URL, e.g. http://localhost:2379 ($RA_ETCD)")
+	etcdPrefix := flags.String("etcd-prefix", envString("RA_ETCD_PREFIX", "/ra/holders/"), "key prefix for --etcd ($RA_ETCD_PREFIX)")
+	etcdTTL := flags.Duration("etcd-ttl", envDuration("RA_ETCD_TTL", 10*time.Second), "lease TTL for --etcd keys; a dead node's keys vanish within it ($RA_ETCD_TTL)")
+	logLevel := flags.String("log-level", envString("RA_LOG_LEVEL", "info"), "least severe messages to log: debug, info, warn or error ($RA_LOG_LEVEL)")
+	logFormat := flags.String("log-format", envString("RA_LOG_FORMAT", "text"), "log as plain text lines or as JSON through log/slog: text or json ($RA_LOG_FORMAT)")
+	probe := flags.Bool("probe", false, "instead of running a node, ask the one serving --admin whether it is ready and exit nonzero if not, e.g. as a Kubernetes exec probe")
+	stuckAfter := flags.Duration("stuck-after", defaultStuckAfter, "with --probe, count the node unready once a request has waited this long")
+	flags.Parse(args)
+	if *probe {
+		if *adminAddr == "" {
+			fmt.Fprintln(os.Stderr, "Error: --probe needs the node's --admin address")
+			return 2
+		}
+		return probeNode(*adminAddr, *id, *stuckAfter)
+	}
+
+	logger, err := newLogger(*logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error configuring logging: %v\n", err)
+		return 2
+	}
+	DefaultLogger = logger
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	addrs, err := ParsePeers(*peerList)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing peers: %v\n", err)
+		return 2
+	}
+	var registry *PeerRegistry
+	if *peersFile != "" {
+		registry, err = LoadPeerRegistry(*peersFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading peers: %v\n", err)
+			return 1
+		}
+		addrs = registry.Merge(addrs)
+		if err := registry.Save(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving peers: %v\n", err)
+			return 1
+		}
+	}
+	codec, err := NewCodec(*codecName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error selecting codec: %v\n", err)
+		return 2
+	}
+	workload := launchWorkload
+	if *workloadPath != "" {
+		workload, err = LoadWorkload(*workloadPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading workload: %v\n", err)
+			return 1
+		}
+	}
+
+	transport, err := NewTCPTransport(*id, *listen, addrs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error starting transport: %v\n", err)
+		return 1
+	}
+	transport.DialTimeout = *dialTimeout
+	transport.Secret = []byte(*secret)
+	if *linkSecrets != "" {
+		if transport.LinkSecrets, err = ParseLinkSecrets(*linkSecrets); err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing --link-secrets: %v\n", err)
+			return 2
+		}
+	}
+	if *tlsCert != "" || *tlsKey != "" || *tlsCA != "" {
+		if *tlsCert == "" || *tlsKey == "" || *tlsCA == "" {
+			fmt.Fprintln(os.Stderr, "--tls-cert, --tls-key and --tls-ca must be given together")
+			return 2
+		}
+		if transport.TLS, err = LoadTLSConfig(*tlsCert, *tlsKey, *tlsCA); err != nil {
+			fmt.Fprintf(os.Stderr, "Error configuring TLS: %v\n", err)
+			return 1
+		}
+	}
+	transport.OnReject = func(remote net.Addr, claimed int, err error) {
+		logger.Warnf("Node %d: rejected connection from %s claiming client %d: %v", *id, remote, claimed, err)
+	}
+	transport.OnLinkState = func(peer int, state LinkState, err error) {
+		if err != nil {
+			logger.Warnf("Node %d: link to node %d %s: %v", *id, peer, state, err)
+		} else {
+			logger.Infof("Node %d: link to node %d %s", *id, peer, state)
+		}
+		if registry != nil {
+			registry.Update(peer, state, err)
+		}
+	}
+	var netem *NetEm
+	fileSystem := NewDistributedFileSystem(codec, transport)
+	if *latency > 0 || *jitter > 0 || *loss > 0 || *adminAddr != "" {
+		netem = NewNetEm(transport, LinkConditions{Latency: *latency, Jitter: *jitter, Loss: *loss})
+		fileSystem.Transport = netem
+	}
+	if *retransmit {
+		reliable := NewReliableTransport(fileSystem.Transport)
+		reliable.OnPeerDown = fileSystem.peerDown
+		fileSystem.Transport = reliable
+	}
+	fileSystem.ReplyTimeout = *replyTimeout
+	fileSystem.NoMutex = *noMutex
+	fileSystem.SharedReads = *sharedReads
+	fileSystem.HoldLimit = *holdLimit
+	if *fanout > 1 {
+		fileSystem.FanOut = NewFanOut(*fanout)
+		defer fileSystem.FanOut.Close()
+	}
+	if err := fileSystem.SetAlgorithm(*algo); err != nil {
+		fmt.Fprintf(os.Stderr, "Error selecting algorithm: %v\n", err)
+		return 2
+	}
+	if *tree != "" {
+		if err := fileSystem.SetTree(*tree); err != nil {
+			fmt.Fprintf(os.Stderr, "Error setting tree: %v\n", err)
+			return 2
+		}
+	}
+	if fileSystem.TieBreak, err = ParseTieBreak(*tieBreak, len(addrs)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error selecting tie-break: %v\n", err)
+		return 2
+	}
+	if *proxies != "" {
+		if fileSystem.Proxies, err = ParseProxies(*proxies); err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing --proxies: %v\n", err)
+			return 2
+		}
+	}
+	if *localQueue != "" {
+		discipline, err := ParseQueueDiscipline(*localQueue)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error selecting local queue: %v\n", err)
+			return 2
+		}
+		fileSystem.LocalQueue = NewLocalQueue(discipline)
+	}
+	if *readCache {
+		fileSystem.Cache = NewReadCache()
+	}
+	if fileSystem.Quotas, err = newQuotas(*fileQuota, *clientQuota); err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing quotas: %v\n", err)
+		return 2
+	}
+	if fileSystem.Storage, err = ParseStorage(*storageSpec); err != nil {
+		fmt.Fprintf(os.Stderr, "Error selecting storage: %v\n", err)
+		return 2
+	}
+	for _, name := range splitList(*eventual) {
+		fileSystem.SetConsistency(name, Eventual)
+	}
+
+	if *eventsPath != "" {
+		fileSystem.Events, err = CreateEventLog(*eventsPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating event log: %v\n", err)
+			return 1
+		}
+		defer fileSystem.Events.Close()
+	}
+	if *observerAddr != "" {
+		stream, err := DialEventStream(*observerAddr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error connecting to observer: %v\n", err)
+			return 1
+		}
+		defer stream.Close()
+		fileSystem.Observers = append(fileSystem.Observers, stream)
+	}
+	if *etcdEndpoint != "" {
+		bridge, err := NewEtcdBridge(*etcdEndpoint, *etcdPrefix, *etcdTTL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error connecting to etcd: %v\n", err)
+			return 1
+		}
+		defer bridge.Close()
+		fileSystem.Observers = append(fileSystem.Observers, bridge)
+	}
+	if *reportPath != "" {
+		fileSystem.Report = NewOperationReport()
+	}
+	fileSystem.Hierarchical = *hierarchical
+	fileSystem.Coalesce = *coalesce
+	fileSystem.PeerWindow = *peerWindow
+	fileSystem.BusyRetryAfter = *busyRetryAfter
+	fileSystem.Optimistic = *optimistic
+	fileSystem.Operations = NewOperationLog(*opHistory)
+	if *opSpill != "" {
+		if err := fileSystem.Operations.SpillTo(*opSpill); err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening operation spill file: %v\n", err)
+			return 1
+		}
+		defer fileSystem.Operations.Close()
+	}
+	if *deferredPath != "" {
+		fileSystem.DeferredJournal = NewDeferredJournal(*deferredPath)
+	}
+	if *historyPath != "" {
+		fileSystem.History, err = OpenHistory(*historyPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening history: %v\n", err)
+			return 1
+		}
+		defer fileSystem.History.Close()
+	}
+	logFile, err := os.OpenFile("file_access.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening log file: %v\n", err)
+		return 1
+	}
+	defer logFile.Close()
+	fileSystem.LogFile = logFile
+	defer fileSystem.Transport.Close()
+	if *watchFiles > 0 {
+		stop := fileSystem.StartFileWatcher(*watchFiles)
+		defer stop()
+	}
+
+	if *adminAddr != "" {
+		admin, err := StartAdmin(*adminAddr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error starting admin endpoint: %v\n", err)
+			return 1
+		}
+		defer admin.Close()
+		netem.RegisterAdmin(admin)
+		fileSystem.RegisterAdmin(admin)
+		fileSystem.RegisterDashboard(admin)
+		fileSystem.Metrics.RegisterAdmin(admin)
+		logger.Infof("Node %d admin endpoint listening on %s", *id, admin.Addr())
+	}
+
+	// Number messages from the start time, so that after a restart peers
+	// still holding the previous run's sequence numbers in their duplicate
+	// windows do not drop this run's requests.
+	fileSystem.Sequences[*id] = uint64(time.Now().UnixMilli())
+	fileSystem.Join(*id)
+	if participant, ok := fileSystem.Proxies[*id]; ok {
+		logger.Infof("Node %d is a lightweight client of participant %d", *id, participant)
+	} else {
+		if _, err := fileSystem.ReplayDeferred(*id); err != nil {
+			logger.Errorf("Error replaying deferred replies: %v", err)
+		}
+		if err := fileSystem.SyncCatalog(*id); err != nil {
+			logger.Errorf("Error syncing the file catalog: %v", err)
+		}
+	}
+	logger.Infof("Node %d listening on %s", *id, transport.Addr())
+	if *secret == "" && *linkSecrets == "" {
+		logger.Warnf("Node %d: no cluster or link secrets, so peers' ids are not authenticated", *id)
+	}
+	runClientWorkload(fileSystem, *id, workload, nil)
+	fmt.Println(nodeDoneMarker)
+
+	<-stop
+	fmt.Println("Message summary:")
+	WriteMessageSummary(os.Stdout, fileSystem.MessageSummary())
+	if fileSystem.LocalQueue != nil {
+		fmt.Printf("Local queue (%s):\n", fileSystem.LocalQueue.Discipline.Name())
+		WriteLocalQueueStats(os.Stdout, fileSystem.LocalQueue)
+	}
+	if *reportPath != "" {
+		if err := fileSystem.Report.Write(*reportPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing report: %v\n", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func envString(name, fallback string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return fallback
+}
+
+func envInt(name string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+func envFloat(name string, fallback float64) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(name), 64); err == nil {
+		return v
+	}
+	return fallback
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(name)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+// runLaunchCommand starts a local cluster of node processes, runs the
+// workload on all of them and merges their event logs into one timeline.
+func runLaunchCommand(args []string) int {
+	flags := flag.NewFlagSet("launch", flag.ExitOnError)
+	numNodes := flags.Int("nodes", 3, "number of node processes to start")
+	basePort := flags.Int("base-port", 7001, "node i listens on 127.0.0.1:base-port+i-1")
+	sockets := flags.Bool("sockets", false, "connect the nodes over Unix domain sockets in --dir instead of TCP")
+	dir := flags.String("dir", "launch", "directory for the per-node logs and the merged timeline")
+	codecName := flags.String("codec", "json", "wire codec for protocol messages (json or gob)")
+	workloadPath := flags.String("workload", "", "JSON workload description (defaults to a short scripted run)")
+	timeout := flags.Duration("timeout", time.Minute, "stop the cluster if the workload has not finished by then")
+	noMutex := flags.Bool("no-mutex", false, "run the nodes without mutual exclusion to show the violations it prevents")
+	algo := flags.String("algo", "ricart-agarwala", "mutual exclusion algorithm the nodes run: "+strings.Join(algorithmNames(), ", "))
+	sharedReads := flags.Bool("shared-reads", false, "let reads of a file run together, excluding only writers")
+	tree := flags.String("tree", "", "with --algo raymond, the tree as child=parent pairs (default: a balanced binary tree)")
+	tieBreak := flags.String("tie-break", "lowest-id", "order of requests with equal timestamps the nodes use: lowest-id, round-robin[:N], random[:seed] or weighted:id=weight,...")
+	observe := flags.Bool("observe", false, "run an observer beside the nodes and print its view of the cluster at the end")
+	participants := flags.Int("participants", 0, "run only the first N nodes as protocol participants and the rest as lightweight clients proxied through them (0: every node participates)")
+	flags.Parse(args)
+
+	if *numNodes < 1 {
+		fmt.Fprintln(os.Stderr, "Error: --nodes must be at least 1")
+		return 2
+	}
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating %s: %v\n", *dir, err)
+		return 1
+	}
+	self, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error locating executable: %v\n", err)
+		return 1
+	}
+
+	socketDir, err := filepath.Abs(*dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error locating %s: %v\n", *dir, err)
+		return 1
+	}
+	peers := make([]string, *numNodes)
+	addrs := make([]string, *numNodes)
+	for i := range peers {
+		addrs[i] = fmt.Sprintf("127.0.0.1:%d", *basePort+i)
+		if *sockets {
+			addrs[i] = filepath.Join(socketDir, fmt.Sprintf("node-%d.sock", i+1))
+		}
+		peers[i] = fmt.Sprintf("%d=%s", i+1, addrs[i])
+	}
+	peerList := strings.Join(peers, ",")
+	// The nodes authenticate each other with the secrets of their links,
+	// derived from a fresh key and passed in the environment rather than on
+	// their command lines.
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		fmt.Fprintf(os.Stderr, "Error generating cluster secret: %v\n", err)
+		return 1
+	}
+	ids := make([]int, *numNodes)
+	for i := range ids {
+		ids[i] = i + 1
+	}
+
+	var observer *Observer
+	var observerAddr string
+	if *observe {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error starting observer: %v\n", err)
+			return 1
+		}
+		defer listener.Close()
+		observer = NewObserver()
+		go observer.Serve(listener)
+		observerAddr = listener.Addr().String()
+	}
+
+	var (
+		cmds    []*exec.Cmd
+		readers sync.WaitGroup
+		done    = make(chan int, *numNodes)
+	)
+	eventPaths := make([]string, *numNodes)
+	for i := 1; i <= *numNodes; i++ {
+		eventPaths[i-1] = filepath.Join(*dir, fmt.Sprintf("node-%d.events.jsonl", i))
+		nodeArgs := []string{"node",
+			"--id", strconv.Itoa(i),
+			"--peers", peerList,
+			"--codec", *codecName,
+			"--algo", *algo,
+			"--tie-break", *tieBreak,
+			"--events", eventPaths[i-1],
+		}
+		if *workloadPath != "" {
+			nodeArgs = append(nodeArgs, "--workload", *workloadPath)
+		}
+		if *noMutex {
+			nodeArgs = append(nodeArgs, "--no-mutex")
+		}
+		if *tree != "" {
+			nodeArgs = append(nodeArgs, "--tree", *tree)
+		}
+		if *sharedReads {
+			nodeArgs = append(nodeArgs, "--shared-reads")
+		}
+		if *participants > 0 && *participants < *numNodes {
+			nodeArgs = append(nodeArgs, "--proxies", FormatProxies(SpreadClients(*numNodes, *participants)))
+		}
+		if observer != nil {
+			nodeArgs = append(nodeArgs, "--observer", observerAddr)
+		}
+
+		logFile, err := os.Create(filepath.Join(*dir, fmt.Sprintf("node-%d.log", i)))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating node log: %v\n", err)
+			stopNodes(cmds, &readers)
+			return 1
+		}
+		defer logFile.Close()
+
+		cmd := exec.Command(self, nodeArgs...)
+		cmd.Env = append(os.Environ(), "RA_LINK_SECRETS="+FormatLinkSecrets(secret, i, ids))
+		cmd.Stderr = logFile
+		stdout, err := cmd.StdoutPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error starting node %d: %v\n", i, err)
+			stopNodes(cmds, &readers)
+			return 1
+		}
+		cmds = append(cmds, cmd)
+		fmt.Printf("Started node %d (pid %d) on %s\n", i, cmd.Process.Pid, addrs[i-1])
+
+		readers.Add(1)
+		go func(id int, stdout io.Reader, log io.Writer) {
+			defer readers.Done()
+			scanner := bufio.NewScanner(stdout)
+			for scanner.Scan() {
+				fmt.Fprintln(log, scanner.Text())
+				if scanner.Text() == nodeDoneMarker {
+					done <- id
+				}
+			}
+		}(i, stdout, logFile)
+	}
+
+	deadline := time.After(*timeout)
+	for finished := 0; finished < *numNodes; {
+		select {
+		case id := <-done:
+			finished++
+			fmt.Printf("Node %d finished its workload\n", id)
+		case <-deadline:
+			fmt.Fprintf(os.Stderr, "Error: workload did not finish within %s\n", *timeout)
+			stopNodes(cmds, &readers)
+			return 1
+		}
+	}
+	stopNodes(cmds, &readers)
+
+	var logs [][]Event
+	for _, path := range eventPaths {
+		events, err := ReadEvents(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", path, err)
+			return 1
+		}
+		logs = append(logs, events)
+	}
+	timeline := MergeEvents(logs...)
+
+	timelinePath := filepath.Join(*dir, "timeline.txt")
+	out, err := os.Create(timelinePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating timeline: %v\n", err)
+		return 1
+	}
+	defer out.Close()
+	if err := WriteTimeline(out, timeline); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing timeline: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Merged %d events from %d nodes into %s\n", len(timeline), *numNodes, timelinePath)
+	fmt.Printf("Safety check: %d mutual-exclusion violations\n", timelineViolations(timeline))
+	if observer != nil {
+		fmt.Println("Observer view:")
+		WriteView(os.Stdout, observer.View())
+	}
+	return 0
+}
+
+// stopNodes signals every node process to exit and waits for it, after
+// draining its output.
+func stopNodes(cmds []*exec.Cmd, readers *sync.WaitGroup) {
+	for _, cmd := range cmds {
+		terminate(cmd.Process)
+	}
+	readers.Wait()
+	for _, cmd := range cmds {
+		cmd.Wait()
+	}
+}
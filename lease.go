@@ -0,0 +1,152 @@
+package ra
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// renewLease pushes the request's lease expiry to d from now.
+func (r *Request) renewLease(d time.Duration) {
+	r.leaseMutex.Lock()
+	defer r.leaseMutex.Unlock()
+	r.leaseExpires = time.Now().Add(d)
+}
+
+// overdue reports how far past its lease the request is, or 0.
+func (r *Request) overdue(now time.Time) time.Duration {
+	r.leaseMutex.Lock()
+	defer r.leaseMutex.Unlock()
+	if r.leaseExpires.IsZero() || now.Before(r.leaseExpires) {
+		return 0
+	}
+	return now.Sub(r.leaseExpires)
+}
+
+// revoke takes the critical section away from the request for reason.
+func (r *Request) revoke(reason string) {
+	r.leaseMutex.Lock()
+	defer r.leaseMutex.Unlock()
+	r.revoked = reason
+}
+
+// Revoked reports whether the request's critical section was taken away
+// because it outlived its lease or its hold limit.
+func (r *Request) Revoked() bool {
+	r.leaseMutex.Lock()
+	defer r.leaseMutex.Unlock()
+	return r.revoked != ""
+}
+
+func (r *Request) revocation() string {
+	r.leaseMutex.Lock()
+	defer r.leaseMutex.Unlock()
+	return r.revoked
+}
+
+// RenewLease extends the lease of a held request by fs.Lease. It returns
+// ErrNotHoldingCS if the lease has already been revoked.
+func (fs *DistributedFileSystem) RenewLease(request *Request) error {
+	if request.Revoked() {
+		return fmt.Errorf("client %d renewing %s: %w", request.ClientID, request.Resource, ErrNotHoldingCS)
+	}
+	request.renewLease(fs.Lease)
+	return nil
+}
+
+// Resynchronize lifts the fence placed on clientID after a lease violation
+// so its operations are accepted again.
+func (fs *DistributedFileSystem) Resynchronize(clientID int) {
+	fs.FencedMutex.Lock()
+	defer fs.FencedMutex.Unlock()
+
+	if fs.Fenced[clientID] {
+		delete(fs.Fenced, clientID)
+		fs.Log.Infof("Client %d resynchronized", clientID)
+	}
+}
+
+func (fs *DistributedFileSystem) isFenced(clientID int) bool {
+	fs.FencedMutex.Lock()
+	defer fs.FencedMutex.Unlock()
+	return fs.Fenced[clientID]
+}
+
+func (fs *DistributedFileSystem) fence(clientID int) {
+	fs.FencedMutex.Lock()
+	defer fs.FencedMutex.Unlock()
+	fs.Fenced[clientID] = true
+}
+
+// StartLeaseMonitor checks every holder against fs.Lease. A holder past its
+// lease is logged as a violation once; with fs.LeaseBreak set its critical
+// section is revoked so the waiting peers can proceed, and the holder is
+// fenced until it calls Resynchronize. A write the holder was already
+// storing when it was revoked is stopped by its fencing token once the
+// next holder has written: it cannot land over the newer content. Tokens
+// are counted per process, so node processes sharing a disk do not fence
+// each other's writes. The returned function stops the monitor.
+func (fs *DistributedFileSystem) StartLeaseMonitor() func() {
+	done := make(chan struct{})
+	reported := make(map[*Request]bool)
+
+	go func() {
+		ticker := time.NewTicker(fs.Lease / 4)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				stillHeld := make(map[*Request]bool)
+				for _, node := range fs.nodes() {
+					_, views := node.View()
+					for _, view := range views {
+						if view.State != Held || view.Lingering {
+							continue
+						}
+						holder := view.Request
+						stillHeld[holder] = reported[holder]
+						if reported[holder] {
+							continue
+						}
+						if overdue := holder.overdue(now); overdue > 0 {
+							stillHeld[holder] = true
+							fs.leaseViolation(holder, view.Deferred, overdue)
+						}
+					}
+				}
+				reported = stillHeld
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// leaseViolation reports a holder that outlived its lease, listing the
+// peers it is keeping waiting, and revokes its critical section if
+// fs.LeaseBreak is set.
+func (fs *DistributedFileSystem) leaseViolation(holder *Request, waiting []*Request, overdue time.Duration) {
+	entry := fmt.Sprintf("LEASE VIOLATION: client %d has held %s %s past its lease (ts %d)\n",
+		holder.ClientID, holder.Resource, overdue.Round(time.Millisecond), holder.Timestamp)
+	for _, waiter := range waiting {
+		entry += fmt.Sprintf("  client %d waiting since %s\n", waiter.ClientID, waiter.Requested.Format("15:04:05.000"))
+	}
+
+	if fs.LeaseBreak {
+		holder.revoke("lease expired")
+		fs.fence(holder.ClientID)
+		if err := fs.ReleaseRequest(holder); err != nil && !errors.Is(err, ErrNotHoldingCS) {
+			fs.Log.Errorf("Error releasing %s: %v", holder.Resource, err)
+		}
+		entry += fmt.Sprintf("  revoked; client %d is fenced until it resynchronizes\n", holder.ClientID)
+	}
+
+	fs.Log.Warnf("%s", strings.TrimSuffix(entry, "\n"))
+	if fs.LogFile != nil {
+		fs.LogFile.WriteString(entry)
+	}
+}
@@ -0,0 +1,90 @@
+package ra
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// A holder revoked while its write is in flight must not overwrite the
+// write of the holder after it.
+func TestLeaseBreakFencesLateWrite(t *testing.T) {
+	fs := NewDistributedFileSystem(JSONCodec{}, NewLocalTransport())
+	fs.Storage = NewMemoryStorage(nil)
+	fs.Storage.Store("notes.txt", []byte("initial"))
+	fs.LeaseBreak = true
+	fs.Join(1)
+	fs.Join(2)
+
+	handle1, err := fs.OpenFile(1, "notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, err := fs.AcquireRequest(1, handle1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Client 1 is past its Revoked check and has staged its write when
+	// its lease is broken.
+	late, err := fs.stage(stale, func(string) string { return "stale" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.leaseViolation(stale, nil, 0)
+
+	handle2, err := fs.OpenFile(2, "notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile(2, handle2, "fresh"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.apply(late, "writing"); !errors.Is(err, ErrFenced) {
+		t.Fatalf("late write: got %v, want %v", err, ErrFenced)
+	}
+	data, _ := fs.Storage.Load("notes.txt")
+	if string(data) != "fresh" {
+		t.Fatalf("stored %q, want %q", data, "fresh")
+	}
+	if content := handle2.File.Snapshot().Content; content != "fresh" {
+		t.Fatalf("content %q, want %q", content, "fresh")
+	}
+	if err := fs.ReleaseRequest(stale); !errors.Is(err, ErrNotHoldingCS) {
+		t.Fatalf("releasing the revoked request: got %v, want %v", err, ErrNotHoldingCS)
+	}
+}
+
+// Revoking a lease releases everything the holder's release would have,
+// including its intention locks on the directories above the path.
+func TestLeaseBreakReleasesIntents(t *testing.T) {
+	fs := NewDistributedFileSystem(JSONCodec{}, NewLocalTransport())
+	fs.Storage = NewMemoryStorage(nil)
+	fs.Hierarchical = true
+	fs.LeaseBreak = true
+	fs.Join(1)
+	fs.Join(2)
+
+	holder, err := fs.AcquireResource(1, "docs/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.leaseViolation(holder, nil, 0)
+
+	acquired := make(chan error, 1)
+	go func() {
+		request, err := fs.AcquireResource(2, "docs/")
+		if err == nil {
+			err = fs.ReleaseRequest(request)
+		}
+		acquired <- err
+	}()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client 1's intention lock on docs/ outlived its revoked lease")
+	}
+}
@@ -0,0 +1,69 @@
+package ra
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Limiter bounds how many critical section requests one node has in
+// flight, from the call to AcquireRequest until the request enters or
+// fails. Callers over the limit wait for a slot; once maxQueued callers are
+// already waiting, further ones are turned away with ErrBackpressure.
+type Limiter struct {
+	mu             sync.Mutex
+	cond           *sync.Cond
+	active         int
+	waiting        int
+	maxOutstanding int
+	// maxQueued < 0 lets any number of callers wait; 0 rejects every
+	// caller over the limit straight away.
+	maxQueued int
+}
+
+func NewLimiter(maxOutstanding, maxQueued int) *Limiter {
+	l := &Limiter{maxOutstanding: maxOutstanding, maxQueued: maxQueued}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire takes a slot, waiting for one if allowed.
+func (l *Limiter) acquire() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active >= l.maxOutstanding {
+		if l.maxQueued >= 0 && l.waiting >= l.maxQueued {
+			return fmt.Errorf("%w: %d requests outstanding, %d queued", ErrBackpressure, l.active, l.waiting)
+		}
+		l.waiting++
+		for l.active >= l.maxOutstanding {
+			l.cond.Wait()
+		}
+		l.waiting--
+	}
+	l.active++
+	return nil
+}
+
+func (l *Limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.cond.Signal()
+}
+
+// limiter returns clientID's limiter, or nil if fs.MaxOutstanding is 0.
+func (fs *DistributedFileSystem) limiter(clientID int) *Limiter {
+	if fs.MaxOutstanding <= 0 {
+		return nil
+	}
+	fs.LimitersMutex.Lock()
+	defer fs.LimitersMutex.Unlock()
+
+	l, ok := fs.Limiters[clientID]
+	if !ok {
+		l = NewLimiter(fs.MaxOutstanding, fs.MaxQueued)
+		fs.Limiters[clientID] = l
+	}
+	return l
+}
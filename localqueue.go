@@ -0,0 +1,302 @@
+package ra
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LocalCaller is one of a node's local clients, e.g. a ClientSession, as
+// seen by a LocalQueue. Callers with the same name share their fair share.
+type LocalCaller struct {
+	Name     string
+	Priority int
+}
+
+// LocalWaiter is a local caller waiting for its turn at a resource.
+type LocalWaiter struct {
+	Caller  LocalCaller
+	Arrived time.Time
+	ready   chan struct{}
+}
+
+// QueueDiscipline picks which of a node's local callers waiting for a
+// resource is served next. Unlike a TieBreak it only orders callers on one
+// node, so nodes may use different ones.
+type QueueDiscipline interface {
+	Name() string
+	// Pick returns the index of the waiter to serve next. waiting is in
+	// arrival order and never empty; used is how long each caller's turns
+	// have lasted so far.
+	Pick(waiting []*LocalWaiter, used map[string]time.Duration) int
+}
+
+// FIFO serves callers in the order they arrived.
+type FIFO struct{}
+
+func (FIFO) Name() string { return "fifo" }
+
+func (FIFO) Pick(waiting []*LocalWaiter, used map[string]time.Duration) int { return 0 }
+
+// Priority serves the caller with the highest priority first, in arrival
+// order among equals. A steady stream of high-priority callers starves the
+// rest.
+type Priority struct{}
+
+func (Priority) Name() string { return "priority" }
+
+func (Priority) Pick(waiting []*LocalWaiter, used map[string]time.Duration) int {
+	best := 0
+	for i, w := range waiting {
+		if w.Caller.Priority > waiting[best].Caller.Priority {
+			best = i
+		}
+	}
+	return best
+}
+
+// FairShare serves the caller that has had the resource for the least time
+// so far, in arrival order among equals, so a caller taking long or many
+// turns yields to the others.
+type FairShare struct{}
+
+func (FairShare) Name() string { return "fair-share" }
+
+func (FairShare) Pick(waiting []*LocalWaiter, used map[string]time.Duration) int {
+	best := 0
+	for i, w := range waiting {
+		if used[w.Caller.Name] < used[waiting[best].Caller.Name] {
+			best = i
+		}
+	}
+	return best
+}
+
+var queueDisciplines = []QueueDiscipline{FIFO{}, Priority{}, FairShare{}}
+
+// ParseQueueDiscipline returns the discipline called name.
+func ParseQueueDiscipline(name string) (QueueDiscipline, error) {
+	var names []string
+	for _, d := range queueDisciplines {
+		if d.Name() == name {
+			return d, nil
+		}
+		names = append(names, d.Name())
+	}
+	return nil, fmt.Errorf("unknown queue discipline %q (want one of %s)", name, strings.Join(names, ", "))
+}
+
+// LocalQueue lines up the local callers of a node that want the same
+// resource and lets them on to the protocol one at a time, in the order
+// its discipline picks. Without one they all wait for the node to leave
+// the resource and whichever wakes first goes next.
+type LocalQueue struct {
+	Discipline QueueDiscipline
+
+	mu      sync.Mutex
+	turns   map[localTurn]*localLine
+	used    map[string]time.Duration
+	callers map[string]*queueStats
+}
+
+// localTurn is a resource at one node.
+type localTurn struct {
+	node     int
+	resource string
+}
+
+// localLine is the callers waiting for one localTurn behind the one whose
+// turn it is.
+type localLine struct {
+	busy    bool
+	waiting []*LocalWaiter
+}
+
+type queueStats struct {
+	served    int
+	totalWait time.Duration
+	maxWait   time.Duration
+}
+
+func NewLocalQueue(discipline QueueDiscipline) *LocalQueue {
+	return &LocalQueue{
+		Discipline: discipline,
+		turns:      make(map[localTurn]*localLine),
+		used:       make(map[string]time.Duration),
+		callers:    make(map[string]*queueStats),
+	}
+}
+
+// wait blocks until it is caller's turn at node's resource, and returns the
+// function that ends the turn once the caller has left the critical
+// section or given up on it. A nil LocalQueue never blocks.
+func (q *LocalQueue) wait(node int, resource string, caller LocalCaller) func() {
+	if q == nil {
+		return func() {}
+	}
+	key := localTurn{node, resource}
+	arrived := time.Now()
+	q.mu.Lock()
+	line, ok := q.turns[key]
+	if !ok {
+		line = &localLine{}
+		q.turns[key] = line
+	}
+	if !line.busy {
+		line.busy = true
+		q.served(caller, 0)
+		q.mu.Unlock()
+	} else {
+		w := &LocalWaiter{Caller: caller, Arrived: arrived, ready: make(chan struct{})}
+		line.waiting = append(line.waiting, w)
+		q.mu.Unlock()
+		<-w.ready
+	}
+
+	started := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() { q.next(key, caller, time.Since(started)) })
+	}
+}
+
+// next ends caller's turn at key, which lasted held, and hands the turn to
+// the waiter the discipline picks.
+func (q *LocalQueue) next(key localTurn, caller LocalCaller, held time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.used[caller.Name] += held
+	line := q.turns[key]
+	if len(line.waiting) == 0 {
+		delete(q.turns, key)
+		return
+	}
+	i := q.Discipline.Pick(line.waiting, q.used)
+	w := line.waiting[i]
+	line.waiting = append(line.waiting[:i], line.waiting[i+1:]...)
+	q.served(w.Caller, time.Since(w.Arrived))
+	close(w.ready)
+}
+
+// served records a caller's turn starting after waiting. The caller holds
+// q.mu.
+func (q *LocalQueue) served(caller LocalCaller, waited time.Duration) {
+	s, ok := q.callers[caller.Name]
+	if !ok {
+		s = &queueStats{}
+		q.callers[caller.Name] = s
+	}
+	s.served++
+	s.totalWait += waited
+	s.maxWait = max(s.maxWait, waited)
+}
+
+// LocalQueueStats is how long one caller waited in a LocalQueue.
+type LocalQueueStats struct {
+	Caller   string   `json:"caller"`
+	Served   int      `json:"served"`
+	MeanWait Duration `json:"mean_wait"`
+	MaxWait  Duration `json:"max_wait"`
+	// Used is how long the caller's turns have lasted in total.
+	Used Duration `json:"used"`
+}
+
+// Stats returns each caller's queueing delay, sorted by caller name.
+func (q *LocalQueue) Stats() []LocalQueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := make([]LocalQueueStats, 0, len(q.callers))
+	for name, s := range q.callers {
+		stats = append(stats, LocalQueueStats{
+			Caller:   name,
+			Served:   s.served,
+			MeanWait: Duration(s.totalWait / time.Duration(s.served)),
+			MaxWait:  Duration(s.maxWait),
+			Used:     Duration(q.used[name]),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Caller < stats[j].Caller })
+	return stats
+}
+
+// WriteLocalQueueStats writes q's stats as a table.
+func WriteLocalQueueStats(w io.Writer, q *LocalQueue) {
+	fmt.Fprintf(w, "%-16s %7s %12s %12s %12s\n", "Caller", "Served", "Mean wait", "Max wait", "Turns held")
+	for _, s := range q.Stats() {
+		fmt.Fprintf(w, "%-16s %7d %12s %12s %12s\n", s.Caller, s.Served,
+			time.Duration(s.MeanWait).Round(time.Microsecond), time.Duration(s.MaxWait).Round(time.Microsecond),
+			time.Duration(s.Used).Round(time.Microsecond))
+	}
+}
+
+// runLocalQueue is the local-queue scenario: on client 1's node an
+// interactive caller with priority 1 and two batch callers, one of them
+// holding the file three times as long, share file1.txt while the other
+// clients contend for it too. It uses FIFO unless -local-queue picked
+// another discipline.
+func runLocalQueue(fs *DistributedFileSystem, n int, diagram *os.File) error {
+	const fileName = "file1.txt"
+	if err := fs.ensureFiles([]string{fileName}); err != nil {
+		return err
+	}
+	if fs.LocalQueue == nil {
+		fs.LocalQueue = NewLocalQueue(FIFO{})
+	}
+	callers := []struct {
+		caller LocalCaller
+		hold   time.Duration
+	}{
+		{LocalCaller{Name: "interactive", Priority: 1}, 2 * time.Millisecond},
+		{LocalCaller{Name: "batch-short"}, 2 * time.Millisecond},
+		{LocalCaller{Name: "batch-long"}, 6 * time.Millisecond},
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(callers)+n)
+	for _, c := range callers {
+		wg.Add(1)
+		go func(caller LocalCaller, hold time.Duration) {
+			defer wg.Done()
+			for op := 0; op < 8; op++ {
+				start := time.Now()
+				request, err := fs.AcquireAs(1, fileName, caller)
+				if err != nil {
+					errs <- err
+					return
+				}
+				time.Sleep(hold)
+				fs.ReleaseRequest(request)
+				printSpaceTimeDiagram(1, start, time.Now(), diagram)
+			}
+		}(c.caller, c.hold)
+	}
+	for id := 2; id <= n; id++ {
+		wg.Add(1)
+		go func(clientID int) {
+			defer wg.Done()
+			for op := 0; op < 4; op++ {
+				start := time.Now()
+				request, err := fs.AcquireResource(clientID, fileName)
+				if err != nil {
+					errs <- err
+					return
+				}
+				time.Sleep(2 * time.Millisecond)
+				fs.ReleaseRequest(request)
+				printSpaceTimeDiagram(clientID, start, time.Now(), diagram)
+				time.Sleep(5 * time.Millisecond)
+			}
+		}(id)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+	narrate("Three local callers on client 1 shared %s under %s queueing; their waits are in the local queue stats.", fileName, fs.LocalQueue.Discipline.Name())
+	return nil
+}
@@ -0,0 +1,152 @@
+package ra
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// ParseLevel returns the level called name: debug, info, warn or error.
+func ParseLevel(name string) (Level, error) {
+	for l := LevelDebug; l <= LevelError; l++ {
+		if strings.EqualFold(name, l.String()) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", name)
+}
+
+// Logger receives the package's log messages. Protocol traces, such as
+// every message sent and every file operation, are logged at debug level;
+// lifecycle events at info; rejected or suspicious input at warn; and
+// failures at error. Implementations must be safe for concurrent use.
+type Logger interface {
+	Debugf(format string, args ...any)
+	Infof(format string, args ...any)
+	Warnf(format string, args ...any)
+	Errorf(format string, args ...any)
+}
+
+// DefaultLogger is used by file systems created after it is set, and by
+// components whose own logger is nil. It writes info and above to stdout.
+var DefaultLogger Logger = NewTextLogger(os.Stdout, LevelInfo)
+
+// loggerOr returns l, or DefaultLogger if l is nil.
+func loggerOr(l Logger) Logger {
+	if l == nil {
+		return DefaultLogger
+	}
+	return l
+}
+
+// TextLogger writes each message at or above its level as one plain line.
+type TextLogger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+}
+
+func NewTextLogger(w io.Writer, level Level) *TextLogger {
+	return &TextLogger{w: w, level: level}
+}
+
+func (l *TextLogger) Debugf(format string, args ...any) { l.logf(LevelDebug, format, args...) }
+func (l *TextLogger) Infof(format string, args ...any)  { l.logf(LevelInfo, format, args...) }
+func (l *TextLogger) Warnf(format string, args ...any)  { l.logf(LevelWarn, format, args...) }
+func (l *TextLogger) Errorf(format string, args ...any) { l.logf(LevelError, format, args...) }
+
+func (l *TextLogger) logf(level Level, format string, args ...any) {
+	if level < l.level {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(l.w, format+"\n", args...)
+}
+
+// SlogLogger adapts a *slog.Logger, so messages go to any slog handler:
+// JSON, a log collector, or zap through its slog handler (zapslog).
+type SlogLogger struct {
+	Logger *slog.Logger
+}
+
+func NewSlogLogger(logger *slog.Logger) *SlogLogger {
+	return &SlogLogger{Logger: logger}
+}
+
+func (l *SlogLogger) Debugf(format string, args ...any) { l.logf(slog.LevelDebug, format, args...) }
+func (l *SlogLogger) Infof(format string, args ...any)  { l.logf(slog.LevelInfo, format, args...) }
+func (l *SlogLogger) Warnf(format string, args ...any)  { l.logf(slog.LevelWarn, format, args...) }
+func (l *SlogLogger) Errorf(format string, args ...any) { l.logf(slog.LevelError, format, args...) }
+
+func (l *SlogLogger) logf(level slog.Level, format string, args ...any) {
+	ctx := context.Background()
+	if !l.Logger.Enabled(ctx, level) {
+		return
+	}
+	l.Logger.Log(ctx, level, fmt.Sprintf(format, args...))
+}
+
+// quietLogs discards log messages until the returned function is called,
+// or with verbose logs every protocol message, for commands that print
+// their own report.
+func quietLogs(verbose bool) (restore func()) {
+	saved := DefaultLogger
+	if verbose {
+		DefaultLogger = NewTextLogger(os.Stdout, LevelDebug)
+	} else {
+		DefaultLogger = NewTextLogger(io.Discard, LevelError)
+	}
+	return func() { DefaultLogger = saved }
+}
+
+// newLogger returns the logger the -log-level and -log-format flags select.
+func newLogger(level, format string) (Logger, error) {
+	l, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case "text":
+		return NewTextLogger(os.Stdout, l), nil
+	case "json":
+		handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slogLevels[l]})
+		return NewSlogLogger(slog.New(handler)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q (want text or json)", format)
+}
+
+var slogLevels = map[Level]slog.Level{
+	LevelDebug: slog.LevelDebug,
+	LevelInfo:  slog.LevelInfo,
+	LevelWarn:  slog.LevelWarn,
+	LevelError: slog.LevelError,
+}
@@ -0,0 +1,219 @@
+package ra
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Consistency selects how a file's reads and writes are coordinated.
+type Consistency int
+
+const (
+	// Strong runs every read and write inside the Ricart-Agarwala critical
+	// section. It is the default.
+	Strong Consistency = iota
+	// Eventual never blocks: each node reads and writes its own replica
+	// and broadcasts writes as UPDATE messages, which replicas merge by
+	// last-writer-wins on (timestamp, node id). Replicas agree once every
+	// update has been delivered, but in the meantime a read can return an
+	// old value and concurrent writes silently lose to the later tag.
+	Eventual
+)
+
+func (c Consistency) String() string {
+	switch c {
+	case Strong:
+		return "strong"
+	case Eventual:
+		return "eventual"
+	}
+	return fmt.Sprintf("Consistency(%d)", int(c))
+}
+
+// Versioned is a replica's content tagged with the write that produced it.
+type Versioned struct {
+	Content   string
+	Timestamp int
+	Node      int
+}
+
+// newer reports whether v wins over o under last-writer-wins.
+func (v Versioned) newer(o Versioned) bool {
+	if v.Timestamp != o.Timestamp {
+		return v.Timestamp > o.Timestamp
+	}
+	return v.Node > o.Node
+}
+
+// LWWStore holds every node's replica of each eventually consistent file.
+type LWWStore struct {
+	mu       sync.Mutex
+	replicas map[int]map[string]Versioned
+}
+
+func NewLWWStore() *LWWStore {
+	return &LWWStore{replicas: make(map[int]map[string]Versioned)}
+}
+
+// apply merges v into node's replica of name and reports whether it won.
+func (s *LWWStore) apply(node int, name string, v Versioned) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.replicas[node] == nil {
+		s.replicas[node] = make(map[string]Versioned)
+	}
+	current, ok := s.replicas[node][name]
+	if ok && !v.newer(current) {
+		return false
+	}
+	s.replicas[node][name] = v
+	return true
+}
+
+// get returns node's replica of name, seeding it with initial (tagged as
+// never written) on first use.
+func (s *LWWStore) get(node int, name string, initial string) Versioned {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.replicas[node] == nil {
+		s.replicas[node] = make(map[string]Versioned)
+	}
+	v, ok := s.replicas[node][name]
+	if !ok {
+		v = Versioned{Content: initial}
+		s.replicas[node][name] = v
+	}
+	return v
+}
+
+// SetConsistency selects the consistency mode of fileName.
+func (fs *DistributedFileSystem) SetConsistency(fileName string, c Consistency) {
+	fs.ConsistencyMutex.Lock()
+	defer fs.ConsistencyMutex.Unlock()
+	fs.Consistency[fileName] = c
+}
+
+func (fs *DistributedFileSystem) consistency(fileName string) Consistency {
+	fs.ConsistencyMutex.Lock()
+	defer fs.ConsistencyMutex.Unlock()
+	return fs.Consistency[fileName]
+}
+
+// readEventual returns clientID's replica of file without entering any
+// critical section.
+func (fs *DistributedFileSystem) readEventual(clientID int, file *File) string {
+	v := fs.Replicas.get(clientID, file.Name, file.Snapshot().Content)
+	fs.Log.Debugf("Client %d read file %s (eventual, ts %d by client %d): %s", clientID, file.Name, v.Timestamp, v.Node, v.Content)
+	fs.LogRequest(clientID, "Read", file.Name, v.Timestamp)
+	return v.Content
+}
+
+// replicaContent returns clientID's replica of file.
+func (fs *DistributedFileSystem) replicaContent(clientID int, file *File) string {
+	return fs.Replicas.get(clientID, file.Name, file.Snapshot().Content).Content
+}
+
+// writeEventual writes clientID's replica of file and sends the write to
+// every peer as an UPDATE.
+func (fs *DistributedFileSystem) writeEventual(clientID int, file *File, content string) error {
+	node := fs.Node(clientID)
+	if node == nil {
+		return fmt.Errorf("client %d writing %s: %w", clientID, file.Name, ErrUnknownPeer)
+	}
+	v := Versioned{Content: content, Timestamp: node.tick(), Node: clientID}
+	fs.Replicas.apply(clientID, file.Name, v)
+	fs.Log.Debugf("Client %d wrote to file %s (eventual, ts %d): %s", clientID, file.Name, v.Timestamp, content)
+	fs.LogRequest(clientID, "Write", file.Name, v.Timestamp)
+
+	fs.FanOut.Run(fs.peersExcept(clientID), func(peer int) {
+		err := fs.send(&Message{
+			Type:      MsgUpdate,
+			From:      clientID,
+			To:        peer,
+			Resource:  file.Name,
+			Timestamp: v.Timestamp,
+			Content:   content,
+		})
+		if err != nil {
+			fs.Log.Errorf("Error sending update from client %d: %v", clientID, err)
+		}
+	})
+	return nil
+}
+
+// ReceiveUpdate merges a peer's write into msg.To's replica.
+func (fs *DistributedFileSystem) ReceiveUpdate(msg *Message) {
+	v := Versioned{Content: msg.Content, Timestamp: msg.Timestamp, Node: msg.From}
+	if !fs.Replicas.apply(msg.To, msg.Resource, v) {
+		fs.Log.Debugf("Client %d kept its %s over client %d's older write (ts %d)", msg.To, msg.Resource, msg.From, msg.Timestamp)
+	}
+}
+
+// ReplicaStates returns every node's replica of fileName, by node id.
+func (fs *DistributedFileSystem) ReplicaStates(fileName string) map[int]Versioned {
+	fs.Replicas.mu.Lock()
+	defer fs.Replicas.mu.Unlock()
+
+	states := make(map[int]Versioned)
+	for node, files := range fs.Replicas.replicas {
+		if v, ok := files[fileName]; ok {
+			states[node] = v
+		}
+	}
+	return states
+}
+
+// printConvergence reports whether the replicas of each eventually
+// consistent file agree, giving updates still in flight up to settle to
+// arrive.
+func (fs *DistributedFileSystem) printConvergence(settle time.Duration) {
+	fs.ConsistencyMutex.Lock()
+	var names []string
+	for name, c := range fs.Consistency {
+		if c == Eventual {
+			names = append(names, name)
+		}
+	}
+	fs.ConsistencyMutex.Unlock()
+	sort.Strings(names)
+
+	deadline := time.Now().Add(settle)
+	for _, name := range names {
+		states := fs.ReplicaStates(name)
+		for !converged(states) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			states = fs.ReplicaStates(name)
+		}
+		ids := make([]int, 0, len(states))
+		for id := range states {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+
+		for _, id := range ids {
+			v := states[id]
+			fmt.Printf("  %s at client %d: ts %d by client %d: %s\n", name, id, v.Timestamp, v.Node, v.Content)
+		}
+		if converged(states) {
+			fmt.Printf("Replicas of %s converged\n", name)
+		} else {
+			fmt.Printf("Replicas of %s diverged\n", name)
+		}
+	}
+}
+
+func converged(states map[int]Versioned) bool {
+	var first *Versioned
+	for _, v := range states {
+		if first == nil {
+			first = &v
+		} else if v != *first {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package ra
+
+import (
+	"fmt"
+	"time"
+)
+
+type MessageType int
+
+const (
+	MsgRequest MessageType = iota + 1
+	MsgReply
+	MsgMarker
+	MsgInvalidate
+	MsgUpdate
+	MsgRelease
+	MsgToken
+	MsgCancel
+	MsgCatalog
+	MsgCatalogSync
+	MsgWound
+	MsgBusy
+	MsgProxyRequest
+	MsgProxyGrant
+	MsgProxyRefuse
+	MsgProxyRelease
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case MsgRequest:
+		return "REQUEST"
+	case MsgReply:
+		return "REPLY"
+	case MsgMarker:
+		return "MARKER"
+	case MsgInvalidate:
+		return "INVALIDATE"
+	case MsgUpdate:
+		return "UPDATE"
+	case MsgRelease:
+		return "RELEASE"
+	case MsgToken:
+		return "TOKEN"
+	case MsgCancel:
+		return "CANCEL"
+	case MsgCatalog:
+		return "CATALOG"
+	case MsgCatalogSync:
+		return "CATALOG_SYNC"
+	case MsgWound:
+		return "WOUND"
+	case MsgBusy:
+		return "BUSY"
+	case MsgProxyRequest:
+		return "PROXY_REQUEST"
+	case MsgProxyGrant:
+		return "PROXY_GRANT"
+	case MsgProxyRefuse:
+		return "PROXY_REFUSE"
+	case MsgProxyRelease:
+		return "PROXY_RELEASE"
+	}
+	return fmt.Sprintf("MessageType(%d)", int(t))
+}
+
+// Message is the unit exchanged between clients on the wire.
+type Message struct {
+	Type      MessageType
+	From      int
+	To        int
+	Seq       uint64
+	Resource  string
+	Timestamp int
+
+	// TraceID and SpanID carry the sender's trace context so the receiver's
+	// spans join the same trace.
+	TraceID string `json:",omitempty"`
+	SpanID  string `json:",omitempty"`
+
+	// SnapshotID is set on MARKER messages.
+	SnapshotID uint64 `json:",omitempty"`
+
+	// Content is the written data carried by UPDATE messages, and the
+	// error carried by PROXY_REFUSE.
+	Content string `json:",omitempty"`
+
+	// Session is the group a REQUEST belongs to; see AcquireSession.
+	Session string `json:",omitempty"`
+
+	// Files lists the file names announced by CATALOG and CATALOG_SYNC.
+	Files []string `json:",omitempty"`
+
+	// RetryAfter is how long the receiver of a BUSY should wait before
+	// sending its REQUEST again.
+	RetryAfter time.Duration `json:",omitempty"`
+}
@@ -0,0 +1,133 @@
+package ra
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metrics is a set of named counters, exported in the Prometheus text
+// format. Names may carry labels, e.g. `ra_messages_sent_total{node="1",type="REPLY"}`.
+// A nil Metrics counts nothing.
+type Metrics struct {
+	mu       sync.Mutex
+	counters map[string]uint64
+	// names caches the labelled names of per-message counters.
+	names map[messageCounterKey]string
+}
+
+type messageCounterKey struct {
+	counter string
+	node    int
+	msgType MessageType
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		counters: make(map[string]uint64),
+		names:    make(map[messageCounterKey]string),
+	}
+}
+
+func (m *Metrics) Add(name string, delta uint64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[name] += delta
+}
+
+// addMessage counts a message of type t at node in counter, labelled like
+// counter{node="1",type="REPLY"}. The name is formatted once per label set
+// rather than for every message.
+func (m *Metrics) addMessage(counter string, node int, t MessageType) {
+	m.addLabelled(messageCounterKey{counter, node, t})
+}
+
+// addNode counts one at node in counter, labelled like counter{node="1"},
+// caching the name like addMessage.
+func (m *Metrics) addNode(counter string, node int) {
+	m.addLabelled(messageCounterKey{counter: counter, node: node})
+}
+
+func (m *Metrics) addLabelled(key messageCounterKey) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name, ok := m.names[key]
+	if !ok {
+		if key.msgType == 0 {
+			name = fmt.Sprintf("%s{node=\"%d\"}", key.counter, key.node)
+		} else {
+			name = fmt.Sprintf("%s{node=\"%d\",type=%q}", key.counter, key.node, key.msgType)
+		}
+		m.names[key] = name
+	}
+	m.counters[name]++
+}
+
+// Get returns the current value of a counter.
+func (m *Metrics) Get(name string) uint64 {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[name]
+}
+
+// Total returns the sum of every counter whose name starts with prefix, so
+// Total("ra_messages_sent_total") counts messages of all types.
+func (m *Metrics) Total(prefix string) uint64 {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var total uint64
+	for name, v := range m.counters {
+		if strings.HasPrefix(name, prefix) {
+			total += v
+		}
+	}
+	return total
+}
+
+// WriteTo writes every counter, sorted by name, one per line.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	names := make([]string, 0, len(m.counters))
+	for name := range m.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := make([]uint64, len(names))
+	for i, name := range names {
+		values[i] = m.counters[name]
+	}
+	m.mu.Unlock()
+
+	var total int64
+	for i, name := range names {
+		n, err := fmt.Fprintf(w, "%s %d\n", name, values[i])
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// RegisterAdmin adds GET /metrics to admin.
+func (m *Metrics) RegisterAdmin(admin *Admin) {
+	admin.Handle("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.WriteTo(w)
+	})
+}
@@ -0,0 +1,93 @@
+package ra
+
+import (
+	"errors"
+	"hash/fnv"
+	"sort"
+)
+
+// MultiRequest is a set of critical sections held together by one client.
+type MultiRequest struct {
+	ClientID int
+	// Requests are in acquisition order.
+	Requests []*Request
+}
+
+// Request returns the held request for resource, or nil.
+func (m *MultiRequest) Request(resource string) *Request {
+	for _, r := range m.Requests {
+		if r.Resource == resource {
+			return r
+		}
+	}
+	return nil
+}
+
+func resourceHash(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return h.Sum64()
+}
+
+// canonicalOrder returns the distinct resources sorted by name hash, with
+// the name itself breaking hash collisions. Every client acquiring in this
+// one global order is what rules out a distributed deadlock between two
+// clients that ask for the same resources in opposite orders.
+func canonicalOrder(resources []string) []string {
+	seen := make(map[string]bool, len(resources))
+	ordered := make([]string, 0, len(resources))
+	for _, r := range resources {
+		if !seen[r] {
+			seen[r] = true
+			ordered = append(ordered, r)
+		}
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		hi, hj := resourceHash(ordered[i]), resourceHash(ordered[j])
+		if hi != hj {
+			return hi < hj
+		}
+		return ordered[i] < ordered[j]
+	})
+	return ordered
+}
+
+// RequestCSMulti enters the critical sections of all resources for
+// clientID, acquiring them one at a time in canonical order. Resources that
+// are open files can then be read and written through the returned
+// requests. If any acquisition fails the ones already held are released
+// and the error is returned.
+func (fs *DistributedFileSystem) RequestCSMulti(clientID int, resources ...string) (*MultiRequest, error) {
+	multi := &MultiRequest{ClientID: clientID}
+	for _, resource := range canonicalOrder(resources) {
+		request, err := fs.acquire(clientID, resource, "", fs.openedFile(resource))
+		if err != nil {
+			if releaseErr := fs.ReleaseCSMulti(multi); releaseErr != nil {
+				err = errors.Join(err, releaseErr)
+			}
+			return nil, err
+		}
+		multi.Requests = append(multi.Requests, request)
+	}
+	return multi, nil
+}
+
+// ReleaseCSMulti releases every critical section in multi, in reverse
+// acquisition order.
+func (fs *DistributedFileSystem) ReleaseCSMulti(multi *MultiRequest) error {
+	var errs []error
+	for i := len(multi.Requests) - 1; i >= 0; i-- {
+		if err := fs.ReleaseRequest(multi.Requests[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	multi.Requests = nil
+	return errors.Join(errs...)
+}
+
+// openedFile returns the open file called name, or nil.
+func (fs *DistributedFileSystem) openedFile(name string) *File {
+	fs.FilesMutex.Lock()
+	defer fs.FilesMutex.Unlock()
+	return fs.Files[name]
+}
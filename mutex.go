@@ -0,0 +1,60 @@
+package ra
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Mutex is a named resource guarded by the same Ricart-Agarwala protocol as
+// files, for applications that need mutual exclusion over something other
+// than a file, e.g. fs.NewMutex("inventory-counter"). Mutexes with the same
+// name share one queue, and names share a namespace with file names.
+type Mutex struct {
+	fs   *DistributedFileSystem
+	name string
+
+	mu   sync.Mutex
+	held map[int]*Request
+}
+
+func (fs *DistributedFileSystem) NewMutex(name string) *Mutex {
+	return &Mutex{fs: fs, name: name, held: make(map[int]*Request)}
+}
+
+func (m *Mutex) Name() string { return m.name }
+
+// Lock blocks until clientID holds the resource.
+func (m *Mutex) Lock(clientID int) error {
+	request, err := m.fs.AcquireResource(clientID, m.name)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.held[clientID] = request
+	m.mu.Unlock()
+	return nil
+}
+
+// Unlock releases the resource held by clientID. It returns ErrNotHoldingCS
+// if clientID does not hold it.
+func (m *Mutex) Unlock(clientID int) error {
+	m.mu.Lock()
+	request, ok := m.held[clientID]
+	delete(m.held, clientID)
+	m.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("client %d unlocking %s: %w", clientID, m.name, ErrNotHoldingCS)
+	}
+	return m.fs.ReleaseRequest(request)
+}
+
+// Do runs fn while clientID holds the resource.
+func (m *Mutex) Do(clientID int, fn func()) error {
+	if err := m.Lock(clientID); err != nil {
+		return err
+	}
+	fn()
+	return m.Unlock(clientID)
+}
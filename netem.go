@@ -0,0 +1,409 @@
+package ra
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LinkConditions are the emulated network conditions on one link. Each
+// frame is delayed by Latency plus a uniform random extra of up to Jitter,
+// or dropped altogether with probability Loss.
+type LinkConditions struct {
+	Latency time.Duration
+	Jitter  time.Duration
+	Loss    float64
+}
+
+type linkKey [2]int
+
+type delayedFrame struct {
+	at   time.Time
+	data []byte
+}
+
+// emLink is one direction of one link: a FIFO of frames waiting out their
+// delay, or the partition, drained by one goroutine.
+type emLink struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []delayedFrame
+	last   time.Time
+	closed bool
+	// steps counts the frames at the head of queue that Step has let
+	// through while the network is paused. It is guarded by NetEm.mu.
+	steps int
+}
+
+// NetEm wraps a Transport and emulates latency, jitter and partitions on
+// the links between clients. Frames on a link are still delivered in
+// order: jitter never lets a frame overtake an earlier one. While two
+// clients are partitioned the frames between them are held back, not
+// dropped, and delivered once the partition heals, like a TCP connection
+// that stalls and then recovers. Only Loss drops frames; put a
+// ReliableTransport above the NetEm to recover from it.
+//
+// Only frames sent through this NetEm are affected. When every client runs
+// in its own process, a partition has to be set on each side of it.
+type NetEm struct {
+	Transport
+	// Log receives delivery errors and partition changes; nil is
+	// DefaultLogger.
+	Log Logger
+	// Describe, if set, turns a frame into a line for Step and Pending,
+	// e.g. by decoding it.
+	Describe func(data []byte) string
+
+	mu        sync.Mutex
+	defaults  LinkConditions
+	overrides map[linkKey]LinkConditions
+	// groups maps each client to its side of the partition; nil when the
+	// network is whole. changed is closed and replaced when it changes.
+	groups  map[int]int
+	changed chan struct{}
+	links   map[linkKey]*emLink
+	rng     *rand.Rand
+	closing chan struct{}
+	// speed divides every delay; paused holds back all frames but those
+	// let through by Step. See simcontrol.go.
+	speed  float64
+	paused bool
+}
+
+func NewNetEm(inner Transport, defaults LinkConditions) *NetEm {
+	return &NetEm{
+		Transport: inner,
+		defaults:  defaults,
+		overrides: make(map[linkKey]LinkConditions),
+		changed:   make(chan struct{}),
+		links:     make(map[linkKey]*emLink),
+		rng:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		closing:   make(chan struct{}),
+		speed:     1,
+	}
+}
+
+func (n *NetEm) Send(from, to int, data []byte) error {
+	if from == to {
+		return n.Transport.Send(from, to, data)
+	}
+
+	n.mu.Lock()
+	select {
+	case <-n.closing:
+		n.mu.Unlock()
+		return net.ErrClosed
+	default:
+	}
+	key := linkKey{from, to}
+	conditions, ok := n.overrides[key]
+	if !ok {
+		conditions = n.defaults
+	}
+	if conditions.Loss > 0 && n.rng.Float64() < conditions.Loss {
+		n.mu.Unlock()
+		return nil
+	}
+	delay := conditions.Latency
+	if conditions.Jitter > 0 {
+		delay += time.Duration(n.rng.Int63n(int64(conditions.Jitter)))
+	}
+	delay = time.Duration(float64(delay) / n.speed)
+	link, ok := n.links[key]
+	if !ok {
+		link = &emLink{}
+		link.cond = sync.NewCond(&link.mu)
+		n.links[key] = link
+		go n.deliver(from, to, link)
+	}
+	n.mu.Unlock()
+
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	at := time.Now().Add(delay)
+	if at.Before(link.last) {
+		at = link.last
+	}
+	link.last = at
+	link.queue = append(link.queue, delayedFrame{at: at, data: data})
+	link.cond.Signal()
+	return nil
+}
+
+// deliver forwards the frames queued on the from->to link to the wrapped
+// transport once their delay has passed and the link is not partitioned.
+func (n *NetEm) deliver(from, to int, link *emLink) {
+	for {
+		link.mu.Lock()
+		for len(link.queue) == 0 && !link.closed {
+			link.cond.Wait()
+		}
+		if link.closed {
+			link.mu.Unlock()
+			return
+		}
+		frame := link.queue[0]
+		link.mu.Unlock()
+
+		if wait := time.Until(frame.at); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-n.closing:
+				return
+			}
+		}
+		for {
+			ok, changed := n.deliverable(from, to, link)
+			if ok {
+				break
+			}
+			select {
+			case <-changed:
+			case <-n.closing:
+				return
+			}
+		}
+
+		link.mu.Lock()
+		link.queue[0] = delayedFrame{}
+		link.queue = link.queue[1:]
+		link.mu.Unlock()
+
+		if err := n.Transport.Send(from, to, frame.data); err != nil {
+			loggerOr(n.Log).Errorf("Error delivering frame from client %d to client %d: %v", from, to, err)
+		}
+	}
+}
+
+// connected reports whether from and to are on the same side of the
+// partition, and returns a channel closed when the partition next changes.
+func (n *NetEm) connected(from, to int) (bool, <-chan struct{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.connectedLocked(from, to), n.changed
+}
+
+func (n *NetEm) connectedLocked(from, to int) bool {
+	return n.groups == nil || n.groups[from] == n.groups[to]
+}
+
+// deliverable reports whether the frame at the head of the from->to link
+// may be delivered now: the link is not partitioned, and the network is
+// running or Step let the frame through, which this uses up. It also
+// returns a channel closed when that may next change.
+func (n *NetEm) deliverable(from, to int, link *emLink) (bool, <-chan struct{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.connectedLocked(from, to) {
+		return false, n.changed
+	}
+	if n.paused {
+		if link.steps == 0 {
+			return false, n.changed
+		}
+		link.steps--
+	}
+	return true, n.changed
+}
+
+// LinkUp reports whether the from->to link is outside any partition and,
+// if the wrapped transport tracks its links, connected.
+func (n *NetEm) LinkUp(from, to int) bool {
+	if ok, _ := n.connected(from, to); !ok {
+		return false
+	}
+	return linkUp(n.Transport, from, to)
+}
+
+// SetLink overrides the conditions on the from->to link.
+func (n *NetEm) SetLink(from, to int, conditions LinkConditions) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.overrides[linkKey{from, to}] = conditions
+}
+
+// SetDefaults changes the conditions of every link without an override.
+func (n *NetEm) SetDefaults(conditions LinkConditions) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.defaults = conditions
+}
+
+// Partition splits the clients into groups that can only talk among
+// themselves. Clients not named in any group form one more group together.
+func (n *NetEm) Partition(groups ...[]int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.groups = make(map[int]int)
+	for i, group := range groups {
+		for _, id := range group {
+			n.groups[id] = i + 1
+		}
+	}
+	n.changedLocked()
+}
+
+// Heal removes the partition and releases every frame it held back.
+func (n *NetEm) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.groups = nil
+	n.changedLocked()
+}
+
+func (n *NetEm) changedLocked() {
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+func (n *NetEm) Close() {
+	n.mu.Lock()
+	close(n.closing)
+	for _, link := range n.links {
+		link.mu.Lock()
+		link.closed = true
+		link.cond.Signal()
+		link.mu.Unlock()
+	}
+	n.mu.Unlock()
+	n.Transport.Close()
+}
+
+// LinkStatus describes one link in the /links admin response.
+type LinkStatus struct {
+	From    int      `json:"from"`
+	To      int      `json:"to"`
+	Latency Duration `json:"latency"`
+	Jitter  Duration `json:"jitter"`
+	Loss    float64  `json:"loss,omitempty"`
+	// Queued counts frames sent but not yet delivered.
+	Queued      int  `json:"queued"`
+	Partitioned bool `json:"partitioned"`
+}
+
+// Links returns the status of every link that has carried a frame.
+func (n *NetEm) Links() []LinkStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var links []LinkStatus
+	for key, link := range n.links {
+		conditions, ok := n.overrides[key]
+		if !ok {
+			conditions = n.defaults
+		}
+		link.mu.Lock()
+		queued := len(link.queue)
+		link.mu.Unlock()
+		links = append(links, LinkStatus{
+			From:        key[0],
+			To:          key[1],
+			Latency:     Duration(conditions.Latency),
+			Jitter:      Duration(conditions.Jitter),
+			Loss:        conditions.Loss,
+			Queued:      queued,
+			Partitioned: n.groups != nil && n.groups[key[0]] != n.groups[key[1]],
+		})
+	}
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].From != links[j].From {
+			return links[i].From < links[j].From
+		}
+		return links[i].To < links[j].To
+	})
+	return links
+}
+
+// RegisterAdmin adds the network emulation routes to admin:
+//
+//	GET  /links                                  link conditions and queued frames
+//	POST /partition?group=1,2&group=3            split the network
+//	POST /heal                                   remove the partition
+//	POST /latency?latency=50ms&jitter=10ms       change every link
+//	POST /latency?loss=0.1                       drop one frame in ten
+//	POST /latency?from=1&to=2&latency=200ms      change one link
+//
+// and the simulation controls of registerSimulation.
+func (n *NetEm) RegisterAdmin(admin *Admin) {
+	n.registerSimulation(admin)
+	admin.Handle("GET /links", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, n.Links())
+	})
+	admin.Handle("POST /partition", func(w http.ResponseWriter, r *http.Request) {
+		var groups [][]int
+		for _, spec := range r.URL.Query()["group"] {
+			group, err := parseIDs(spec)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			groups = append(groups, group)
+		}
+		if len(groups) == 0 {
+			http.Error(w, "need at least one group=id,id,...", http.StatusBadRequest)
+			return
+		}
+		n.Partition(groups...)
+		loggerOr(n.Log).Infof("Network partitioned: %v", groups)
+		writeJSON(w, n.Links())
+	})
+	admin.Handle("POST /heal", func(w http.ResponseWriter, r *http.Request) {
+		n.Heal()
+		loggerOr(n.Log).Infof("Network partition healed")
+		writeJSON(w, n.Links())
+	})
+	admin.Handle("POST /latency", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var conditions LinkConditions
+		var err error
+		if v := q.Get("latency"); v != "" {
+			if conditions.Latency, err = time.ParseDuration(v); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("jitter"); v != "" {
+			if conditions.Jitter, err = time.ParseDuration(v); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("loss"); v != "" {
+			if conditions.Loss, err = strconv.ParseFloat(v, 64); err != nil || conditions.Loss < 0 || conditions.Loss > 1 {
+				http.Error(w, "loss must be a probability between 0 and 1", http.StatusBadRequest)
+				return
+			}
+		}
+		if q.Get("from") == "" && q.Get("to") == "" {
+			n.SetDefaults(conditions)
+		} else {
+			from, errFrom := strconv.Atoi(q.Get("from"))
+			to, errTo := strconv.Atoi(q.Get("to"))
+			if errFrom != nil || errTo != nil {
+				http.Error(w, "from and to must both be client ids", http.StatusBadRequest)
+				return
+			}
+			n.SetLink(from, to, conditions)
+		}
+		writeJSON(w, n.Links())
+	})
+}
+
+// parseIDs parses a comma-separated list of client ids.
+func parseIDs(list string) ([]int, error) {
+	var ids []int
+	for _, field := range strings.Split(list, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("bad client id %q", field)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,370 @@
+package ra
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CSState is a node's participation in one resource's critical section.
+type CSState int
+
+const (
+	Released CSState = iota
+	Wanted
+	Held
+)
+
+func (s CSState) String() string {
+	switch s {
+	case Released:
+		return "RELEASED"
+	case Wanted:
+		return "WANTED"
+	case Held:
+		return "HELD"
+	}
+	return fmt.Sprintf("CSState(%d)", int(s))
+}
+
+// MarshalText encodes the state by name, as in Stats.
+func (s CSState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+type resourceState struct {
+	state    CSState
+	request  *Request
+	deferred *RequestQueue
+	// since is when the node started wanting the resource, or entered it
+	// once HELD.
+	since time.Time
+	// lingering is set while a HELD resource is kept for the client's next
+	// operation after its caller released it (see coalesce.go). Its exit
+	// hooks have run already.
+	lingering bool
+}
+
+// Node is one client's side of the Ricart-Agarwala protocol: its Lamport
+// clock and, per resource, a RELEASED/WANTED/HELD state machine plus the
+// queue of peer requests it is deferring. Every protocol decision is made
+// by a state transition on a Node:
+//
+//	RELEASED --want--> WANTED --enter--> HELD --release--> RELEASED
+//	                   WANTED --release (withdraw)-------> RELEASED
+//
+// An incoming REQUEST is answered at once unless the node holds the
+// resource, or wants it with a smaller (timestamp, id); then it is deferred
+// until the node leaves the critical section.
+//
+// Each transition is recorded in the node's event log and applied from it;
+// see nodelog.go.
+type Node struct {
+	ID int
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	clock     int
+	resources map[string]*resourceState
+	onEnter   []CSHook
+	onExit    []CSHook
+	// tieBreak orders requests with equal timestamps; nil is lowest id.
+	tieBreak TieBreak
+	stats    nodeStats
+	// created is when the node started, for telling which peers it has
+	// heard from since.
+	created time.Time
+	// events is the log since base, the state as of an earlier event;
+	// index numbers the last event.
+	events []NodeEvent
+	base   NodeState
+	index  uint64
+}
+
+// CSHook is called with the resource and request timestamp of a critical
+// section the node enters or leaves.
+type CSHook func(resource string, timestamp int)
+
+func NewNode(id int) *Node {
+	n := &Node{ID: id, resources: make(map[string]*resourceState), created: time.Now()}
+	n.cond = sync.NewCond(&n.mu)
+	return n
+}
+
+func (n *Node) resource(name string) *resourceState {
+	rs, ok := n.resources[name]
+	if !ok {
+		rs = &resourceState{deferred: NewRequestQueue(n.tieBreak)}
+		n.resources[name] = rs
+	}
+	return rs
+}
+
+// OnEnterCS registers fn to run every time the node enters a critical
+// section, right after it moves to HELD. Hooks run in registration order on
+// the entering goroutine, so a slow hook delays the critical section.
+func (n *Node) OnEnterCS(fn CSHook) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.onEnter = append(n.onEnter, fn)
+}
+
+// OnExitCS registers fn to run every time the node leaves a critical
+// section, after it moves back to RELEASED and before any deferred peer is
+// replied to. It is not called for requests withdrawn before entering.
+func (n *Node) OnExitCS(fn CSHook) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.onExit = append(n.onExit, fn)
+}
+
+// State returns the node's state for resource.
+func (n *Node) State(resource string) CSState {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if rs, ok := n.resources[resource]; ok {
+		return rs.state
+	}
+	return Released
+}
+
+// Clock returns the node's Lamport clock.
+func (n *Node) Clock() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.clock
+}
+
+// observe advances the clock past a timestamp seen on an incoming message.
+func (n *Node) observe(timestamp int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if timestamp > n.clock {
+		n.record(NodeEvent{Kind: NodeClockObserved, Timestamp: timestamp})
+	}
+}
+
+// tick advances the clock for a local event and returns the new value.
+func (n *Node) tick() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.record(NodeEvent{Kind: NodeClockTicked})
+	return n.clock
+}
+
+// want moves resource from RELEASED to WANTED and returns the request built
+// for it. If another local caller is already using the resource it waits
+// for that to finish first, so a node never has two requests outstanding
+// for the same resource.
+func (n *Node) want(resource string, build func(timestamp int) *Request) *Request {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for {
+		rs, ok := n.resources[resource]
+		if !ok || rs.state == Released {
+			break
+		}
+		n.cond.Wait()
+	}
+	request := build(n.clock + 1)
+	n.record(NodeEvent{
+		Kind:      NodeRequestWanted,
+		Time:      request.Requested,
+		Resource:  resource,
+		Timestamp: request.Timestamp,
+		Seq:       request.Seq,
+		Session:   request.Session,
+		request:   request,
+	})
+	return request
+}
+
+// enter moves request's resource from WANTED to HELD. It reports false if
+// request is no longer the one the node wants.
+func (n *Node) enter(request *Request) bool {
+	n.mu.Lock()
+	rs, ok := n.resources[request.Resource]
+	if !ok || rs.state != Wanted || rs.request != request {
+		n.mu.Unlock()
+		return false
+	}
+	n.record(NodeEvent{Kind: NodeCSEntered, Resource: request.Resource, Timestamp: request.Timestamp, Seq: request.Seq})
+	hooks := n.onEnter
+	n.mu.Unlock()
+
+	for _, fn := range hooks {
+		fn(request.Resource, request.Timestamp)
+	}
+	return true
+}
+
+// release moves request's resource back to RELEASED, from either HELD or
+// WANTED (a withdrawn request), and returns the deferred peer requests that
+// must now be replied to. held reports whether request was in the critical
+// section.
+func (n *Node) release(request *Request) (deferred []*Request, held bool) {
+	n.mu.Lock()
+	rs, ok := n.resources[request.Resource]
+	if !ok || rs.request != request {
+		n.mu.Unlock()
+		return nil, false
+	}
+	held = rs.state == Held
+	n.record(NodeEvent{Kind: NodeCSReleased, Resource: request.Resource, Timestamp: request.Timestamp, Seq: request.Seq})
+	// rs is no longer part of the node's state; its queue is ours.
+	for d := rs.deferred.Pop(); d != nil; d = rs.deferred.Pop() {
+		deferred = append(deferred, d)
+	}
+	n.cond.Broadcast()
+	hooks := n.onExit
+	n.mu.Unlock()
+
+	if held && !rs.lingering {
+		for _, fn := range hooks {
+			fn(request.Resource, request.Timestamp)
+		}
+	}
+	return deferred, held
+}
+
+// linger keeps request's resource HELD after its caller released it,
+// running the exit hooks as release would. It reports false, changing
+// nothing, unless the node holds the resource with request and no peer
+// request is deferred there.
+func (n *Node) linger(request *Request) bool {
+	n.mu.Lock()
+	rs, ok := n.resources[request.Resource]
+	if !ok || rs.state != Held || rs.request != request || rs.deferred.Len() != 0 || rs.lingering {
+		n.mu.Unlock()
+		return false
+	}
+	rs.lingering = true
+	hooks := n.onExit
+	n.mu.Unlock()
+
+	for _, fn := range hooks {
+		fn(request.Resource, request.Timestamp)
+	}
+	return true
+}
+
+// reenter hands a lingering request's resource to the client's next
+// operation, running the enter hooks as enter would. It reports false if
+// request is not lingering, or a peer request has been deferred since.
+func (n *Node) reenter(request *Request) bool {
+	n.mu.Lock()
+	rs, ok := n.resources[request.Resource]
+	if !ok || rs.state != Held || rs.request != request || rs.deferred.Len() != 0 || !rs.lingering {
+		n.mu.Unlock()
+		return false
+	}
+	rs.lingering = false
+	hooks := n.onEnter
+	n.mu.Unlock()
+
+	for _, fn := range hooks {
+		fn(request.Resource, request.Timestamp)
+	}
+	return true
+}
+
+// onRequest applies a peer's REQUEST and reports whether it should be
+// replied to now. Otherwise it has been deferred, unless busy reports that
+// the node is already deferring window requests from the peer (0 is no
+// limit) and turned it away.
+func (n *Node) onRequest(request *Request, window int) (replyNow, busy bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	deferred := false
+	if rs, ok := n.resources[request.Resource]; ok && !(rs.state != Released && sameSession(rs.request, request)) {
+		switch rs.state {
+		case Held:
+			deferred = true
+		case Wanted:
+			deferred = requestLess(n.tieBreak, rs.request, request)
+		}
+	}
+	if deferred && window > 0 && n.deferredFrom(request.ClientID) >= window {
+		deferred, busy = false, true
+	}
+	n.record(NodeEvent{
+		Kind:      NodeRequestReceived,
+		Time:      request.Requested,
+		Resource:  request.Resource,
+		Peer:      request.ClientID,
+		Timestamp: request.Timestamp,
+		Seq:       request.Seq,
+		Session:   request.Session,
+		Deferred:  deferred,
+		request:   request,
+	})
+	return !deferred && !busy, busy
+}
+
+// wanting returns the request the node is waiting to enter resource with,
+// or nil if it is not waiting.
+func (n *Node) wanting(resource string) *Request {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	rs, ok := n.resources[resource]
+	if !ok || rs.state != Wanted {
+		return nil
+	}
+	return rs.request
+}
+
+// onCancel drops the peer request from, seq deferred for resource and
+// reports whether it was deferred.
+func (n *Node) onCancel(resource string, from int, seq uint64) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	rs, ok := n.resources[resource]
+	if !ok || rs.deferred.Find(from, seq) == nil {
+		return false
+	}
+	n.record(NodeEvent{Kind: NodeRequestCancelled, Resource: resource, Peer: from, Seq: seq})
+	return true
+}
+
+// sameSession reports whether a and b are in the same non-empty session and
+// so may hold their resource together.
+func sameSession(a, b *Request) bool {
+	return a.Session != "" && a.Session == b.Session
+}
+
+// ResourceView is a copy of a node's state for one resource.
+type ResourceView struct {
+	Resource string
+	State    CSState
+	Request  *Request
+	Deferred []*Request
+	// Lingering is set for a HELD resource kept for the client's next
+	// operation, which no caller is in.
+	Lingering bool
+}
+
+// View returns the node's clock and the state of every resource it is not
+// idle on, sorted by resource name, read atomically.
+func (n *Node) View() (int, []ResourceView) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var views []ResourceView
+	for name, rs := range n.resources {
+		if rs.state == Released && rs.deferred.Len() == 0 {
+			continue
+		}
+		views = append(views, ResourceView{
+			Resource:  name,
+			State:     rs.state,
+			Request:   rs.request,
+			Deferred:  rs.deferred.Items(),
+			Lingering: rs.lingering,
+		})
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].Resource < views[j].Resource })
+	return n.clock, views
+}
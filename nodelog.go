@@ -0,0 +1,295 @@
+package ra
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// A Node's state is derived from its event log. Every transition (a clock
+// tick, a REQUEST deferred, a critical section entered) is appended to the
+// log as a NodeEvent and applied by apply, the only code that changes the
+// state. The state a Node keeps is a cache of folding its log, so the log
+// can be replayed elsewhere (FoldNode), checked against the live state
+// (Verify) and shown as it happened (GET /node-log).
+
+// NodeEventKind names a state change of a Node.
+type NodeEventKind string
+
+const (
+	// NodeClockObserved advances the clock to a Timestamp seen on an
+	// incoming message, if it is ahead.
+	NodeClockObserved NodeEventKind = "ClockObserved"
+	// NodeClockTicked advances the clock for a local event.
+	NodeClockTicked NodeEventKind = "ClockTicked"
+	// NodeRequestWanted moves Resource to WANTED with a new local request
+	// stamped Timestamp, the clock's next value.
+	NodeRequestWanted NodeEventKind = "RequestWanted"
+	// NodeCSEntered moves Resource from WANTED to HELD.
+	NodeCSEntered NodeEventKind = "CSEntered"
+	// NodeCSReleased moves Resource back to RELEASED from HELD, or from
+	// WANTED for a withdrawn request, and hands its deferred requests to
+	// be replied to.
+	NodeCSReleased NodeEventKind = "CSReleased"
+	// NodeRequestReceived applies Peer's REQUEST: the clock catches up
+	// with it and, if Deferred, it is queued until Resource is released.
+	NodeRequestReceived NodeEventKind = "RequestReceived"
+	// NodeRequestCancelled drops Peer's deferred request Seq.
+	NodeRequestCancelled NodeEventKind = "RequestCancelled"
+	// NodeMessageSent and NodeMessageReceived count protocol messages.
+	NodeMessageSent     NodeEventKind = "MessageSent"
+	NodeMessageReceived NodeEventKind = "MessageReceived"
+)
+
+// NodeEvent is one state change of a Node, numbered from 1 by Index.
+type NodeEvent struct {
+	Index     uint64        `json:"index"`
+	Time      time.Time     `json:"time"`
+	Kind      NodeEventKind `json:"kind"`
+	Resource  string        `json:"resource,omitempty"`
+	Peer      int           `json:"peer,omitempty"`
+	Timestamp int           `json:"timestamp,omitempty"`
+	Seq       uint64        `json:"seq,omitempty"`
+	Session   string        `json:"session,omitempty"`
+	Deferred  bool          `json:"deferred,omitempty"`
+	// request is the live request a RequestWanted or RequestReceived
+	// event is about. apply keeps it in the state in place of one rebuilt
+	// from the fields above; the log does not hold on to it.
+	request *Request
+}
+
+// DefaultNodeLogSize is how many events a node logs before folding them
+// into its snapshot.
+const DefaultNodeLogSize = 4096
+
+// NodeState is a node's state as of event Index, as plain data: the
+// snapshot its event log is folded from.
+type NodeState struct {
+	Index     uint64         `json:"index"`
+	Clock     int            `json:"clock"`
+	Entries   uint64         `json:"entries"`
+	TotalWait Duration       `json:"total_wait"`
+	Sent      uint64         `json:"sent"`
+	Received  uint64         `json:"received"`
+	Deferred  uint64         `json:"deferred"`
+	Resources []NodeResource `json:"resources,omitempty"`
+}
+
+// NodeResource is a node's state for one resource it is not idle on.
+type NodeResource struct {
+	Resource string          `json:"resource"`
+	State    CSState         `json:"state"`
+	Request  *RequestRecord  `json:"request,omitempty"`
+	Since    time.Time       `json:"since"`
+	Deferred []RequestRecord `json:"deferred,omitempty"`
+}
+
+// RequestRecord identifies a request in a NodeState.
+type RequestRecord struct {
+	Client    int    `json:"client"`
+	Timestamp int    `json:"timestamp"`
+	Seq       uint64 `json:"seq"`
+	Session   string `json:"session,omitempty"`
+}
+
+func requestRecord(r *Request) RequestRecord {
+	return RequestRecord{Client: r.ClientID, Timestamp: r.Timestamp, Seq: r.Seq, Session: r.Session}
+}
+
+// record stamps e, applies it and appends it to the log, folding the log
+// into the snapshot once it is full. The caller holds n.mu.
+func (n *Node) record(e NodeEvent) {
+	n.index++
+	e.Index = n.index
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	n.apply(e)
+	e.request = nil
+	n.events = append(n.events, e)
+	if len(n.events) >= DefaultNodeLogSize {
+		n.base = n.snapshotLocked()
+		n.events = n.events[:0]
+	}
+}
+
+// apply changes the node's state by e. It is the fold function of the log
+// and must depend on nothing but the state and e.
+func (n *Node) apply(e NodeEvent) {
+	switch e.Kind {
+	case NodeClockObserved:
+		if e.Timestamp > n.clock {
+			n.clock = e.Timestamp
+		}
+	case NodeClockTicked:
+		n.clock++
+	case NodeRequestWanted:
+		if e.Timestamp > n.clock {
+			n.clock = e.Timestamp
+		}
+		request := e.request
+		if request == nil {
+			request = &Request{ClientID: n.ID, Resource: e.Resource, Session: e.Session, Timestamp: e.Timestamp, Seq: e.Seq, Requested: e.Time}
+		}
+		rs := n.resource(e.Resource)
+		rs.state = Wanted
+		rs.request = request
+		rs.since = e.Time
+	case NodeCSEntered:
+		rs := n.resources[e.Resource]
+		rs.state = Held
+		n.stats.entries++
+		n.stats.totalWait += e.Time.Sub(rs.since)
+		rs.since = e.Time
+	case NodeCSReleased:
+		// An idle resource is the same as one never used, so drop its
+		// state rather than keep one per resource the node ever touched.
+		// Its deferred requests go with it, to be replied to.
+		delete(n.resources, e.Resource)
+	case NodeRequestReceived:
+		if e.Timestamp > n.clock {
+			n.clock = e.Timestamp
+		}
+		if e.Deferred {
+			request := e.request
+			if request == nil {
+				request = &Request{ClientID: e.Peer, Resource: e.Resource, Session: e.Session, Timestamp: e.Timestamp, Seq: e.Seq, Requested: e.Time}
+			}
+			n.resources[e.Resource].deferred.Push(request)
+			n.stats.deferred++
+		}
+	case NodeRequestCancelled:
+		rs := n.resources[e.Resource]
+		rs.deferred.Remove(rs.deferred.Find(e.Peer, e.Seq))
+	case NodeMessageSent:
+		n.stats.sent++
+	case NodeMessageReceived:
+		n.stats.received++
+	}
+}
+
+// Events returns the snapshot the node's log starts from and the events
+// logged since.
+func (n *Node) Events() (NodeState, []NodeEvent) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	events := make([]NodeEvent, len(n.events))
+	copy(events, n.events)
+	return n.base, events
+}
+
+// Export returns the node's current state as plain data.
+func (n *Node) Export() NodeState {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.snapshotLocked()
+}
+
+func (n *Node) snapshotLocked() NodeState {
+	s := NodeState{
+		Index:     n.index,
+		Clock:     n.clock,
+		Entries:   n.stats.entries,
+		TotalWait: Duration(n.stats.totalWait),
+		Sent:      n.stats.sent,
+		Received:  n.stats.received,
+		Deferred:  n.stats.deferred,
+	}
+	for name, rs := range n.resources {
+		r := NodeResource{Resource: name, State: rs.state, Since: rs.since}
+		if rs.request != nil {
+			record := requestRecord(rs.request)
+			r.Request = &record
+		}
+		for _, d := range rs.deferred.Items() {
+			r.Deferred = append(r.Deferred, requestRecord(d))
+		}
+		s.Resources = append(s.Resources, r)
+	}
+	sort.Slice(s.Resources, func(i, j int) bool { return s.Resources[i].Resource < s.Resources[j].Resource })
+	return s
+}
+
+// FoldNode rebuilds node id from snapshot and the events logged after it,
+// as returned by Node.Events. tieBreak must be the one the node ran with.
+func FoldNode(id int, tieBreak TieBreak, snapshot NodeState, events []NodeEvent) (*Node, error) {
+	n := NewNode(id)
+	n.tieBreak = tieBreak
+	n.index = snapshot.Index
+	n.clock = snapshot.Clock
+	n.stats = nodeStats{
+		entries:   snapshot.Entries,
+		totalWait: time.Duration(snapshot.TotalWait),
+		sent:      snapshot.Sent,
+		received:  snapshot.Received,
+		deferred:  snapshot.Deferred,
+	}
+	for _, r := range snapshot.Resources {
+		rs := n.resource(r.Resource)
+		rs.state = r.State
+		rs.since = r.Since
+		if r.Request != nil {
+			rs.request = &Request{ClientID: r.Request.Client, Resource: r.Resource, Session: r.Request.Session, Timestamp: r.Request.Timestamp, Seq: r.Request.Seq}
+		}
+		for _, d := range r.Deferred {
+			rs.deferred.Push(&Request{ClientID: d.Client, Resource: r.Resource, Session: d.Session, Timestamp: d.Timestamp, Seq: d.Seq})
+		}
+	}
+	n.base = snapshot
+	for _, e := range events {
+		if e.Index != n.index+1 {
+			return nil, fmt.Errorf("node %d: event %d follows %d", id, e.Index, n.index)
+		}
+		if err := n.check(e); err != nil {
+			return nil, fmt.Errorf("node %d: event %d: %w", id, e.Index, err)
+		}
+		n.index = e.Index
+		n.apply(e)
+		n.events = append(n.events, e)
+	}
+	return n, nil
+}
+
+// check reports whether e can be applied to the node's state, as it can to
+// every event the node logged itself.
+func (n *Node) check(e NodeEvent) error {
+	rs, ok := n.resources[e.Resource]
+	switch e.Kind {
+	case NodeRequestWanted:
+		if ok && rs.state != Released {
+			return fmt.Errorf("%s wanted while %s", e.Resource, rs.state)
+		}
+	case NodeCSEntered:
+		if !ok || rs.state != Wanted {
+			return fmt.Errorf("%s entered without being wanted", e.Resource)
+		}
+	case NodeCSReleased, NodeRequestCancelled:
+		if !ok {
+			return fmt.Errorf("%s %s while idle", e.Resource, e.Kind)
+		}
+	case NodeRequestReceived:
+		if e.Deferred && !ok {
+			return fmt.Errorf("request for idle %s deferred", e.Resource)
+		}
+	}
+	return nil
+}
+
+// Verify folds the node's log and reports an error if the result differs
+// from the node's state, which would mean state changed outside apply.
+func (n *Node) Verify() error {
+	n.mu.Lock()
+	base, events := n.base, append([]NodeEvent(nil), n.events...)
+	live := n.snapshotLocked()
+	n.mu.Unlock()
+
+	folded, err := FoldNode(n.ID, n.tieBreak, base, events)
+	if err != nil {
+		return err
+	}
+	if want := folded.Export(); !reflect.DeepEqual(live, want) {
+		return fmt.Errorf("node %d: state differs from its folded event log:\n live   %+v\n folded %+v", n.ID, live, want)
+	}
+	return nil
+}
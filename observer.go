@@ -0,0 +1,365 @@
+package ra
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// observedIntervals is how many past critical sections of each node the
+// observer keeps per resource to check for overlaps. Events from different
+// nodes can reach it out of order, so an overlap is only decided once both
+// critical sections have ended.
+const observedIntervals = 8
+
+// csInterval is one critical section as seen by the observer.
+type csInterval struct {
+	node    int
+	session string
+	enter   time.Time
+	exit    time.Time
+}
+
+func (a csInterval) overlaps(b csInterval) bool {
+	if a.session != "" && a.session == b.session {
+		return false
+	}
+	return a.enter.Before(b.exit) && b.enter.Before(a.exit)
+}
+
+// observedNode is the observer's view of one node.
+type observedNode struct {
+	clock    int
+	events   int
+	lastSeen time.Time
+	// wanted maps a resource to the timestamp of the node's request.
+	wanted   map[string]int
+	held     map[string]csInterval
+	deferred map[string]int
+}
+
+// Observer is a passive member of the cluster: it receives the protocol
+// events of every node but never sends a message or enters a critical
+// section. From them it keeps a live view of each node's clock and each
+// resource's holders, queue and deferred replies, and checks that no two
+// critical sections overlapped.
+type Observer struct {
+	mu         sync.Mutex
+	nodes      map[int]*observedNode
+	past       map[string][]csInterval
+	violations int
+}
+
+func NewObserver() *Observer {
+	return &Observer{nodes: make(map[int]*observedNode), past: make(map[string][]csInterval)}
+}
+
+func (o *Observer) node(id int) *observedNode {
+	n, ok := o.nodes[id]
+	if !ok {
+		n = &observedNode{wanted: make(map[string]int), held: make(map[string]csInterval), deferred: make(map[string]int)}
+		o.nodes[id] = n
+	}
+	return n
+}
+
+// Record applies one event to the view.
+func (o *Observer) Record(e Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	n := o.node(e.Node)
+	n.events++
+	if e.Clock > n.clock {
+		n.clock = e.Clock
+	}
+	if e.Time.After(n.lastSeen) {
+		n.lastSeen = e.Time
+	}
+
+	switch e.Kind {
+	case EventRequestSent:
+		if _, held := n.held[e.Resource]; !held {
+			n.wanted[e.Resource] = e.Timestamp
+		}
+	case EventEnter:
+		delete(n.wanted, e.Resource)
+		n.held[e.Resource] = csInterval{node: e.Node, session: e.Session, enter: e.Time}
+	case EventExit:
+		interval, ok := n.held[e.Resource]
+		if !ok {
+			return
+		}
+		delete(n.held, e.Resource)
+		interval.exit = e.Time
+		o.checkOverlaps(e.Resource, interval)
+	case EventReplyDeferred:
+		n.deferred[e.Resource]++
+	case EventReplySent, EventCancelRecv:
+		if n.deferred[e.Resource] > 0 {
+			n.deferred[e.Resource]--
+		}
+	case EventCancelSent:
+		delete(n.wanted, e.Resource)
+	}
+}
+
+// checkOverlaps compares a critical section that just ended with the
+// recent ones of other nodes on the same resource.
+func (o *Observer) checkOverlaps(resource string, interval csInterval) {
+	past := o.past[resource]
+	for _, other := range past {
+		if other.node != interval.node && interval.overlaps(other) {
+			o.violations++
+			fmt.Printf("Observer: clients %d and %d were in the critical section of %s together\n", other.node, interval.node, resource)
+		}
+	}
+	past = append(past, interval)
+	if len(past) > observedIntervals*len(o.nodes) {
+		past = past[1:]
+	}
+	o.past[resource] = past
+}
+
+// Violations returns how many overlapping critical sections the observer
+// has seen.
+func (o *Observer) Violations() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.violations
+}
+
+// ObservedNode is one node in an ObserverView.
+type ObservedNode struct {
+	ID       int       `json:"id"`
+	Clock    int       `json:"clock"`
+	Events   int       `json:"events"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// ObservedRequest is a request waiting for a resource.
+type ObservedRequest struct {
+	Client    int `json:"client"`
+	Timestamp int `json:"timestamp"`
+}
+
+// ObservedResource is the cluster-wide state of one resource.
+type ObservedResource struct {
+	Resource string            `json:"resource"`
+	Holders  []int             `json:"holders"`
+	Queue    []ObservedRequest `json:"queue"`
+	// Deferred maps each node to the replies it is holding back.
+	Deferred map[int]int `json:"deferred,omitempty"`
+}
+
+// ObserverView is the observer's view of the cluster, as served by
+// /observe.
+type ObserverView struct {
+	Nodes      []ObservedNode     `json:"nodes"`
+	Resources  []ObservedResource `json:"resources"`
+	Violations int                `json:"violations"`
+}
+
+// View returns the current view. Queues are in (timestamp, id) order, the
+// order Ricart-Agarwala grants them in.
+func (o *Observer) View() ObserverView {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	view := ObserverView{Violations: o.violations}
+	resources := make(map[string]*ObservedResource)
+	resource := func(name string) *ObservedResource {
+		r, ok := resources[name]
+		if !ok {
+			r = &ObservedResource{Resource: name, Holders: []int{}, Queue: []ObservedRequest{}, Deferred: make(map[int]int)}
+			resources[name] = r
+		}
+		return r
+	}
+	for id, n := range o.nodes {
+		view.Nodes = append(view.Nodes, ObservedNode{ID: id, Clock: n.clock, Events: n.events, LastSeen: n.lastSeen})
+		for name, ts := range n.wanted {
+			r := resource(name)
+			r.Queue = append(r.Queue, ObservedRequest{Client: id, Timestamp: ts})
+		}
+		for name := range n.held {
+			r := resource(name)
+			r.Holders = append(r.Holders, id)
+		}
+		for name, count := range n.deferred {
+			if count > 0 {
+				resource(name).Deferred[id] = count
+			}
+		}
+	}
+	for name := range o.past {
+		resource(name)
+	}
+
+	sort.Slice(view.Nodes, func(i, j int) bool { return view.Nodes[i].ID < view.Nodes[j].ID })
+	for _, r := range resources {
+		sort.Ints(r.Holders)
+		sort.Slice(r.Queue, func(i, j int) bool {
+			a, b := r.Queue[i], r.Queue[j]
+			if a.Timestamp != b.Timestamp {
+				return a.Timestamp < b.Timestamp
+			}
+			return a.Client < b.Client
+		})
+		view.Resources = append(view.Resources, *r)
+	}
+	sort.Slice(view.Resources, func(i, j int) bool { return view.Resources[i].Resource < view.Resources[j].Resource })
+	return view
+}
+
+// WriteView writes the view as a short human-readable summary.
+func WriteView(w io.Writer, view ObserverView) {
+	for _, n := range view.Nodes {
+		fmt.Fprintf(w, "  node %d: clock %d, %d events\n", n.ID, n.Clock, n.Events)
+	}
+	for _, r := range view.Resources {
+		queue := make([]string, len(r.Queue))
+		for i, q := range r.Queue {
+			queue[i] = fmt.Sprintf("%d@%d", q.Client, q.Timestamp)
+		}
+		fmt.Fprintf(w, "  %s: holders %v, queue [%s]", r.Resource, r.Holders, strings.Join(queue, " "))
+		if len(r.Deferred) > 0 {
+			fmt.Fprintf(w, ", deferred replies %v", r.Deferred)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "  %d mutual-exclusion violations observed\n", view.Violations)
+}
+
+// RegisterAdmin serves the view on admin as GET /observe.
+func (o *Observer) RegisterAdmin(admin *Admin) {
+	admin.Handle("GET /observe", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, o.View())
+	})
+}
+
+// Serve accepts event streams from nodes on listener until it is closed.
+func (o *Observer) Serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go o.serve(conn)
+	}
+}
+
+func (o *Observer) serve(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		o.Record(e)
+	}
+}
+
+// EventStream sends a node's events to a remote observer as JSON lines.
+// Events are dropped once the observer has gone away; a node never blocks
+// on it for long.
+type EventStream struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	enc    *json.Encoder
+	failed bool
+}
+
+// DialEventStream connects to the observer at addr.
+func DialEventStream(addr string) (*EventStream, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &EventStream{conn: conn, enc: json.NewEncoder(conn)}, nil
+}
+
+func (s *EventStream) Record(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed {
+		return
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if err := s.enc.Encode(e); err != nil {
+		s.failed = true
+		fmt.Printf("Error streaming events to observer: %v\n", err)
+	}
+}
+
+func (s *EventStream) Close() error {
+	return s.conn.Close()
+}
+
+// runObserveCommand runs an observer process that nodes started with
+// --observer stream their events to.
+func runObserveCommand(args []string) int {
+	flags := flag.NewFlagSet("observe", flag.ExitOnError)
+	listen := flags.String("listen", envString("RA_OBSERVE_LISTEN", ":7070"), "address to accept node event streams on ($RA_OBSERVE_LISTEN)")
+	adminAddr := flags.String("admin", os.Getenv("RA_ADMIN"), "serve the view as GET /observe on this address ($RA_ADMIN)")
+	interval := flags.Duration("interval", envDuration("RA_OBSERVE_INTERVAL", 5*time.Second), "print the view this often, 0 only on exit ($RA_OBSERVE_INTERVAL)")
+	flags.Parse(args)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error listening for event streams: %v\n", err)
+		return 1
+	}
+	defer listener.Close()
+	observer := NewObserver()
+	go observer.Serve(listener)
+	fmt.Printf("Observer listening on %s\n", listener.Addr())
+
+	if *adminAddr != "" {
+		admin, err := StartAdmin(*adminAddr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error starting admin endpoint: %v\n", err)
+			return 1
+		}
+		defer admin.Close()
+		observer.RegisterAdmin(admin)
+		fmt.Printf("Observer admin endpoint listening on %s\n", admin.Addr())
+	}
+
+	var tick <-chan time.Time
+	if *interval > 0 {
+		ticker := time.NewTicker(*interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+			fmt.Printf("Observed at %s:\n", time.Now().Format("15:04:05"))
+			WriteView(os.Stdout, observer.View())
+		case <-stop:
+			fmt.Println("Final view:")
+			view := observer.View()
+			WriteView(os.Stdout, view)
+			if view.Violations > 0 {
+				return 1
+			}
+			return 0
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package ra
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// DefaultOperationLogSize is how many operations an OperationLog keeps in
+// memory unless told otherwise.
+const DefaultOperationLogSize = 1024
+
+// OperationLog is the history of file operations printed as the deferred
+// array at the end of a run. It keeps the latest operations in a ring
+// buffer of fixed size, so a long-running cluster's memory stays flat.
+// Operations pushed out of the ring are appended to the spill file if
+// there is one, and forgotten otherwise.
+type OperationLog struct {
+	mu    sync.Mutex
+	ring  []string
+	start int
+	count int
+	total int
+	spill *os.File
+	// spillPath outlives spill, which Close clears.
+	spillPath string
+	err       error
+}
+
+// NewOperationLog returns a log keeping the last size operations, or
+// DefaultOperationLogSize if size is not positive. It drops older ones
+// until SpillTo gives it a file for them.
+func NewOperationLog(size int) *OperationLog {
+	if size <= 0 {
+		size = DefaultOperationLogSize
+	}
+	return &OperationLog{ring: make([]string, size)}
+}
+
+// SpillTo appends the operations pushed out of memory to the file at path
+// from now on.
+func (l *OperationLog) SpillTo(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.spill != nil {
+		l.spill.Close()
+	}
+	l.spill = f
+	l.spillPath = path
+	return nil
+}
+
+// Add appends operation, spilling or dropping the oldest one if the ring
+// is full.
+func (l *OperationLog) Add(operation string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total++
+	if l.count < len(l.ring) {
+		l.ring[(l.start+l.count)%len(l.ring)] = operation
+		l.count++
+		return
+	}
+	if l.spill != nil && l.err == nil {
+		_, l.err = fmt.Fprintln(l.spill, l.ring[l.start])
+	}
+	l.ring[l.start] = operation
+	l.start = (l.start + 1) % len(l.ring)
+}
+
+// Recent returns the operations still in memory, oldest first.
+func (l *OperationLog) Recent() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	recent := make([]string, l.count)
+	for i := range recent {
+		recent[i] = l.ring[(l.start+i)%len(l.ring)]
+	}
+	return recent
+}
+
+// Total returns how many operations were ever added, including those no
+// longer in memory.
+func (l *OperationLog) Total() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.total
+}
+
+// SpillPath returns the spill file's name, or "" if older operations are
+// dropped.
+func (l *OperationLog) SpillPath() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.spillPath
+}
+
+// Close closes the spill file, reporting the first error writing it.
+func (l *OperationLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.spill == nil {
+		return nil
+	}
+	err := l.spill.Close()
+	if l.err != nil {
+		err = l.err
+	}
+	l.spill = nil
+	return err
+}
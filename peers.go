@@ -0,0 +1,117 @@
+package ra
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PeerRecord is what the registry remembers about one peer.
+type PeerRecord struct {
+	ID            int        `json:"id"`
+	Addr          string     `json:"addr"`
+	State         string     `json:"state,omitempty"`
+	LastConnected *time.Time `json:"last_connected,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// PeerRegistry persists the peers a node knows about, and the last state of
+// its link to each, in a JSON file. A node restarted without --peers can
+// rejoin the cluster from it.
+type PeerRegistry struct {
+	// Log receives errors saving the registry; nil is DefaultLogger.
+	Log    Logger
+	path   string
+	saveMu sync.Mutex
+	mu     sync.Mutex
+	peers  map[int]*PeerRecord
+}
+
+// LoadPeerRegistry reads the registry at path. A missing file is an empty
+// registry.
+func LoadPeerRegistry(path string) (*PeerRegistry, error) {
+	r := &PeerRegistry{path: path, peers: make(map[int]*PeerRecord)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []*PeerRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("reading peer registry %s: %w", path, err)
+	}
+	for _, record := range records {
+		r.peers[record.ID] = record
+	}
+	return r, nil
+}
+
+// Merge adds addrs to the registry, replacing the address of peers it
+// already knows, and returns every known peer's address.
+func (r *PeerRegistry) Merge(addrs map[int]string) map[int]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, addr := range addrs {
+		if record, ok := r.peers[id]; ok {
+			record.Addr = addr
+		} else {
+			r.peers[id] = &PeerRecord{ID: id, Addr: addr}
+		}
+	}
+	all := make(map[int]string, len(r.peers))
+	for id, record := range r.peers {
+		all[id] = record.Addr
+	}
+	return all
+}
+
+// Update records a change in the state of the link to peer and saves the
+// registry. It is a TCPTransport.OnLinkState callback.
+func (r *PeerRegistry) Update(peer int, state LinkState, err error) {
+	r.mu.Lock()
+	record, ok := r.peers[peer]
+	if !ok {
+		r.mu.Unlock()
+		return
+	}
+	record.State = state.String()
+	record.LastError = ""
+	if err != nil {
+		record.LastError = err.Error()
+	}
+	if state == LinkConnected {
+		now := time.Now()
+		record.LastConnected = &now
+	}
+	r.mu.Unlock()
+
+	if err := r.Save(); err != nil {
+		loggerOr(r.Log).Errorf("Error saving peer registry: %v", err)
+	}
+}
+
+// Save writes the registry, replacing the file atomically.
+func (r *PeerRegistry) Save() error {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+
+	r.mu.Lock()
+	records := make([]*PeerRecord, 0, len(r.peers))
+	for _, record := range r.peers {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	data, err := json.MarshalIndent(records, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(r.path, data, 0644)
+}
@@ -0,0 +1,35 @@
+package ra
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Files are written the same way on every platform: to a temporary file in
+// the target's directory, which is then put in the target's place with
+// replaceFile. Readers see the old content or the new, never a mix.
+// replaceFile and terminate have one implementation for Windows and one
+// for everything else; permissions such as 0644 only set the read-only
+// attribute on Windows, which the file system never relies on.
+
+// writeFileAtomic replaces the file at path with data.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = replaceFile(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
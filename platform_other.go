@@ -0,0 +1,18 @@
+//go:build !windows
+
+package ra
+
+import (
+	"os"
+	"syscall"
+)
+
+// replaceFile renames from over to, which POSIX makes atomic.
+func replaceFile(from, to string) error {
+	return os.Rename(from, to)
+}
+
+// terminate asks process p to shut down cleanly.
+func terminate(p *os.Process) error {
+	return p.Signal(syscall.SIGTERM)
+}
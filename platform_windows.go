@@ -0,0 +1,39 @@
+package ra
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// errorSharingViolation is ERROR_SHARING_VIOLATION, which the syscall
+// package does not name.
+const errorSharingViolation syscall.Errno = 32
+
+// replaceFileAttempts is how many times replaceFile tries the rename.
+const replaceFileAttempts = 10
+
+// replaceFile renames from over to. os.Rename replaces an existing file on
+// Windows too, but fails while another process, such as a node reading
+// the file, a watcher or a virus scanner, has it open without delete
+// sharing. Those opens are short, so the rename is retried for a while.
+func replaceFile(from, to string) error {
+	backoff := time.Millisecond
+	var err error
+	for range replaceFileAttempts {
+		err = os.Rename(from, to)
+		if !errors.Is(err, syscall.ERROR_ACCESS_DENIED) && !errors.Is(err, errorSharingViolation) {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return err
+}
+
+// terminate stops process p. Windows cannot deliver SIGTERM, so p is
+// killed; nodes the launcher started lose nothing they were asked to keep.
+func terminate(p *os.Process) error {
+	return p.Kill()
+}
@@ -0,0 +1,39 @@
+package ra
+
+import "sync"
+
+// Messages and peer requests on the hot path are recycled through pools
+// instead of being allocated for every frame, which keeps garbage
+// collection out of the way at high request rates. Only objects whose whole
+// lifetime is known are pooled: a message from the moment it is built or
+// decoded until it has been sent or handled, and a peer's request that is
+// answered without being deferred.
+var (
+	messagePool = sync.Pool{New: func() any { return new(Message) }}
+	requestPool = sync.Pool{New: func() any { return new(Request) }}
+)
+
+// newMessage returns a zeroed message from the pool.
+func newMessage() *Message {
+	return messagePool.Get().(*Message)
+}
+
+// freeMessage returns msg to the pool. Nothing may use msg afterwards.
+func freeMessage(msg *Message) {
+	*msg = Message{}
+	messagePool.Put(msg)
+}
+
+// newPeerRequest returns a zeroed request from the pool, for recording a
+// peer's REQUEST.
+func newPeerRequest() *Request {
+	return requestPool.Get().(*Request)
+}
+
+// freePeerRequest returns a request from newPeerRequest to the pool once it
+// has been answered. A request that was deferred or queued must not be
+// freed: the node still holds it.
+func freePeerRequest(request *Request) {
+	*request = Request{}
+	requestPool.Put(request)
+}
@@ -0,0 +1,122 @@
+package ra
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// requestLess orders requests by Lamport timestamp, breaking ties with tb
+// (the lower client id if tb is nil). This is the total order
+// Ricart-Agarwala grants the critical section in.
+func requestLess(tb TieBreak, a, b *Request) bool {
+	return before(tb, a.Timestamp, a.ClientID, b.Timestamp, b.ClientID)
+}
+
+type requestHeap struct {
+	requests []*Request
+	tieBreak TieBreak
+}
+
+func (h *requestHeap) Len() int { return len(h.requests) }
+
+func (h *requestHeap) Less(i, j int) bool {
+	return requestLess(h.tieBreak, h.requests[i], h.requests[j])
+}
+
+func (h *requestHeap) Swap(i, j int) {
+	r := h.requests
+	r[i], r[j] = r[j], r[i]
+	r[i].index = i
+	r[j].index = j
+}
+
+func (h *requestHeap) Push(x any) {
+	req := x.(*Request)
+	req.index = len(h.requests)
+	h.requests = append(h.requests, req)
+}
+
+func (h *requestHeap) Pop() any {
+	old := h.requests
+	n := len(old)
+	req := old[n-1]
+	old[n-1] = nil
+	req.index = -1
+	h.requests = old[:n-1]
+	return req
+}
+
+// RequestQueue is a priority queue of requests for one resource, ordered by
+// timestamp and then by its tie-break policy. Ricart-Agarwala nodes keep the requests they
+// defer in one, and Lamport nodes every request they know of. Either way it
+// holds at most one request per client. It is not safe for concurrent use;
+// its owner's lock protects it.
+type RequestQueue struct {
+	items requestHeap
+}
+
+// NewRequestQueue returns an empty queue breaking timestamp ties with tb,
+// or by lowest client id if tb is nil.
+func NewRequestQueue(tb TieBreak) *RequestQueue {
+	return &RequestQueue{items: requestHeap{tieBreak: tb}}
+}
+
+// Push adds req unless a request with the same client and sequence number
+// is already queued, in which case it reports false.
+func (q *RequestQueue) Push(req *Request) bool {
+	for _, queued := range q.items.requests {
+		if queued.ClientID == req.ClientID && queued.Seq == req.Seq {
+			return false
+		}
+	}
+	heap.Push(&q.items, req)
+	return true
+}
+
+// Pop removes and returns the oldest request, or nil if the queue is empty.
+func (q *RequestQueue) Pop() *Request {
+	if q.items.Len() == 0 {
+		return nil
+	}
+	return heap.Pop(&q.items).(*Request)
+}
+
+// Remove withdraws req if it is queued and reports whether it was.
+func (q *RequestQueue) Remove(req *Request) bool {
+	if req.index >= 0 && req.index < len(q.items.requests) && q.items.requests[req.index] == req {
+		heap.Remove(&q.items, req.index)
+		return true
+	}
+	return false
+}
+
+// Peek returns the oldest request without removing it, or nil.
+func (q *RequestQueue) Peek() *Request {
+	if q.items.Len() == 0 {
+		return nil
+	}
+	return q.items.requests[0]
+}
+
+// Find returns the queued request with the given client and sequence
+// number, or nil.
+func (q *RequestQueue) Find(clientID int, seq uint64) *Request {
+	for _, queued := range q.items.requests {
+		if queued.ClientID == clientID && queued.Seq == seq {
+			return queued
+		}
+	}
+	return nil
+}
+
+func (q *RequestQueue) Len() int {
+	return q.items.Len()
+}
+
+// Items returns a copy of the queued requests, oldest first.
+func (q *RequestQueue) Items() []*Request {
+	items := make([]*Request, len(q.items.requests))
+	copy(items, q.items.requests)
+	sort.Slice(items, func(i, j int) bool { return requestLess(q.items.tieBreak, items[i], items[j]) })
+	return items
+}
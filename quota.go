@@ -0,0 +1,169 @@
+package ra
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Quotas limits how large files may grow. A file's size is bounded by its
+// file limit, and the total size of the files a client last wrote by that
+// client's limit, as a disk quota charges a file to its owner. Limits are in
+// bytes; 0 is no limit. Quotas are enforced by writes inside the critical
+// section, so they never race with another client's write to the same file;
+// writes to files in Eventual mode are not checked.
+type Quotas struct {
+	// FileLimit applies to every file not in Files.
+	FileLimit int
+	Files     map[string]int
+	// ClientLimit applies to every client not in Clients.
+	ClientLimit int
+	Clients     map[int]int
+
+	mu     sync.Mutex
+	owners map[string]int
+	sizes  map[string]int
+	usage  map[int]int
+}
+
+func NewQuotas() *Quotas {
+	return &Quotas{
+		Files:   make(map[string]int),
+		Clients: make(map[int]int),
+		owners:  make(map[string]int),
+		sizes:   make(map[string]int),
+		usage:   make(map[int]int),
+	}
+}
+
+func (q *Quotas) fileLimit(name string) int {
+	if limit, ok := q.Files[name]; ok {
+		return limit
+	}
+	return q.FileLimit
+}
+
+func (q *Quotas) clientLimit(clientID int) int {
+	if limit, ok := q.Clients[clientID]; ok {
+		return limit
+	}
+	return q.ClientLimit
+}
+
+// charge checks that clientID may make file size bytes long and, if so,
+// records clientID as its owner and returns a function undoing the charge.
+// It returns an error wrapping ErrQuotaExceeded otherwise. A nil Quotas
+// allows everything.
+func (q *Quotas) charge(clientID int, file string, size int) (undo func(), err error) {
+	if q == nil {
+		return func() {}, nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if limit := q.fileLimit(file); limit > 0 && size > limit {
+		return nil, fmt.Errorf("client %d writing %s: %w: %d bytes exceeds the file limit of %d",
+			clientID, file, ErrQuotaExceeded, size, limit)
+	}
+	usage := q.usage[clientID] + size
+	if owner, ok := q.owners[file]; ok && owner == clientID {
+		usage -= q.sizes[file]
+	}
+	if limit := q.clientLimit(clientID); limit > 0 && usage > limit {
+		return nil, fmt.Errorf("client %d writing %s: %w: client would use %d bytes of its %d",
+			clientID, file, ErrQuotaExceeded, usage, limit)
+	}
+
+	prevOwner, owned := q.owners[file]
+	prevSize := q.sizes[file]
+	if owned {
+		q.usage[prevOwner] -= prevSize
+	}
+	q.owners[file] = clientID
+	q.sizes[file] = size
+	q.usage[clientID] += size
+	return func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.usage[clientID] -= size
+		if owned {
+			q.owners[file] = prevOwner
+			q.sizes[file] = prevSize
+			q.usage[prevOwner] += prevSize
+		} else {
+			delete(q.owners, file)
+			delete(q.sizes, file)
+		}
+	}, nil
+}
+
+// Usage returns the bytes charged to clientID.
+func (q *Quotas) Usage(clientID int) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.usage[clientID]
+}
+
+// ParseFileQuota sets file limits from spec, a comma-separated list of
+// byte counts: "name=N" limits one file and a bare "N" every other file.
+func (q *Quotas) ParseFileQuota(spec string) error {
+	return parseLimits(spec, func(key string, limit int) error {
+		if key == "" {
+			q.FileLimit = limit
+		} else {
+			q.Files[key] = limit
+		}
+		return nil
+	})
+}
+
+// ParseClientQuota sets client limits from spec like ParseFileQuota, with
+// client ids in place of file names: "2=512,1024".
+func (q *Quotas) ParseClientQuota(spec string) error {
+	return parseLimits(spec, func(key string, limit int) error {
+		if key == "" {
+			q.ClientLimit = limit
+			return nil
+		}
+		id, err := strconv.Atoi(key)
+		if err != nil || id <= 0 {
+			return fmt.Errorf("quota %s=%d: bad client id", key, limit)
+		}
+		q.Clients[id] = limit
+		return nil
+	})
+}
+
+// newQuotas returns the quotas given by the file and client specs, or nil
+// if both are empty.
+func newQuotas(fileSpec, clientSpec string) (*Quotas, error) {
+	if fileSpec == "" && clientSpec == "" {
+		return nil, nil
+	}
+	q := NewQuotas()
+	if err := q.ParseFileQuota(fileSpec); err != nil {
+		return nil, err
+	}
+	if err := q.ParseClientQuota(clientSpec); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func parseLimits(spec string, set func(key string, limit int) error) error {
+	for _, entry := range splitList(spec) {
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			key, value = "", entry
+		}
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return fmt.Errorf("quota %q: want a byte count", entry)
+		}
+		if err := set(strings.TrimSpace(key), limit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package ra
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// raymondState is one client's view of one resource's token.
+type raymondState struct {
+	// holder is the neighbour in the direction of the token, or the client
+	// itself while it has the token.
+	holder int
+	using  bool
+	// asked is set once a REQUEST has gone to holder for the waiters in
+	// queue, so each client asks at most once per token visit.
+	asked bool
+	// queue holds the neighbours, and the client itself, waiting for the
+	// token in arrival order.
+	queue   []int
+	request *Request
+	granted chan struct{}
+}
+
+// Raymond is Raymond's tree-based algorithm. The clients form a spanning
+// tree and each resource has one token that moves along its edges; only the
+// client holding the token may enter. Every client points at the neighbour
+// in the direction of the token and forwards requests that way, at most one
+// per resource until the token passes through, so an entry costs O(log N)
+// messages on a balanced tree instead of O(N).
+type Raymond struct {
+	fs *DistributedFileSystem
+
+	mu sync.Mutex
+	// tree maps each client to its parent; the root maps to itself and
+	// starts with every token. Built from the peers on first use unless
+	// set by SetTree.
+	tree   map[int]int
+	states map[clientResource]*raymondState
+}
+
+func NewRaymond(fs *DistributedFileSystem) *Raymond {
+	return &Raymond{fs: fs, states: make(map[clientResource]*raymondState)}
+}
+
+func (r *Raymond) Name() string { return "raymond" }
+
+func (r *Raymond) MessageCost(n int) string { return "O(log N)" }
+
+// SetTree sets the tree the tokens move along. It must be called before any
+// client requests a resource, and every client must be given the same tree.
+func (r *Raymond) SetTree(tree map[int]int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tree = tree
+}
+
+// SetTree parses spec with ParseTree and gives it to the Raymond algorithm,
+// which must already be selected.
+func (fs *DistributedFileSystem) SetTree(spec string) error {
+	raymond, ok := fs.Mutex.(*Raymond)
+	if !ok {
+		return fmt.Errorf("a tree only applies to the raymond algorithm, not %s", fs.Mutex.Name())
+	}
+	tree, err := ParseTree(spec)
+	if err != nil {
+		return err
+	}
+	raymond.SetTree(tree)
+	return nil
+}
+
+// ParseTree parses a tree written as child=parent pairs, e.g. "2=1,3=1,4=2".
+// The one client that is never a child is the root.
+func ParseTree(spec string) (map[int]int, error) {
+	tree := make(map[int]int)
+	for _, pair := range splitList(spec) {
+		child, parent, ok := strings.Cut(pair, "=")
+		c, errChild := strconv.Atoi(strings.TrimSpace(child))
+		p, errParent := strconv.Atoi(strings.TrimSpace(parent))
+		if !ok || errChild != nil || errParent != nil {
+			return nil, fmt.Errorf("bad tree edge %q (want child=parent)", pair)
+		}
+		if _, dup := tree[c]; dup || c == p {
+			return nil, fmt.Errorf("client %d is given more than one parent", c)
+		}
+		tree[c] = p
+	}
+
+	var roots []int
+	for _, p := range tree {
+		if _, isChild := tree[p]; !isChild && !slices.Contains(roots, p) {
+			roots = append(roots, p)
+		}
+	}
+	if len(roots) != 1 {
+		sort.Ints(roots)
+		return nil, fmt.Errorf("tree must have exactly one root, found %v", roots)
+	}
+	tree[roots[0]] = roots[0]
+	for c := range tree {
+		steps := 0
+		for id := c; tree[id] != id; id = tree[id] {
+			if steps++; steps > len(tree) {
+				return nil, fmt.Errorf("tree has a cycle through client %d", c)
+			}
+		}
+	}
+	return tree, nil
+}
+
+// BinaryTree arranges ids as a balanced binary tree rooted at the lowest.
+func BinaryTree(ids []int) map[int]int {
+	sorted := append([]int(nil), ids...)
+	sort.Ints(sorted)
+	tree := make(map[int]int, len(sorted))
+	for i, id := range sorted {
+		if i == 0 {
+			tree[id] = id
+			continue
+		}
+		tree[id] = sorted[(i-1)/2]
+	}
+	return tree
+}
+
+// state returns clientID's state for resource, starting it with the holder
+// pointing up the tree. The caller holds r.mu.
+func (r *Raymond) state(clientID int, resource string) (*raymondState, error) {
+	key := clientResource{clientID, resource}
+	if st, ok := r.states[key]; ok {
+		return st, nil
+	}
+	if r.tree == nil {
+		r.tree = BinaryTree(r.fs.participants())
+	}
+	parent, ok := r.tree[clientID]
+	if !ok {
+		return nil, fmt.Errorf("%w: client %d is not in the raymond tree", ErrUnknownPeer, clientID)
+	}
+	st := &raymondState{holder: parent}
+	r.states[key] = st
+	return st, nil
+}
+
+func (r *Raymond) Acquire(node *Node, resource, session string, file *File, span *Span) (*Request, error) {
+	fs := r.fs
+	done := fs.step(TraceStep{Client: node.ID, Kind: StepWant, Resource: resource})
+	request := fs.want(node, resource, session, file, span)
+	granted := make(chan struct{})
+
+	r.mu.Lock()
+	st, err := r.state(node.ID, resource)
+	if err != nil {
+		r.mu.Unlock()
+		node.release(request)
+		done()
+		return nil, err
+	}
+	st.request = request
+	st.granted = granted
+	st.queue = append(st.queue, node.ID)
+	r.step(node.ID, resource, st)
+	r.mu.Unlock()
+	done()
+
+	wait := fs.Tracer.Start("token.wait", span)
+	timeout, stop := fs.replyTimeout()
+	defer stop()
+	select {
+	case <-granted:
+	case <-request.cancelled:
+		r.Release(request)
+		wait.SetAttribute("error", "cancelled")
+		wait.Finish()
+		return nil, fmt.Errorf("client %d requesting %s: %w", node.ID, resource, ErrCancelled)
+	case <-timeout:
+		r.mu.Lock()
+		holder := st.holder
+		r.mu.Unlock()
+		r.Release(request)
+		wait.SetAttribute("error", "peer timeout")
+		wait.Finish()
+		return nil, fmt.Errorf("client %d requesting %s: %w: no token from client %d", node.ID, resource, ErrPeerTimeout, holder)
+	}
+	wait.Finish()
+
+	if !node.enter(request) {
+		r.Release(request)
+		return nil, fmt.Errorf("client %d requesting %s: %w", node.ID, resource, ErrNotHoldingCS)
+	}
+	return request, nil
+}
+
+func (r *Raymond) granted(request *Request) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st := r.states[clientResource{request.ClientID, request.Resource}]
+	return st != nil && st.request == request && st.using
+}
+
+// Release gives up the token, or withdraws a request still waiting for it,
+// and passes the token on to the next waiter.
+func (r *Raymond) Release(request *Request) bool {
+	defer r.fs.step(TraceStep{Client: request.ClientID, Kind: StepRelease, Resource: request.Resource})()
+	_, held := r.fs.Node(request.ClientID).release(request)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st := r.states[clientResource{request.ClientID, request.Resource}]
+	if st == nil || st.request != request {
+		return held
+	}
+	st.request = nil
+	if st.using {
+		st.using = false
+	} else {
+		for i, id := range st.queue {
+			if id == request.ClientID {
+				st.queue = append(st.queue[:i:i], st.queue[i+1:]...)
+				break
+			}
+		}
+	}
+	r.step(request.ClientID, request.Resource, st)
+	return held
+}
+
+func (r *Raymond) Receive(msg *Message) bool {
+	switch msg.Type {
+	case MsgRequest:
+		r.fs.event(EventRequestRecv, msg.To, msg.From, msg.Resource, msg.Timestamp)
+	case MsgToken:
+		r.fs.event(EventTokenRecv, msg.To, msg.From, msg.Resource, msg.Timestamp)
+	default:
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st, err := r.state(msg.To, msg.Resource)
+	if err != nil {
+		r.fs.Log.Errorf("Client %d: error handling %s from client %d: %v", msg.To, msg.Type, msg.From, err)
+		return true
+	}
+	if msg.Type == MsgToken {
+		st.holder = msg.To
+		if st.request != nil {
+			st.request.messages.Add(1)
+		}
+	} else {
+		st.queue = append(st.queue, msg.From)
+	}
+	r.step(msg.To, msg.Resource, st)
+	return true
+}
+
+// step passes the token on, or asks for it, as st now requires. The caller
+// holds r.mu; messages are sent under it so that each link carries them in
+// the order the state changed.
+func (r *Raymond) step(clientID int, resource string, st *raymondState) {
+	if st.holder == clientID && !st.using && len(st.queue) > 0 {
+		next := st.queue[0]
+		st.queue = st.queue[1:]
+		st.asked = false
+		if next == clientID {
+			st.using = true
+			close(st.granted)
+		} else {
+			st.holder = next
+			r.fs.Log.Debugf("Client %d passed the %s token to client %d", clientID, resource, next)
+			r.send(MsgToken, clientID, next, resource)
+		}
+	}
+	if st.holder != clientID && len(st.queue) > 0 && !st.asked {
+		st.asked = true
+		r.fs.Log.Debugf("Client %d asked client %d for the %s token", clientID, st.holder, resource)
+		r.send(MsgRequest, clientID, st.holder, resource)
+		if st.request != nil {
+			st.request.messages.Add(1)
+		}
+	}
+}
+
+func (r *Raymond) send(msgType MessageType, from, to int, resource string) {
+	timestamp := r.fs.Node(from).tick()
+	err := r.fs.send(&Message{
+		Type:      msgType,
+		From:      from,
+		To:        to,
+		Resource:  resource,
+		Timestamp: timestamp,
+	})
+	if err != nil {
+		r.fs.Log.Errorf("Error sending %s from client %d: %v", msgType, from, err)
+		return
+	}
+	kind := EventRequestSent
+	if msgType == MsgToken {
+		kind = EventTokenSent
+	}
+	r.fs.event(kind, from, to, resource, timestamp)
+}
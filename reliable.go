@@ -0,0 +1,273 @@
+package ra
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Defaults of a ReliableTransport.
+const (
+	DefaultRetransmitTimeout = 50 * time.Millisecond
+	DefaultMaxBackoff        = 2 * time.Second
+	DefaultMaxRetries        = 8
+)
+
+// ErrPeerDown is reported through ReliableTransport.OnPeerDown when a
+// frame is still unacknowledged after every retransmission.
+var ErrPeerDown = errors.New("peer down")
+
+const (
+	reliableData byte = iota
+	reliableAck
+)
+
+// reliableHeaderSize is the kind byte, the epoch and the sequence number
+// put in front of every frame.
+const reliableHeaderSize = 1 + 8 + 8
+
+// ReliableTransport wraps a Transport that may lose frames, such as a
+// NetEm with Loss set, and delivers every frame exactly once and in order.
+// Each frame on a link is numbered and kept until the receiver
+// acknowledges it; unacknowledged frames are sent again after
+// RetransmitTimeout, doubling the wait each time up to MaxBackoff. A frame
+// still unacknowledged after MaxRetries retransmissions is given up on:
+// OnPeerDown is called and the link starts afresh, dropping everything
+// still queued on it, so one dead peer never holds frames forever.
+//
+// Both ends of a link must use a ReliableTransport.
+type ReliableTransport struct {
+	Transport
+	RetransmitTimeout time.Duration
+	MaxBackoff        time.Duration
+	MaxRetries        int
+	// OnPeerDown, if set, is called when from gives up on to. It is
+	// called from a timer goroutine and must not block.
+	OnPeerDown func(from, to int, err error)
+
+	mu    sync.Mutex
+	sends map[linkKey]*reliableSend
+	recvs map[linkKey]*reliableRecv
+}
+
+// reliableSend is the sending end of one link.
+type reliableSend struct {
+	// epoch numbers the link's incarnations: it starts from the clock, so
+	// a restarted sender is not mistaken for the old one, and goes up each
+	// time the link is given up on.
+	epoch   uint64
+	next    uint64
+	unacked map[uint64]*unackedFrame
+}
+
+type unackedFrame struct {
+	frame    []byte
+	attempts int
+	timer    *time.Timer
+}
+
+// reliableRecv is the receiving end of one link.
+type reliableRecv struct {
+	epoch uint64
+	next  uint64
+	// early holds frames that arrived ahead of a lost one.
+	early map[uint64][]byte
+}
+
+func NewReliableTransport(inner Transport) *ReliableTransport {
+	return &ReliableTransport{
+		Transport:         inner,
+		RetransmitTimeout: DefaultRetransmitTimeout,
+		MaxBackoff:        DefaultMaxBackoff,
+		MaxRetries:        DefaultMaxRetries,
+		sends:             make(map[linkKey]*reliableSend),
+		recvs:             make(map[linkKey]*reliableRecv),
+	}
+}
+
+func (t *ReliableTransport) Register(id int, handler Handler) {
+	t.Transport.Register(id, func(from int, data []byte) {
+		t.receive(from, id, data, handler)
+	})
+}
+
+func (t *ReliableTransport) Send(from, to int, data []byte) error {
+	if from == to {
+		return t.Transport.Send(from, to, data)
+	}
+
+	t.mu.Lock()
+	key := linkKey{from, to}
+	link, ok := t.sends[key]
+	if !ok {
+		link = &reliableSend{epoch: uint64(time.Now().UnixNano()), next: 1, unacked: make(map[uint64]*unackedFrame)}
+		t.sends[key] = link
+	}
+	seq := link.next
+	link.next++
+	epoch := link.epoch
+	pending := &unackedFrame{frame: reliableFrame(reliableData, epoch, seq, data)}
+	link.unacked[seq] = pending
+	pending.timer = time.AfterFunc(t.RetransmitTimeout, func() { t.retransmit(key, epoch, seq) })
+	t.mu.Unlock()
+
+	// A frame the inner transport fails to send is retried like a lost
+	// one, except when there is no such peer at all.
+	if err := t.Transport.Send(from, to, pending.frame); errors.Is(err, ErrUnknownPeer) {
+		t.mu.Lock()
+		pending.timer.Stop()
+		delete(link.unacked, seq)
+		t.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// retransmit sends frame seq of epoch on the link again if it is still
+// unacknowledged, or gives up on the link once it has been retried
+// MaxRetries times.
+func (t *ReliableTransport) retransmit(key linkKey, epoch, seq uint64) {
+	t.mu.Lock()
+	link := t.sends[key]
+	pending, ok := link.unacked[seq]
+	if !ok || link.epoch != epoch {
+		t.mu.Unlock()
+		return
+	}
+	if pending.attempts >= t.MaxRetries {
+		for _, frame := range link.unacked {
+			frame.timer.Stop()
+		}
+		clear(link.unacked)
+		link.epoch++
+		link.next = 1
+		t.mu.Unlock()
+		if t.OnPeerDown != nil {
+			t.OnPeerDown(key[0], key[1], fmt.Errorf("%w: frame %d unacknowledged after %d retransmissions", ErrPeerDown, seq, pending.attempts))
+		}
+		return
+	}
+	pending.attempts++
+	backoff := t.RetransmitTimeout << pending.attempts
+	if backoff > t.MaxBackoff || backoff <= 0 {
+		backoff = t.MaxBackoff
+	}
+	pending.timer.Reset(backoff)
+	frame := pending.frame
+	t.mu.Unlock()
+
+	t.Transport.Send(key[0], key[1], frame)
+}
+
+// receive handles a frame the inner transport delivered on the from->to
+// link: an ack settles a frame to→from, data is acked and handed to
+// handler in sequence order. The inner transport calls this for one frame
+// at a time per receiver, so handler sees the same.
+func (t *ReliableTransport) receive(from, to int, data []byte, handler Handler) {
+	if from == to {
+		handler(from, data)
+		return
+	}
+	if len(data) < reliableHeaderSize {
+		return
+	}
+	kind := data[0]
+	epoch := binary.BigEndian.Uint64(data[1:9])
+	seq := binary.BigEndian.Uint64(data[9:17])
+
+	if kind == reliableAck {
+		t.mu.Lock()
+		if link, ok := t.sends[linkKey{to, from}]; ok && link.epoch == epoch {
+			if pending, ok := link.unacked[seq]; ok {
+				pending.timer.Stop()
+				delete(link.unacked, seq)
+			}
+		}
+		t.mu.Unlock()
+		return
+	}
+
+	// Ack every copy, so a sender whose ack was lost stops retransmitting.
+	t.Transport.Send(to, from, reliableFrame(reliableAck, epoch, seq, nil))
+
+	t.mu.Lock()
+	key := linkKey{from, to}
+	link, ok := t.recvs[key]
+	switch {
+	case !ok || epoch > link.epoch:
+		link = &reliableRecv{epoch: epoch, next: 1, early: make(map[uint64][]byte)}
+		t.recvs[key] = link
+	case epoch < link.epoch:
+		t.mu.Unlock()
+		return
+	}
+	if seq < link.next {
+		t.mu.Unlock()
+		return
+	}
+	if seq > link.next {
+		link.early[seq] = data[reliableHeaderSize:]
+		t.mu.Unlock()
+		return
+	}
+	ready := [][]byte{data[reliableHeaderSize:]}
+	link.next++
+	for {
+		payload, ok := link.early[link.next]
+		if !ok {
+			break
+		}
+		delete(link.early, link.next)
+		ready = append(ready, payload)
+		link.next++
+	}
+	t.mu.Unlock()
+
+	for _, payload := range ready {
+		handler(from, payload)
+	}
+}
+
+// LinkUp reports whether the wrapped transport's link is up.
+func (t *ReliableTransport) LinkUp(from, to int) bool {
+	return linkUp(t.Transport, from, to)
+}
+
+func (t *ReliableTransport) Close() {
+	t.mu.Lock()
+	for _, link := range t.sends {
+		for _, frame := range link.unacked {
+			frame.timer.Stop()
+		}
+		clear(link.unacked)
+	}
+	t.mu.Unlock()
+	t.Transport.Close()
+}
+
+// reliablePayload returns the message carried by a ReliableTransport
+// frame, or false for an ack.
+func reliablePayload(frame []byte) ([]byte, bool) {
+	if len(frame) < reliableHeaderSize || frame[0] != reliableData {
+		return nil, false
+	}
+	return frame[reliableHeaderSize:], true
+}
+
+// peerDown is the OnPeerDown of a ReliableTransport carrying fs's messages.
+// Requests waiting on to are left to ReplyTimeout.
+func (fs *DistributedFileSystem) peerDown(from, to int, err error) {
+	fs.Log.Warnf("Client %d: giving up on client %d: %v", from, to, err)
+	fs.Metrics.addNode("ra_peers_down_total", from)
+	fs.event(EventPeerDown, from, to, "", 0)
+}
+
+func reliableFrame(kind byte, epoch, seq uint64, data []byte) []byte {
+	frame := make([]byte, reliableHeaderSize, reliableHeaderSize+len(data))
+	frame[0] = kind
+	binary.BigEndian.PutUint64(frame[1:9], epoch)
+	binary.BigEndian.PutUint64(frame[9:17], seq)
+	return append(frame, data...)
+}
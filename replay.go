@@ -0,0 +1,426 @@
+package ra
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Trace step kinds. A client's protocol state only changes when it handles
+// a delivered message or takes one of its own steps, so the order of these
+// per client fixes every decision the protocol makes.
+const (
+	StepDeliver = "deliver"
+	StepWant    = "want"
+	StepRelease = "release"
+)
+
+// TraceStep is one step taken by a client.
+type TraceStep struct {
+	Client   int    `json:"client"`
+	Kind     string `json:"kind"`
+	From     int    `json:"from,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Seq      uint64 `json:"seq,omitempty"`
+	Resource string `json:"resource,omitempty"`
+}
+
+// Trace is a recorded run: enough configuration to run the same clients
+// again, the steps in the order they happened, and the order in which
+// clients entered each resource, to check a replay against.
+type Trace struct {
+	Clients     int              `json:"clients"`
+	Codec       string           `json:"codec"`
+	Algorithm   string           `json:"algorithm"`
+	SharedReads bool             `json:"shared_reads,omitempty"`
+	Workload    *Workload        `json:"workload,omitempty"`
+	Steps       []TraceStep      `json:"steps"`
+	Entries     map[string][]int `json:"entries"`
+}
+
+// LoadTrace reads a trace written by TraceRecorder.Save.
+func LoadTrace(path string) (*Trace, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	trace := &Trace{}
+	if err := json.Unmarshal(data, trace); err != nil {
+		return nil, fmt.Errorf("parsing trace %s: %w", path, err)
+	}
+	return trace, nil
+}
+
+// Scheduler is told about every step a client takes. The function it
+// returns is called once the step is complete.
+type Scheduler interface {
+	Step(step TraceStep) func()
+}
+
+// step reports a step to fs.Scheduler, if there is one.
+func (fs *DistributedFileSystem) step(step TraceStep) func() {
+	if fs.Scheduler == nil {
+		return func() {}
+	}
+	return fs.Scheduler.Step(step)
+}
+
+// TraceRecorder is a Scheduler that records the steps of a run. It makes
+// each client's steps atomic so that their recorded order is the order in
+// which they took effect. Clients must issue one operation at a time.
+type TraceRecorder struct {
+	mu      sync.Mutex
+	trace   *Trace
+	clients map[int]*sync.Mutex
+}
+
+// NewTraceRecorder starts recording a run described by trace, whose Steps
+// and Entries are filled in.
+func NewTraceRecorder(trace *Trace) *TraceRecorder {
+	return &TraceRecorder{trace: trace, clients: make(map[int]*sync.Mutex)}
+}
+
+func (r *TraceRecorder) Step(step TraceStep) func() {
+	r.mu.Lock()
+	client, ok := r.clients[step.Client]
+	if !ok {
+		client = &sync.Mutex{}
+		r.clients[step.Client] = client
+	}
+	r.mu.Unlock()
+
+	client.Lock()
+	r.mu.Lock()
+	r.trace.Steps = append(r.trace.Steps, step)
+	r.mu.Unlock()
+	return client.Unlock
+}
+
+// Save writes the trace, with entries as the order the run ended up
+// entering each resource in.
+func (r *TraceRecorder) Save(path string, entries map[string][]int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.trace.Entries = entries
+	data, err := json.MarshalIndent(r.trace, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// EntryOrder collects the order in which clients enter each resource.
+type EntryOrder struct {
+	mu      sync.Mutex
+	entries map[string][]int
+}
+
+// WatchEntries starts collecting the entries of every client joined so far.
+func (fs *DistributedFileSystem) WatchEntries() *EntryOrder {
+	order := &EntryOrder{entries: make(map[string][]int)}
+	for _, node := range fs.nodes() {
+		clientID := node.ID
+		node.OnEnterCS(func(resource string, timestamp int) {
+			order.mu.Lock()
+			order.entries[resource] = append(order.entries[resource], clientID)
+			order.mu.Unlock()
+		})
+	}
+	return order
+}
+
+// Entries returns a copy of the entry order so far.
+func (o *EntryOrder) Entries() map[string][]int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	entries := make(map[string][]int, len(o.entries))
+	for resource, clients := range o.entries {
+		entries[resource] = append([]int(nil), clients...)
+	}
+	return entries
+}
+
+// replayStall is how long a replay may make no progress before it is
+// declared diverged and the clients are let go.
+const replayStall = 5 * time.Second
+
+// Replayer is a Transport and Scheduler that re-runs a trace in-process.
+// Frames are held back and every client handles them, and takes its own
+// steps, in exactly the recorded order. If the run stops matching the
+// trace, e.g. because a reply timeout fired differently, the replay reports
+// where and lets the rest of the run proceed unscheduled.
+type Replayer struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	pending  map[int][]TraceStep
+	frames   map[linkKey][][]byte
+	handlers map[int]Handler
+	diverged bool
+	replayed int
+	total    int
+	progress time.Time
+	closed   bool
+}
+
+func NewReplayer(trace *Trace) *Replayer {
+	r := &Replayer{
+		pending:  make(map[int][]TraceStep),
+		frames:   make(map[linkKey][][]byte),
+		handlers: make(map[int]Handler),
+		total:    len(trace.Steps),
+		progress: time.Now(),
+	}
+	r.cond = sync.NewCond(&r.mu)
+	for _, step := range trace.Steps {
+		r.pending[step.Client] = append(r.pending[step.Client], step)
+	}
+	go r.watch()
+	return r
+}
+
+// watch declares the replay diverged once it stops making progress.
+func (r *Replayer) watch() {
+	ticker := time.NewTicker(replayStall / 10)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			return
+		}
+		if !r.diverged && r.replayed < r.total && time.Since(r.progress) > replayStall {
+			r.divergeLocked(fmt.Sprintf("no progress for %s", replayStall))
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *Replayer) divergeLocked(reason string) {
+	fmt.Printf("Replay diverged after %d of %d steps: %s\n", r.replayed, r.total, reason)
+	r.diverged = true
+	r.cond.Broadcast()
+}
+
+func (r *Replayer) Step(step TraceStep) func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for !r.diverged {
+		pending := r.pending[step.Client]
+		if len(pending) == 0 {
+			r.divergeLocked(fmt.Sprintf("client %d took a %s step past the end of its trace", step.Client, step.Kind))
+			break
+		}
+		next := pending[0]
+		if next.Kind == step.Kind && next.From == step.From && next.Resource == step.Resource {
+			return func() { r.advance(step.Client) }
+		}
+		if next.Kind != StepDeliver && step.Kind != StepDeliver {
+			r.divergeLocked(fmt.Sprintf("client %d took a %s step on %s where the trace has %s on %s",
+				step.Client, step.Kind, step.Resource, next.Kind, next.Resource))
+			break
+		}
+		r.cond.Wait()
+	}
+	return func() {}
+}
+
+func (r *Replayer) advance(clientID int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.diverged {
+		r.pending[clientID] = r.pending[clientID][1:]
+		r.replayed++
+		r.progress = time.Now()
+	}
+	r.cond.Broadcast()
+}
+
+// Wait blocks until every step has been replayed or the replay diverged,
+// and returns how many steps were replayed.
+func (r *Replayer) Wait() (replayed, total int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.replayed < r.total && !r.diverged {
+		r.cond.Wait()
+	}
+	return r.replayed, r.total
+}
+
+func (r *Replayer) Register(id int, handler Handler) {
+	r.mu.Lock()
+	r.handlers[id] = handler
+	r.mu.Unlock()
+	go r.deliver(id, handler)
+}
+
+// deliver hands client id its frames in the recorded order.
+func (r *Replayer) deliver(id int, handler Handler) {
+	for {
+		r.mu.Lock()
+		from, data, ok := r.nextFrameLocked(id)
+		for !ok && !r.closed {
+			r.cond.Wait()
+			from, data, ok = r.nextFrameLocked(id)
+		}
+		r.mu.Unlock()
+		if !ok {
+			return
+		}
+		handler(from, data)
+	}
+}
+
+// nextFrameLocked takes the frame client id is due to handle next, if it
+// has arrived. Once the replay has diverged any waiting frame will do.
+func (r *Replayer) nextFrameLocked(id int) (int, []byte, bool) {
+	if !r.diverged {
+		pending := r.pending[id]
+		if len(pending) == 0 || pending[0].Kind != StepDeliver {
+			return 0, nil, false
+		}
+		return r.popFrameLocked(pending[0].From, id)
+	}
+	var senders []int
+	for key, queue := range r.frames {
+		if key[1] == id && len(queue) > 0 {
+			senders = append(senders, key[0])
+		}
+	}
+	if len(senders) == 0 {
+		return 0, nil, false
+	}
+	sort.Ints(senders)
+	return r.popFrameLocked(senders[0], id)
+}
+
+func (r *Replayer) popFrameLocked(from, to int) (int, []byte, bool) {
+	key := linkKey{from, to}
+	queue := r.frames[key]
+	if len(queue) == 0 {
+		return 0, nil, false
+	}
+	r.frames[key] = queue[1:]
+	return from, queue[0], true
+}
+
+func (r *Replayer) Send(from, to int, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return net.ErrClosed
+	}
+	if _, ok := r.handlers[to]; !ok {
+		return fmt.Errorf("%w: client %d", ErrUnknownPeer, to)
+	}
+	key := linkKey{from, to}
+	r.frames[key] = append(r.frames[key], data)
+	r.cond.Broadcast()
+	return nil
+}
+
+func (r *Replayer) Peers() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	peers := make([]int, 0, len(r.handlers))
+	for id := range r.handlers {
+		peers = append(peers, id)
+	}
+	sort.Ints(peers)
+	return peers
+}
+
+func (r *Replayer) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	r.cond.Broadcast()
+}
+
+// runReplayCommand re-runs a trace recorded with -record.
+func runReplayCommand(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s replay trace.json\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	trace, err := LoadTrace(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading trace: %v\n", err)
+		return 1
+	}
+	codec, err := NewCodec(trace.Codec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error selecting codec: %v\n", err)
+		return 1
+	}
+	replayer := NewReplayer(trace)
+	fs := NewDistributedFileSystem(codec, replayer)
+	defer fs.Transport.Close()
+	fs.Scheduler = replayer
+	fs.SharedReads = trace.SharedReads
+	if err := fs.SetAlgorithm(trace.Algorithm); err != nil {
+		fmt.Fprintf(os.Stderr, "Error selecting algorithm: %v\n", err)
+		return 1
+	}
+	discard, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening %s: %v\n", os.DevNull, err)
+		return 1
+	}
+	defer discard.Close()
+	fs.LogFile = discard
+
+	for i := 1; i <= trace.Clients; i++ {
+		fs.Join(i)
+	}
+	order := fs.WatchEntries()
+	if trace.Workload != nil {
+		RunWorkload(fs, trace.Clients, trace.Workload, nil)
+	} else {
+		runDemo(fs, trace.Clients, discard)
+	}
+
+	replayed, total := replayer.Wait()
+	fmt.Printf("Replayed %d of %d steps\n", replayed, total)
+	fmt.Printf("Safety check: %d mutual-exclusion violations\n", fs.Safety.Violations())
+	entries := order.Entries()
+	matched := true
+	for _, resource := range sortedKeys(trace.Entries, entries) {
+		if !slices.Equal(entries[resource], trace.Entries[resource]) {
+			fmt.Printf("%s entered in a different order: recorded %v, replayed %v\n", resource, trace.Entries[resource], entries[resource])
+			matched = false
+		}
+	}
+	if !matched || replayed < total {
+		return 1
+	}
+	fmt.Printf("Every resource was entered in the recorded order\n")
+	return 0
+}
+
+// sortedKeys returns the resources named in either entry order, sorted.
+func sortedKeys(a, b map[string][]int) []string {
+	var keys []string
+	for resource := range a {
+		keys = append(keys, resource)
+	}
+	for resource := range b {
+		if _, ok := a[resource]; !ok {
+			keys = append(keys, resource)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,114 @@
+package ra
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OperationRecord is one completed critical section as written by
+// -report. Times are milliseconds since the report started, so they plot
+// directly.
+type OperationRecord struct {
+	Node      int    `json:"node"`
+	Resource  string `json:"resource"`
+	Op        string `json:"op,omitempty"`
+	Timestamp int    `json:"timestamp"`
+	// RequestedMS, EnteredMS and ExitedMS are when the node asked for the
+	// critical section, entered it and left it.
+	RequestedMS float64 `json:"requested_ms"`
+	EnteredMS   float64 `json:"entered_ms"`
+	ExitedMS    float64 `json:"exited_ms"`
+	WaitMS      float64 `json:"wait_ms"`
+	HoldMS      float64 `json:"hold_ms"`
+	// Messages counts the protocol messages sent or received on the
+	// request's behalf: its requests and the replies to them, its releases
+	// under Lamport, and the token traffic it caused under Raymond.
+	Messages int `json:"messages"`
+}
+
+// OperationReport collects an OperationRecord for every critical section
+// released while fs.Report is set.
+type OperationReport struct {
+	Start time.Time
+
+	mu      sync.Mutex
+	records []OperationRecord
+}
+
+func NewOperationReport() *OperationReport {
+	return &OperationReport{Start: time.Now()}
+}
+
+// record adds request, which left its critical section at exited. A nil
+// report records nothing.
+func (r *OperationReport) record(request *Request, exited time.Time) {
+	if r == nil || request.Entered.IsZero() {
+		return
+	}
+	ms := func(t time.Time) float64 { return float64(t.Sub(r.Start)) / float64(time.Millisecond) }
+	record := OperationRecord{
+		Node:        request.ClientID,
+		Resource:    request.Resource,
+		Op:          request.Op,
+		Timestamp:   request.Timestamp,
+		RequestedMS: ms(request.Requested),
+		EnteredMS:   ms(request.Entered),
+		ExitedMS:    ms(exited),
+		WaitMS:      float64(request.Entered.Sub(request.Requested)) / float64(time.Millisecond),
+		HoldMS:      float64(exited.Sub(request.Entered)) / float64(time.Millisecond),
+		Messages:    int(request.messages.Load()),
+	}
+	r.mu.Lock()
+	r.records = append(r.records, record)
+	r.mu.Unlock()
+}
+
+// Records returns the records in the order the critical sections were
+// left.
+func (r *OperationReport) Records() []OperationRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]OperationRecord(nil), r.records...)
+}
+
+// Write saves the records to path, as CSV with a header row if path ends
+// in ".csv" and as a JSON array otherwise.
+func (r *OperationReport) Write(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	records := r.Records()
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		err = writeReportCSV(f, records)
+	} else {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(records)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func writeReportCSV(f *os.File, records []OperationRecord) error {
+	w := csv.NewWriter(f)
+	w.Write([]string{"node", "resource", "op", "timestamp", "requested_ms", "entered_ms", "exited_ms", "wait_ms", "hold_ms", "messages"})
+	ms := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	for _, r := range records {
+		w.Write([]string{
+			strconv.Itoa(r.Node), r.Resource, r.Op, strconv.Itoa(r.Timestamp),
+			ms(r.RequestedMS), ms(r.EnteredMS), ms(r.ExitedMS), ms(r.WaitMS), ms(r.HoldMS),
+			strconv.Itoa(r.Messages),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,290 @@
+package ra
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Node roles let many clients share a few protocol participants. Every
+// client is a participant unless fs.Proxies names it a lightweight client:
+// a participant runs the mutual exclusion algorithm, while a lightweight
+// client has no node and enters critical sections through its
+// participant, which queues it as a local caller (see LocalQueue) and
+// takes part in the protocol on its behalf. Only participants exchange
+// protocol messages, so with K participants an entry costs 2(K-1) of them
+// plus two between the client and its participant, instead of 2(N-1) for
+// N clients.
+//
+// Participants can be weighted with the weighted tie-break, e.g.
+// -tie-break weighted:1=3,2=1 (see Weighted): a participant with three
+// times the weight of another goes first three times as often when their
+// requests carry the same timestamp. The weight is a priority, not a
+// vote: every algorithm here needs a reply or the token from each
+// participant, so no quorum of them can stand in for the rest.
+//
+// A lightweight client sends PROXY_REQUEST to its participant, which
+// answers PROXY_GRANT once it is in the critical section for the client,
+// or PROXY_REFUSE with the error if it could not get in, and leaves on the
+// client's PROXY_RELEASE. A client that gives up waiting after
+// fs.ReplyTimeout sends PROXY_RELEASE all the same, and again for a grant
+// that arrives after it gave up, so the participant does not stay in the
+// critical section. A client that goes away holding a critical section
+// keeps its participant in it until a lease (fs.Lease) runs out.
+// Lightweight clients do not use the read cache or eventual consistency,
+// which need a node of their own.
+
+// proxyKey identifies a lightweight client's request to its participant.
+type proxyKey struct {
+	client int
+	seq    uint64
+}
+
+// proxyGrant is a participant's answer to a PROXY_REQUEST.
+type proxyGrant struct {
+	timestamp int
+	err       error
+}
+
+// ParseProxies parses lightweight clients written as client=participant
+// pairs, e.g. "4=1,5=1,6=2".
+func ParseProxies(spec string) (map[int]int, error) {
+	proxies := make(map[int]int)
+	for _, pair := range splitList(spec) {
+		client, participant, ok := strings.Cut(pair, "=")
+		c, errClient := strconv.Atoi(strings.TrimSpace(client))
+		p, errParticipant := strconv.Atoi(strings.TrimSpace(participant))
+		if !ok || errClient != nil || errParticipant != nil || c <= 0 || p <= 0 {
+			return nil, fmt.Errorf("bad proxy %q (want client=participant)", pair)
+		}
+		if _, dup := proxies[c]; dup || c == p {
+			return nil, fmt.Errorf("client %d is given more than one participant", c)
+		}
+		proxies[c] = p
+	}
+	for c, p := range proxies {
+		if _, ok := proxies[p]; ok {
+			return nil, fmt.Errorf("client %d's participant %d is a lightweight client itself", c, p)
+		}
+	}
+	return proxies, nil
+}
+
+// SpreadClients makes clients participants+1 to n lightweight clients,
+// spread round-robin over participants 1 to participants.
+func SpreadClients(n, participants int) map[int]int {
+	proxies := make(map[int]int)
+	for id := participants + 1; id <= n; id++ {
+		proxies[id] = (id-participants-1)%participants + 1
+	}
+	return proxies
+}
+
+// FormatProxies writes proxies in the form ParseProxies reads.
+func FormatProxies(proxies map[int]int) string {
+	pairs := make([]string, 0, len(proxies))
+	for id := 1; len(pairs) < len(proxies); id++ {
+		if p, ok := proxies[id]; ok {
+			pairs = append(pairs, fmt.Sprintf("%d=%d", id, p))
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+// participants returns the transport's peers that run the protocol: all
+// but the lightweight clients.
+func (fs *DistributedFileSystem) participants() []int {
+	peers := fs.Transport.Peers()
+	if len(fs.Proxies) == 0 {
+		return peers
+	}
+	var ids []int
+	for _, peer := range peers {
+		if _, ok := fs.Proxies[peer]; !ok {
+			ids = append(ids, peer)
+		}
+	}
+	return ids
+}
+
+// joinLightweight registers the lightweight client clientID with the
+// transport, to receive its participant's answers.
+func (fs *DistributedFileSystem) joinLightweight(clientID int) {
+	fs.Transport.Register(clientID, func(from int, data []byte) {
+		msg, err := fs.decode(data)
+		if err != nil {
+			fs.Log.Warnf("Client %d: error decoding message from client %d: %v", clientID, from, err)
+			return
+		}
+		defer freeMessage(msg)
+		if msg.From != from || msg.From != fs.Proxies[clientID] {
+			fs.Log.Warnf("Client %d: rejecting %s from client %d, which is not its participant", clientID, msg.Type, from)
+			return
+		}
+		switch msg.Type {
+		case MsgProxyGrant:
+			if !fs.granted(proxyKey{clientID, msg.Seq}, proxyGrant{timestamp: msg.Timestamp}) {
+				fs.Log.Warnf("Client %d: PROXY_GRANT %d for %s after giving up on it; releasing", clientID, msg.Seq, msg.Resource)
+				fs.abandonProxied(from, proxyKey{clientID, msg.Seq}, msg.Resource)
+			}
+		case MsgProxyRefuse:
+			fs.granted(proxyKey{clientID, msg.Seq}, proxyGrant{err: remoteError(msg.Content)})
+		default:
+			fs.Log.Debugf("Client %d: ignoring %s from client %d", clientID, msg.Type, from)
+		}
+	})
+}
+
+// granted hands a participant's answer to the acquire waiting for it,
+// reporting whether one still was.
+func (fs *DistributedFileSystem) granted(key proxyKey, grant proxyGrant) bool {
+	fs.proxyMutex.Lock()
+	wait, ok := fs.proxyWaits[key]
+	delete(fs.proxyWaits, key)
+	fs.proxyMutex.Unlock()
+	if ok {
+		wait <- grant
+	}
+	return ok
+}
+
+// abandonProxied tells participant to leave the critical section it
+// entered, or is entering, for key, whose client gave up on it.
+func (fs *DistributedFileSystem) abandonProxied(participant int, key proxyKey, resource string) {
+	err := fs.send(&Message{Type: MsgProxyRelease, From: key.client, To: participant, Seq: key.seq, Resource: resource})
+	if err != nil {
+		fs.Log.Errorf("Error sending PROXY_RELEASE from client %d: %v", key.client, err)
+	}
+}
+
+// remoteErrors are the errors a PROXY_REFUSE can carry that callers may
+// test for with errors.Is.
+var remoteErrors = []error{ErrPeerTimeout, ErrFenced, ErrBackpressure, ErrCancelled, ErrUnknownPeer, ErrLockUpgrade}
+
+// remoteError rebuilds an error a participant sent as text.
+func remoteError(text string) error {
+	for _, err := range remoteErrors {
+		if strings.Contains(text, err.Error()) {
+			return fmt.Errorf("%w (participant: %s)", err, text)
+		}
+	}
+	return errors.New(text)
+}
+
+// acquireVia enters resource's critical section for the lightweight
+// client clientID through participant.
+func (fs *DistributedFileSystem) acquireVia(participant, clientID int, resource, session string, file *File) (*Request, error) {
+	key := proxyKey{clientID, fs.NextSequence(clientID)}
+	wait := make(chan proxyGrant, 1)
+	fs.proxyMutex.Lock()
+	if fs.proxyWaits == nil {
+		fs.proxyWaits = make(map[proxyKey]chan proxyGrant)
+	}
+	fs.proxyWaits[key] = wait
+	fs.proxyMutex.Unlock()
+
+	requested := time.Now()
+	err := fs.send(&Message{Type: MsgProxyRequest, From: clientID, To: participant, Seq: key.seq, Resource: resource, Session: session})
+	if err != nil {
+		fs.proxyMutex.Lock()
+		delete(fs.proxyWaits, key)
+		fs.proxyMutex.Unlock()
+		return nil, fmt.Errorf("client %d requesting %s through client %d: %w", clientID, resource, participant, err)
+	}
+	timeout, stop := fs.replyTimeout()
+	defer stop()
+	var grant proxyGrant
+	select {
+	case grant = <-wait:
+	case <-timeout:
+		fs.proxyMutex.Lock()
+		delete(fs.proxyWaits, key)
+		fs.proxyMutex.Unlock()
+		fs.abandonProxied(participant, key, resource)
+		return nil, fmt.Errorf("client %d requesting %s through client %d: %w", clientID, resource, participant, ErrPeerTimeout)
+	}
+	if grant.err != nil {
+		return nil, fmt.Errorf("client %d requesting %s through client %d: %w", clientID, resource, participant, grant.err)
+	}
+	return &Request{
+		ClientID:  clientID,
+		Resource:  resource,
+		Session:   session,
+		File:      file,
+		Timestamp: grant.timestamp,
+		Seq:       key.seq,
+		Requested: requested,
+		Entered:   time.Now(),
+		proxy:     participant,
+	}, nil
+}
+
+// releaseVia leaves the critical section request's participant entered
+// for it.
+func (fs *DistributedFileSystem) releaseVia(request *Request) error {
+	if request.checksum != "" {
+		fs.logChecksum(request)
+	}
+	err := fs.send(&Message{Type: MsgProxyRelease, From: request.ClientID, To: request.proxy, Seq: request.Seq, Resource: request.Resource})
+	if err != nil {
+		return fmt.Errorf("client %d releasing %s through client %d: %w", request.ClientID, request.Resource, request.proxy, err)
+	}
+	return nil
+}
+
+// ReceiveProxyRequest enters a critical section on behalf of the
+// lightweight client msg.From, as a local caller of msg.To, and tells the
+// client once it is in.
+func (fs *DistributedFileSystem) ReceiveProxyRequest(msg *Message) {
+	participant, key := msg.To, proxyKey{msg.From, msg.Seq}
+	resource, session := msg.Resource, msg.Session
+	fs.Metrics.addNode("ra_proxied_requests_total", participant)
+	go func() {
+		caller := LocalCaller{Name: fmt.Sprintf("client %d", key.client)}
+		request, err := fs.acquireAs(caller, participant, resource, session, nil)
+		answer := &Message{Type: MsgProxyGrant, From: participant, To: key.client, Seq: key.seq, Resource: resource}
+		if err != nil {
+			answer.Type, answer.Content = MsgProxyRefuse, err.Error()
+		} else {
+			answer.Timestamp = request.Timestamp
+			fs.proxyMutex.Lock()
+			if fs.proxyHeld == nil {
+				fs.proxyHeld = make(map[proxyKey]*Request)
+			}
+			fs.proxyHeld[key] = request
+			fs.proxyMutex.Unlock()
+		}
+		if err := fs.send(answer); err != nil {
+			fs.Log.Errorf("Error sending %s from client %d: %v", answer.Type, participant, err)
+			if request != nil {
+				fs.releaseProxied(key)
+			}
+		}
+	}()
+}
+
+// ReceiveProxyRelease leaves the critical section msg.To entered for the
+// lightweight client msg.From.
+func (fs *DistributedFileSystem) ReceiveProxyRelease(msg *Message) {
+	if !fs.releaseProxied(proxyKey{msg.From, msg.Seq}) {
+		fs.Log.Warnf("Client %d: PROXY_RELEASE %d from client %d for no critical section it holds", msg.To, msg.Seq, msg.From)
+	}
+}
+
+// releaseProxied releases the critical section held for key, reporting
+// whether there was one.
+func (fs *DistributedFileSystem) releaseProxied(key proxyKey) bool {
+	fs.proxyMutex.Lock()
+	request, ok := fs.proxyHeld[key]
+	delete(fs.proxyHeld, key)
+	fs.proxyMutex.Unlock()
+	if !ok {
+		return false
+	}
+	if err := fs.ReleaseRequest(request); err != nil {
+		fs.Log.Warnf("Client %d releasing %s for client %d: %v", request.ClientID, request.Resource, key.client, err)
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+package ra
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// A lightweight client that gives up waiting for its participant must not
+// leave the participant in the critical section once it gets in.
+func TestProxyTimeoutReleasesLateGrant(t *testing.T) {
+	transport := NewLocalTransport()
+	proxies := map[int]int{3: 1}
+	participants := NewDistributedFileSystem(JSONCodec{}, transport)
+	participants.Storage = NewMemoryStorage(nil)
+	participants.Proxies = proxies
+	participants.Join(1)
+	participants.Join(2)
+	// Client 3 runs apart from its participant, as on another host, with
+	// a timeout of its own.
+	lightweight := NewDistributedFileSystem(JSONCodec{}, transport)
+	lightweight.Storage = participants.Storage
+	lightweight.Proxies = proxies
+	lightweight.ReplyTimeout = 50 * time.Millisecond
+	lightweight.Join(3)
+
+	held, err := participants.AcquireResource(2, "notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lightweight.AcquireResource(3, "notes.txt"); !errors.Is(err, ErrPeerTimeout) {
+		t.Fatalf("client 3 waiting on client 2's critical section: got %v, want ErrPeerTimeout", err)
+	}
+	// Client 1 gets in for client 3 only now, after client 3 gave up.
+	if err := participants.ReleaseRequest(held); err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan error, 1)
+	go func() {
+		request, err := participants.AcquireResource(2, "notes.txt")
+		if err == nil {
+			err = participants.ReleaseRequest(request)
+		}
+		acquired <- err
+	}()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client 1 stayed in the critical section it entered for client 3")
+	}
+}
@@ -0,0 +1,88 @@
+package ra
+
+import "sync"
+
+// SafetyChecker watches critical section entries and exits and counts the
+// times two clients were inside the same resource at once, other than
+// members of one session. With the protocol running that count must stay
+// at zero. A nil SafetyChecker checks nothing.
+type SafetyChecker struct {
+	// Log receives each violation; nil is DefaultLogger.
+	Log        Logger
+	mu         sync.Mutex
+	holders    map[string][]*Request
+	violations int
+}
+
+func NewSafetyChecker() *SafetyChecker {
+	return &SafetyChecker{holders: make(map[string][]*Request)}
+}
+
+// Enter records that request entered its resource.
+func (c *SafetyChecker) Enter(request *Request) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, other := range c.holders[request.Resource] {
+		if sameSession(other, request) {
+			continue
+		}
+		c.violations++
+		loggerOr(c.Log).Errorf("SAFETY VIOLATION: client %d entered %s while client %d holds it", request.ClientID, request.Resource, other.ClientID)
+	}
+	c.holders[request.Resource] = append(c.holders[request.Resource], request)
+}
+
+// Exit records that request left its resource. Exiting twice is harmless.
+func (c *SafetyChecker) Exit(request *Request) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	holders := c.holders[request.Resource]
+	for i, r := range holders {
+		if r == request {
+			c.holders[request.Resource] = append(holders[:i:i], holders[i+1:]...)
+			return
+		}
+	}
+}
+
+// Violations returns the number of overlapping entries seen so far.
+func (c *SafetyChecker) Violations() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.violations
+}
+
+// timelineViolations counts the overlapping critical sections in a merged
+// event timeline.
+func timelineViolations(events []Event) int {
+	holders := make(map[string]map[int]string)
+	violations := 0
+	for _, e := range events {
+		switch e.Kind {
+		case EventEnter:
+			if holders[e.Resource] == nil {
+				holders[e.Resource] = make(map[int]string)
+			}
+			for _, session := range holders[e.Resource] {
+				if session == "" || session != e.Session {
+					violations++
+				}
+			}
+			holders[e.Resource][e.Node] = e.Session
+		case EventExit:
+			delete(holders[e.Resource], e.Node)
+		}
+	}
+	return violations
+}
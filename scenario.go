@@ -0,0 +1,309 @@
+package ra
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scenario is a demo run selectable with -scenario. Most are workloads
+// built for the number of clients; scripted ones drive the clients
+// themselves.
+type Scenario struct {
+	Description string
+	// Workload builds the scenario's workload for n clients. It is nil for
+	// scripted scenarios.
+	Workload func(n int) *Workload
+	// Run runs a scripted scenario on n clients, writing each client's span
+	// to the space-time diagram.
+	Run func(fs *DistributedFileSystem, n int, diagram *os.File) error
+}
+
+var scenarios = map[string]Scenario{
+	"demo": {
+		Description: "every client writes and then reads file1.txt once",
+		Run: func(fs *DistributedFileSystem, n int, diagram *os.File) error {
+			runDemo(fs, n, diagram)
+			return nil
+		},
+	},
+	"high-contention": {
+		Description: "every client hammers file1.txt with short think times",
+		Workload: func(n int) *Workload {
+			return &Workload{Seed: 1, Default: ClientWorkload{
+				Operations: 10,
+				ReadRatio:  0.3,
+				ThinkTime:  Distribution{Kind: "uniform", Max: Duration(5 * time.Millisecond)},
+				HoldTime:   Distribution{Kind: "constant", Mean: Duration(5 * time.Millisecond)},
+				Files:      []string{"file1.txt"},
+			}}
+		},
+	},
+	"low-contention": {
+		Description: "clients spread their operations over one file each, rarely meeting",
+		Workload: func(n int) *Workload {
+			return &Workload{Seed: 1, Default: ClientWorkload{
+				Operations: 10,
+				ReadRatio:  0.5,
+				ThinkTime:  Distribution{Kind: "exponential", Mean: Duration(20 * time.Millisecond), Max: Duration(100 * time.Millisecond)},
+				HoldTime:   Distribution{Kind: "constant", Mean: Duration(2 * time.Millisecond)},
+				Files:      numberedFiles(max(n, 2)),
+			}}
+		},
+	},
+	"skewed": {
+		Description: "operations over eight files with Zipf-like popularity, so a few files are hot",
+		Workload: func(n int) *Workload {
+			files := numberedFiles(8)
+			weights := make([]float64, len(files))
+			for i := range weights {
+				weights[i] = 1 / float64(i+1)
+			}
+			return &Workload{Seed: 1, Default: ClientWorkload{
+				Operations:  15,
+				ReadRatio:   0.5,
+				ThinkTime:   Distribution{Kind: "exponential", Mean: Duration(10 * time.Millisecond), Max: Duration(50 * time.Millisecond)},
+				HoldTime:    Distribution{Kind: "constant", Mean: Duration(3 * time.Millisecond)},
+				Files:       files,
+				FileWeights: weights,
+			}}
+		},
+	},
+	"bursty": {
+		Description: "clients idle together, then all fire bursts of five back-to-back operations",
+		Workload: func(n int) *Workload {
+			return &Workload{Seed: 1, Default: ClientWorkload{
+				Operations: 15,
+				ReadRatio:  0.5,
+				ThinkTime:  Distribution{Kind: "constant", Mean: Duration(150 * time.Millisecond)},
+				HoldTime:   Distribution{Kind: "constant", Mean: Duration(2 * time.Millisecond)},
+				Files:      []string{"file1.txt", "file2.txt"},
+				Burst:      5,
+			}}
+		},
+	},
+	"transactions": {
+		Description: "clients take two files in opposite orders inside wound-wait transactions, which cannot deadlock",
+		Run:         runTransactions,
+	},
+	"local-queue": {
+		Description: "three local callers on client 1 share file1.txt with the other clients, served by -local-queue (fifo by default)",
+		Run:         runLocalQueue,
+	},
+	"bank": {
+		Description: "every client deposits to and withdraws from one account, whose final balance is checked against the operations (try with -no-mutex)",
+		Run:         runBank,
+	},
+	"flood": {
+		Description: "client 1 asks for eight resources client 2 holds at once, and client 2 answers beyond its -peer-window (default 2 here) with BUSY",
+		Run:         runFlood,
+	},
+	"lost-update": {
+		Description: "clients 1 and 2 both read a counter and write back one more; with optimistic writes the stale write is rejected with a conflict and retried",
+		Run:         runLostUpdate,
+	},
+	"hierarchy": {
+		Description: "client 1 locks the directory docs/ while the other clients write files inside it, with -hierarchical locking",
+		Run:         runHierarchy,
+	},
+	"classroom": {
+		Description: "a scripted walk through Ricart-Agarwala with the protocol explained as it runs",
+		Run:         runClassroom,
+	},
+}
+
+// scenarioNames returns the selectable scenario names, sorted.
+func scenarioNames() []string {
+	names := make([]string, 0, len(scenarios))
+	for name := range scenarios {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupScenario returns the scenario called name.
+func LookupScenario(name string) (Scenario, error) {
+	sc, ok := scenarios[name]
+	if !ok {
+		return Scenario{}, fmt.Errorf("unknown scenario %q (want one of %s)", name, strings.Join(scenarioNames(), ", "))
+	}
+	return sc, nil
+}
+
+// numberedFiles returns file1.txt to fileN.txt.
+func numberedFiles(n int) []string {
+	files := make([]string, n)
+	for i := range files {
+		files[i] = fmt.Sprintf("file%d.txt", i+1)
+	}
+	return files
+}
+
+// ensureFiles creates any of files missing from storage, empty, so a
+// scenario can open them.
+func (fs *DistributedFileSystem) ensureFiles(files []string) error {
+	for _, name := range files {
+		_, err := fs.Storage.Load(name)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := fs.Storage.Store(name, nil); err != nil {
+			return err
+		}
+		fs.Log.Infof("Created empty %s for the scenario", name)
+	}
+	return nil
+}
+
+// narrate prints a classroom explanation, set apart from the protocol's own
+// output.
+func narrate(format string, args ...interface{}) {
+	fmt.Printf("\n== "+format+"\n", args...)
+}
+
+// runClassroom walks through the cases that matter in Ricart-Agarwala on
+// clients 1 to 3, explaining each as it happens: an uncontended request, a
+// request deferred by the holder, and two concurrent requests ordered by
+// (timestamp, id).
+func runClassroom(fs *DistributedFileSystem, n int, diagram *os.File) error {
+	if n < 3 {
+		return fmt.Errorf("the classroom scenario needs at least 3 clients, got %d", n)
+	}
+	if fs.Mutex.Name() != "ricart-agarwala" {
+		return fmt.Errorf("the classroom scenario explains ricart-agarwala, not %s", fs.Mutex.Name())
+	}
+	const fileName = "file1.txt"
+	handles := make(map[int]*Handle)
+	for id := 1; id <= 3; id++ {
+		handle, err := fs.OpenFile(id, fileName)
+		if err != nil {
+			return err
+		}
+		defer fs.CloseFile(handle)
+		handles[id] = handle
+	}
+	starts := map[int]time.Time{1: time.Now(), 2: time.Now(), 3: time.Now()}
+
+	narrate("Step 1: client 1 asks for %s while everyone else is idle.", fileName)
+	narrate("It stamps its REQUEST with its Lamport clock and sends it to all %d peers. Idle peers reply at once.", n-1)
+	request, err := fs.AcquireRequest(1, handles[1])
+	if err != nil {
+		return err
+	}
+	narrate("Client 1 has all %d replies and enters the critical section (request ts %d).", n-1, request.Timestamp)
+	fs.ReleaseRequest(request)
+	narrate("Client 1 leaves. It deferred no replies, so it sends nothing more.")
+
+	narrate("Step 2: client 1 enters again, and client 2 asks while it is inside.")
+	held, err := fs.AcquireRequest(1, handles[1])
+	if err != nil {
+		return err
+	}
+	entered := make(chan *Request, 1)
+	go func() {
+		request, err := fs.AcquireRequest(2, handles[2])
+		if err != nil {
+			fs.Log.Errorf("Error acquiring %s: %v", fileName, err)
+			close(entered)
+			return
+		}
+		entered <- request
+	}()
+	if d := waitDeferred(fs.Node(1), fileName, 2, time.Second); d != nil {
+		narrate("Client 1 is HELD, so instead of replying it defers client 2's request (ts %d) in its queue.", d.Timestamp)
+	}
+	narrate("Client 2 now waits with replies from every peer but client 1.")
+	time.Sleep(20 * time.Millisecond)
+	narrate("Client 1 leaves and sends the reply it deferred.")
+	fs.ReleaseRequest(held)
+	second, ok := <-entered
+	if !ok {
+		return fmt.Errorf("client 2 could not enter %s", fileName)
+	}
+	narrate("That was the last reply client 2 needed: it enters (request ts %d).", second.Timestamp)
+	fs.ReleaseRequest(second)
+
+	narrate("Step 3: clients 2 and 3 ask at the same moment.")
+	narrate("Each defers the other's request if its own (timestamp, id) is smaller, so exactly one enters first.")
+	type entry struct {
+		client  int
+		request *Request
+	}
+	order := make(chan entry, 2)
+	var wg sync.WaitGroup
+	for _, id := range []int{2, 3} {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			request, err := fs.AcquireRequest(id, handles[id])
+			if err != nil {
+				fs.Log.Errorf("Error acquiring %s: %v", fileName, err)
+				return
+			}
+			order <- entry{id, request}
+			time.Sleep(10 * time.Millisecond)
+			fs.ReleaseRequest(request)
+		}(id)
+	}
+	wg.Wait()
+	close(order)
+	var entries []entry
+	for e := range order {
+		entries = append(entries, e)
+	}
+	if len(entries) == 2 {
+		first, next := entries[0], entries[1]
+		narrate("Client %d entered first with (ts %d, id %d); client %d followed with (ts %d, id %d).",
+			first.client, first.request.Timestamp, first.client, next.client, next.request.Timestamp, next.client)
+		if first.request.Timestamp == next.request.Timestamp {
+			narrate("The timestamps were equal, so the %s tie-break decided.", tieBreakName(fs.TieBreak))
+		} else {
+			narrate("The earlier timestamp won; client ids only matter when timestamps are equal.")
+		}
+	}
+
+	if coster, ok := fs.Mutex.(messageCoster); ok {
+		narrate("Every entry costs %s messages: a REQUEST and a REPLY for each peer.", coster.MessageCost(n))
+	}
+	end := time.Now()
+	for id := 1; id <= 3; id++ {
+		printSpaceTimeDiagram(id, starts[id], end, diagram)
+	}
+	return nil
+}
+
+// waitDeferred waits up to timeout for node to defer a request of client
+// for resource and returns it, or nil.
+func waitDeferred(node *Node, resource string, client int, timeout time.Duration) *Request {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		_, views := node.View()
+		for _, view := range views {
+			if view.Resource != resource {
+				continue
+			}
+			for _, d := range view.Deferred {
+				if d.ClientID == client {
+					return d
+				}
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+func tieBreakName(tb TieBreak) string {
+	if tb == nil {
+		return LowestID{}.Name()
+	}
+	return tb.Name()
+}
@@ -0,0 +1,258 @@
+package ra
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Simulation controls, for walking through the protocol in front of a
+// class: a NetEm can run at a multiple of real speed, be paused, and then
+// deliver the frames it holds back one at a time.
+
+// PendingFrame is a frame sent but not yet delivered.
+type PendingFrame struct {
+	From int       `json:"from"`
+	To   int       `json:"to"`
+	Due  time.Time `json:"due"`
+	// Message describes the frame, if the NetEm has a Describe function.
+	Message string `json:"message,omitempty"`
+}
+
+func (f PendingFrame) String() string {
+	s := fmt.Sprintf("client %d -> client %d", f.From, f.To)
+	if f.Message != "" {
+		s += ": " + f.Message
+	}
+	return s
+}
+
+// SimState is the simulation as served by GET /sim.
+type SimState struct {
+	Paused  bool           `json:"paused"`
+	Speed   float64        `json:"speed"`
+	Pending []PendingFrame `json:"pending"`
+}
+
+// SetSpeed runs the emulated network at speed times real time: every
+// latency and jitter is divided by it, so 0.5 is half speed. It applies to
+// frames sent from now on.
+func (n *NetEm) SetSpeed(speed float64) error {
+	if speed <= 0 {
+		return fmt.Errorf("speed %g: must be positive", speed)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.speed = speed
+	return nil
+}
+
+// Pause holds back every frame until Resume, except those let through by
+// Step.
+func (n *NetEm) Pause() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.paused = true
+	n.changedLocked()
+}
+
+// Resume delivers frames again as they fall due.
+func (n *NetEm) Resume() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.paused = false
+	for _, link := range n.links {
+		link.steps = 0
+	}
+	n.changedLocked()
+}
+
+// Step lets the next frame through while the network is paused: of the
+// frames not yet let through on links outside any partition, the one due
+// first. It reports false if there is none or the network is running.
+func (n *NetEm) Step() (PendingFrame, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.paused {
+		return PendingFrame{}, false
+	}
+	var (
+		next     *emLink
+		nextKey  linkKey
+		nextData []byte
+		due      time.Time
+	)
+	for key, link := range n.links {
+		if !n.connectedLocked(key[0], key[1]) {
+			continue
+		}
+		link.mu.Lock()
+		if link.steps < len(link.queue) {
+			frame := link.queue[link.steps]
+			if next == nil || frame.at.Before(due) {
+				next, nextKey, nextData, due = link, key, frame.data, frame.at
+			}
+		}
+		link.mu.Unlock()
+	}
+	if next == nil {
+		return PendingFrame{}, false
+	}
+	next.steps++
+	n.changedLocked()
+	return n.pending(nextKey, nextData, due), true
+}
+
+// Pending returns the frames not yet delivered, in the order they fall due.
+func (n *NetEm) Pending() []PendingFrame {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var frames []PendingFrame
+	for key, link := range n.links {
+		link.mu.Lock()
+		for _, frame := range link.queue {
+			frames = append(frames, n.pending(key, frame.data, frame.at))
+		}
+		link.mu.Unlock()
+	}
+	sort.SliceStable(frames, func(i, j int) bool { return frames[i].Due.Before(frames[j].Due) })
+	return frames
+}
+
+func (n *NetEm) pending(key linkKey, data []byte, due time.Time) PendingFrame {
+	frame := PendingFrame{From: key[0], To: key[1], Due: due}
+	if n.Describe != nil {
+		frame.Message = n.Describe(data)
+	}
+	return frame
+}
+
+// SimState returns whether the network is paused, its speed and the frames
+// it holds.
+func (n *NetEm) SimState() SimState {
+	pending := n.Pending()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return SimState{Paused: n.paused, Speed: n.speed, Pending: pending}
+}
+
+// registerSimulation adds the simulation routes to admin:
+//
+//	GET  /sim               paused, speed and pending frames
+//	POST /sim/pause
+//	POST /sim/resume
+//	POST /sim/step?n=1      let the next n frames through
+//	POST /sim/speed?x=0.5   run at half speed
+func (n *NetEm) registerSimulation(admin *Admin) {
+	admin.Handle("GET /sim", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, n.SimState())
+	})
+	admin.Handle("POST /sim/pause", func(w http.ResponseWriter, r *http.Request) {
+		n.Pause()
+		writeJSON(w, n.SimState())
+	})
+	admin.Handle("POST /sim/resume", func(w http.ResponseWriter, r *http.Request) {
+		n.Resume()
+		writeJSON(w, n.SimState())
+	})
+	admin.Handle("POST /sim/step", func(w http.ResponseWriter, r *http.Request) {
+		count := 1
+		if v := r.URL.Query().Get("n"); v != "" {
+			c, err := strconv.Atoi(v)
+			if err != nil || c < 1 {
+				http.Error(w, "n must be a positive number of frames", http.StatusBadRequest)
+				return
+			}
+			count = c
+		}
+		stepped := []PendingFrame{}
+		for range count {
+			frame, ok := n.Step()
+			if !ok {
+				break
+			}
+			stepped = append(stepped, frame)
+		}
+		writeJSON(w, stepped)
+	})
+	admin.Handle("POST /sim/speed", func(w http.ResponseWriter, r *http.Request) {
+		speed, err := strconv.ParseFloat(r.URL.Query().Get("x"), 64)
+		if err == nil {
+			err = n.SetSpeed(speed)
+		}
+		if err != nil {
+			http.Error(w, "x must be a positive speed, e.g. 0.5 or 2", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, n.SimState())
+	})
+}
+
+// RunSimConsole reads simulation commands from r, one per line, and
+// answers on w until r ends, when it resumes the network so the run can
+// finish:
+//
+//	s [n]     step: deliver the next n frames (default 1)
+//	p         pause
+//	r         resume
+//	x SPEED   run at SPEED times real time
+//	l         list the pending frames
+func RunSimConsole(r io.Reader, w io.Writer, n *NetEm) {
+	defer n.Resume()
+	fmt.Fprintln(w, "Simulation paused. Commands: s [n] step, p pause, r resume, x SPEED, l list pending")
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			fields = []string{"s"}
+		}
+		switch fields[0] {
+		case "s", "step":
+			count := 1
+			if len(fields) > 1 {
+				if c, err := strconv.Atoi(fields[1]); err == nil && c > 0 {
+					count = c
+				}
+			}
+			for range count {
+				frame, ok := n.Step()
+				if !ok {
+					fmt.Fprintln(w, "nothing to step (running, or no frames pending)")
+					break
+				}
+				fmt.Fprintf(w, "delivering %s\n", frame)
+			}
+		case "p", "pause":
+			n.Pause()
+			fmt.Fprintln(w, "paused")
+		case "r", "resume":
+			n.Resume()
+			fmt.Fprintln(w, "running")
+		case "x", "speed":
+			speed := 0.0
+			if len(fields) > 1 {
+				speed, _ = strconv.ParseFloat(fields[1], 64)
+			}
+			if err := n.SetSpeed(speed); err != nil {
+				fmt.Fprintf(w, "usage: x SPEED, e.g. x 0.5: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(w, "speed %gx\n", speed)
+		case "l", "list":
+			pending := n.Pending()
+			if len(pending) == 0 {
+				fmt.Fprintln(w, "no frames pending")
+			}
+			for i, frame := range pending {
+				fmt.Fprintf(w, "%d. %s\n", i+1, frame)
+			}
+		default:
+			fmt.Fprintf(w, "unknown command %q\n", fields[0])
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package ra
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrSnapshotTimeout = errors.New("snapshot did not complete in time")
+
+// RequestState is a request as captured in a snapshot.
+type RequestState struct {
+	ClientID  int    `json:"client"`
+	Resource  string `json:"resource"`
+	Timestamp int    `json:"timestamp"`
+}
+
+// NodeSnapshot is one client's recorded state plus the messages that were
+// in flight on each of its incoming channels.
+type NodeSnapshot struct {
+	ClientID int                `json:"client"`
+	Clock    int                `json:"clock"`
+	Held     []string           `json:"held"`
+	Waiting  []RequestState     `json:"waiting"`
+	Deferred []RequestState     `json:"deferred"`
+	Channels map[int][]*Message `json:"channels"`
+}
+
+// GlobalSnapshot is a consistent cut of the whole cluster.
+type GlobalSnapshot struct {
+	ID        uint64         `json:"id"`
+	Initiator int            `json:"initiator"`
+	Taken     time.Time      `json:"taken"`
+	Nodes     []NodeSnapshot `json:"nodes"`
+}
+
+type localSnapshot struct {
+	state NodeSnapshot
+	// open holds the incoming channels still being recorded, i.e. those
+	// a marker has not arrived on yet.
+	open map[int]bool
+}
+
+type snapshotRun struct {
+	initiator int
+	peers     []int
+	local     map[int]*localSnapshot
+	remaining int
+	done      chan *GlobalSnapshot
+}
+
+// Snapshotter runs the Chandy-Lamport algorithm over the transport. A node
+// records its own state the first time it sees a marker (or when it starts
+// the snapshot), sends markers on every outgoing channel and then records
+// each incoming channel until a marker arrives on it.
+type Snapshotter struct {
+	mu     sync.Mutex
+	nextID uint64
+	runs   map[uint64]*snapshotRun
+}
+
+func NewSnapshotter() *Snapshotter {
+	return &Snapshotter{runs: make(map[uint64]*snapshotRun)}
+}
+
+// TakeSnapshot starts a snapshot at initiator and waits for every client to
+// finish recording.
+func (fs *DistributedFileSystem) TakeSnapshot(initiator int, timeout time.Duration) (*GlobalSnapshot, error) {
+	sn := fs.Snapshots
+	peers := fs.participants()
+
+	sn.mu.Lock()
+	sn.nextID++
+	id := sn.nextID
+	run := &snapshotRun{
+		initiator: initiator,
+		peers:     peers,
+		local:     make(map[int]*localSnapshot),
+		remaining: len(peers),
+		done:      make(chan *GlobalSnapshot, 1),
+	}
+	sn.runs[id] = run
+	sn.recordLocked(fs, id, run, initiator, 0)
+	sn.mu.Unlock()
+
+	select {
+	case snapshot := <-run.done:
+		return snapshot, nil
+	case <-time.After(timeout):
+		sn.mu.Lock()
+		delete(sn.runs, id)
+		sn.mu.Unlock()
+		return nil, ErrSnapshotTimeout
+	}
+}
+
+// SaveSnapshot takes a snapshot and writes it to snapshot-<id>.json.
+func (fs *DistributedFileSystem) SaveSnapshot(initiator int, timeout time.Duration) {
+	snapshot, err := fs.TakeSnapshot(initiator, timeout)
+	if err != nil {
+		fs.Log.Errorf("Error taking snapshot: %v", err)
+		return
+	}
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		fs.Log.Errorf("Error encoding snapshot: %v", err)
+		return
+	}
+	path := fmt.Sprintf("snapshot-%d.json", snapshot.ID)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		fs.Log.Errorf("Error writing snapshot: %v", err)
+		return
+	}
+	fs.Log.Infof("Snapshot %d written to %s", snapshot.ID, path)
+}
+
+// recordLocked records clientID's state, starts recording every incoming
+// channel except the one the marker came in on and sends markers to every
+// peer. from is 0 when clientID is the initiator.
+func (sn *Snapshotter) recordLocked(fs *DistributedFileSystem, id uint64, run *snapshotRun, clientID, from int) {
+	local := &localSnapshot{
+		state: fs.captureNodeState(clientID),
+		open:  make(map[int]bool),
+	}
+	for _, peer := range run.peers {
+		if peer != clientID && peer != from {
+			local.open[peer] = true
+		}
+	}
+	run.local[clientID] = local
+
+	for _, peer := range run.peers {
+		if peer == clientID {
+			continue
+		}
+		err := fs.send(&Message{
+			Type:       MsgMarker,
+			From:       clientID,
+			To:         peer,
+			Timestamp:  fs.Node(clientID).Clock(),
+			SnapshotID: id,
+		})
+		if err != nil {
+			fs.Log.Errorf("Error sending marker from client %d: %v", clientID, err)
+		}
+	}
+
+	sn.maybeFinishLocked(id, run, clientID)
+}
+
+func (sn *Snapshotter) maybeFinishLocked(id uint64, run *snapshotRun, clientID int) {
+	if len(run.local[clientID].open) > 0 {
+		return
+	}
+	run.remaining--
+	if run.remaining > 0 {
+		return
+	}
+
+	snapshot := &GlobalSnapshot{ID: id, Initiator: run.initiator, Taken: time.Now()}
+	for _, peer := range run.peers {
+		snapshot.Nodes = append(snapshot.Nodes, run.local[peer].state)
+	}
+	delete(sn.runs, id)
+	run.done <- snapshot
+}
+
+// receiveMarker handles a MARKER delivered to clientID.
+func (sn *Snapshotter) receiveMarker(fs *DistributedFileSystem, clientID int, msg *Message) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	run, ok := sn.runs[msg.SnapshotID]
+	if !ok {
+		return
+	}
+	local, recorded := run.local[clientID]
+	if !recorded {
+		sn.recordLocked(fs, msg.SnapshotID, run, clientID, msg.From)
+		return
+	}
+	if local.open[msg.From] {
+		delete(local.open, msg.From)
+		sn.maybeFinishLocked(msg.SnapshotID, run, clientID)
+	}
+}
+
+// recordMessage adds msg to the channel state of every snapshot that is
+// still recording the channel it arrived on.
+func (sn *Snapshotter) recordMessage(clientID int, msg *Message) {
+	if sn == nil {
+		return
+	}
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	for _, run := range sn.runs {
+		local, ok := run.local[clientID]
+		if ok && local.open[msg.From] {
+			// msg goes back to the pool once handled, so keep a copy.
+			recorded := *msg
+			local.state.Channels[msg.From] = append(local.state.Channels[msg.From], &recorded)
+		}
+	}
+}
+
+// captureNodeState reads clientID's clock and per-resource state.
+func (fs *DistributedFileSystem) captureNodeState(clientID int) NodeSnapshot {
+	clock, views := fs.Node(clientID).View()
+	state := NodeSnapshot{
+		ClientID: clientID,
+		Clock:    clock,
+		Channels: make(map[int][]*Message),
+	}
+
+	for _, view := range views {
+		switch view.State {
+		case Held:
+			state.Held = append(state.Held, view.Resource)
+		case Wanted:
+			state.Waiting = append(state.Waiting, RequestState{ClientID: clientID, Resource: view.Resource, Timestamp: view.Request.Timestamp})
+		}
+		for _, r := range view.Deferred {
+			state.Deferred = append(state.Deferred, RequestState{ClientID: r.ClientID, Resource: view.Resource, Timestamp: r.Timestamp})
+		}
+	}
+	return state
+}
@@ -0,0 +1,394 @@
+package ra
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// messageID identifies a message between its send and its receipt.
+type messageID struct {
+	typ       MessageType
+	from, to  int
+	seq       uint64
+	resource  string
+	timestamp int
+}
+
+// TracedMessage is one message as drawn in the space-time diagram: when it
+// was sent and received by Lamport clock and by each end's simulated
+// physical clock.
+type TracedMessage struct {
+	Type     MessageType
+	From, To int
+	Resource string
+	// SendClock and RecvClock are the sender's Lamport clock when it sent
+	// the message and the receiver's once it had observed it.
+	SendClock, RecvClock int
+	// SendTime and RecvTime are read from the sender's and receiver's
+	// simulated physical clocks, which are skewed by up to the drift.
+	SendTime, RecvTime time.Time
+	// Delay is the true time the message took, measured on one clock.
+	Delay    time.Duration
+	sent     time.Time
+	received bool
+}
+
+// TracedSection is one critical section as stamped by Lamport clock and by
+// its holder's simulated physical clock.
+type TracedSection struct {
+	Client   int
+	Resource string
+	Session  string
+	// Timestamp is the request's Lamport timestamp, which orders it against
+	// concurrent requests; Requested is the physical time it was made.
+	Timestamp int
+	Requested time.Time
+	// EnterClock and ExitClock are the holder's Lamport clock on entering
+	// and leaving; Entered and Exited are its physical clock then.
+	EnterClock, ExitClock int
+	Entered, Exited       time.Time
+	// entered and left are the true times, measured on one clock.
+	entered, left time.Time
+}
+
+// MessageTrace records every message sent between local clients for the
+// space-time diagram. Each client reads a simulated physical clock offset
+// from the real one by a random skew of up to Drift, to show that physical
+// timestamps can put a receipt before its send while Lamport timestamps
+// never do. A nil MessageTrace records nothing.
+type MessageTrace struct {
+	Drift time.Duration
+
+	mu       sync.Mutex
+	skews    map[int]time.Duration
+	rng      *rand.Rand
+	messages []*TracedMessage
+	inFlight map[messageID][]*TracedMessage
+	sections []*TracedSection
+	open     map[*Request]*TracedSection
+}
+
+func NewMessageTrace(drift time.Duration, seed int64) *MessageTrace {
+	return &MessageTrace{
+		Drift:    drift,
+		skews:    make(map[int]time.Duration),
+		rng:      rand.New(rand.NewSource(seed)),
+		inFlight: make(map[messageID][]*TracedMessage),
+		open:     make(map[*Request]*TracedSection),
+	}
+}
+
+// skew returns client's clock offset, choosing it on first use. The caller
+// holds t.mu.
+func (t *MessageTrace) skew(client int) time.Duration {
+	s, ok := t.skews[client]
+	if !ok && t.Drift > 0 {
+		s = time.Duration(t.rng.Int63n(int64(2*t.Drift)+1)) - t.Drift
+		t.skews[client] = s
+	}
+	return s
+}
+
+func tracedID(msg *Message) messageID {
+	return messageID{msg.Type, msg.From, msg.To, msg.Seq, msg.Resource, msg.Timestamp}
+}
+
+// sent records msg leaving its sender, whose Lamport clock reads clock.
+func (t *MessageTrace) sent(msg *Message, clock int) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := &TracedMessage{
+		Type:      msg.Type,
+		From:      msg.From,
+		To:        msg.To,
+		Resource:  msg.Resource,
+		SendClock: clock,
+		SendTime:  now.Add(t.skew(msg.From)),
+		sent:      now,
+	}
+	t.messages = append(t.messages, m)
+	id := tracedID(msg)
+	t.inFlight[id] = append(t.inFlight[id], m)
+}
+
+// received records msg arriving at its receiver, whose Lamport clock reads
+// clock after observing it.
+func (t *MessageTrace) received(msg *Message, clock int) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id := tracedID(msg)
+	queue := t.inFlight[id]
+	if len(queue) == 0 {
+		return
+	}
+	m := queue[0]
+	if len(queue) == 1 {
+		delete(t.inFlight, id)
+	} else {
+		t.inFlight[id] = queue[1:]
+	}
+	m.RecvClock = clock
+	m.RecvTime = now.Add(t.skew(msg.To))
+	m.Delay = now.Sub(m.sent)
+	m.received = true
+}
+
+// enter records request's holder entering the critical section with its
+// Lamport clock reading clock.
+func (t *MessageTrace) enter(request *Request, clock int) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	skew := t.skew(request.ClientID)
+	s := &TracedSection{
+		Client:     request.ClientID,
+		Resource:   request.Resource,
+		Session:    request.Session,
+		Timestamp:  request.Timestamp,
+		Requested:  request.Requested.Add(skew),
+		EnterClock: clock,
+		Entered:    now.Add(skew),
+		entered:    now,
+	}
+	t.sections = append(t.sections, s)
+	t.open[request] = s
+}
+
+// exit records request's holder leaving the critical section with its
+// Lamport clock reading clock.
+func (t *MessageTrace) exit(request *Request, clock int) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.open[request]
+	if !ok {
+		return
+	}
+	delete(t.open, request)
+	s.ExitClock = clock
+	s.Exited = now.Add(t.skew(request.ClientID))
+	s.left = now
+}
+
+// Sections returns the completed critical sections in the order they were
+// really entered.
+func (t *MessageTrace) Sections() []TracedSection {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var sections []TracedSection
+	for _, s := range t.sections {
+		if !s.left.IsZero() {
+			sections = append(sections, *s)
+		}
+	}
+	sort.SliceStable(sections, func(i, j int) bool { return sections[i].entered.Before(sections[j].entered) })
+	return sections
+}
+
+// ClockComparison sets the order physical timestamps give the critical
+// sections against the order Lamport timestamps give them.
+type ClockComparison struct {
+	Sections int
+	// Pairs counts pairs of requests for the same resource, and Reordered
+	// those whose physical request times order them differently from their
+	// Lamport (timestamp, client) order, i.e. the pairs a mutex ordering
+	// requests by physical time would have served the other way round.
+	Pairs, Reordered int
+	// Successions counts critical sections that followed another on the
+	// same resource. PhysicalOverlaps are those the physical clocks stamp
+	// as entered before the previous holder left, a mutual exclusion
+	// violation that never happened; LamportOverlaps those the Lamport
+	// clocks do, which the algorithm rules out.
+	Successions                       int
+	PhysicalOverlaps, LamportOverlaps []Succession
+}
+
+// Succession is a critical section on a resource and the one before it.
+type Succession struct {
+	Previous, Next TracedSection
+}
+
+// CompareClocks compares physical with Lamport ordering over every
+// completed critical section.
+func (t *MessageTrace) CompareClocks() ClockComparison {
+	var c ClockComparison
+	if t == nil {
+		return c
+	}
+	byResource := make(map[string][]TracedSection)
+	for _, s := range t.Sections() {
+		byResource[s.Resource] = append(byResource[s.Resource], s)
+		c.Sections++
+	}
+	for _, sections := range byResource {
+		for i := range sections {
+			for j := i + 1; j < len(sections); j++ {
+				a, b := sections[i], sections[j]
+				c.Pairs++
+				lamport := a.Timestamp < b.Timestamp || a.Timestamp == b.Timestamp && a.Client < b.Client
+				if lamport != a.Requested.Before(b.Requested) {
+					c.Reordered++
+				}
+			}
+		}
+		for i := 1; i < len(sections); i++ {
+			prev, next := sections[i-1], sections[i]
+			// Sections sharing a session, or that really overlapped, hold
+			// the resource together and do not succeed one another.
+			if prev.Session != "" && prev.Session == next.Session || next.entered.Before(prev.left) {
+				continue
+			}
+			c.Successions++
+			if next.Entered.Before(prev.Exited) {
+				c.PhysicalOverlaps = append(c.PhysicalOverlaps, Succession{prev, next})
+			}
+			if next.EnterClock < prev.ExitClock {
+				c.LamportOverlaps = append(c.LamportOverlaps, Succession{prev, next})
+			}
+		}
+	}
+	return c
+}
+
+func (c ClockComparison) String() string {
+	return fmt.Sprintf("%d of %d request pairs ordered differently by physical time than by Lamport time; %d of %d successive critical sections appear to overlap by physical time, %d by Lamport time",
+		c.Reordered, c.Pairs, len(c.PhysicalOverlaps), c.Successions, len(c.LamportOverlaps))
+}
+
+// Messages returns the received messages in the order they were sent.
+func (t *MessageTrace) Messages() []TracedMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var messages []TracedMessage
+	for _, m := range t.messages {
+		if m.received {
+			messages = append(messages, *m)
+		}
+	}
+	return messages
+}
+
+// DelayStats summarises the delays of some messages.
+type DelayStats struct {
+	Count         int
+	Min, Avg, Max time.Duration
+}
+
+func delayStats(messages []TracedMessage) DelayStats {
+	var s DelayStats
+	var total time.Duration
+	for _, m := range messages {
+		if s.Count == 0 || m.Delay < s.Min {
+			s.Min = m.Delay
+		}
+		if m.Delay > s.Max {
+			s.Max = m.Delay
+		}
+		total += m.Delay
+		s.Count++
+	}
+	if s.Count > 0 {
+		s.Avg = total / time.Duration(s.Count)
+	}
+	return s
+}
+
+func (s DelayStats) String() string {
+	return fmt.Sprintf("%d messages, delay min %s, avg %s, max %s", s.Count,
+		s.Min.Round(time.Microsecond), s.Avg.Round(time.Microsecond), s.Max.Round(time.Microsecond))
+}
+
+// WriteDiagram appends every message to the space-time diagram, with its
+// Lamport send and receive timestamps, its physical ones and its delay,
+// followed by delay statistics and a comparison of the two kinds of time.
+func (t *MessageTrace) WriteDiagram(w io.Writer) {
+	if t == nil {
+		return
+	}
+	messages := t.Messages()
+	fmt.Fprintln(w, "Messages (sender -> receiver, Lamport send -> receive, physical send -> receive, delay):")
+	backwards := 0
+	for _, m := range messages {
+		note := ""
+		if m.RecvTime.Before(m.SendTime) {
+			backwards++
+			note = "  <- received before sent by physical clocks"
+		}
+		fmt.Fprintf(w, "  %-10s %d -> %d %-10s L %3d -> %3d   P %s -> %s   %10s%s\n",
+			m.Type, m.From, m.To, m.Resource, m.SendClock, m.RecvClock,
+			m.SendTime.Format("15:04:05.000000"), m.RecvTime.Format("15:04:05.000000"),
+			m.Delay.Round(time.Microsecond), note)
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintf(w, "Delay statistics: %s\n", delayStats(messages))
+	byType := make(map[MessageType][]TracedMessage)
+	for _, m := range messages {
+		byType[m.Type] = append(byType[m.Type], m)
+	}
+	types := make([]MessageType, 0, len(byType))
+	for typ := range byType {
+		types = append(types, typ)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	for _, typ := range types {
+		fmt.Fprintf(w, "  %-10s %s\n", typ, delayStats(byType[typ]))
+	}
+
+	t.mu.Lock()
+	clients := make([]int, 0, len(t.skews))
+	for client := range t.skews {
+		clients = append(clients, client)
+	}
+	sort.Ints(clients)
+	skews := make([]time.Duration, len(clients))
+	for i, client := range clients {
+		skews[i] = t.skews[client]
+	}
+	t.mu.Unlock()
+	if len(clients) > 0 {
+		fmt.Fprintf(w, "Simulated clock skews (drift up to %s):", t.Drift)
+		for i, client := range clients {
+			fmt.Fprintf(w, " client %d %+v", client, skews[i].Round(time.Microsecond))
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "%d of %d messages appear received before they were sent by physical time; by Lamport time none can be\n", backwards, len(messages))
+
+	c := t.CompareClocks()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Critical sections (client, resource, Lamport request timestamp, physical request time, Lamport enter -> exit, physical enter -> exit):")
+	for _, s := range t.Sections() {
+		fmt.Fprintf(w, "  %d %-10s L %3d   P %s   L %3d -> %3d   P %s -> %s\n",
+			s.Client, s.Resource, s.Timestamp, s.Requested.Format("15:04:05.000000"), s.EnterClock, s.ExitClock,
+			s.Entered.Format("15:04:05.000000"), s.Exited.Format("15:04:05.000000"))
+	}
+	for _, o := range c.PhysicalOverlaps {
+		fmt.Fprintf(w, "  physical clocks put client %d into %s at %s, before client %d left it at %s\n",
+			o.Next.Client, o.Next.Resource, o.Next.Entered.Format("15:04:05.000000"),
+			o.Previous.Client, o.Previous.Exited.Format("15:04:05.000000"))
+	}
+	for _, o := range c.LamportOverlaps {
+		fmt.Fprintf(w, "  LAMPORT clocks put client %d into %s at %d, before client %d left it at %d\n",
+			o.Next.Client, o.Next.Resource, o.Next.EnterClock, o.Previous.Client, o.Previous.ExitClock)
+	}
+	fmt.Fprintln(w, c)
+}
@@ -0,0 +1,91 @@
+package ra
+
+import (
+	"sort"
+	"time"
+)
+
+// Stats is a snapshot of one node's counters and protocol state, for
+// programs embedding the package to publish however they like. It is kept
+// by the node itself, independently of Metrics and the Prometheus endpoint.
+type Stats struct {
+	Node  int `json:"node"`
+	Clock int `json:"clock"`
+	// Entries counts the critical sections the node has entered, and
+	// MeanWait is the mean time from request to entry over them.
+	Entries  uint64   `json:"entries"`
+	MeanWait Duration `json:"mean_wait"`
+	// MessagesSent and MessagesReceived count protocol messages of every
+	// type.
+	MessagesSent     uint64 `json:"messages_sent"`
+	MessagesReceived uint64 `json:"messages_received"`
+	// Deferred counts the peer requests the node has deferred so far.
+	Deferred  uint64          `json:"deferred"`
+	Resources []ResourceStats `json:"resources,omitempty"`
+}
+
+// ResourceStats is a node's state for one resource it is not idle on.
+type ResourceStats struct {
+	Resource string  `json:"resource"`
+	State    CSState `json:"state"`
+	// Holder is the client in the critical section as far as this node
+	// knows: the node itself while HELD, or 0.
+	Holder int `json:"holder,omitempty"`
+	// Waiting lists the peers whose requests the node is deferring.
+	Waiting []int `json:"waiting,omitempty"`
+}
+
+// nodeStats are the counters behind Stats, guarded by the node's mutex.
+type nodeStats struct {
+	entries   uint64
+	totalWait time.Duration
+	sent      uint64
+	received  uint64
+	deferred  uint64
+}
+
+// Stats returns a snapshot of the node's counters and of every resource
+// it is not idle on, sorted by name.
+func (n *Node) Stats() Stats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	s := Stats{
+		Node:             n.ID,
+		Clock:            n.clock,
+		Entries:          n.stats.entries,
+		MessagesSent:     n.stats.sent,
+		MessagesReceived: n.stats.received,
+		Deferred:         n.stats.deferred,
+	}
+	if n.stats.entries > 0 {
+		s.MeanWait = Duration(n.stats.totalWait / time.Duration(n.stats.entries))
+	}
+	for name, rs := range n.resources {
+		if rs.state == Released && rs.deferred.Len() == 0 {
+			continue
+		}
+		r := ResourceStats{Resource: name, State: rs.state}
+		if rs.state == Held {
+			r.Holder = n.ID
+		}
+		for _, d := range rs.deferred.Items() {
+			r.Waiting = append(r.Waiting, d.ClientID)
+		}
+		s.Resources = append(s.Resources, r)
+	}
+	sort.Slice(s.Resources, func(i, j int) bool { return s.Resources[i].Resource < s.Resources[j].Resource })
+	return s
+}
+
+// countMessage counts a message the node sent, or received if sent is
+// false.
+func (n *Node) countMessage(sent bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if sent {
+		n.record(NodeEvent{Kind: NodeMessageSent})
+	} else {
+		n.record(NodeEvent{Kind: NodeMessageReceived})
+	}
+}
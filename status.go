@@ -0,0 +1,269 @@
+package ra
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ResourceStatus is a node's state for one resource.
+type ResourceStatus struct {
+	Resource  string `json:"resource"`
+	State     string `json:"state"`
+	Session   string `json:"session,omitempty"`
+	Timestamp int    `json:"timestamp,omitempty"`
+	// Awaiting lists the peers a WANTED request has no reply from yet.
+	Awaiting []int `json:"awaiting,omitempty"`
+	// Waiting is how long a WANTED request has been waiting.
+	Waiting Duration `json:"waiting,omitempty"`
+}
+
+// DeferredReply is a reply a node owes a peer once it leaves a resource.
+type DeferredReply struct {
+	Resource  string `json:"resource"`
+	Client    int    `json:"client"`
+	Timestamp int    `json:"timestamp"`
+	Seq       uint64 `json:"seq"`
+}
+
+// PeerStatus is what a node knows about one of its peers.
+type PeerStatus struct {
+	ID       int        `json:"id"`
+	Alive    bool       `json:"alive"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// NodeStatus is a node's view of the protocol, as served by /status.
+type NodeStatus struct {
+	Node      int              `json:"node"`
+	Clock     int              `json:"clock"`
+	Resources []ResourceStatus `json:"resources"`
+	Deferred  []DeferredReply  `json:"deferred"`
+	Peers     []PeerStatus     `json:"peers"`
+}
+
+// Status returns clientID's view. A peer counts as alive if a message from
+// it arrived within aliveWithin.
+func (fs *DistributedFileSystem) Status(clientID int, aliveWithin time.Duration) (*NodeStatus, error) {
+	node := fs.Node(clientID)
+	if node == nil {
+		return nil, fmt.Errorf("%w: client %d", ErrUnknownPeer, clientID)
+	}
+
+	now := time.Now()
+	clock, views := node.View()
+	status := &NodeStatus{
+		Node:      clientID,
+		Clock:     clock,
+		Resources: []ResourceStatus{},
+		Deferred:  []DeferredReply{},
+		Peers:     []PeerStatus{},
+	}
+	for _, view := range views {
+		rs := ResourceStatus{Resource: view.Resource, State: view.State.String()}
+		if view.Request != nil {
+			rs.Timestamp = view.Request.Timestamp
+			rs.Session = view.Request.Session
+		}
+		if view.State == Wanted {
+			rs.Awaiting = view.Request.Awaiting()
+			rs.Waiting = Duration(now.Sub(view.Request.Requested))
+		}
+		status.Resources = append(status.Resources, rs)
+		for _, r := range view.Deferred {
+			status.Deferred = append(status.Deferred, DeferredReply{Resource: view.Resource, Client: r.ClientID, Timestamp: r.Timestamp, Seq: r.Seq})
+		}
+	}
+
+	fs.LastSeenMutex.Lock()
+	defer fs.LastSeenMutex.Unlock()
+	for _, peer := range fs.participants() {
+		if peer == clientID {
+			continue
+		}
+		ps := PeerStatus{ID: peer}
+		if lastSeen, ok := fs.LastSeen[peer]; ok {
+			ps.LastSeen = &lastSeen
+			ps.Alive = now.Sub(lastSeen) <= aliveWithin
+		}
+		status.Peers = append(status.Peers, ps)
+	}
+	return status, nil
+}
+
+// RegisterAdmin adds the status, files and cancel routes to admin, the
+// probes of registerHealth and the routes of registerClientSessions:
+//
+//	GET /status?node=2&alive=30s
+//	GET /files?node=2
+//	POST /cancel?node=2&resource=file1.txt
+//	GET /node-log?node=2
+//
+// node may be left out when the process runs a single node.
+func (fs *DistributedFileSystem) RegisterAdmin(admin *Admin) {
+	fs.registerHealth(admin)
+	fs.registerClientSessions(admin)
+	admin.Handle("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		aliveWithin := 30 * time.Second
+		if v := q.Get("alive"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			aliveWithin = d
+		}
+
+		clientID, err := fs.adminNode(q.Get("node"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		status, err := fs.Status(clientID, aliveWithin)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, status)
+	})
+	admin.Handle("GET /files", func(w http.ResponseWriter, r *http.Request) {
+		clientID, err := fs.adminNode(r.URL.Query().Get("node"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		files, err := fs.ListFiles(clientID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, files)
+	})
+	admin.Handle("POST /cancel", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		clientID, err := fs.adminNode(q.Get("node"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !fs.CancelRequest(clientID, q.Get("resource")) {
+			http.Error(w, fmt.Sprintf("node %d is not waiting for %q", clientID, q.Get("resource")), http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, "cancelled node %d's request for %s\n", clientID, q.Get("resource"))
+	})
+	admin.Handle("GET /node-log", func(w http.ResponseWriter, r *http.Request) {
+		clientID, err := fs.adminNode(r.URL.Query().Get("node"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		node := fs.Node(clientID)
+		if node == nil {
+			http.Error(w, fmt.Sprintf("no node %d", clientID), http.StatusNotFound)
+			return
+		}
+		base, events := node.Events()
+		writeJSON(w, struct {
+			Base   NodeState   `json:"base"`
+			Events []NodeEvent `json:"events"`
+		}{base, events})
+	})
+}
+
+// adminNode returns the node an admin request names, which may be left
+// out when the process runs a single node.
+func (fs *DistributedFileSystem) adminNode(v string) (int, error) {
+	if v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, errors.New("bad node id")
+		}
+		return id, nil
+	}
+	if nodes := fs.nodes(); len(nodes) == 1 {
+		return nodes[0].ID, nil
+	}
+	return 0, errors.New("this process runs several nodes; pass node=<id>")
+}
+
+// runStatusCommand prints a node's status fetched from an admin endpoint.
+func runStatusCommand(args []string) int {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	addr := flags.String("addr", "http://localhost:8080", "admin endpoint of the process running the node")
+	node := flags.Int("node", 0, "node to show (may be left out if the process runs one node)")
+	alive := flags.Duration("alive", 30*time.Second, "count peers heard from within this long as alive")
+	asJSON := flags.Bool("json", false, "print the raw JSON status")
+	flags.Parse(args)
+
+	url := fmt.Sprintf("%s/status?alive=%s", *addr, *alive)
+	if *node != 0 {
+		url += fmt.Sprintf("&node=%d", *node)
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error contacting %s: %v\n", *addr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "Error from %s: %s\n", *addr, resp.Status)
+		return 1
+	}
+
+	var status NodeStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading status: %v\n", err)
+		return 1
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(status)
+		return 0
+	}
+
+	fmt.Printf("Node %d, Lamport clock %d\n", status.Node, status.Clock)
+	fmt.Println("Resources:")
+	if len(status.Resources) == 0 {
+		fmt.Println("  idle")
+	}
+	for _, rs := range status.Resources {
+		fmt.Printf("  %-12s %-8s ts %d", rs.Resource, rs.State, rs.Timestamp)
+		if rs.Session != "" {
+			fmt.Printf(", session %s", rs.Session)
+		}
+		if rs.State == Wanted.String() {
+			fmt.Printf(", waiting %s for %v", time.Duration(rs.Waiting).Round(time.Millisecond), rs.Awaiting)
+		}
+		fmt.Println()
+	}
+	fmt.Println("Deferred replies owed:")
+	if len(status.Deferred) == 0 {
+		fmt.Println("  none")
+	}
+	for _, d := range status.Deferred {
+		fmt.Printf("  client %d for %s (ts %d)\n", d.Client, d.Resource, d.Timestamp)
+	}
+	fmt.Println("Peers:")
+	for _, p := range status.Peers {
+		state := "no messages yet"
+		if p.LastSeen != nil {
+			state = "last message " + p.LastSeen.Format("15:04:05.000")
+			if p.Alive {
+				state = "alive, " + state
+			} else {
+				state = "silent, " + state
+			}
+		}
+		fmt.Printf("  client %d: %s\n", p.ID, state)
+	}
+	return 0
+}
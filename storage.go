@@ -0,0 +1,177 @@
+package ra
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Storage persists file contents by name. The file system keeps the
+// current content of every open file in memory and stores it after each
+// write, inside the critical section, so the mutual exclusion layer
+// coordinates access to whatever the names refer to: local files, or keys
+// in a shared object store. Load returns an error wrapping os.ErrNotExist
+// for a name that was never stored.
+type Storage interface {
+	Load(name string) ([]byte, error)
+	Store(name string, data []byte) error
+	Delete(name string) error
+	List() ([]string, error)
+}
+
+// ParseStorage returns the storage backend described by spec:
+//
+//	disk[:dir]                  files in dir, the working directory by default
+//	memory                      in memory, reading initial contents from disk
+//	s3://bucket[/prefix][?endpoint=URL&region=R]
+//	                            objects in an S3-compatible store
+//
+// S3 credentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN.
+func ParseStorage(spec string) (Storage, error) {
+	switch {
+	case spec == "" || spec == "disk":
+		return DiskStorage{}, nil
+	case strings.HasPrefix(spec, "disk:"):
+		return DiskStorage{Dir: strings.TrimPrefix(spec, "disk:")}, nil
+	case spec == "memory":
+		return NewMemoryStorage(DiskStorage{}), nil
+	case strings.HasPrefix(spec, "s3://"):
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("storage %q: %w", spec, err)
+		}
+		return NewS3Storage(u.Host, strings.TrimPrefix(u.Path, "/"), u.Query().Get("endpoint"), u.Query().Get("region"))
+	}
+	return nil, fmt.Errorf("unknown storage %q: want disk[:dir], memory or s3://bucket[/prefix]", spec)
+}
+
+// DiskStorage keeps each name as a file in Dir.
+type DiskStorage struct {
+	Dir string
+}
+
+func (d DiskStorage) path(name string) string {
+	return filepath.Join(d.Dir, name)
+}
+
+func (d DiskStorage) Load(name string) ([]byte, error) {
+	return os.ReadFile(d.path(name))
+}
+
+// Store writes data to a temporary file and puts it in name's place, so a
+// failed write leaves the previous content in place.
+func (d DiskStorage) Store(name string, data []byte) error {
+	return writeFileAtomic(d.path(name), data, 0644)
+}
+
+func (d DiskStorage) Delete(name string) error {
+	return os.Remove(d.path(name))
+}
+
+// List returns the regular files in Dir, not descending into
+// subdirectories.
+func (d DiskStorage) List() ([]string, error) {
+	dir := d.Dir
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// MemoryStorage keeps contents in memory. Names it has not stored or
+// deleted are loaded from Fallback, if set, so a run can start from files on
+// disk without ever writing them.
+type MemoryStorage struct {
+	Fallback Storage
+
+	mu      sync.Mutex
+	data    map[string][]byte
+	deleted map[string]bool
+}
+
+func NewMemoryStorage(fallback Storage) *MemoryStorage {
+	return &MemoryStorage{
+		Fallback: fallback,
+		data:     make(map[string][]byte),
+		deleted:  make(map[string]bool),
+	}
+}
+
+func (m *MemoryStorage) Load(name string) ([]byte, error) {
+	m.mu.Lock()
+	data, ok := m.data[name]
+	deleted := m.deleted[name]
+	m.mu.Unlock()
+	if ok {
+		return append([]byte(nil), data...), nil
+	}
+	if deleted || m.Fallback == nil {
+		return nil, &os.PathError{Op: "load", Path: name, Err: os.ErrNotExist}
+	}
+	return m.Fallback.Load(name)
+}
+
+func (m *MemoryStorage) Store(name string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[name] = append([]byte(nil), data...)
+	delete(m.deleted, name)
+	return nil
+}
+
+func (m *MemoryStorage) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.data[name]; !ok && m.Fallback == nil {
+		return &os.PathError{Op: "delete", Path: name, Err: os.ErrNotExist}
+	}
+	delete(m.data, name)
+	m.deleted[name] = true
+	return nil
+}
+
+// List returns the stored names, together with Fallback's names that have
+// not been deleted.
+func (m *MemoryStorage) List() ([]string, error) {
+	seen := make(map[string]bool)
+	if m.Fallback != nil {
+		names, err := m.Fallback.List()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		for _, name := range names {
+			seen[name] = true
+		}
+	}
+	m.mu.Lock()
+	for name := range m.data {
+		seen[name] = true
+	}
+	for name := range m.deleted {
+		delete(seen, name)
+	}
+	m.mu.Unlock()
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
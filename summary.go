@@ -0,0 +1,73 @@
+package ra
+
+import (
+	"fmt"
+	"io"
+)
+
+// MessageStats is what one node sent, received and deferred during a run.
+type MessageStats struct {
+	Node            int
+	RequestsSent    uint64
+	RepliesSent     uint64
+	RepliesRecv     uint64
+	RepliesDeferred uint64
+	Entries         uint64
+	// Messages counts every message the node sent, of any type.
+	Messages uint64
+}
+
+// PerEntry is the average number of messages sent per critical section
+// entry, or 0 without entries.
+func (s MessageStats) PerEntry() float64 {
+	if s.Entries == 0 {
+		return 0
+	}
+	return float64(s.Messages) / float64(s.Entries)
+}
+
+// MessageSummary returns the message counters of every local node, in id
+// order.
+func (fs *DistributedFileSystem) MessageSummary() []MessageStats {
+	m := fs.Metrics
+	var stats []MessageStats
+	for _, node := range fs.nodes() {
+		label := func(name, typ string) string {
+			if typ == "" {
+				return fmt.Sprintf("%s{node=\"%d\"}", name, node.ID)
+			}
+			return fmt.Sprintf("%s{node=\"%d\",type=%q}", name, node.ID, typ)
+		}
+		stats = append(stats, MessageStats{
+			Node:            node.ID,
+			RequestsSent:    m.Get(label("ra_messages_sent_total", MsgRequest.String())),
+			RepliesSent:     m.Get(label("ra_messages_sent_total", MsgReply.String())),
+			RepliesRecv:     m.Get(label("ra_messages_received_total", MsgReply.String())),
+			RepliesDeferred: m.Get(label("ra_replies_deferred_total", "")),
+			Entries:         m.Get(label("ra_cs_entries_total", "")),
+			Messages:        m.Total(fmt.Sprintf("ra_messages_sent_total{node=\"%d\",", node.ID)),
+		})
+	}
+	return stats
+}
+
+// WriteMessageSummary writes stats as a table with a total row.
+func WriteMessageSummary(w io.Writer, stats []MessageStats) {
+	fmt.Fprintf(w, "%-6s %9s %10s %10s %9s %8s %9s %11s\n", "Node", "REQ sent", "REPLY sent", "REPLY recv", "Deferred", "Entries", "Messages", "Msgs/entry")
+	row := func(name string, s MessageStats) {
+		fmt.Fprintf(w, "%-6s %9d %10d %10d %9d %8d %9d %11.2f\n", name, s.RequestsSent, s.RepliesSent, s.RepliesRecv, s.RepliesDeferred, s.Entries, s.Messages, s.PerEntry())
+	}
+	var total MessageStats
+	for _, s := range stats {
+		row(fmt.Sprint(s.Node), s)
+		total.RequestsSent += s.RequestsSent
+		total.RepliesSent += s.RepliesSent
+		total.RepliesRecv += s.RepliesRecv
+		total.RepliesDeferred += s.RepliesDeferred
+		total.Entries += s.Entries
+		total.Messages += s.Messages
+	}
+	if len(stats) > 1 {
+		row("Total", total)
+	}
+}
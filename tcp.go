@@ -0,0 +1,477 @@
+package ra
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxFrameSize bounds the frames a TCPTransport accepts from the network.
+const maxFrameSize = 1 << 20
+
+// LinkState is the state of an outgoing link, as reported to
+// TCPTransport.OnLinkState.
+type LinkState int
+
+const (
+	LinkConnected LinkState = iota + 1
+	// LinkDisconnected is reported when an established connection breaks.
+	LinkDisconnected
+	// LinkRetrying is reported after each failed attempt to connect.
+	LinkRetrying
+)
+
+func (s LinkState) String() string {
+	switch s {
+	case LinkConnected:
+		return "connected"
+	case LinkDisconnected:
+		return "disconnected"
+	case LinkRetrying:
+		return "retrying"
+	default:
+		return fmt.Sprintf("LinkState(%d)", int(s))
+	}
+}
+
+// TCPTransport connects one client to peers running in other processes.
+// Each link is a single TCP connection, so frames on it stay in order; a
+// frame is a 4-byte length, the 4-byte sender id and the encoded message.
+// A connection starts with a handshake binding it to the dialer's id (see
+// tcpauth.go), and frames claiming any other sender are rejected.
+//
+// A peer whose address is a filesystem path, i.e. contains a slash, is
+// reached over a Unix domain socket instead, which costs less than TCP
+// loopback when several nodes share a host. TCP and socket peers may be
+// mixed in one cluster.
+type TCPTransport struct {
+	// DialTimeout is how long Send keeps retrying a peer that is not
+	// accepting connections yet, e.g. because its process is still starting.
+	DialTimeout time.Duration
+	// MaxBackoff caps the exponential backoff between connection attempts.
+	MaxBackoff time.Duration
+	// OnLinkState, if set, is called whenever a link to a peer connects,
+	// breaks or fails an attempt to connect. It must not block.
+	OnLinkState func(peer int, state LinkState, err error)
+	// Secret is the key every node of the cluster shares. When set, a
+	// connecting node must prove it holds the key, so a process without it
+	// cannot claim to be a client; a node holding it still can. Set it
+	// before Register.
+	Secret []byte
+	// LinkSecrets, if set, replaces Secret with one key per peer, known
+	// only to the two nodes at the ends of the link (see LinkSecret), so
+	// that no node can claim another's id. Set it before Register.
+	LinkSecrets map[int][]byte
+	// OnReject, if set, is called when an incoming connection fails its
+	// handshake or a frame claims a sender other than the one the
+	// connection belongs to. claimed is the id asserted, if any. It must
+	// not block.
+	OnReject func(remote net.Addr, claimed int, err error)
+	// TLS, if set, runs every connection over TLS with this config, which
+	// should require client certificates from the cluster's CA (see
+	// LoadTLSConfig), so peers' traffic is encrypted and only holders of a
+	// certificate can connect. A peer's certificate must name it, with
+	// common name node-<id> as issued by `ra init`, so no node can connect
+	// as another or answer for another's address. Set it before Register.
+	TLS *tls.Config
+
+	self     int
+	addrs    map[int]string
+	listener net.Listener
+
+	mu     sync.Mutex
+	conns  map[int]*tcpLink
+	in     *inbox
+	closed bool
+}
+
+type tcpLink struct {
+	mu   sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+	// up mirrors conn != nil, for readers that must not wait on mu while
+	// a dial is in progress.
+	up atomic.Bool
+}
+
+// NewTCPTransport starts listening for self. addrs maps every client id in
+// the cluster (self included) to the host:port peers reach it on. listen is
+// the local address to bind, e.g. ":7000" inside a container; when empty it
+// is self's entry in addrs. Frames are not delivered until self is
+// registered.
+func NewTCPTransport(self int, listen string, addrs map[int]string) (*TCPTransport, error) {
+	addr, ok := addrs[self]
+	if !ok {
+		return nil, fmt.Errorf("%w: no address for client %d", ErrUnknownPeer, self)
+	}
+	if listen != "" {
+		addr = listen
+	}
+	network := addrNetwork(addr)
+	if network == "unix" {
+		removeStaleSocket(addr)
+	}
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &TCPTransport{
+		DialTimeout: 10 * time.Second,
+		MaxBackoff:  5 * time.Second,
+		self:        self,
+		addrs:       addrs,
+		listener:    listener,
+		conns:       make(map[int]*tcpLink),
+	}, nil
+}
+
+// addrNetwork returns the network a peer address is on: "unix" for a
+// filesystem path, with / or, on Windows, \ separators, and "tcp" for
+// host:port.
+func addrNetwork(addr string) string {
+	if strings.ContainsAny(addr, "/"+string(filepath.Separator)) {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// removeStaleSocket removes the socket file a node that did not shut down
+// cleanly left at path, so the address can be listened on again. Anything
+// other than a socket is left alone.
+func removeStaleSocket(path string) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+}
+
+// ParsePeers parses a peer list of the form "1=host:port,2=host:port", or
+// with socket paths in place of some or all host:port pairs, e.g.
+// "1=/run/ra/1.sock".
+func ParsePeers(list string) (map[int]string, error) {
+	addrs := make(map[int]string)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		idText, addr, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("peer %q: want id=host:port or id=/path/to.sock", entry)
+		}
+		id, err := strconv.Atoi(idText)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("peer %q: bad client id", entry)
+		}
+		addrs[id] = addr
+	}
+	return addrs, nil
+}
+
+// Addr returns the address the transport is listening on.
+func (t *TCPTransport) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// Register starts delivering frames for the local client. Only the id the
+// transport was created for can be registered.
+func (t *TCPTransport) Register(id int, handler Handler) {
+	if id != t.self {
+		panic(fmt.Sprintf("tcp transport for client %d cannot register client %d", t.self, id))
+	}
+	t.mu.Lock()
+	t.in = newInbox(handler)
+	t.mu.Unlock()
+	go t.accept()
+}
+
+func (t *TCPTransport) accept() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		if t.TLS != nil {
+			conn = tls.Server(conn, t.TLS)
+		}
+		go t.serve(conn)
+	}
+}
+
+// serve reads frames from one incoming connection until it closes.
+func (t *TCPTransport) serve(conn net.Conn) {
+	defer conn.Close()
+	peer, err := t.authenticate(conn)
+	if err != nil {
+		t.reject(conn, peer, err)
+		return
+	}
+	r := bufio.NewReader(conn)
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		from := int(binary.BigEndian.Uint32(header[4:8]))
+		if size > maxFrameSize {
+			return
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return
+		}
+		if from != peer {
+			t.reject(conn, from, fmt.Errorf("%w: frame from client %d on client %d's connection", ErrImpersonation, from, peer))
+			continue
+		}
+		t.in.put(envelope{from: from, data: data})
+	}
+}
+
+func (t *TCPTransport) Send(from, to int, data []byte) error {
+	if to == t.self {
+		t.in.put(envelope{from: from, data: data})
+		return nil
+	}
+	link, err := t.link(to)
+	if err != nil {
+		return err
+	}
+
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(header[4:8], uint32(from))
+
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	// A connection that broke since the last frame is redialled and the
+	// frame sent once more. A frame written in full before the break may
+	// then arrive twice, which receivers tolerate.
+	for attempt := 0; ; attempt++ {
+		if link.conn == nil {
+			if err := t.dial(link, to); err != nil {
+				return err
+			}
+		}
+		if _, err = link.w.Write(header[:]); err == nil {
+			_, err = link.w.Write(data)
+		}
+		if err == nil {
+			err = link.w.Flush()
+		}
+		if err == nil {
+			return nil
+		}
+		t.drop(link, to, link.conn, err)
+		if attempt == 1 {
+			return fmt.Errorf("sending to client %d: %w", to, err)
+		}
+	}
+}
+
+// drop forgets conn if it is still link's connection, so the next Send
+// redials. The caller holds link.mu.
+func (t *TCPTransport) drop(link *tcpLink, peer int, conn net.Conn, err error) {
+	if link.conn != conn {
+		return
+	}
+	link.conn.Close()
+	link.conn = nil
+	link.up.Store(false)
+	t.report(peer, LinkDisconnected, err)
+}
+
+// watch notices when the peer closes conn, which it never writes to, and
+// reconnects in the background so the link is up again before the next
+// Send.
+func (t *TCPTransport) watch(link *tcpLink, peer int, conn net.Conn) {
+	_, err := io.Copy(io.Discard, conn)
+	if err == nil {
+		err = io.EOF
+	}
+	if t.isClosed() {
+		return
+	}
+	link.mu.Lock()
+	current := link.conn == conn
+	t.drop(link, peer, conn, err)
+	link.mu.Unlock()
+	if current && !t.isClosed() {
+		t.reconnect(link, peer)
+	}
+}
+
+// reconnect dials peer with exponential backoff until it answers, the link
+// is reconnected by a Send, or the transport is closed.
+func (t *TCPTransport) reconnect(link *tcpLink, peer int) {
+	for backoff := t.initialBackoff(); !t.isClosed(); backoff = t.nextBackoff(backoff) {
+		time.Sleep(jittered(backoff))
+		link.mu.Lock()
+		if link.conn != nil {
+			link.mu.Unlock()
+			return
+		}
+		conn, err := t.open(t.addrs[peer], peer)
+		if err == nil {
+			t.connected(link, peer, conn)
+			link.mu.Unlock()
+			return
+		}
+		link.mu.Unlock()
+		t.report(peer, LinkRetrying, err)
+	}
+}
+
+// connected makes conn link's connection. The caller holds link.mu.
+func (t *TCPTransport) connected(link *tcpLink, peer int, conn net.Conn) {
+	link.conn = conn
+	link.w = bufio.NewWriter(conn)
+	link.up.Store(true)
+	t.report(peer, LinkConnected, nil)
+	go t.watch(link, peer, conn)
+}
+
+func (t *TCPTransport) report(peer int, state LinkState, err error) {
+	if t.OnLinkState != nil {
+		t.OnLinkState(peer, state, err)
+	}
+}
+
+func (t *TCPTransport) initialBackoff() time.Duration {
+	return min(100*time.Millisecond, t.MaxBackoff)
+}
+
+func (t *TCPTransport) nextBackoff(backoff time.Duration) time.Duration {
+	return min(2*backoff, t.MaxBackoff)
+}
+
+// jittered spreads d by up to a fifth either way, so peers that lost the
+// same node do not all redial it in step.
+func jittered(d time.Duration) time.Duration {
+	spread := int64(d) / 5
+	if spread <= 0 {
+		return d
+	}
+	return d - time.Duration(spread) + time.Duration(rand.Int63n(2*spread))
+}
+
+// link returns the link to peer, creating it unconnected if needed.
+func (t *TCPTransport) link(peer int) (*tcpLink, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil, net.ErrClosed
+	}
+	if link, ok := t.conns[peer]; ok {
+		return link, nil
+	}
+	if _, ok := t.addrs[peer]; !ok {
+		return nil, fmt.Errorf("%w: client %d", ErrUnknownPeer, peer)
+	}
+	link := &tcpLink{}
+	t.conns[peer] = link
+	return link, nil
+}
+
+// dial connects link to peer, retrying with exponential backoff for up to
+// DialTimeout. The caller holds link.mu.
+func (t *TCPTransport) dial(link *tcpLink, peer int) error {
+	addr := t.addrs[peer]
+	deadline := time.Now().Add(t.DialTimeout)
+	for backoff := t.initialBackoff(); ; backoff = t.nextBackoff(backoff) {
+		conn, err := t.open(addr, peer)
+		if err == nil {
+			t.connected(link, peer, conn)
+			return nil
+		}
+		if t.isClosed() || time.Now().After(deadline) {
+			return fmt.Errorf("dialing client %d at %s: %w", peer, addr, err)
+		}
+		t.report(peer, LinkRetrying, err)
+		time.Sleep(min(jittered(backoff), time.Until(deadline)))
+	}
+}
+
+// open connects to peer at addr and introduces this node on the new
+// connection.
+func (t *TCPTransport) open(addr string, peer int) (net.Conn, error) {
+	conn, err := net.DialTimeout(addrNetwork(addr), addr, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if t.TLS != nil {
+		conn = tls.Client(conn, tlsFor(t.TLS, addr))
+	}
+	if err := t.introduce(conn, peer); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (t *TCPTransport) isClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}
+
+// LinkUp reports whether the link from self to peer is connected. Links
+// are dialled on first use, so it is false for a peer never sent to.
+func (t *TCPTransport) LinkUp(from, to int) bool {
+	if to == t.self {
+		return true
+	}
+	if from != t.self {
+		return false
+	}
+	t.mu.Lock()
+	link, ok := t.conns[to]
+	t.mu.Unlock()
+	return ok && link.up.Load()
+}
+
+// Peers returns every client id in the cluster in ascending order.
+func (t *TCPTransport) Peers() []int {
+	ids := make([]int, 0, len(t.addrs))
+	for id := range t.addrs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (t *TCPTransport) Close() {
+	t.listener.Close()
+
+	t.mu.Lock()
+	t.closed = true
+	links := make([]*tcpLink, 0, len(t.conns))
+	for _, link := range t.conns {
+		links = append(links, link)
+	}
+	if t.in != nil {
+		t.in.close()
+	}
+	t.mu.Unlock()
+
+	for _, link := range links {
+		link.mu.Lock()
+		if link.conn != nil {
+			link.conn.Close()
+		}
+		link.mu.Unlock()
+	}
+}
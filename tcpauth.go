@@ -0,0 +1,245 @@
+package ra
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every TCP connection opens with a handshake that binds it to the client
+// id of the dialing node. The listener sends a challenge: "RAH", the
+// handshake version and 16 random bytes. The dialer answers with its 4-byte
+// id and an HMAC-SHA256 of the challenge and id under the secret of the
+// link between the two nodes, and the listener accepts with a single byte
+// or hangs up. A link secret is known only to the nodes at its two ends
+// (see LinkSecret), so no node can prove another's id. A cluster secret
+// shared by every node keeps out processes without it, but not a node
+// claiming another's id. Without a secret the id is taken on trust, but it
+// is still fixed for the life of the connection, so frames on it cannot
+// claim another sender.
+const (
+	handshakeVersion = 1
+	challengeSize    = 20
+	helloSize        = 4 + sha256.Size
+	handshakeTimeout = 5 * time.Second
+)
+
+var (
+	// ErrHandshake is returned when a connection's handshake is malformed
+	// or its proof does not match the cluster secret.
+	ErrHandshake = errors.New("handshake failed")
+	// ErrImpersonation is reported for a frame or message claiming to come
+	// from a client other than the one its connection belongs to.
+	ErrImpersonation = errors.New("sender does not match connection identity")
+)
+
+// handshakeMAC proves knowledge of secret for id answering challenge.
+func handshakeMAC(secret, challenge []byte, id int) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(challenge)
+	var idBytes [4]byte
+	binary.BigEndian.PutUint32(idBytes[:], uint32(id))
+	mac.Write(idBytes[:])
+	return mac.Sum(nil)
+}
+
+// LinkSecret derives the secret of the link between clients a and b from
+// the key cluster, which only the tool setting up the cluster keeps.
+func LinkSecret(cluster []byte, a, b int) []byte {
+	mac := hmac.New(sha256.New, cluster)
+	var ids [8]byte
+	binary.BigEndian.PutUint32(ids[:4], uint32(min(a, b)))
+	binary.BigEndian.PutUint32(ids[4:], uint32(max(a, b)))
+	mac.Write([]byte("ra link"))
+	mac.Write(ids[:])
+	return mac.Sum(nil)
+}
+
+// FormatLinkSecrets writes the secrets of self's links to peers, derived
+// from cluster, in the form ParseLinkSecrets reads.
+func FormatLinkSecrets(cluster []byte, self int, peers []int) string {
+	var pairs []string
+	for _, peer := range peers {
+		if peer != self {
+			pairs = append(pairs, fmt.Sprintf("%d=%x", peer, LinkSecret(cluster, self, peer)))
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+// ParseLinkSecrets parses link secrets written as peer=hex pairs, e.g.
+// "2=9f86...,3=60303...".
+func ParseLinkSecrets(spec string) (map[int][]byte, error) {
+	secrets := make(map[int][]byte)
+	for _, pair := range splitList(spec) {
+		peer, secret, ok := strings.Cut(pair, "=")
+		id, err := strconv.Atoi(strings.TrimSpace(peer))
+		if !ok || err != nil || id <= 0 {
+			return nil, fmt.Errorf("bad link secret %q (want peer=hex)", pair)
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(secret))
+		if err != nil || len(key) == 0 {
+			return nil, fmt.Errorf("bad link secret for client %d", id)
+		}
+		secrets[id] = key
+	}
+	return secrets, nil
+}
+
+// secretFor returns the key the handshake with peer is proved with: the
+// link secret if the transport has link secrets, else the cluster secret.
+func (t *TCPTransport) secretFor(peer int) []byte {
+	if t.LinkSecrets != nil {
+		return t.LinkSecrets[peer]
+	}
+	return t.Secret
+}
+
+// introduce runs the dialer's side of the handshake with peer on conn.
+func (t *TCPTransport) introduce(conn net.Conn, peer int) error {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	challenge := make([]byte, challengeSize)
+	if _, err := io.ReadFull(conn, challenge); err != nil {
+		return fmt.Errorf("%w: reading challenge: %v", ErrHandshake, err)
+	}
+	if string(challenge[:3]) != "RAH" || challenge[3] != handshakeVersion {
+		return fmt.Errorf("%w: peer speaks another handshake", ErrHandshake)
+	}
+	if err := checkCertificate(conn, peer); err != nil {
+		return err
+	}
+	hello := make([]byte, 4, helloSize)
+	binary.BigEndian.PutUint32(hello, uint32(t.self))
+	hello = append(hello, handshakeMAC(t.secretFor(peer), challenge, t.self)...)
+	if _, err := conn.Write(hello); err != nil {
+		return fmt.Errorf("%w: sending hello: %v", ErrHandshake, err)
+	}
+	var accepted [1]byte
+	if _, err := io.ReadFull(conn, accepted[:]); err != nil {
+		return fmt.Errorf("%w: peer refused client %d: %v", ErrHandshake, t.self, err)
+	}
+	return nil
+}
+
+// authenticate runs the listener's side of the handshake on conn and
+// returns the id of the client it belongs to.
+func (t *TCPTransport) authenticate(conn net.Conn) (int, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	challenge := make([]byte, challengeSize)
+	copy(challenge, "RAH")
+	challenge[3] = handshakeVersion
+	if _, err := rand.Read(challenge[4:]); err != nil {
+		return 0, err
+	}
+	if _, err := conn.Write(challenge); err != nil {
+		return 0, fmt.Errorf("%w: sending challenge: %v", ErrHandshake, err)
+	}
+	hello := make([]byte, helloSize)
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		return 0, fmt.Errorf("%w: reading hello: %v", ErrHandshake, err)
+	}
+	id := int(binary.BigEndian.Uint32(hello[:4]))
+	if _, ok := t.addrs[id]; !ok || id == t.self {
+		return id, fmt.Errorf("%w: client %d", ErrUnknownPeer, id)
+	}
+	if err := checkCertificate(conn, id); err != nil {
+		return id, err
+	}
+	if t.LinkSecrets != nil {
+		secret := t.LinkSecrets[id]
+		if len(secret) == 0 || !hmac.Equal(hello[4:], handshakeMAC(secret, challenge, id)) {
+			return id, fmt.Errorf("%w: client %d did not prove the secret of its link", ErrHandshake, id)
+		}
+	} else if len(t.Secret) > 0 && !hmac.Equal(hello[4:], handshakeMAC(t.Secret, challenge, id)) {
+		return id, fmt.Errorf("%w: client %d did not prove the cluster secret", ErrHandshake, id)
+	}
+	if _, err := conn.Write([]byte{1}); err != nil {
+		return id, fmt.Errorf("%w: accepting: %v", ErrHandshake, err)
+	}
+	return id, nil
+}
+
+// checkCertificate checks that the certificate the far end of conn showed
+// belongs to client id. Connections without TLS pass.
+func checkCertificate(conn net.Conn, id int) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("%w: %v", ErrHandshake, err)
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return fmt.Errorf("%w: client %d showed no certificate", ErrHandshake, id)
+	}
+	if name := certs[0].Subject.CommonName; name != nodeName(id) {
+		return fmt.Errorf("%w: certificate of %s cannot be used as client %d", ErrHandshake, name, id)
+	}
+	return nil
+}
+
+// nodeName returns the common name of client id's certificate.
+func nodeName(id int) string {
+	return fmt.Sprintf("node-%d", id)
+}
+
+func (t *TCPTransport) reject(conn net.Conn, claimed int, err error) {
+	if t.OnReject != nil {
+		t.OnReject(conn.RemoteAddr(), claimed, err)
+	}
+}
+
+// LoadTLSConfig returns the TLS config for a node holding the certificate
+// and key in certFile and keyFile, trusting only peers whose certificates
+// were issued by the CA in caFile, in either direction. Each certificate
+// must have common name node-<id> for the client it belongs to.
+func LoadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate: %w", err)
+	}
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("loading CA: no certificates in %s", caFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
+
+// tlsFor returns config for dialing addr, checking the peer's certificate
+// against addr's host. Socket peers are on this host, so they are checked
+// as localhost.
+func tlsFor(config *tls.Config, addr string) *tls.Config {
+	config = config.Clone()
+	config.ServerName = "localhost"
+	if host, _, err := net.SplitHostPort(addr); err == nil && addrNetwork(addr) == "tcp" && host != "" {
+		config.ServerName = host
+	}
+	return config
+}
@@ -0,0 +1,79 @@
+package ra
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// testTLSConfigs issues a certificate for each of ids from a fresh CA and
+// returns the TLS config of the node holding each one.
+func testTLSConfigs(t *testing.T, ids ...int) map[int]*tls.Config {
+	t.Helper()
+	ca, err := newCertAuthority(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	configs := make(map[int]*tls.Config)
+	for _, id := range ids {
+		cert, err := ca.issue(nodeName(id), []string{"127.0.0.1"}, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		configs[id] = &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{cert.der}, PrivateKey: cert.key}},
+			RootCAs:      pool,
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			MinVersion:   tls.VersionTLS13,
+		}
+	}
+	return configs
+}
+
+// A node's certificate is signed by the cluster CA, but must not let it
+// connect as another client.
+func TestTLSCertificateBindsClientID(t *testing.T) {
+	configs := testTLSConfigs(t, 1, 2, 3)
+	rejected := make(chan error, 4)
+	listener, err := NewTCPTransport(1, "", map[int]string{1: "127.0.0.1:0", 2: "127.0.0.1:1", 3: "127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	listener.TLS = configs[1]
+	listener.OnReject = func(_ net.Addr, _ int, err error) { rejected <- err }
+	listener.Register(1, func(int, []byte) {})
+
+	dial := func(config *tls.Config) error {
+		dialer, err := NewTCPTransport(3, "", map[int]string{1: listener.Addr().String(), 3: "127.0.0.1:0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dialer.Close()
+		dialer.TLS = config
+		dialer.DialTimeout = 200 * time.Millisecond
+		dialer.Register(3, func(int, []byte) {})
+		return dialer.Send(3, 1, []byte("hello"))
+	}
+
+	if err := dial(configs[3]); err != nil {
+		t.Fatalf("node 3 with its own certificate: %v", err)
+	}
+	if err := dial(configs[2]); err == nil {
+		t.Fatal("node 2's certificate was accepted as client 3")
+	}
+	select {
+	case err := <-rejected:
+		if !errors.Is(err, ErrHandshake) {
+			t.Fatalf("rejected with %v, want ErrHandshake", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("listener did not reject node 2's certificate")
+	}
+}
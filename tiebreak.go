@@ -0,0 +1,205 @@
+package ra
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// TieBreak orders two different clients' requests that carry the same
+// Lamport timestamp.
+//
+// Every policy here preserves mutual exclusion and freedom from starvation,
+// because each is a strict total order on client ids that depends only on
+// the timestamp and the ids: two nodes comparing the same pair of requests
+// always agree on which goes first. That only holds if every node runs the
+// same policy with the same parameters. A policy that consulted anything
+// local to a node, such as its own clock, the wall time or an unseeded
+// random number, would let two nodes each decide they go first and enter
+// the critical section together.
+type TieBreak interface {
+	Name() string
+	// Before reports whether client a goes before client b when both
+	// requested at timestamp. It is only asked about a != b.
+	Before(timestamp, a, b int) bool
+}
+
+// LowestID lets the lower client id go first. It is the classic
+// Ricart-Agarwala rule, and the default, but under steady contention it
+// favours low ids every time timestamps tie.
+type LowestID struct{}
+
+func (LowestID) Name() string { return "lowest-id" }
+
+func (LowestID) Before(timestamp, a, b int) bool { return a < b }
+
+// RoundRobin rotates priority with the timestamp: at timestamp t, client
+// t mod N + 1 goes first, then the ids after it, wrapping around. N is the
+// cluster size; ids above N share ranks with lower ones and fall back to
+// the lower id.
+type RoundRobin struct {
+	N int
+}
+
+func (RoundRobin) Name() string { return "round-robin" }
+
+func (r RoundRobin) Before(timestamp, a, b int) bool {
+	ra, rb := r.rank(timestamp, a), r.rank(timestamp, b)
+	if ra != rb {
+		return ra < rb
+	}
+	return a < b
+}
+
+func (r RoundRobin) rank(timestamp, id int) int {
+	return ((id-1-timestamp)%r.N + r.N) % r.N
+}
+
+// Seeded orders tied clients by a hash of the seed, the timestamp and the
+// id, which shuffles them differently at every timestamp. All nodes must
+// share the seed.
+type Seeded struct {
+	Seed int64
+}
+
+func (Seeded) Name() string { return "random" }
+
+func (s Seeded) Before(timestamp, a, b int) bool {
+	ha, hb := s.hash(timestamp, a), s.hash(timestamp, b)
+	if ha != hb {
+		return ha < hb
+	}
+	return a < b
+}
+
+func (s Seeded) hash(timestamp, id int) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d/%d/%d", s.Seed, timestamp, id)
+	return h.Sum64()
+}
+
+// Weighted gives participants priority in proportion to their weights,
+// as a weighted round-robin: of every W consecutive timestamps, where W is
+// the sum of the weights, client i goes first at Weights[i] of them. The
+// weights of clients 1 to N default to 1; other ids go after them, by
+// lowest id. It works on integers alone, so every node ranks alike.
+type Weighted struct {
+	N       int
+	Weights map[int]int
+}
+
+func (Weighted) Name() string { return "weighted" }
+
+func (w Weighted) Before(timestamp, a, b int) bool {
+	ra, rb := w.rank(timestamp, a), w.rank(timestamp, b)
+	if ra != rb {
+		return ra < rb
+	}
+	return a < b
+}
+
+// rank lays clients 1 to N out in id order, each over as many slots as its
+// weight, and counts the slots from the one timestamp picks to the client's
+// first.
+func (w Weighted) rank(timestamp, id int) int {
+	total, first := 0, -1
+	for c := 1; c <= w.N; c++ {
+		if c == id {
+			first = total
+		}
+		total += w.weight(c)
+	}
+	if first < 0 {
+		return total
+	}
+	start := (timestamp%total + total) % total
+	if start >= first+w.weight(id) {
+		return first + total - start
+	}
+	return max(first-start, 0)
+}
+
+func (w Weighted) weight(id int) int {
+	if weight, ok := w.Weights[id]; ok {
+		return weight
+	}
+	return 1
+}
+
+// ParseWeights parses participant weights written as id=weight pairs,
+// e.g. "1=3,2=1".
+func ParseWeights(spec string) (map[int]int, error) {
+	weights := make(map[int]int)
+	for _, pair := range splitList(spec) {
+		idText, weightText, ok := strings.Cut(pair, "=")
+		id, idErr := strconv.Atoi(strings.TrimSpace(idText))
+		weight, weightErr := strconv.Atoi(strings.TrimSpace(weightText))
+		if !ok || idErr != nil || weightErr != nil || id <= 0 || weight < 1 {
+			return nil, fmt.Errorf("bad weight %q (want id=weight, weight at least 1)", pair)
+		}
+		weights[id] = weight
+	}
+	return weights, nil
+}
+
+// tieBreakNames lists the policies ParseTieBreak accepts.
+var tieBreakNames = []string{"lowest-id", "round-robin", "random", "weighted"}
+
+// ParseTieBreak parses a policy name: lowest-id, round-robin[:N],
+// random[:seed] or weighted:id=weight,... Round-robin defaults N to
+// clusterSize and random the seed to 1; weighted ranks clients 1 to
+// clusterSize.
+func ParseTieBreak(spec string, clusterSize int) (TieBreak, error) {
+	name, arg, hasArg := strings.Cut(spec, ":")
+	switch name {
+	case "", "lowest-id":
+		if hasArg {
+			return nil, fmt.Errorf("tie-break %q takes no argument", name)
+		}
+		return LowestID{}, nil
+	case "round-robin":
+		n := clusterSize
+		if hasArg {
+			var err error
+			if n, err = strconv.Atoi(arg); err != nil {
+				return nil, fmt.Errorf("bad round-robin size %q", arg)
+			}
+		}
+		if n < 1 {
+			return nil, fmt.Errorf("round-robin needs a cluster size of at least 1, got %d", n)
+		}
+		return RoundRobin{N: n}, nil
+	case "random":
+		seed := int64(1)
+		if hasArg {
+			var err error
+			if seed, err = strconv.ParseInt(arg, 10, 64); err != nil {
+				return nil, fmt.Errorf("bad random seed %q", arg)
+			}
+		}
+		return Seeded{Seed: seed}, nil
+	case "weighted":
+		weights, err := ParseWeights(arg)
+		if err != nil {
+			return nil, err
+		}
+		return Weighted{N: clusterSize, Weights: weights}, nil
+	}
+	return nil, fmt.Errorf("unknown tie-break %q (want one of %s)", name, strings.Join(tieBreakNames, ", "))
+}
+
+// before orders requests by Lamport timestamp, breaking ties between
+// different clients with tb, or by lowest id if tb is nil.
+func before(tb TieBreak, aTimestamp, aClient, bTimestamp, bClient int) bool {
+	if aTimestamp != bTimestamp {
+		return aTimestamp < bTimestamp
+	}
+	if aClient == bClient {
+		return false
+	}
+	if tb == nil {
+		return aClient < bClient
+	}
+	return tb.Before(aTimestamp, aClient, bClient)
+}
@@ -0,0 +1,36 @@
+package ra
+
+import "testing"
+
+// Weighted lets each client go first at as many of every W tied timestamps
+// as its weight, and orders every pair of clients the same both ways.
+func TestWeightedTieBreakIsProportional(t *testing.T) {
+	tb, err := ParseTieBreak("weighted:1=3,3=2", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]int{1: 3, 2: 1, 3: 2, 4: 1}
+	firsts := make(map[int]int)
+	for timestamp := 0; timestamp < 7; timestamp++ {
+		first := 1
+		for id := 1; id <= 5; id++ {
+			for other := 1; other <= 5; other++ {
+				if id != other && tb.Before(timestamp, id, other) == tb.Before(timestamp, other, id) {
+					t.Fatalf("timestamp %d: clients %d and %d do not have a single order", timestamp, id, other)
+				}
+			}
+			if id != first && tb.Before(timestamp, id, first) {
+				first = id
+			}
+		}
+		firsts[first]++
+	}
+	for id, weight := range want {
+		if firsts[id] != weight {
+			t.Errorf("client %d went first at %d of 7 timestamps, want %d", id, firsts[id], weight)
+		}
+	}
+	if _, err := ParseTieBreak("weighted:1=0", 3); err == nil {
+		t.Error("accepted a weight of 0")
+	}
+}
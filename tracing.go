@@ -0,0 +1,273 @@
+package ra
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Span is one timed step of a request's lifecycle. Spans are exported in the
+// OpenTelemetry (OTLP) format so traces from every node can be viewed
+// together in Jaeger.
+type Span struct {
+	TraceID  string
+	SpanID   string
+	ParentID string
+	Name     string
+	Start    time.Time
+	End      time.Time
+
+	mu         sync.Mutex
+	attributes map[string]any
+	tracer     *Tracer
+}
+
+// SetAttribute attaches a string, int or bool attribute to the span. It is a
+// no-op on a nil span so callers don't need to check whether tracing is on.
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// Finish records the end time and hands the span to the exporter.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	s.tracer.enqueue(s)
+}
+
+// SpanExporter ships finished spans somewhere.
+type SpanExporter interface {
+	Export(spans []*Span) error
+}
+
+// Tracer creates spans and exports them in batches. A nil *Tracer is valid
+// and produces nil spans.
+type Tracer struct {
+	// Log receives dropped spans and export errors; nil is DefaultLogger.
+	Log      Logger
+	exporter SpanExporter
+	// spans is never closed, since spans may still be finished after
+	// Shutdown; stop tells run to flush and return instead.
+	spans chan *Span
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// NewTracer starts a tracer that flushes to exporter every interval.
+func NewTracer(exporter SpanExporter, interval time.Duration) *Tracer {
+	t := &Tracer{
+		exporter: exporter,
+		spans:    make(chan *Span, 1024),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.run(interval)
+	return t
+}
+
+// Start opens a span. With a nil parent the span starts a new trace.
+func (t *Tracer) Start(name string, parent *Span) *Span {
+	if t == nil {
+		return nil
+	}
+	if parent != nil {
+		return t.StartRemote(name, parent.TraceID, parent.SpanID)
+	}
+	return t.StartRemote(name, newTraceID(), "")
+}
+
+// StartRemote opens a span whose parent lives in another process, as
+// carried in a Message's trace fields.
+func (t *Tracer) StartRemote(name, traceID, parentID string) *Span {
+	if t == nil {
+		return nil
+	}
+	if traceID == "" {
+		traceID = newTraceID()
+	}
+	return &Span{
+		TraceID:    traceID,
+		SpanID:     newSpanID(),
+		ParentID:   parentID,
+		Name:       name,
+		Start:      time.Now(),
+		attributes: make(map[string]any),
+		tracer:     t,
+	}
+}
+
+// Shutdown flushes any buffered spans and stops the tracer. Spans
+// finished after it are dropped.
+func (t *Tracer) Shutdown() {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+	<-t.done
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	select {
+	case <-t.stop:
+		return
+	default:
+	}
+	select {
+	case t.spans <- s:
+	default:
+		loggerOr(t.Log).Warnf("Dropping span %s: export queue full", s.Name)
+	}
+}
+
+func (t *Tracer) run(interval time.Duration) {
+	defer close(t.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(batch); err != nil {
+			loggerOr(t.Log).Errorf("Error exporting %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+		case <-ticker.C:
+			flush()
+		case <-t.stop:
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func newTraceID() string { return randomHex(16) }
+func newSpanID() string  { return randomHex(8) }
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// OTLPExporter posts spans to an OpenTelemetry collector (or Jaeger, which
+// accepts OTLP directly) using the OTLP/HTTP JSON encoding.
+type OTLPExporter struct {
+	Endpoint    string
+	ServiceName string
+	Client      *http.Client
+}
+
+func NewOTLPExporter(endpoint, serviceName string) *OTLPExporter {
+	return &OTLPExporter{
+		Endpoint:    endpoint + "/v1/traces",
+		ServiceName: serviceName,
+		Client:      &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+type otlpKeyValue struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID      string         `json:"traceId"`
+	SpanID       string         `json:"spanId"`
+	ParentSpanID string         `json:"parentSpanId,omitempty"`
+	Name         string         `json:"name"`
+	Kind         int            `json:"kind"`
+	Start        string         `json:"startTimeUnixNano"`
+	End          string         `json:"endTimeUnixNano"`
+	Attributes   []otlpKeyValue `json:"attributes"`
+}
+
+func otlpValue(v any) map[string]any {
+	switch v := v.(type) {
+	case int:
+		return map[string]any{"intValue": strconv.Itoa(v)}
+	case uint64:
+		return map[string]any{"intValue": strconv.FormatUint(v, 10)}
+	case bool:
+		return map[string]any{"boolValue": v}
+	case string:
+		return map[string]any{"stringValue": v}
+	}
+	return map[string]any{"stringValue": fmt.Sprint(v)}
+}
+
+func (e *OTLPExporter) Export(spans []*Span) error {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		attrs := make([]otlpKeyValue, 0, len(s.attributes))
+		for k, v := range s.attributes {
+			attrs = append(attrs, otlpKeyValue{Key: k, Value: otlpValue(v)})
+		}
+		s.mu.Unlock()
+
+		out = append(out, otlpSpan{
+			TraceID:      s.TraceID,
+			SpanID:       s.SpanID,
+			ParentSpanID: s.ParentID,
+			Name:         s.Name,
+			Kind:         1,
+			Start:        strconv.FormatInt(s.Start.UnixNano(), 10),
+			End:          strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:   attrs,
+		})
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpKeyValue{{Key: "service.name", Value: otlpValue(e.ServiceName)}},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "ricart-agarwala"},
+				"spans": out,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.Client.Post(e.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
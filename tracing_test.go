@@ -0,0 +1,37 @@
+package ra
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (e *recordingExporter) Export(spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+// Spans finished after Shutdown, as by a message still being handled, are
+// dropped rather than sent on a closed queue.
+func TestTracerFinishAfterShutdown(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracer := NewTracer(exporter, time.Hour)
+	before := tracer.Start("before", nil)
+	after := tracer.Start("after", nil)
+	before.Finish()
+	tracer.Shutdown()
+	after.Finish()
+
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+	if len(exporter.spans) != 1 || exporter.spans[0].Name != "before" {
+		t.Fatalf("exported %d spans, want only the one finished before Shutdown", len(exporter.spans))
+	}
+}
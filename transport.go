@@ -0,0 +1,126 @@
+package ra
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var ErrUnknownPeer = errors.New("unknown peer")
+
+// Handler is called for every frame delivered to a client.
+type Handler func(from int, data []byte)
+
+// Transport moves encoded frames between clients. Frames on the same
+// (from, to) link are delivered in the order they were sent and each
+// receiver handles one frame at a time.
+type Transport interface {
+	Register(id int, handler Handler)
+	Send(from, to int, data []byte) error
+	Peers() []int
+	Close()
+}
+
+type envelope struct {
+	from int
+	data []byte
+}
+
+// inbox is an unbounded FIFO queue drained by one goroutine, so a slow
+// receiver never blocks a sender.
+type inbox struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []envelope
+	closed  bool
+	handler Handler
+}
+
+func newInbox(handler Handler) *inbox {
+	in := &inbox{handler: handler}
+	in.cond = sync.NewCond(&in.mu)
+	go in.run()
+	return in
+}
+
+func (in *inbox) put(e envelope) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.queue = append(in.queue, e)
+	in.cond.Signal()
+}
+
+func (in *inbox) close() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.closed = true
+	in.cond.Signal()
+}
+
+func (in *inbox) run() {
+	for {
+		in.mu.Lock()
+		for len(in.queue) == 0 && !in.closed {
+			in.cond.Wait()
+		}
+		if len(in.queue) == 0 {
+			in.mu.Unlock()
+			return
+		}
+		e := in.queue[0]
+		in.queue[0] = envelope{}
+		in.queue = in.queue[1:]
+		in.mu.Unlock()
+
+		in.handler(e.from, e.data)
+	}
+}
+
+// LocalTransport connects clients running in the same process.
+type LocalTransport struct {
+	mu      sync.Mutex
+	inboxes map[int]*inbox
+}
+
+func NewLocalTransport() *LocalTransport {
+	return &LocalTransport{inboxes: make(map[int]*inbox)}
+}
+
+func (t *LocalTransport) Register(id int, handler Handler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inboxes[id] = newInbox(handler)
+}
+
+func (t *LocalTransport) Send(from, to int, data []byte) error {
+	t.mu.Lock()
+	in, ok := t.inboxes[to]
+	t.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: client %d", ErrUnknownPeer, to)
+	}
+	in.put(envelope{from: from, data: data})
+	return nil
+}
+
+// Peers returns the registered client ids in ascending order.
+func (t *LocalTransport) Peers() []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ids := make([]int, 0, len(t.inboxes))
+	for id := range t.inboxes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (t *LocalTransport) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, in := range t.inboxes {
+		in.close()
+	}
+}
@@ -0,0 +1,316 @@
+package ra
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// woundInterval is how long a transaction waits on a resource before it
+// wounds the peers holding it up, and then how often it looks for new ones.
+const woundInterval = 10 * time.Millisecond
+
+// Txn is a transaction: critical sections one client enters in whatever
+// order it likes and holds until the transaction ends. Transactions are
+// ordered by age, their (Timestamp, ClientID), and resolve conflicts by
+// wound-wait: a transaction kept waiting by a younger one that holds or
+// wants the resource wounds it, and one kept waiting by an older one
+// waits. A wounded transaction loses every critical section it holds and
+// restarts with its original timestamp, so it only ever gets older and
+// eventually wins. Waits therefore always point from older to younger,
+// which rules out a distributed deadlock without a canonical order.
+//
+// Wounds are sent to the peers a request is still awaiting replies from,
+// which under Ricart-Agarwala are exactly the peers holding it up, so
+// transactions need that algorithm.
+type Txn struct {
+	ClientID  int
+	Timestamp int
+
+	fs        *DistributedFileSystem
+	mu        sync.Mutex
+	held      []*Request
+	wanting   string
+	wounded   string
+	woundedCh chan struct{}
+	ending    bool
+}
+
+// RunTxn runs fn in a transaction for clientID and then releases every
+// critical section fn acquired through it. If the transaction is wounded
+// fn is run again, after its critical sections have been released, until
+// it completes unwounded; fn should therefore stop once Acquire returns
+// ErrWounded, and only change shared state that it can safely redo.
+// Changes made before a wound are not undone.
+func (fs *DistributedFileSystem) RunTxn(clientID int, fn func(txn *Txn) error) error {
+	node := fs.Node(clientID)
+	if node == nil {
+		return fmt.Errorf("client %d starting transaction: %w", clientID, ErrUnknownPeer)
+	}
+	if _, ok := fs.Mutex.(*RicartAgarwala); !ok {
+		return fmt.Errorf("client %d starting transaction: %s cannot wound peers", clientID, fs.Mutex.Name())
+	}
+	timestamp := node.tick()
+	for attempt := 1; ; attempt++ {
+		txn, err := fs.beginTxn(clientID, timestamp)
+		if err != nil {
+			return err
+		}
+		err = fn(txn)
+		if !txn.end() {
+			return err
+		}
+		fs.Metrics.addNode("ra_txn_restarts_total", clientID)
+		fs.Log.Debugf("Client %d restarting transaction %d (%s)", clientID, timestamp, txn.reason())
+		time.Sleep(time.Duration(min(attempt, 10)) * woundInterval)
+	}
+}
+
+// beginTxn registers a new transaction as clientID's active one.
+func (fs *DistributedFileSystem) beginTxn(clientID, timestamp int) (*Txn, error) {
+	fs.TxnsMutex.Lock()
+	defer fs.TxnsMutex.Unlock()
+	if _, ok := fs.Txns[clientID]; ok {
+		return nil, fmt.Errorf("client %d starting transaction: another one is running", clientID)
+	}
+	txn := &Txn{ClientID: clientID, Timestamp: timestamp, fs: fs, woundedCh: make(chan struct{})}
+	fs.Txns[clientID] = txn
+	return txn, nil
+}
+
+// Acquire enters resource's critical section as part of the transaction
+// and returns its request, or the one already held. It fails with an
+// error wrapping ErrWounded once the transaction has been wounded.
+func (t *Txn) Acquire(resource string) (*Request, error) {
+	t.mu.Lock()
+	for _, r := range t.held {
+		if r.Resource == resource {
+			t.mu.Unlock()
+			return r, nil
+		}
+	}
+	if t.wounded != "" {
+		t.mu.Unlock()
+		return nil, t.woundErr(resource)
+	}
+	t.wanting = resource
+	t.mu.Unlock()
+
+	type result struct {
+		request *Request
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		request, err := t.fs.acquire(t.ClientID, resource, "", t.fs.openedFile(resource))
+		done <- result{request, err}
+	}()
+
+	ticker := time.NewTicker(woundInterval)
+	defer ticker.Stop()
+	woundedCh := t.woundedCh
+	sent := make(map[int]bool)
+	for {
+		select {
+		case res := <-done:
+			t.mu.Lock()
+			t.wanting = ""
+			wounded := t.wounded != ""
+			if res.err == nil && !wounded {
+				t.held = append(t.held, res.request)
+			}
+			t.mu.Unlock()
+			if res.err == nil && wounded {
+				t.fs.ReleaseRequest(res.request)
+			}
+			if wounded {
+				return nil, t.woundErr(resource)
+			}
+			return res.request, res.err
+		case <-ticker.C:
+			t.woundBlockers(resource, sent)
+		case <-woundedCh:
+			woundedCh = nil
+			t.fs.CancelRequest(t.ClientID, resource)
+		}
+	}
+}
+
+// Wounded reports whether an older transaction has wounded this one.
+func (t *Txn) Wounded() bool {
+	return t.reason() != ""
+}
+
+func (t *Txn) reason() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.wounded
+}
+
+func (t *Txn) woundErr(resource string) error {
+	return fmt.Errorf("client %d acquiring %s: %w: %s", t.ClientID, resource, ErrWounded, t.reason())
+}
+
+// older reports whether the transaction is older than one with timestamp
+// from clientID.
+func (t *Txn) older(timestamp, clientID int) bool {
+	if t.Timestamp != timestamp {
+		return t.Timestamp < timestamp
+	}
+	return t.ClientID < clientID
+}
+
+// woundBlockers sends a WOUND to every peer the transaction's request for
+// resource is still awaiting, once each.
+func (t *Txn) woundBlockers(resource string, sent map[int]bool) {
+	request := t.fs.Node(t.ClientID).wanting(resource)
+	if request == nil {
+		return
+	}
+	for _, peer := range request.Awaiting() {
+		if sent[peer] {
+			continue
+		}
+		sent[peer] = true
+		err := t.fs.send(&Message{
+			Type:      MsgWound,
+			From:      t.ClientID,
+			To:        peer,
+			Resource:  resource,
+			Timestamp: t.Timestamp,
+		})
+		if err != nil {
+			t.fs.Log.Errorf("Error sending wound from client %d: %v", t.ClientID, err)
+		}
+	}
+}
+
+// wound aborts the transaction for reason: every critical section it
+// holds is revoked and released, and a pending Acquire withdraws its
+// request. It reports false if the transaction is already ending or
+// wounded.
+func (t *Txn) wound(reason string) bool {
+	t.mu.Lock()
+	if t.ending || t.wounded != "" {
+		t.mu.Unlock()
+		return false
+	}
+	t.wounded = reason
+	close(t.woundedCh)
+	held := t.held
+	t.held = nil
+	t.mu.Unlock()
+
+	for i := len(held) - 1; i >= 0; i-- {
+		held[i].revoke(reason)
+		t.fs.ReleaseRequest(held[i])
+	}
+	return true
+}
+
+// end releases the transaction's critical sections and unregisters it. It
+// reports whether the transaction had been wounded and must be rerun.
+func (t *Txn) end() (wounded bool) {
+	t.mu.Lock()
+	t.ending = true
+	held := t.held
+	t.held = nil
+	wounded = t.wounded != ""
+	t.mu.Unlock()
+
+	for i := len(held) - 1; i >= 0; i-- {
+		if err := t.fs.ReleaseRequest(held[i]); err != nil {
+			t.fs.Log.Errorf("Error releasing %s: %v", held[i].Resource, err)
+		}
+	}
+	t.fs.TxnsMutex.Lock()
+	delete(t.fs.Txns, t.ClientID)
+	t.fs.TxnsMutex.Unlock()
+	return wounded
+}
+
+// involves reports whether the transaction holds or is waiting for
+// resource.
+func (t *Txn) involves(resource string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.wanting == resource {
+		return true
+	}
+	for _, r := range t.held {
+		if r.Resource == resource {
+			return true
+		}
+	}
+	return false
+}
+
+// ReceiveWound wounds msg.To's transaction if it is younger than the
+// sender's and holds or wants the resource the sender is waiting for.
+// Otherwise the sender is the younger one and keeps waiting.
+func (fs *DistributedFileSystem) ReceiveWound(msg *Message) {
+	fs.TxnsMutex.Lock()
+	txn := fs.Txns[msg.To]
+	fs.TxnsMutex.Unlock()
+	if txn == nil || !txn.involves(msg.Resource) {
+		return
+	}
+	if txn.older(msg.Timestamp, msg.From) {
+		fs.Log.Debugf("Client %d keeps %s: its transaction %d is older than client %d's %d", msg.To, msg.Resource, txn.Timestamp, msg.From, msg.Timestamp)
+		return
+	}
+	reason := fmt.Sprintf("wounded by client %d's older transaction %d over %s", msg.From, msg.Timestamp, msg.Resource)
+	if txn.wound(reason) {
+		fs.Log.Debugf("Client %d's transaction %d %s", msg.To, txn.Timestamp, reason)
+		fs.Metrics.addNode("ra_txn_wounds_total", msg.To)
+	}
+}
+
+// runTransactions is the transactions scenario: clients repeatedly take
+// file1.txt and file2.txt together in a transaction, odd clients in one
+// order and even clients in the other, which would deadlock without
+// wound-wait.
+func runTransactions(fs *DistributedFileSystem, n int, diagram *os.File) error {
+	files := []string{"file1.txt", "file2.txt"}
+	if err := fs.ensureFiles(files); err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 1; i <= n; i++ {
+		wg.Add(1)
+		go func(clientID int) {
+			defer wg.Done()
+			order := files
+			if clientID%2 == 0 {
+				order = []string{files[1], files[0]}
+			}
+			for round := 0; round < 3; round++ {
+				start := time.Now()
+				err := fs.RunTxn(clientID, func(txn *Txn) error {
+					for _, name := range order {
+						if _, err := txn.Acquire(name); err != nil {
+							return err
+						}
+						time.Sleep(5 * time.Millisecond)
+					}
+					return nil
+				})
+				if err != nil {
+					errs[clientID-1] = err
+					return
+				}
+				printSpaceTimeDiagram(clientID, start, time.Now(), diagram)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	narrate("%d clients ran 3 transactions each over %v in opposite orders: %d wounds, %d restarts, no deadlock",
+		n, files, fs.Metrics.Total("ra_txn_wounds_total"), fs.Metrics.Total("ra_txn_restarts_total"))
+	return nil
+}
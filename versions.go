@@ -0,0 +1,200 @@
+package ra
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// The version store keeps every version of every file a run produced, so
+// a file can be read as it was at a given logical time: ReadAsOf, and
+// "ra cat --as-of" for a finished run. The content a file is loaded with
+// is its version 0 at timestamp 0; each write that commits adds a version
+// stamped with the Lamport timestamp of the request that made it. Under
+// ricart-agarwala and lamport, critical sections are entered in timestamp
+// order, so the file as of T is the last version recorded at or before T.
+// Raymond grants the token in the order requests reach it instead, and
+// without mutual exclusion or with eventual consistency writes are not
+// ordered at all, so timestamps say nothing about the order of writes:
+// the versions are still recorded, but ReadAsOf refuses to read them as
+// of a timestamp. "ra cat" cannot tell how a run was made and leaves that
+// to whoever runs it.
+
+// FileVersion is one version of a file.
+type FileVersion struct {
+	File    string `json:"file"`
+	Version uint64 `json:"version"`
+	// Client made the version; 0 for content loaded from storage or
+	// changed outside the system.
+	Client    int       `json:"client,omitempty"`
+	Timestamp int       `json:"timestamp"`
+	Written   time.Time `json:"written"`
+	Content   string    `json:"content"`
+}
+
+// VersionStore records FileVersions as one JSON document per line, like
+// HistoryStore.
+type VersionStore struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// OpenVersions creates the store at path, replacing one an earlier run
+// left there: Lamport timestamps start again from 0 every run, so versions
+// of two runs cannot be told apart.
+func OpenVersions(path string) (*VersionStore, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &VersionStore{path: path, file: file}, nil
+}
+
+func (s *VersionStore) Append(v FileVersion) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(append(data, '\n'))
+	return err
+}
+
+// AsOf returns fileName's last version recorded at or before timestamp.
+func (s *VersionStore) AsOf(fileName string, timestamp int) (FileVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return versionAsOf(s.path, fileName, timestamp)
+}
+
+func (s *VersionStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// versionAsOf reads the store at path for fileName's last version at or
+// before timestamp. Lines that fail to parse are skipped.
+func versionAsOf(path, fileName string, timestamp int) (FileVersion, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	defer file.Close()
+
+	var found FileVersion
+	seen, ok := false, false
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var v FileVersion
+		if err := json.Unmarshal(scanner.Bytes(), &v); err != nil || v.File != fileName {
+			continue
+		}
+		seen = true
+		if v.Timestamp <= timestamp {
+			found, ok = v, true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return FileVersion{}, err
+	}
+	if !seen {
+		return FileVersion{}, fmt.Errorf("%w: no versions of %s in %s", ErrFileNotFound, fileName, path)
+	}
+	if !ok {
+		return FileVersion{}, fmt.Errorf("%s has no version at or before timestamp %d", fileName, timestamp)
+	}
+	return found, nil
+}
+
+// recordVersion adds a version of file to fs.Versions, if fs keeps one.
+func (fs *DistributedFileSystem) recordVersion(file *File, version uint64, clientID, timestamp int, content string) {
+	if fs.Versions == nil {
+		return
+	}
+	err := fs.Versions.Append(FileVersion{
+		File:      file.Name,
+		Version:   version,
+		Client:    clientID,
+		Timestamp: timestamp,
+		Written:   time.Now(),
+		Content:   content,
+	})
+	if err != nil {
+		fs.Log.Errorf("Error recording version %d of %s: %v", version, file.Name, err)
+	}
+}
+
+// ReadAsOf returns fileName as it was at Lamport time timestamp: the
+// content of the last write whose request was stamped at or before it, or
+// the content the file was loaded with. Past versions never change, so it
+// does not enter the critical section. It needs fs.Versions, and returns
+// ErrUnordered unless the file's writes are made in timestamp order: under
+// ricart-agarwala or lamport, with strong consistency (see above).
+func (fs *DistributedFileSystem) ReadAsOf(fileName string, timestamp int) (FileSnapshot, error) {
+	if fs.Versions == nil {
+		return FileSnapshot{}, fmt.Errorf("reading %s as of timestamp %d: no version store", fileName, timestamp)
+	}
+	if err := fs.timestampOrdered(fileName); err != nil {
+		return FileSnapshot{}, fmt.Errorf("reading %s as of timestamp %d: %w", fileName, timestamp, err)
+	}
+	v, err := fs.Versions.AsOf(fileName, timestamp)
+	if err != nil {
+		return FileSnapshot{}, fmt.Errorf("reading %s as of timestamp %d: %w", fileName, timestamp, err)
+	}
+	return FileSnapshot{Name: v.File, Content: v.Content, Version: v.Version, Modified: v.Written}, nil
+}
+
+// timestampOrdered returns ErrUnordered, saying why, unless writes to
+// fileName are made in the timestamp order of their requests.
+func (fs *DistributedFileSystem) timestampOrdered(fileName string) error {
+	switch {
+	case fs.NoMutex:
+		return fmt.Errorf("%w: running without mutual exclusion", ErrUnordered)
+	case fs.consistency(fileName) == Eventual:
+		return fmt.Errorf("%w: the file is eventually consistent", ErrUnordered)
+	}
+	switch fs.Mutex.(type) {
+	case *RicartAgarwala, *Lamport:
+		return nil
+	}
+	return fmt.Errorf("%w: %s grants entries out of timestamp order", ErrUnordered, fs.Mutex.Name())
+}
+
+func runCatCommand(args []string) int {
+	flags := flag.NewFlagSet("cat", flag.ExitOnError)
+	db := flags.String("versions", "versions.jsonl", "version store a run wrote with -versions")
+	asOf := flags.Int("as-of", -1, "print the files as they were at this Lamport timestamp, for a run under ricart-agarwala or lamport; -1 for their last versions")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s cat [flags] file ...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	timestamp := *asOf
+	if timestamp < 0 {
+		timestamp = math.MaxInt
+	}
+	for _, name := range flags.Args() {
+		v, err := versionAsOf(*db, name, timestamp)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", name, err)
+			return 1
+		}
+		os.Stdout.WriteString(v.Content)
+	}
+	return 0
+}
@@ -0,0 +1,44 @@
+package ra
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// Reading as of a timestamp is refused where timestamps do not order the
+// writes.
+func TestReadAsOfRejectsUnorderedWrites(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		setup func(fs *DistributedFileSystem) error
+		err   error
+	}{
+		{"ricart-agarwala", func(fs *DistributedFileSystem) error { return nil }, nil},
+		{"lamport", func(fs *DistributedFileSystem) error { return fs.SetAlgorithm("lamport") }, nil},
+		{"raymond", func(fs *DistributedFileSystem) error { return fs.SetAlgorithm("raymond") }, ErrUnordered},
+		{"no-mutex", func(fs *DistributedFileSystem) error { fs.NoMutex = true; return nil }, ErrUnordered},
+		{"eventual", func(fs *DistributedFileSystem) error { fs.SetConsistency("notes.txt", Eventual); return nil }, ErrUnordered},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := NewDistributedFileSystem(JSONCodec{}, NewLocalTransport())
+			fs.Storage = NewMemoryStorage(nil)
+			fs.Storage.Store("notes.txt", []byte("draft"))
+			var err error
+			if fs.Versions, err = OpenVersions(filepath.Join(t.TempDir(), "versions.jsonl")); err != nil {
+				t.Fatal(err)
+			}
+			defer fs.Versions.Close()
+			if err := tc.setup(fs); err != nil {
+				t.Fatal(err)
+			}
+			fs.Join(1)
+			if _, err := fs.OpenFile(1, "notes.txt"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fs.ReadAsOf("notes.txt", 0); !errors.Is(err, tc.err) {
+				t.Fatalf("got %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package ra
+
+import (
+	"fmt"
+	"time"
+)
+
+// The file watcher notices managed files edited outside the system, e.g.
+// file1.txt changed in an editor, which nodes would otherwise keep serving
+// their stale Content for. It polls Storage, so it works the same on disk,
+// in memory and on S3, and compares what it finds with what the file
+// system itself last loaded or stored:
+//
+//   - a file no local client is in the critical section for is refreshed:
+//     its Content becomes the new data and cached reads of it are dropped;
+//   - a file changed while a local client holds it, or while a write of it
+//     is being stored, raced with a protocol-protected write, and is
+//     reported as a conflict in the log instead. It is refreshed once the
+//     critical section is over, unless the write replaced it.
+//
+// Node processes sharing a disk see each other's writes the same way, and
+// pick them up the same way.
+//
+// Polling, rather than change notifications from fsnotify, keeps the module
+// free of third-party dependencies and covers storage that has no
+// notifications at all. It has three costs: a change is noticed up to one
+// interval late, every open file is read in full each interval, and a
+// file changed and changed back within one interval looks unchanged.
+
+// beginStore records that content is about to be stored for the file.
+func (f *File) beginStore(content string) {
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+	f.storing = checksum(content)
+}
+
+// endStore records the end of a store begun with beginStore, which
+// succeeded if ok.
+func (f *File) endStore(ok bool) {
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+	if ok {
+		f.stored = f.storing
+	}
+	f.storing = ""
+}
+
+// StartFileWatcher checks the open files for changes made outside the
+// system every interval, until the returned function is called. A shorter
+// interval notices changes sooner at the cost of reading every open file
+// more often.
+func (fs *DistributedFileSystem) StartFileWatcher(interval time.Duration) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		// conflicts holds the checksum last reported as a conflict for
+		// each file, so a change is reported once, not every tick.
+		conflicts := make(map[string]string)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				for _, file := range fs.watchedFiles() {
+					fs.checkExternalChange(file, conflicts)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// watchedFiles returns the open files kept with strong consistency.
+func (fs *DistributedFileSystem) watchedFiles() []*File {
+	fs.FilesMutex.Lock()
+	defer fs.FilesMutex.Unlock()
+	var files []*File
+	for _, file := range fs.Files {
+		if fs.consistency(file.Name) == Strong {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// checkExternalChange compares file's stored data with what the file
+// system last put there and refreshes the file or reports a conflict.
+func (fs *DistributedFileSystem) checkExternalChange(file *File, conflicts map[string]string) {
+	data, err := fs.Storage.Load(file.Name)
+	if err != nil {
+		fs.Log.Debugf("File watcher: loading %s: %v", file.Name, err)
+		return
+	}
+	content := string(data)
+	sum := checksum(content)
+
+	file.Mutex.Lock()
+	stored := file.stored
+	changed := sum != stored && sum != file.storing
+	writing := file.storing != ""
+	file.Mutex.Unlock()
+	if !changed {
+		delete(conflicts, file.Name)
+		return
+	}
+
+	holder := fs.holder(file.Name)
+	if holder != 0 || writing {
+		if conflicts[file.Name] == sum {
+			return
+		}
+		conflicts[file.Name] = sum
+		entry := fmt.Sprintf("CONFLICT: %s was changed outside this process while", file.Name)
+		if holder != 0 {
+			entry += fmt.Sprintf(" client %d held it", holder)
+		} else {
+			entry += " a write of it was being stored"
+		}
+		fs.Log.Warnf("%s", entry)
+		if fs.LogFile != nil {
+			fs.LogFile.WriteString(entry + "\n")
+		}
+		fs.Metrics.Add("ra_external_conflicts_total", 1)
+		fs.externalEvent(EventExternalConflict, holder, file.Name)
+		return
+	}
+
+	delete(conflicts, file.Name)
+	file.Mutex.Lock()
+	// A write stored or begun since the check above wins.
+	if file.stored != stored || file.storing != "" {
+		file.Mutex.Unlock()
+		return
+	}
+	version := file.setContentLocked(content)
+	file.stored = sum
+	file.Mutex.Unlock()
+	// The change has no timestamp of its own; it happened after every
+	// event the local clients have seen.
+	timestamp := 0
+	for _, node := range fs.nodes() {
+		timestamp = max(timestamp, node.Clock())
+	}
+	fs.recordVersion(file, version, 0, timestamp, content)
+	if fs.Cache != nil {
+		for _, node := range fs.nodes() {
+			fs.Cache.invalidate(node.ID, file.Name)
+		}
+	}
+	fs.Log.Infof("File %s was changed outside this process; refreshed it (%d bytes)", file.Name, len(content))
+	fs.Metrics.Add("ra_external_changes_total", 1)
+	fs.externalEvent(EventExternalChange, 0, file.Name)
+}
+
+// holder returns a local client in resource's critical section, or 0.
+func (fs *DistributedFileSystem) holder(resource string) int {
+	for _, node := range fs.nodes() {
+		if node.State(resource) == Held {
+			return node.ID
+		}
+	}
+	return 0
+}
+
+// externalEvent records an external change to resource as an event of
+// clientID, or of the lowest local client if clientID is 0.
+func (fs *DistributedFileSystem) externalEvent(kind string, clientID int, resource string) {
+	if clientID == 0 {
+		nodes := fs.nodes()
+		if len(nodes) == 0 {
+			return
+		}
+		clientID = nodes[0].ID
+	}
+	fs.event(kind, clientID, 0, resource, 0)
+}
@@ -0,0 +1,129 @@
+package ra
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StartWatchdog checks every node at half the threshold and dumps a
+// diagnostic for each request that has been WANTED longer than threshold.
+// Each stuck request is reported once. The returned function stops the
+// watchdog.
+func (fs *DistributedFileSystem) StartWatchdog(threshold time.Duration) func() {
+	done := make(chan struct{})
+	reported := make(map[*Request]bool)
+
+	go func() {
+		ticker := time.NewTicker(threshold / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				stillStuck := make(map[*Request]bool)
+				for _, request := range fs.stuckRequests(now, threshold) {
+					stillStuck[request] = true
+					if !reported[request] {
+						fs.dumpDiagnostic(request, now)
+					}
+				}
+				reported = stillStuck
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+func (fs *DistributedFileSystem) stuckRequests(now time.Time, threshold time.Duration) []*Request {
+	var stuck []*Request
+	for _, node := range fs.nodes() {
+		_, views := node.View()
+		for _, view := range views {
+			if view.State == Wanted && now.Sub(view.Request.Requested) > threshold {
+				stuck = append(stuck, view.Request)
+			}
+		}
+	}
+	return stuck
+}
+
+// peerState describes what node was last seen doing.
+func (fs *DistributedFileSystem) peerState(node *Node) string {
+	clock, views := node.View()
+
+	var states []string
+	for _, view := range views {
+		if view.State == Released {
+			continue
+		}
+		states = append(states, fmt.Sprintf("%s %s (ts %d)", view.State, view.Resource, view.Request.Timestamp))
+	}
+	if len(states) == 0 {
+		states = append(states, "idle")
+	}
+	states = append(states, fmt.Sprintf("clock %d", clock))
+
+	fs.LastSeenMutex.Lock()
+	lastSeen, ok := fs.LastSeen[node.ID]
+	fs.LastSeenMutex.Unlock()
+	if ok {
+		states = append(states, "last message "+lastSeen.Format("15:04:05.000"))
+	}
+	return strings.Join(states, ", ")
+}
+
+func (fs *DistributedFileSystem) dumpDiagnostic(request *Request, now time.Time) {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "WATCHDOG: client %d has waited %s for %s (ts %d, seq %d)\n",
+		request.ClientID, now.Sub(request.Requested).Round(time.Millisecond),
+		request.Resource, request.Timestamp, request.Seq)
+
+	awaiting := request.Awaiting()
+	if len(awaiting) == 0 {
+		fmt.Fprintln(&b, "  all peers replied")
+	}
+	for _, peer := range awaiting {
+		if node := fs.Node(peer); node != nil {
+			fmt.Fprintf(&b, "  no reply from client %d: %s\n", peer, fs.peerState(node))
+		} else {
+			fmt.Fprintf(&b, "  no reply from client %d: unknown peer\n", peer)
+		}
+	}
+
+	for _, node := range fs.nodes() {
+		_, views := node.View()
+		for _, view := range views {
+			if len(view.Deferred) == 0 {
+				continue
+			}
+			fmt.Fprintf(&b, "  client %d defers for %s (%s):\n", node.ID, view.Resource, view.State)
+			for _, r := range view.Deferred {
+				fmt.Fprintf(&b, "    client %d ts %d waiting since %s\n", r.ClientID, r.Timestamp, r.Requested.Format("15:04:05.000"))
+			}
+		}
+	}
+
+	fs.OutstandingMutex.Lock()
+	outstanding := make([]*Request, 0, len(fs.Outstanding))
+	for _, r := range fs.Outstanding {
+		outstanding = append(outstanding, r)
+	}
+	fs.OutstandingMutex.Unlock()
+	sort.Slice(outstanding, func(i, j int) bool { return requestLess(fs.TieBreak, outstanding[i], outstanding[j]) })
+	for _, r := range outstanding {
+		fmt.Fprintf(&b, "  outstanding: client %d %s ts %d awaiting %v\n", r.ClientID, r.Resource, r.Timestamp, r.Awaiting())
+	}
+
+	io.WriteString(os.Stderr, b.String())
+	if fs.LogFile != nil {
+		fs.LogFile.WriteString(b.String())
+	}
+}
@@ -0,0 +1,306 @@
+package ra
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Duration is a time.Duration that reads and writes JSON as "150ms" style
+// strings.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Distribution describes how a duration is sampled. Kind is one of
+// "constant" (always Mean), "uniform" (between Min and Max) or
+// "exponential" (with the given Mean, capped at Max when Max is set).
+type Distribution struct {
+	Kind string   `json:"kind"`
+	Min  Duration `json:"min,omitempty"`
+	Max  Duration `json:"max,omitempty"`
+	Mean Duration `json:"mean,omitempty"`
+}
+
+func (d Distribution) Sample(rng *rand.Rand) time.Duration {
+	switch d.Kind {
+	case "uniform":
+		if d.Max <= d.Min {
+			return time.Duration(d.Min)
+		}
+		return time.Duration(d.Min) + time.Duration(rng.Int63n(int64(d.Max-d.Min)))
+	case "exponential":
+		sample := time.Duration(rng.ExpFloat64() * float64(d.Mean))
+		if d.Max > 0 && sample > time.Duration(d.Max) {
+			sample = time.Duration(d.Max)
+		}
+		return sample
+	}
+	return time.Duration(d.Mean)
+}
+
+func (d Distribution) validate() error {
+	switch d.Kind {
+	case "", "constant", "uniform", "exponential":
+		return nil
+	}
+	return fmt.Errorf("unknown distribution %q", d.Kind)
+}
+
+// ClientWorkload is what a single client does during a workload run.
+type ClientWorkload struct {
+	Operations int     `json:"operations"`
+	ReadRatio  float64 `json:"read_ratio"`
+	// AppendRatio is the fraction of writes that append a line to the file
+	// instead of overwriting it.
+	AppendRatio float64      `json:"append_ratio,omitempty"`
+	ThinkTime   Distribution `json:"think_time"`
+	HoldTime    Distribution `json:"hold_time"`
+	Files       []string     `json:"files"`
+	// FileWeights, if set, gives each of Files a relative probability of
+	// being picked instead of picking uniformly.
+	FileWeights []float64 `json:"file_weights,omitempty"`
+	// Burst issues operations in bursts of this many, back to back, with
+	// ThinkTime only between bursts. 0 or 1 thinks before every operation.
+	Burst int `json:"burst,omitempty"`
+}
+
+// Workload is the configuration for a workload run. Clients without an
+// entry in Clients use Default.
+type Workload struct {
+	Seed    int64                  `json:"seed"`
+	Default ClientWorkload         `json:"default"`
+	Clients map[int]ClientWorkload `json:"clients,omitempty"`
+}
+
+// LoadWorkload reads a workload description from a JSON file.
+func LoadWorkload(path string) (*Workload, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Workload{}
+	if err := json.Unmarshal(data, w); err != nil {
+		return nil, fmt.Errorf("parsing workload %s: %w", path, err)
+	}
+	if err := w.validate(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Workload) validate() error {
+	all := []ClientWorkload{w.Default}
+	for _, c := range w.Clients {
+		all = append(all, c)
+	}
+	for _, c := range all {
+		if c.ReadRatio < 0 || c.ReadRatio > 1 {
+			return fmt.Errorf("read_ratio %v out of range [0, 1]", c.ReadRatio)
+		}
+		if c.AppendRatio < 0 || c.AppendRatio > 1 {
+			return fmt.Errorf("append_ratio %v out of range [0, 1]", c.AppendRatio)
+		}
+		if len(c.Files) == 0 {
+			return fmt.Errorf("workload needs at least one target file")
+		}
+		if c.FileWeights != nil {
+			if len(c.FileWeights) != len(c.Files) {
+				return fmt.Errorf("file_weights has %d entries for %d files", len(c.FileWeights), len(c.Files))
+			}
+			total := 0.0
+			for _, weight := range c.FileWeights {
+				if weight < 0 {
+					return fmt.Errorf("file_weights: negative weight %v", weight)
+				}
+				total += weight
+			}
+			if total == 0 {
+				return fmt.Errorf("file_weights are all zero")
+			}
+		}
+		if c.Burst < 0 {
+			return fmt.Errorf("burst %d is negative", c.Burst)
+		}
+		if err := c.ThinkTime.validate(); err != nil {
+			return err
+		}
+		if err := c.HoldTime.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// files returns every file the workload touches.
+func (w *Workload) files() []string {
+	all := []ClientWorkload{w.Default}
+	ids := make([]int, 0, len(w.Clients))
+	for id := range w.Clients {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		all = append(all, w.Clients[id])
+	}
+
+	seen := make(map[string]bool)
+	var files []string
+	for _, c := range all {
+		for _, name := range c.Files {
+			if !seen[name] {
+				seen[name] = true
+				files = append(files, name)
+			}
+		}
+	}
+	return files
+}
+
+// pickFile picks the file for the next operation.
+func (c ClientWorkload) pickFile(rng *rand.Rand) string {
+	if c.FileWeights == nil {
+		return c.Files[rng.Intn(len(c.Files))]
+	}
+	total := 0.0
+	for _, weight := range c.FileWeights {
+		total += weight
+	}
+	r := rng.Float64() * total
+	for i, weight := range c.FileWeights {
+		if r < weight {
+			return c.Files[i]
+		}
+		r -= weight
+	}
+	return c.Files[len(c.Files)-1]
+}
+
+// For returns the workload for clientID.
+func (w *Workload) For(clientID int) ClientWorkload {
+	if c, ok := w.Clients[clientID]; ok {
+		return c
+	}
+	return w.Default
+}
+
+// RunWorkload runs the workload on numClients concurrent clients and writes
+// each client's span to the space-time diagram.
+func RunWorkload(fs *DistributedFileSystem, numClients int, w *Workload, diagram *os.File) {
+	var wg sync.WaitGroup
+	for i := 0; i < numClients; i++ {
+		wg.Add(1)
+		go func(clientID int) {
+			defer wg.Done()
+			runClientWorkload(fs, clientID, w, diagram)
+		}(i + 1)
+	}
+	wg.Wait()
+}
+
+// runClientWorkload runs clientID's part of the workload. diagram may be nil.
+func runClientWorkload(fs *DistributedFileSystem, clientID int, w *Workload, diagram *os.File) {
+	cw := w.For(clientID)
+	rng := rand.New(rand.NewSource(w.Seed + int64(clientID)))
+
+	startTime := time.Now()
+	for op := 1; op <= cw.Operations; op++ {
+		if cw.Burst <= 1 || (op-1)%cw.Burst == 0 {
+			time.Sleep(cw.ThinkTime.Sample(rng))
+		}
+
+		fileName := cw.pickFile(rng)
+		handle, err := fs.OpenFile(clientID, fileName)
+		if err != nil {
+			fs.Log.Errorf("Error opening file %s: %v", fileName, err)
+			continue
+		}
+		read := rng.Float64() < cw.ReadRatio
+		// Only draw when appending is configured, so existing workloads
+		// keep their sequence of operations.
+		appending := !read && cw.AppendRatio > 0 && rng.Float64() < cw.AppendRatio
+		content := fmt.Sprintf("Content written by Client %d (op %d)", clientID, op)
+		if appending {
+			content = fmt.Sprintf("Line appended by Client %d (op %d)\n", clientID, op)
+		}
+		if fs.consistency(fileName) == Eventual {
+			switch {
+			case read:
+				fs.ReadFile(clientID, handle)
+			case appending:
+				fs.AppendFile(clientID, handle, content)
+			default:
+				fs.WriteFile(clientID, handle, content)
+			}
+			time.Sleep(cw.HoldTime.Sample(rng))
+			fs.CloseFile(handle)
+			continue
+		}
+		if read {
+			if _, ok := fs.cachedRead(clientID, handle.File); ok {
+				fs.CloseFile(handle)
+				continue
+			}
+		}
+
+		var request *Request
+		if read {
+			request, err = fs.acquireRead(clientID, handle.File)
+		} else {
+			request, err = fs.AcquireRequest(clientID, handle)
+		}
+		if err != nil {
+			fs.Log.Errorf("Error acquiring %s: %v", fileName, err)
+			if errors.Is(err, ErrFenced) {
+				fs.Resynchronize(clientID)
+			}
+			fs.CloseFile(handle)
+			continue
+		}
+		hold := cw.HoldTime.Sample(rng)
+		err = fs.runHeld(request, func(request *Request) error {
+			var err error
+			switch {
+			case read:
+				_, err = fs.readHeld(request)
+			case appending:
+				err = fs.appendHeld(request, content)
+			default:
+				err = fs.writeHeld(request, content)
+			}
+			if err != nil {
+				fs.Log.Errorf("Error operating on %s: %v", fileName, err)
+			}
+			time.Sleep(hold)
+			return nil
+		})
+		if err != nil && !errors.Is(err, ErrForcedRelease) {
+			fs.Log.Errorf("Error releasing %s: %v", fileName, err)
+		}
+		fs.CloseFile(handle)
+	}
+	if diagram != nil {
+		printSpaceTimeDiagram(clientID, startTime, time.Now(), diagram)
+	}
+}